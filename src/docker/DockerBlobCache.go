@@ -0,0 +1,377 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"hash"
+	"sort"
+	"time"
+	"sync"
+	"strings"
+	"path/filepath"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * An on-disk cache of registry blobs (image layers), keyed by digest. Because
+ * blobs are content-addressed, a cache can be shared by any number of registry
+ * connections (see DockerRegistryImpl.SetBlobCache), whatever their registry,
+ * and by several processes that use the same directory. Layers that GetImage
+ * and GetBlob find in the cache are not downloaded, and those that they do
+ * download are added to it.
+ *
+ * The content of a blob is verified against its digest whenever it is read
+ * from the cache; a blob that fails verification is removed. Blobs are
+ * written to a temporary file and renamed into place, so that no reader sees a
+ * partial blob. If the cache has a size limit, the least recently used blobs
+ * are removed when the limit is exceeded; a blob is used when it is written or
+ * read, and the time of its last use is its modification time. To tell when
+ * the limit is exceeded without listing the directory, each cache keeps a
+ * total of the blobs it has added since it last listed them; blobs that other
+ * processes add are counted when the directory is next listed.
+ *
+ * The layout of the cache directory is,
+	blobs/<algorithm>/<hex digest>
+	tmp/  - blobs being written
+	lock  - held while blobs are evicted
+ */
+type DockerBlobCache struct {
+	dirPath string
+	maxSize int64  // in bytes; 0 if unlimited
+	lock sync.Mutex  // for size
+	size int64  // the total size of the blobs; -1 until the directory is listed
+}
+
+/*
+ * A temporary file older than this is the remnant of a failed write, and is
+ * removed when the cache is opened, and when blobs are evicted.
+ */
+const staleBlobTempFileAge = 24 * time.Hour
+
+/*******************************************************************************
+ * Return a cache that keeps its blobs in the specified directory, which is
+ * created if it does not exist, and whose blobs total no more than maxSize
+ * bytes. A maxSize of 0 means no limit.
+ */
+func NewDockerBlobCache(dirPath string, maxSize int64) (*DockerBlobCache, error) {
+	
+	if maxSize < 0 { return nil, utilities.ConstructUserError(fmt.Sprintf(
+		"Invalid blob cache size: %d", maxSize)) }
+	var cache = &DockerBlobCache{ dirPath: dirPath, maxSize: maxSize, size: -1 }
+	for _, subdirPath := range []string{ cache.blobsDirPath(), cache.tempDirPath() } {
+		var err = os.MkdirAll(subdirPath, 0700)
+		if err != nil { return nil, utilities.ConstructServerError(fmt.Sprintf(
+			"Could not create blob cache directory '%s': %s", subdirPath, err.Error())) }
+	}
+	var err = cache.removeStaleTempFiles()
+	if err != nil { return nil, err }
+	return cache, nil
+}
+
+func (cache *DockerBlobCache) GetDirPath() string {
+	return cache.dirPath
+}
+
+func (cache *DockerBlobCache) GetMaxSize() int64 {
+	return cache.maxSize
+}
+
+/*******************************************************************************
+ * Open the cached blob with the specified digest (e.g., "sha256:3cba..."),
+ * after verifying its content. Return an ErrNotFound error if the cache does
+ * not have the blob, and an ErrDigestMismatch error if its content does not
+ * match the digest (in which case it is removed).
+ */
+func (cache *DockerBlobCache) Open(digest string) (*os.File, error) {
+	
+	var blobPath, hasher, err = cache.blobPath(digest)
+	if err != nil { return nil, err }
+	var file *os.File
+	file, err = os.Open(blobPath)
+	if os.IsNotExist(err) { return nil, newDockerError(ErrNotFound, "BlobCache",
+		"Blob " + digest + " is not in the cache") }
+	if err != nil { return nil, utilities.ConstructServerError(fmt.Sprintf(
+		"Could not open cached blob %s: %s", digest, err.Error())) }
+	
+	// The file remains readable if the blob is evicted, or replaced, while it
+	// is open, so it is the content verified that is returned.
+	_, err = io.Copy(hasher, file)
+	if err == nil { _, err = file.Seek(0, io.SeekStart) }
+	if err != nil {
+		file.Close()
+		return nil, utilities.ConstructServerError(fmt.Sprintf(
+			"Could not read cached blob %s: %s", digest, err.Error()))
+	}
+	if ! digestMatches(digest, hasher) {
+		file.Close()
+		os.Remove(blobPath)
+		return nil, newDockerError(ErrDigestMismatch, "BlobCache", fmt.Sprintf(
+			"Cached blob %s does not match its digest, and was removed", digest))
+	}
+	
+	var now = time.Now()
+	os.Chtimes(blobPath, now, now)  // a blob that is evicted meanwhile need not be touched
+	return file, nil
+}
+
+/*******************************************************************************
+ * Add the blob, whose content is read from the reader, to the cache. The
+ * content is verified against the digest, and is not added if it does not
+ * match. If the cache already has the blob, the reader is not read.
+ */
+func (cache *DockerBlobCache) Put(digest string, content io.Reader) error {
+	
+	var blobPath, hasher, err = cache.blobPath(digest)
+	if err != nil { return err }
+	if cache.touch(blobPath) { return nil }
+	
+	var tempFile *os.File
+	tempFile, err = os.CreateTemp(cache.tempDirPath(), "blob-")
+	if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
+		"Could not create temporary file in blob cache: %s", err.Error())) }
+	var tempFilePath = tempFile.Name()
+	defer os.Remove(tempFilePath)  // fails once the file has been renamed
+	
+	_, err = io.Copy(io.MultiWriter(tempFile, hasher), content)
+	if err == nil { err = tempFile.Sync() }
+	var closeErr = tempFile.Close()
+	if err == nil { err = closeErr }
+	if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
+		"Could not write blob %s to the cache: %s", digest, err.Error())) }
+	if ! digestMatches(digest, hasher) { return newDockerError(ErrDigestMismatch, "BlobCache",
+		fmt.Sprintf("Content of blob %s does not match its digest", digest)) }
+	
+	return cache.install(digest, tempFilePath, blobPath)
+}
+
+/*******************************************************************************
+ * Add the content of the specified file, which has been verified against the
+ * digest, to the cache. The file is linked into the cache, if possible, and
+ * otherwise copied.
+ */
+func (cache *DockerBlobCache) putVerifiedFile(digest, filePath string) error {
+	
+	var blobPath, _, err = cache.blobPath(digest)
+	if err != nil { return err }
+	if cache.touch(blobPath) { return nil }
+	
+	var tempFilePath = filepath.Join(cache.tempDirPath(),
+		fmt.Sprintf("link-%d-%d", os.Getpid(), time.Now().UnixNano()))
+	err = os.Link(filePath, tempFilePath)
+	if err != nil {  // e.g., the file is on another file system
+		var file *os.File
+		file, err = os.Open(filePath)
+		if err != nil { return err }
+		defer file.Close()
+		return cache.Put(digest, file)
+	}
+	defer os.Remove(tempFilePath)
+	
+	// The link shares the file's modification time: make it the time of use.
+	var now = time.Now()
+	os.Chtimes(tempFilePath, now, now)
+	return cache.install(digest, tempFilePath, blobPath)
+}
+
+/*******************************************************************************
+ * Remove the blob from the cache, if it is there.
+ */
+func (cache *DockerBlobCache) Remove(digest string) error {
+	
+	var blobPath, _, err = cache.blobPath(digest)
+	if err != nil { return err }
+	err = os.Remove(blobPath)
+	if (err != nil) && (! os.IsNotExist(err)) { return utilities.ConstructServerError(fmt.Sprintf(
+		"Could not remove cached blob %s: %s", digest, err.Error())) }
+	return nil
+}
+
+/*******************************************************************************
+ * Return the total size, in bytes, of the cached blobs.
+ */
+func (cache *DockerBlobCache) Size() (int64, error) {
+	
+	var blobs, err = cache.listBlobs()
+	if err != nil { return 0, err }
+	var size int64
+	for _, blob := range blobs { size = size + blob.size }
+	return size, nil
+}
+
+/*******************************************************************************
+ * Remove least recently used blobs until the cache is within its size limit,
+ * and remove the remnants of failed writes. Only one process at a time evicts
+ * blobs from a cache directory.
+ */
+func (cache *DockerBlobCache) Evict() error {
+	
+	var unlock, err = lockFile(filepath.Join(cache.dirPath, "lock"))
+	if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
+		"Could not lock blob cache '%s': %s", cache.dirPath, err.Error())) }
+	defer unlock()
+	
+	err = cache.removeStaleTempFiles()
+	if err != nil { return err }
+	
+	if cache.maxSize == 0 { return nil }
+	var blobs []cachedBlob
+	blobs, err = cache.listBlobs()
+	if err != nil { return err }
+	var size int64
+	for _, blob := range blobs { size = size + blob.size }
+	defer func() {
+		cache.lock.Lock()
+		cache.size = size
+		cache.lock.Unlock()
+	}()
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].lastUsed.Before(blobs[j].lastUsed) })
+	for _, blob := range blobs {
+		if size <= cache.maxSize { break }
+		err = os.Remove(blob.path)
+		if (err != nil) && (! os.IsNotExist(err)) { return utilities.ConstructServerError(fmt.Sprintf(
+			"Could not evict cached blob '%s': %s", blob.path, err.Error())) }
+		size = size - blob.size
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Remove the temporary files that are the remnants of failed writes.
+ */
+func (cache *DockerBlobCache) removeStaleTempFiles() error {
+	
+	var tempFileInfos, err = os.ReadDir(cache.tempDirPath())
+	if err != nil { return utilities.ConstructServerError(err.Error()) }
+	for _, entry := range tempFileInfos {
+		var info, err = entry.Info()
+		if (err == nil) && (time.Since(info.ModTime()) > staleBlobTempFileAge) {
+			os.Remove(filepath.Join(cache.tempDirPath(), entry.Name()))
+		}
+	}
+	return nil
+}
+
+type cachedBlob struct {
+	path string
+	size int64
+	lastUsed time.Time
+}
+
+func (cache *DockerBlobCache) listBlobs() ([]cachedBlob, error) {
+	
+	var blobs = make([]cachedBlob, 0)
+	var algorithmEntries, err = os.ReadDir(cache.blobsDirPath())
+	if err != nil { return nil, utilities.ConstructServerError(err.Error()) }
+	for _, algorithmEntry := range algorithmEntries {
+		var algorithmDirPath = filepath.Join(cache.blobsDirPath(), algorithmEntry.Name())
+		var blobEntries, err = os.ReadDir(algorithmDirPath)
+		if err != nil { return nil, utilities.ConstructServerError(err.Error()) }
+		for _, blobEntry := range blobEntries {
+			var info, err = blobEntry.Info()
+			if err != nil { continue }  // removed meanwhile
+			blobs = append(blobs, cachedBlob{
+				path: filepath.Join(algorithmDirPath, blobEntry.Name()),
+				size: info.Size(),
+				lastUsed: info.ModTime(),
+			})
+		}
+	}
+	return blobs, nil
+}
+
+/*******************************************************************************
+ * Rename the temporary file, whose content has been verified, into place as
+ * the blob, and evict blobs if the cache is over its limit. The directory is
+ * listed (by Evict) only the first time, and when the blobs that have been
+ * added take the total over the limit.
+ */
+func (cache *DockerBlobCache) install(digest, tempFilePath, blobPath string) error {
+	
+	var info, err = os.Stat(tempFilePath)
+	if err == nil { err = os.MkdirAll(filepath.Dir(blobPath), 0700) }
+	if err == nil { err = os.Rename(tempFilePath, blobPath) }
+	if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
+		"Could not add blob %s to the cache: %s", digest, err.Error())) }
+	if cache.maxSize == 0 { return nil }
+	
+	cache.lock.Lock()
+	var overLimit = (cache.size < 0) || (cache.size + info.Size() > cache.maxSize)
+	if cache.size >= 0 { cache.size = cache.size + info.Size() }
+	cache.lock.Unlock()
+	if ! overLimit { return nil }
+	return cache.Evict()
+}
+
+/*******************************************************************************
+ * If the blob is cached, mark it as used now, and return true.
+ */
+func (cache *DockerBlobCache) touch(blobPath string) bool {
+	var now = time.Now()
+	return os.Chtimes(blobPath, now, now) == nil
+}
+
+/*******************************************************************************
+ * Return the path of the blob's file, and a hash with which to verify it.
+ */
+func (cache *DockerBlobCache) blobPath(digest string) (string, hash.Hash, error) {
+	
+	var hasher, algorithm, hexDigest, err = parseDigest(digest)
+	if err != nil { return "", nil, err }
+	return filepath.Join(cache.blobsDirPath(), algorithm, hexDigest), hasher, nil
+}
+
+func (cache *DockerBlobCache) blobsDirPath() string {
+	return filepath.Join(cache.dirPath, "blobs")
+}
+
+func (cache *DockerBlobCache) tempDirPath() string {
+	return filepath.Join(cache.dirPath, "tmp")
+}
+
+/*******************************************************************************
+ * Split a digest, e.g., "sha256:3cba...", into its algorithm and hex parts,
+ * and return a hash for the algorithm.
+ */
+func parseDigest(digest string) (hasher hash.Hash, algorithm, hexDigest string, err error) {
+	
+	var parts = strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 { return nil, "", "", utilities.ConstructUserError(
+		"Ill-formed digest: '" + digest + "'") }
+	algorithm = parts[0]
+	hexDigest = parts[1]
+	var hexLen int
+	switch algorithm {
+		case "sha256": hasher = sha256.New(); hexLen = 64
+		case "sha512": hasher = sha512.New(); hexLen = 128
+		default: return nil, "", "", newDockerError(ErrUnsupported, "BlobCache",
+			"Unsupported digest algorithm: '" + digest + "'")
+	}
+	var _, decodeErr = hex.DecodeString(hexDigest)
+	if (decodeErr != nil) || (len(hexDigest) != hexLen) || (strings.ToLower(hexDigest) != hexDigest) {
+		return nil, "", "", utilities.ConstructUserError("Ill-formed digest: '" + digest + "'")
+	}
+	return hasher, algorithm, hexDigest, nil
+}
+
+func digestMatches(digest string, hasher hash.Hash) bool {
+	return strings.HasSuffix(digest, ":" + hex.EncodeToString(hasher.Sum(nil)))
+}
+
+/*******************************************************************************
+ * Set the blob cache of the connection; nil disables caching. Copies made by
+ * WithContext after the call share the cache. The cache is particular to
+ * DockerRegistryImpl (and InMemoryDockerRegistry), and is not part of the
+ * DockerRegistry interface.
+ */
+func (registry *DockerRegistryImpl) SetBlobCache(cache *DockerBlobCache) {
+	registry.cache = cache
+}
+
+func (registry *DockerRegistryImpl) GetBlobCache() *DockerBlobCache {
+	return registry.cache
+}
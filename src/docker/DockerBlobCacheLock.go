@@ -0,0 +1,26 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package docker
+
+import (
+	"os"
+	"syscall"
+)
+
+/*******************************************************************************
+ * Obtain an exclusive lock on the specified file, which is created if it does
+ * not exist, waiting until other processes (and goroutines) release it. Return
+ * a function that releases the lock.
+ */
+func lockFile(path string) (func(), error) {
+	
+	var file, err = os.OpenFile(path, os.O_CREATE | os.O_RDWR, 0600)
+	if err != nil { return nil, err }
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil { file.Close(); return nil, err }
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
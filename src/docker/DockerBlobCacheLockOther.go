@@ -0,0 +1,36 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly,!windows
+
+package docker
+
+import (
+	"os"
+	"time"
+)
+
+/*******************************************************************************
+ * Where neither flock nor LockFileEx is available, the lock is the existence
+ * of the specified file, which is created exclusively and removed when the
+ * lock is released. A lock file is not removed if its process ends without
+ * releasing it, so one older than staleLockFileAge is taken to be abandoned.
+ */
+const staleLockFileAge = 10 * time.Minute
+
+func lockFile(path string) (func(), error) {
+
+	for {
+		var file, err = os.OpenFile(path, os.O_CREATE | os.O_EXCL | os.O_RDWR, 0600)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if ! os.IsExist(err) { return nil, err }
+		var info os.FileInfo
+		info, err = os.Stat(path)
+		if (err == nil) && (time.Since(info.ModTime()) > staleLockFileAge) {
+			os.Remove(path)
+			continue
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,40 @@
+//go:build windows
+// +build windows
+
+package docker
+
+import (
+	"os"
+	"unsafe"
+	"syscall"
+)
+
+var (
+	kernel32 = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const lockfileExclusiveLock = 0x00000002
+
+/*******************************************************************************
+ * Obtain an exclusive lock on the specified file, which is created if it does
+ * not exist, waiting until other processes (and goroutines) release it. Return
+ * a function that releases the lock. The first byte of the file is locked with
+ * LockFileEx, which, like flock, is released if the process ends.
+ */
+func lockFile(path string) (func(), error) {
+
+	var file, err = os.OpenFile(path, os.O_CREATE | os.O_RDWR, 0600)
+	if err != nil { return nil, err }
+	var handle = file.Fd()
+	var overlapped syscall.Overlapped
+	var result, _, callErr = procLockFileEx.Call(handle, lockfileExclusiveLock, 0, 1, 0,
+		uintptr(unsafe.Pointer(&overlapped)))
+	if result == 0 { file.Close(); return nil, callErr }
+	return func() {
+		var overlapped syscall.Overlapped
+		procUnlockFileEx.Call(handle, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+		file.Close()
+	}, nil
+}
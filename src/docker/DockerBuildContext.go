@@ -0,0 +1,166 @@
+package docker
+
+import (
+	"io"
+	"os"
+	"sort"
+	"time"
+	"strings"
+	"archive/tar"
+	"path/filepath"
+)
+
+/*******************************************************************************
+ * Write the contents of the build directory, as a tar archive, to the writer.
+ * Files that are excluded by the directory's .dockerignore file (see
+ * ReadDockerIgnore) are omitted, except for the dockerfile, which is always
+ * included. Return the paths (relative to the build directory) that were
+ * excluded.
+ *
+ * The archive is a faithful copy of the directory: directories (including
+ * empty ones) and symbolic links are stored as such, permission bits are
+ * preserved, and entries are named relative to the build directory. Entries
+ * are written in sorted order, and host specific header fields (user and group
+ * names, access and change times) are omitted, so that identical directories
+ * produce identical archives. If reproducible is true, the owner and the
+ * modification time of each entry are zeroed too, so that the archive depends
+ * only on the names, content and permissions of the files.
+ */
+func WriteBuildContext(buildDirPath, dockerfileName string, writer io.Writer,
+	reproducible bool) ([]string, error) {
+	
+	var relPaths []string
+	var infos map[string]os.FileInfo
+	var excluded []string
+	var err error
+	relPaths, infos, excluded, err = listBuildContext(buildDirPath, dockerfileName)
+	if err != nil { return excluded, err }
+	
+	// Write the entries in sorted order. A directory sorts before its contents.
+	var tarWriter = tar.NewWriter(writer)
+	for _, relPath := range relPaths {
+		err = writeTarEntry(tarWriter, filepath.Join(buildDirPath, filepath.FromSlash(relPath)),
+			relPath, infos[relPath], reproducible)
+		if err != nil { return excluded, err }
+	}
+	
+	return excluded, tarWriter.Close()
+}
+
+/*******************************************************************************
+ * Return the paths (relative to the build directory, in sorted order) of the
+ * entries that belong in the build context of the specified build directory,
+ * and the file info of each. The paths that the directory's .dockerignore file
+ * excludes are returned separately.
+ */
+func listBuildContext(buildDirPath, dockerfileName string) ([]string,
+	map[string]os.FileInfo, []string, error) {
+	
+	var dockerIgnore *DockerIgnore
+	var err error
+	dockerIgnore, err = ReadDockerIgnore(buildDirPath, dockerfileName)
+	if err != nil { return nil, nil, nil, err }
+	
+	// The dockerfile and .dockerignore are sent even if they are excluded, as
+	// the docker CLI does.
+	var alwaysIncluded = map[string]bool{
+		filepath.ToSlash(filepath.Clean(dockerfileName)): true,
+		".dockerignore": true,
+	}
+	
+	// Walk the build directory to find the entries for the tar. Walk does not
+	// follow symbolic links.
+	var excluded = make([]string, 0)
+	var infos = make(map[string]os.FileInfo)
+	var relPaths = make([]string, 0)
+	err = filepath.Walk(buildDirPath,
+		func(path string, info os.FileInfo, err error) error {
+		
+			if err != nil { return err }
+			var relPath string
+			relPath, err = filepath.Rel(buildDirPath, path)
+			if err != nil { return err }
+			relPath = filepath.ToSlash(relPath)
+			if relPath == "." { return nil }
+			
+			// Apply the .dockerignore patterns.
+			if (! alwaysIncluded[relPath]) && dockerIgnore.Excludes(relPath) {
+				excluded = append(excluded, relPath)
+				if info.Mode().IsDir() && (! dockerIgnore.HasExceptions()) {
+					// Nothing within the directory can be re-included.
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			
+			infos[relPath] = info
+			relPaths = append(relPaths, relPath)
+			return nil
+		})
+	if err != nil { return nil, nil, excluded, err }
+	
+	// A file that is always included may be within an excluded directory that
+	// the walk skipped.
+	for relPath := range alwaysIncluded {
+		if (infos[relPath] != nil) || (relPath == "..") || strings.HasPrefix(relPath, "../") ||
+			filepath.IsAbs(relPath) { continue }
+		var info os.FileInfo
+		info, err = os.Lstat(filepath.Join(buildDirPath, filepath.FromSlash(relPath)))
+		if err != nil { continue }
+		if info.Mode().IsDir() { continue }
+		infos[relPath] = info
+		relPaths = append(relPaths, relPath)
+	}
+	
+	sort.Strings(relPaths)
+	return relPaths, infos, excluded, nil
+}
+
+/*******************************************************************************
+ * Write a tar entry, with the specified name, for the specified local file,
+ * directory or symbolic link. Other kinds of file (devices, sockets, pipes)
+ * cannot be part of an image, and are skipped. See WriteBuildContext for the
+ * meaning of reproducible.
+ */
+func writeTarEntry(tarWriter *tar.Writer, path, name string, info os.FileInfo,
+	reproducible bool) error {
+	
+	var mode = info.Mode()
+	if (! mode.IsRegular()) && (! mode.IsDir()) && (mode & os.ModeSymlink == 0) {
+		return nil
+	}
+	
+	var linkTarget string
+	var err error
+	if mode & os.ModeSymlink != 0 {
+		linkTarget, err = os.Readlink(path)
+		if err != nil { return err }
+	}
+	var header *tar.Header
+	header, err = tar.FileInfoHeader(info, linkTarget)
+	if err != nil { return err }
+	
+	header.Name = name
+	if mode.IsDir() { header.Name = name + "/" }
+	header.Uname = ""
+	header.Gname = ""
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.ModTime = header.ModTime.Truncate(time.Second)
+	header.Format = tar.FormatPAX
+	if reproducible {
+		header.Uid = 0
+		header.Gid = 0
+		header.ModTime = time.Unix(0, 0)
+	}
+	err = tarWriter.WriteHeader(header)
+	if err != nil { return err }
+	
+	if ! mode.IsRegular() { return nil }
+	var file *os.File
+	file, err = os.Open(path)
+	if err != nil { return err }
+	defer file.Close()
+	_, err = io.Copy(tarWriter, file)
+	return err
+}
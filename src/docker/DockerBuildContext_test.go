@@ -0,0 +1,129 @@
+package docker
+
+import (
+	"io"
+	"os"
+	"time"
+	"bytes"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"archive/tar"
+	"path/filepath"
+)
+
+/*******************************************************************************
+ * Create the specified files (relative path -> content) in dirPath.
+ */
+func writeTestFiles(t *testing.T, dirPath string, files map[string]string) {
+	
+	for relPath, content := range files {
+		var path = filepath.Join(dirPath, filepath.FromSlash(relPath))
+		var err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil { t.Fatal(err) }
+		err = ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil { t.Fatal(err) }
+	}
+}
+
+/*******************************************************************************
+ * Return the build context of dirPath as a tar archive, and the names of its
+ * entries.
+ */
+func writeTestBuildContext(t *testing.T, dirPath, dockerfileName string,
+	reproducible bool) ([]byte, []string) {
+	
+	var buffer bytes.Buffer
+	var _, err = WriteBuildContext(dirPath, dockerfileName, &buffer, reproducible)
+	if err != nil { t.Fatal(err) }
+	
+	var names = make([]string, 0)
+	var tarReader = tar.NewReader(bytes.NewReader(buffer.Bytes()))
+	for {
+		var header *tar.Header
+		header, err = tarReader.Next()
+		if err == io.EOF { break }
+		if err != nil { t.Fatal(err) }
+		names = append(names, header.Name)
+	}
+	return buffer.Bytes(), names
+}
+
+func TestWriteBuildContextIgnore(t *testing.T) {
+	
+	var dirPath = t.TempDir()
+	writeTestFiles(t, dirPath, map[string]string{
+		"Dockerfile": "FROM scratch\n",
+		".dockerignore": "*.key\nlogs\n",
+		"app.py": "",
+		"secret.key": "",
+		"logs/a.log": "",
+	})
+	var _, names = writeTestBuildContext(t, dirPath, "Dockerfile", false)
+	var expected = ".dockerignore Dockerfile app.py"
+	if strings.Join(names, " ") != expected {
+		t.Errorf("Expected entries %q, got %q", expected, strings.Join(names, " "))
+	}
+}
+
+/*******************************************************************************
+ * The dockerfile is sent even if the directory that contains it is excluded.
+ */
+func TestWriteBuildContextDockerfileInExcludedDir(t *testing.T) {
+	
+	var dirPath = t.TempDir()
+	writeTestFiles(t, dirPath, map[string]string{
+		"build/Dockerfile": "FROM scratch\n",
+		"build/other": "",
+		".dockerignore": "build\n",
+	})
+	var _, names = writeTestBuildContext(t, dirPath, "build/Dockerfile", false)
+	var expected = ".dockerignore build/Dockerfile"
+	if strings.Join(names, " ") != expected {
+		t.Errorf("Expected entries %q, got %q", expected, strings.Join(names, " "))
+	}
+}
+
+func TestWriteBuildContextReproducible(t *testing.T) {
+	
+	var files = map[string]string{
+		"Dockerfile": "FROM scratch\nCOPY a /a\n",
+		"a": "a",
+		"dir/b": "b",
+	}
+	var dirPath1 = t.TempDir()
+	var dirPath2 = t.TempDir()
+	writeTestFiles(t, dirPath1, files)
+	writeTestFiles(t, dirPath2, files)
+	var err = os.Chtimes(filepath.Join(dirPath2, "a"), time.Unix(0, 0), time.Unix(0, 0))
+	if err != nil { t.Fatal(err) }
+	
+	var archive1, _ = writeTestBuildContext(t, dirPath1, "Dockerfile", true)
+	var archive2, _ = writeTestBuildContext(t, dirPath2, "Dockerfile", true)
+	if ! bytes.Equal(archive1, archive2) {
+		t.Error("Reproducible build contexts of identical directories differ")
+	}
+}
+
+func TestCheckBuildContextDir(t *testing.T) {
+	
+	var dirPath = t.TempDir()
+	writeTestFiles(t, dirPath, map[string]string{
+		"Dockerfile": "FROM scratch\nCOPY app.py /app/\nCOPY [\"data/*.json\", \"/data/\"]\n" +
+			"COPY secret.key missing.txt /k/\nCOPY --from=builder /x /y\n",
+		".dockerignore": "*.key\n",
+		"app.py": "",
+		"data/a.json": "",
+		"secret.key": "",
+	})
+	var err = CheckBuildContextDir(dirPath, "Dockerfile")
+	if err == nil { t.Fatal("Expected an error for the missing sources") }
+	var message = err.Error()
+	if (! strings.Contains(message, "missing.txt")) || (! strings.Contains(message, "secret.key")) {
+		t.Errorf("Expected missing.txt and secret.key to be reported: %s", message)
+	}
+	if strings.Contains(message, "app.py") || strings.Contains(message, "json") ||
+		strings.Contains(message, "/x") {
+		t.Errorf("Unexpected source reported: %s", message)
+	}
+}
@@ -0,0 +1,183 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * The kinds of event that occur during a docker build.
+ */
+type DockerBuildEventKind int
+
+const (
+	BuildEventStream DockerBuildEventKind = iota  // a line of build output text
+	BuildEventStepStarted  // a "Step N : <command>" line
+	BuildEventCacheHit  // the current step used the cache
+	BuildEventProducedId  // the current step produced an image
+	BuildEventAuxImageId  // the engine reported the Id of the built image
+	BuildEventError  // the build failed
+	BuildEventContextExcluded  // .dockerignore excluded a path from the build context
+)
+
+func (kind DockerBuildEventKind) String() string {
+	switch kind {
+		case BuildEventStream: return "Stream"
+		case BuildEventStepStarted: return "StepStarted"
+		case BuildEventCacheHit: return "CacheHit"
+		case BuildEventProducedId: return "ProducedId"
+		case BuildEventAuxImageId: return "AuxImageId"
+		case BuildEventError: return "Error"
+		case BuildEventContextExcluded: return "ContextExcluded"
+		default: return fmt.Sprintf("DockerBuildEventKind(%d)", int(kind))
+	}
+}
+
+/*******************************************************************************
+ * An event that occurs during a docker build, reported as the build output
+ * is received from the engine.
+ */
+type DockerBuildEvent struct {
+	Kind DockerBuildEventKind
+	Text string  // the line of output, for BuildEventStream; the path, for BuildEventContextExcluded
+	Step *DockerBuildStep  // the current step, if any
+	ImageId string  // for BuildEventProducedId and BuildEventAuxImageId
+	Err error  // for BuildEventError
+}
+
+/*******************************************************************************
+ * Incrementally parses the output of a docker build, as it arrives, into a
+ * DockerBuildOutput. This is the state machine that is described for
+ * ParseBuildCommandOutput. Output text is passed to write, which may be called
+ * with any fragment of the output; finish is called at the end of the output.
+ */
+type buildOutputParser struct {
+	output *DockerBuildOutput
+	handler func(*DockerBuildEvent)
+	state int
+	step *DockerBuildStep
+	partialLine string
+	done bool
+	err error
+	buildKitSteps map[string]*DockerBuildStep  // steps of a BuildKit build, by vertex digest
+}
+
+func newBuildOutputParser(handler func(*DockerBuildEvent)) *buildOutputParser {
+	return &buildOutputParser{
+		output: NewDockerBuildOutput(),
+		handler: handler,
+		state: 1,
+	}
+}
+
+func (parser *buildOutputParser) emit(event *DockerBuildEvent) {
+	if parser.handler != nil { parser.handler(event) }
+}
+
+/*******************************************************************************
+ * Add the text to the output received so far, and parse each complete line.
+ */
+func (parser *buildOutputParser) write(text string) {
+	
+	var lines = strings.Split(parser.partialLine + text, "\n")
+	parser.partialLine = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		parser.parseLine(strings.TrimRight(line, "\r"))
+	}
+}
+
+/*******************************************************************************
+ * The engine reported the Id of the image that was built.
+ */
+func (parser *buildOutputParser) auxImageId(id string) {
+	
+	parser.emit(&DockerBuildEvent{ Kind: BuildEventAuxImageId, Step: parser.step, ImageId: id })
+	if parser.output.GetFinalDockerImageId() == "" { parser.output.SetFinalImageId(id) }
+}
+
+/*******************************************************************************
+ * The build failed. Only the first failure is recorded.
+ */
+func (parser *buildOutputParser) fail(err error) {
+	
+	if parser.err != nil { return }
+	parser.done = true
+	parser.err = err
+	parser.output.ErrorMessage = err.Error()
+	parser.emit(&DockerBuildEvent{ Kind: BuildEventError, Step: parser.step, Err: err })
+}
+
+func (parser *buildOutputParser) parseLine(line string) {
+	
+	parser.emit(&DockerBuildEvent{ Kind: BuildEventStream, Step: parser.step, Text: line })
+	if parser.done { return }
+	
+	if parser.state == 2 { // Looking for step parts
+		var therest = strings.TrimPrefix(line, " ---> ")
+		if len(therest) < len(line) {
+			if strings.HasPrefix(therest, "Using cache") {
+				parser.step.SetUsedCache()
+				parser.emit(&DockerBuildEvent{ Kind: BuildEventCacheHit, Step: parser.step })
+			} else if strings.Contains(therest, " ") {
+				// Unrecognized line, e.g., "Running in 3bac4e50b6f9" - skip it
+				// but stay in the current state.
+			} else {
+				parser.step.SetProducedImageId(therest)
+				parser.emit(&DockerBuildEvent{ Kind: BuildEventProducedId,
+					Step: parser.step, ImageId: therest })
+			}
+			return
+		}
+		parser.state = 1
+	}
+	
+	// Looking for next step.
+	var therest = strings.TrimPrefix(line, "Step ")
+	if len(therest) < len(line) {
+		// Syntax is: number space colon space command
+		var stepNo int
+		fmt.Sscanf(therest, "%d", &stepNo)
+		
+		var separator = " : "
+		var seppos int = strings.Index(therest, separator)
+		if seppos != -1 { // found
+			var cmd = therest[seppos + len(separator):] // portion from seppos on
+			parser.step = parser.output.AddStep(stepNo, cmd)
+			parser.state = 2
+			parser.emit(&DockerBuildEvent{ Kind: BuildEventStepStarted, Step: parser.step })
+		}
+		return
+	}
+	
+	therest = strings.TrimPrefix(line, "Successfully built ")
+	if len(therest) < len(line) {
+		parser.output.SetFinalImageId(therest)
+		parser.done = true
+		return
+	}
+	
+	therest = strings.TrimPrefix(line, "Error")
+	if len(therest) < len(line) {
+		parser.fail(utilities.ConstructServerError(therest))
+	}
+}
+
+/*******************************************************************************
+ * Parse any final partial line, and return the output and the outcome of the
+ * build.
+ */
+func (parser *buildOutputParser) finish() (*DockerBuildOutput, error) {
+	
+	if parser.partialLine != "" {
+		var line = strings.TrimRight(parser.partialLine, "\r")
+		parser.partialLine = ""
+		parser.parseLine(line)
+	}
+	if parser.err != nil { return parser.output, parser.err }
+	if parser.output.GetFinalDockerImageId() == "" {
+		return parser.output, utilities.ConstructServerError("Incomplete")
+	}
+	return parser.output, nil
+}
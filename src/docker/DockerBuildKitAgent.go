@@ -0,0 +1,334 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"bytes"
+	"math/big"
+	"encoding/binary"
+	"encoding/pem"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * A minimal SSH agent (see draft-miller-ssh-agent), which holds private keys
+ * in memory and answers identity and signature requests. It is used to forward
+ * keys to "RUN --mount=type=ssh" without requiring a running ssh-agent.
+ */
+const (
+	sshAgentFailure = 5
+	sshAgentRequestIdentities = 11
+	sshAgentIdentitiesAnswer = 12
+	sshAgentSignRequest = 13
+	sshAgentSignResponse = 14
+	
+	sshAgentRSASHA256 = 2
+	sshAgentRSASHA512 = 4
+)
+
+type sshAgentKey struct {
+	signer crypto.Signer
+	comment string
+}
+
+/*******************************************************************************
+ * Parse the specified private keys, each of which is PEM encoded as PKCS1,
+ * PKCS8, SEC1 (EC) or OpenSSH format. Encrypted keys are not supported.
+ */
+func parseSSHAgentKeys(pemKeys [][]byte) ([]*sshAgentKey, error) {
+	
+	var keys = make([]*sshAgentKey, 0)
+	for _, pemKey := range pemKeys {
+		var block *pem.Block
+		block, _ = pem.Decode(pemKey)
+		if block == nil { return nil, utilities.ConstructUserError(
+			"SSH private key is not PEM encoded") }
+		if block.Headers["Proc-Type"] != "" { return nil, utilities.ConstructUserError(
+			"Encrypted SSH private keys are not supported") }
+		
+		var key interface{}
+		var comment string
+		var err error
+		switch block.Type {
+			case "RSA PRIVATE KEY": key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			case "EC PRIVATE KEY": key, err = x509.ParseECPrivateKey(block.Bytes)
+			case "PRIVATE KEY": key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			case "OPENSSH PRIVATE KEY": key, comment, err = parseOpenSSHPrivateKey(block.Bytes)
+			default: err = fmt.Errorf("unsupported key type %s", block.Type)
+		}
+		if err != nil { return nil, utilities.ConstructUserError(
+			"Could not parse SSH private key: " + err.Error()) }
+		
+		var signer, isSigner = key.(crypto.Signer)
+		if ! isSigner { return nil, utilities.ConstructUserError(
+			"Unsupported SSH private key type") }
+		if _, err = sshPublicKeyBlob(signer.Public()); err != nil { return nil, err }
+		keys = append(keys, &sshAgentKey{ signer: signer, comment: comment })
+	}
+	return keys, nil
+}
+
+/*******************************************************************************
+ * Answer the agent requests that are read from the connection, until it is
+ * closed.
+ */
+func serveSSHAgent(conn io.ReadWriter, keys []*sshAgentKey) error {
+	
+	for {
+		var lengthBytes = make([]byte, 4)
+		var _, err = io.ReadFull(conn, lengthBytes)
+		if err != nil { if err == io.EOF { return nil }; return err }
+		var length = binary.BigEndian.Uint32(lengthBytes)
+		if (length == 0) || (length > 256 * 1024) { return utilities.ConstructServerError(
+			"Invalid SSH agent request length") }
+		var request = make([]byte, length)
+		_, err = io.ReadFull(conn, request)
+		if err != nil { return err }
+		
+		var response = handleSSHAgentRequest(request, keys)
+		var message = binary.BigEndian.AppendUint32(nil, uint32(len(response)))
+		_, err = conn.Write(append(message, response...))
+		if err != nil { return err }
+	}
+}
+
+/*******************************************************************************
+ * Return the response to a single agent request.
+ */
+func handleSSHAgentRequest(request []byte, keys []*sshAgentKey) []byte {
+	
+	switch request[0] {
+		
+		case sshAgentRequestIdentities:
+			var response = []byte{ sshAgentIdentitiesAnswer }
+			response = binary.BigEndian.AppendUint32(response, uint32(len(keys)))
+			for _, key := range keys {
+				var blob, _ = sshPublicKeyBlob(key.signer.Public())
+				response = appendSSHString(response, blob)
+				response = appendSSHString(response, []byte(key.comment))
+			}
+			return response
+		
+		case sshAgentSignRequest:
+			var reader = &sshReader{ data: request[1:] }
+			var blob = reader.readString()
+			var data = reader.readString()
+			var flags = reader.readUint32()
+			if reader.err != nil { return []byte{ sshAgentFailure } }
+			for _, key := range keys {
+				var keyBlob, _ = sshPublicKeyBlob(key.signer.Public())
+				if ! bytes.Equal(blob, keyBlob) { continue }
+				var signature, err = sshSign(key.signer, data, flags)
+				if err != nil { return []byte{ sshAgentFailure } }
+				return appendSSHString([]byte{ sshAgentSignResponse }, signature)
+			}
+			return []byte{ sshAgentFailure }
+		
+		default:
+			return []byte{ sshAgentFailure }
+	}
+}
+
+/*******************************************************************************
+ * Return the SSH wire format of the public key.
+ */
+func sshPublicKeyBlob(publicKey crypto.PublicKey) ([]byte, error) {
+	
+	switch key := publicKey.(type) {
+		case ed25519.PublicKey:
+			var blob = appendSSHString(nil, []byte("ssh-ed25519"))
+			return appendSSHString(blob, key), nil
+		case *rsa.PublicKey:
+			var blob = appendSSHString(nil, []byte("ssh-rsa"))
+			blob = appendSSHMpint(blob, big.NewInt(int64(key.E)))
+			return appendSSHMpint(blob, key.N), nil
+		case *ecdsa.PublicKey:
+			var curveName, err = sshCurveName(key.Curve)
+			if err != nil { return nil, err }
+			var point []byte
+			point, err = key.Bytes()
+			if err != nil { return nil, utilities.ConstructUserError(err.Error()) }
+			var blob = appendSSHString(nil, []byte("ecdsa-sha2-" + curveName))
+			blob = appendSSHString(blob, []byte(curveName))
+			return appendSSHString(blob, point), nil
+		default:
+			return nil, utilities.ConstructUserError("Unsupported SSH key type")
+	}
+}
+
+/*******************************************************************************
+ * Return the SSH signature of the data.
+ */
+func sshSign(signer crypto.Signer, data []byte, flags uint32) ([]byte, error) {
+	
+	var algorithm string
+	var signature []byte
+	var err error
+	switch key := signer.(type) {
+		case ed25519.PrivateKey:
+			algorithm = "ssh-ed25519"
+			signature = ed25519.Sign(key, data)
+		case *rsa.PrivateKey:
+			var hash = crypto.SHA1
+			algorithm = "ssh-rsa"
+			if (flags & sshAgentRSASHA512) != 0 {
+				hash = crypto.SHA512; algorithm = "rsa-sha2-512"
+			} else if (flags & sshAgentRSASHA256) != 0 {
+				hash = crypto.SHA256; algorithm = "rsa-sha2-256"
+			}
+			var hasher = hash.New()
+			hasher.Write(data)
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, hasher.Sum(nil))
+			if err != nil { return nil, err }
+		case *ecdsa.PrivateKey:
+			var curveName string
+			curveName, err = sshCurveName(key.Curve)
+			if err != nil { return nil, err }
+			algorithm = "ecdsa-sha2-" + curveName
+			var digest []byte
+			switch key.Curve.Params().BitSize {
+				case 256: var sum = sha256.Sum256(data); digest = sum[:]
+				case 384: var sum = sha512.Sum384(data); digest = sum[:]
+				default: var sum = sha512.Sum512(data); digest = sum[:]
+			}
+			var r, s *big.Int
+			r, s, err = ecdsa.Sign(rand.Reader, key, digest)
+			if err != nil { return nil, err }
+			signature = appendSSHMpint(appendSSHMpint(nil, r), s)
+		default:
+			return nil, utilities.ConstructUserError("Unsupported SSH key type")
+	}
+	return appendSSHString(appendSSHString(nil, []byte(algorithm)), signature), nil
+}
+
+func sshCurveName(curve elliptic.Curve) (string, error) {
+	switch curve {
+		case elliptic.P256(): return "nistp256", nil
+		case elliptic.P384(): return "nistp384", nil
+		case elliptic.P521(): return "nistp521", nil
+	}
+	return "", utilities.ConstructUserError("Unsupported SSH ECDSA curve")
+}
+
+/*******************************************************************************
+ * Parse an unencrypted private key in OpenSSH format (the content of the PEM
+ * block), returning the key and its comment. See PROTOCOL.key in the OpenSSH
+ * sources.
+ */
+func parseOpenSSHPrivateKey(data []byte) (interface{}, string, error) {
+	
+	const magic = "openssh-key-v1\x00"
+	if ! bytes.HasPrefix(data, []byte(magic)) { return nil, "", fmt.Errorf("bad OpenSSH key magic") }
+	var reader = &sshReader{ data: data[len(magic):] }
+	var cipherName = string(reader.readString())
+	var kdfName = string(reader.readString())
+	reader.readString()  // kdf options
+	var keyCount = reader.readUint32()
+	reader.readString()  // public key
+	var private = &sshReader{ data: reader.readString() }
+	if reader.err != nil { return nil, "", reader.err }
+	if (cipherName != "none") || (kdfName != "none") { return nil, "", fmt.Errorf(
+		"encrypted OpenSSH keys are not supported") }
+	if keyCount != 1 { return nil, "", fmt.Errorf("OpenSSH key file contains %d keys", keyCount) }
+	
+	if private.readUint32() != private.readUint32() { return nil, "", fmt.Errorf(
+		"OpenSSH key check values do not match") }
+	var keyType = string(private.readString())
+	var key interface{}
+	switch keyType {
+		case "ssh-ed25519":
+			private.readString()  // public key
+			var seedAndPublic = private.readString()
+			if len(seedAndPublic) != ed25519.PrivateKeySize { return nil, "", fmt.Errorf(
+				"bad ed25519 key size") }
+			key = ed25519.PrivateKey(seedAndPublic)
+		case "ssh-rsa":
+			var n = private.readMpint()
+			var e = private.readMpint()
+			var d = private.readMpint()
+			private.readMpint()  // iqmp
+			var p = private.readMpint()
+			var q = private.readMpint()
+			if private.err != nil { return nil, "", private.err }
+			var rsaKey = &rsa.PrivateKey{
+				PublicKey: rsa.PublicKey{ N: n, E: int(e.Int64()) },
+				D: d,
+				Primes: []*big.Int{ p, q },
+			}
+			var err = rsaKey.Validate()
+			if err != nil { return nil, "", err }
+			rsaKey.Precompute()
+			key = rsaKey
+		case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+			var curve elliptic.Curve
+			switch string(private.readString()) {
+				case "nistp256": curve = elliptic.P256()
+				case "nistp384": curve = elliptic.P384()
+				case "nistp521": curve = elliptic.P521()
+				default: return nil, "", fmt.Errorf("unsupported ECDSA curve")
+			}
+			private.readString()  // public point
+			var scalar = private.readMpint()
+			if private.err != nil { return nil, "", private.err }
+			var privateBytes = make([]byte, (curve.Params().BitSize + 7) / 8)
+			var err error
+			key, err = ecdsa.ParseRawPrivateKey(curve, scalar.FillBytes(privateBytes))
+			if err != nil { return nil, "", err }
+		default:
+			return nil, "", fmt.Errorf("unsupported OpenSSH key type %s", keyType)
+	}
+	var comment = string(private.readString())
+	if private.err != nil { return nil, "", private.err }
+	return key, comment, nil
+}
+
+/*******************************************************************************
+ * Reads the SSH wire encodings of RFC 4251. The first error is retained, and
+ * subsequent reads return zero values.
+ */
+type sshReader struct {
+	data []byte
+	err error
+}
+
+func (reader *sshReader) readUint32() uint32 {
+	if (reader.err == nil) && (len(reader.data) < 4) { reader.err = fmt.Errorf("truncated SSH data") }
+	if reader.err != nil { return 0 }
+	var value = binary.BigEndian.Uint32(reader.data)
+	reader.data = reader.data[4:]
+	return value
+}
+
+func (reader *sshReader) readString() []byte {
+	var length = reader.readUint32()
+	if (reader.err == nil) && (uint32(len(reader.data)) < length) { reader.err = fmt.Errorf("truncated SSH data") }
+	if reader.err != nil { return nil }
+	var value = reader.data[:length]
+	reader.data = reader.data[length:]
+	return value
+}
+
+func (reader *sshReader) readMpint() *big.Int {
+	return new(big.Int).SetBytes(reader.readString())  // only non-negative values occur in keys
+}
+
+func appendSSHString(data []byte, value []byte) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(value)))
+	return append(data, value...)
+}
+
+func appendSSHMpint(data []byte, value *big.Int) []byte {
+	var bytes = value.Bytes()
+	if (len(bytes) > 0) && ((bytes[0] & 0x80) != 0) { bytes = append([]byte{ 0 }, bytes...) }
+	return appendSSHString(data, bytes)
+}
@@ -0,0 +1,150 @@
+package docker
+
+import (
+	"io"
+	"net"
+	"testing"
+	"math/big"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/binary"
+)
+
+/*******************************************************************************
+ * Return an unencrypted OpenSSH format private key file for the ed25519 key.
+ */
+func openSSHTestKey(privateKey ed25519.PrivateKey, comment string) []byte {
+	
+	var publicBlob, _ = sshPublicKeyBlob(privateKey.Public())
+	var private = binary.BigEndian.AppendUint32(nil, 0x12345678)
+	private = binary.BigEndian.AppendUint32(private, 0x12345678)
+	private = appendSSHString(private, []byte("ssh-ed25519"))
+	private = appendSSHString(private, privateKey.Public().(ed25519.PublicKey))
+	private = appendSSHString(private, privateKey)
+	private = appendSSHString(private, []byte(comment))
+	for i := 1; len(private) % 8 != 0; i++ { private = append(private, byte(i)) }
+	
+	var data = []byte("openssh-key-v1\x00")
+	data = appendSSHString(data, []byte("none"))
+	data = appendSSHString(data, []byte("none"))
+	data = appendSSHString(data, nil)
+	data = binary.BigEndian.AppendUint32(data, 1)
+	data = appendSSHString(data, publicBlob)
+	data = appendSSHString(data, private)
+	return pem.EncodeToMemory(&pem.Block{ Type: "OPENSSH PRIVATE KEY", Bytes: data })
+}
+
+/*******************************************************************************
+ * Send a request to the agent, and return its response.
+ */
+func callTestSSHAgent(t *testing.T, conn net.Conn, request []byte) []byte {
+	
+	var _, err = conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(request))), request...))
+	if err != nil { t.Fatal(err) }
+	var lengthBytes = make([]byte, 4)
+	_, err = io.ReadFull(conn, lengthBytes)
+	if err != nil { t.Fatal(err) }
+	var response = make([]byte, binary.BigEndian.Uint32(lengthBytes))
+	_, err = io.ReadFull(conn, response)
+	if err != nil { t.Fatal(err) }
+	return response
+}
+
+func TestSSHAgent(t *testing.T) {
+	
+	var rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil { t.Fatal(err) }
+	var ecKey *ecdsa.PrivateKey
+	ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil { t.Fatal(err) }
+	var ecDER []byte
+	ecDER, err = x509.MarshalECPrivateKey(ecKey)
+	if err != nil { t.Fatal(err) }
+	var edKey ed25519.PrivateKey
+	_, edKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil { t.Fatal(err) }
+	
+	var keys []*sshAgentKey
+	keys, err = parseSSHAgentKeys([][]byte{
+		pem.EncodeToMemory(&pem.Block{ Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey) }),
+		pem.EncodeToMemory(&pem.Block{ Type: "EC PRIVATE KEY", Bytes: ecDER }),
+		openSSHTestKey(edKey, "me@example.com"),
+	})
+	if err != nil { t.Fatal(err) }
+	var agentEnd, clientEnd = net.Pipe()
+	go serveSSHAgent(agentEnd, keys)
+	defer clientEnd.Close()
+	
+	// The identities are the keys' public keys, with their comments.
+	var response = callTestSSHAgent(t, clientEnd, []byte{ sshAgentRequestIdentities })
+	var reader = &sshReader{ data: response[1:] }
+	if (response[0] != sshAgentIdentitiesAnswer) || (reader.readUint32() != 3) {
+		t.Fatalf("Unexpected identities answer %v", response)
+	}
+	var blobs = make([][]byte, 0)
+	var comments = make([]string, 0)
+	for i := 0; i < 3; i++ {
+		blobs = append(blobs, reader.readString())
+		comments = append(comments, string(reader.readString()))
+	}
+	if reader.err != nil { t.Fatal(reader.err) }
+	if comments[2] != "me@example.com" { t.Errorf("Unexpected comments %q", comments) }
+	
+	// Each key signs, in the format for its type.
+	var data = []byte("data to sign")
+	var sign = func(blob []byte, flags uint32) (string, []byte) {
+		var request = appendSSHString(appendSSHString([]byte{ sshAgentSignRequest }, blob), data)
+		var response = callTestSSHAgent(t, clientEnd, binary.BigEndian.AppendUint32(request, flags))
+		if response[0] != sshAgentSignResponse { t.Fatalf("Sign request failed: %v", response) }
+		var reader = &sshReader{ data: response[1:] }
+		var signature = &sshReader{ data: reader.readString() }
+		return string(signature.readString()), signature.readString()
+	}
+	var digest = sha256.Sum256(data)
+	
+	var algorithm, signature = sign(blobs[0], sshAgentRSASHA256)
+	if (algorithm != "rsa-sha2-256") ||
+		(rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature) != nil) {
+		t.Errorf("RSA signature (%s) does not verify", algorithm)
+	}
+	algorithm, signature = sign(blobs[1], 0)
+	var rs = &sshReader{ data: signature }
+	var r, s = rs.readMpint(), rs.readMpint()
+	if (algorithm != "ecdsa-sha2-nistp256") || (! ecdsa.Verify(&ecKey.PublicKey, digest[:], r, s)) {
+		t.Errorf("ECDSA signature (%s) does not verify", algorithm)
+	}
+	algorithm, signature = sign(blobs[2], 0)
+	if (algorithm != "ssh-ed25519") || (! ed25519.Verify(edKey.Public().(ed25519.PublicKey), data, signature)) {
+		t.Errorf("ed25519 signature (%s) does not verify", algorithm)
+	}
+	
+	// Unknown keys and requests fail.
+	var unknownBlob = appendSSHMpint(appendSSHString(nil, []byte("ssh-rsa")), big.NewInt(3))
+	var request = appendSSHString(appendSSHString([]byte{ sshAgentSignRequest }, unknownBlob), data)
+	response = callTestSSHAgent(t, clientEnd, binary.BigEndian.AppendUint32(request, 0))
+	if response[0] != sshAgentFailure { t.Errorf("Sign request for unknown key did not fail") }
+	response = callTestSSHAgent(t, clientEnd, []byte{ 17 })  // add identity
+	if response[0] != sshAgentFailure { t.Errorf("Unsupported request did not fail") }
+}
+
+func TestParseSSHAgentKeysRejected(t *testing.T) {
+	
+	var cases = map[string][]byte{
+		"not PEM": []byte("ssh-ed25519 AAAA"),
+		"encrypted": pem.EncodeToMemory(&pem.Block{ Type: "RSA PRIVATE KEY",
+			Headers: map[string]string{ "Proc-Type": "4,ENCRYPTED" }, Bytes: []byte{ 0 } }),
+		"unknown type": pem.EncodeToMemory(&pem.Block{ Type: "DSA PRIVATE KEY", Bytes: []byte{ 0 } }),
+		"malformed": pem.EncodeToMemory(&pem.Block{ Type: "OPENSSH PRIVATE KEY", Bytes: []byte("openssh") }),
+	}
+	for name, pemKey := range cases {
+		var _, err = parseSSHAgentKeys([][]byte{ pemKey })
+		if err == nil { t.Errorf("%s key: expected an error", name) }
+	}
+}
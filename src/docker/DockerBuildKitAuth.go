@@ -0,0 +1,131 @@
+package docker
+
+import (
+	"fmt"
+	"context"
+	"time"
+	"strings"
+	"net/url"
+	"net/http"
+	"encoding/json"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * A BuildKit build (version=2) ignores the X-Registry-Config header: it obtains
+ * the credentials for pulling FROM images from the client, via the session's
+ * Auth service (see github.com/moby/buildkit/session/auth/auth.proto):
+	service Auth {
+		rpc Credentials(CredentialsRequest) returns (CredentialsResponse);
+		rpc FetchToken(FetchTokenRequest) returns (FetchTokenResponse);
+	}
+	message CredentialsRequest { string Host = 1; }
+	message CredentialsResponse { string Username = 1; string Secret = 2; }
+	message FetchTokenRequest {
+		string ClientID = 1;
+		string Host = 2;
+		string Realm = 3;
+		string Service = 4;
+		repeated string Scopes = 5;
+	}
+	message FetchTokenResponse { string Token = 1; int64 ExpiresIn = 2; int64 IssuedAt = 3; }
+ * The engine asks for the credentials of a registry host, and obtains a token
+ * with them itself; it asks the client to fetch a token only when there are no
+ * credentials. As with the docker CLI, an identity token is returned as the
+ * secret, with no user name.
+ */
+
+/*******************************************************************************
+ * Return the CredentialsResponse to a CredentialsRequest. A registry for which
+ * there are no credentials has an empty response (anonymous access).
+ */
+func (session *buildKitSession) authCredentials(request []byte) []byte {
+	
+	var auth = session.auths.Lookup(protobufStringField(request, 1))
+	var response = make([]byte, 0)
+	if auth == nil { return response }
+	if auth.IdentityToken != "" { return appendProtobufBytes(response, 2, []byte(auth.IdentityToken)) }
+	response = appendProtobufBytes(response, 1, []byte(auth.Username))
+	return appendProtobufBytes(response, 2, []byte(auth.Password))
+}
+
+/*******************************************************************************
+ * Fetch a token from the authorization server (realm) that a FetchTokenRequest
+ * names, using the credentials of the registry host, if there are any, and
+ * return the FetchTokenResponse. See
+ * https://distribution.github.io/distribution/spec/auth/token/ and .../oauth/.
+ */
+func (session *buildKitSession) authFetchToken(ctx context.Context, request []byte) ([]byte, error) {
+	
+	var clientId, host, realm, service string
+	var scopes = make([]string, 0)
+	var err = forEachProtobufField(request, func(fieldNo int, wireType int, value []byte, varint uint64) error {
+		switch fieldNo {
+			case 1: clientId = string(value)
+			case 2: host = string(value)
+			case 3: realm = string(value)
+			case 4: service = string(value)
+			case 5: scopes = append(scopes, string(value))
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+	if ! IsHTTPURL(realm) { return nil, utilities.ConstructServerError(
+		"Token realm is not an http URL: " + realm) }
+	
+	// An identity token is exchanged for a token with an OAuth2 refresh token
+	// grant; otherwise the token is requested with basic authentication, or
+	// anonymously if there are no credentials.
+	var auth = session.auths.Lookup(host)
+	var httpRequest *http.Request
+	if (auth != nil) && (auth.IdentityToken != "") {
+		var form = url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", auth.IdentityToken)
+		form.Set("service", service)
+		form.Set("scope", strings.Join(scopes, " "))
+		form.Set("client_id", clientId)
+		httpRequest, err = http.NewRequestWithContext(ctx, "POST", realm, strings.NewReader(form.Encode()))
+		if err != nil { return nil, err }
+		httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		var query = url.Values{}
+		if service != "" { query.Set("service", service) }
+		for _, scope := range scopes { query.Add("scope", scope) }
+		if clientId != "" { query.Set("client_id", clientId) }
+		var tokenURL = realm
+		if len(query) > 0 {
+			if strings.Contains(tokenURL, "?") { tokenURL = tokenURL + "&" } else { tokenURL = tokenURL + "?" }
+			tokenURL = tokenURL + query.Encode()
+		}
+		httpRequest, err = http.NewRequestWithContext(ctx, "GET", tokenURL, nil)
+		if err != nil { return nil, err }
+		if auth != nil { httpRequest.SetBasicAuth(auth.Username, auth.Password) }
+	}
+	
+	var httpResponse *http.Response
+	httpResponse, err = http.DefaultClient.Do(httpRequest)
+	if err != nil { return nil, err }
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK { return nil, utilities.ConstructServerError(fmt.Sprintf(
+		"Token request to %s failed: %s", realm, httpResponse.Status)) }
+	var tokenResponse struct {
+		Token string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn int64 `json:"expires_in"`
+		IssuedAt string `json:"issued_at"`  // RFC 3339
+	}
+	err = json.NewDecoder(httpResponse.Body).Decode(&tokenResponse)
+	if err != nil { return nil, utilities.ConstructServerError(
+		"Token response is not valid: " + err.Error()) }
+	
+	var token = tokenResponse.AccessToken
+	if token == "" { token = tokenResponse.Token }
+	if token == "" { return nil, utilities.ConstructServerError("Token response has no token") }
+	var response = appendProtobufBytes(nil, 1, []byte(token))
+	if tokenResponse.ExpiresIn > 0 { response = appendProtobufVarint(response, 2, uint64(tokenResponse.ExpiresIn)) }
+	var issuedAt, parseErr = time.Parse(time.RFC3339, tokenResponse.IssuedAt)
+	if parseErr == nil { response = appendProtobufVarint(response, 3, uint64(issuedAt.Unix())) }
+	return response, nil
+}
@@ -0,0 +1,487 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"context"
+	"os"
+	"net"
+	"net/http"
+	"bufio"
+	"sync"
+	"strings"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * A secret that a BuildKit build can mount with
+ *	RUN --mount=type=secret,id=<Id> ...
+ * The value is either the content of a local file, which is read when the
+ * build requests it, or a value held in memory. Secrets are never stored in
+ * the image or the build cache.
+ */
+type DockerBuildSecret struct {
+	Id string
+	FilePath string
+	Value []byte
+}
+
+func NewDockerBuildSecretFromFile(id, filePath string) *DockerBuildSecret {
+	return &DockerBuildSecret{ Id: id, FilePath: filePath }
+}
+
+func NewDockerBuildSecretFromValue(id string, value []byte) *DockerBuildSecret {
+	return &DockerBuildSecret{ Id: id, Value: value }
+}
+
+func (secret *DockerBuildSecret) read() ([]byte, error) {
+	if secret.FilePath == "" { return secret.Value, nil }
+	return os.ReadFile(secret.FilePath)
+}
+
+/*******************************************************************************
+ * An SSH agent that a BuildKit build can use with
+ *	RUN --mount=type=ssh,id=<Id> ...
+ * (the id defaults to "default"). The agent is either an existing ssh-agent,
+ * reached via its unix socket, or an agent that this package runs in memory
+ * for the specified private keys.
+ */
+type DockerBuildSSH struct {
+	Id string
+	AgentSocketPath string
+	keys []*sshAgentKey
+}
+
+/*******************************************************************************
+ * Forward the ssh-agent that listens at the specified socket path; if the path
+ * is empty, the agent identified by $SSH_AUTH_SOCK.
+ */
+func NewDockerBuildSSHFromAgent(id, agentSocketPath string) (*DockerBuildSSH, error) {
+	
+	if agentSocketPath == "" { agentSocketPath = os.Getenv("SSH_AUTH_SOCK") }
+	if agentSocketPath == "" { return nil, utilities.ConstructUserError(
+		"No SSH agent socket specified, and SSH_AUTH_SOCK is not set") }
+	return &DockerBuildSSH{ Id: sshIdOrDefault(id), AgentSocketPath: agentSocketPath }, nil
+}
+
+/*******************************************************************************
+ * Provide the private keys in the specified files (PEM or OpenSSH format, not
+ * encrypted) via an in-memory agent.
+ */
+func NewDockerBuildSSHFromKeyFiles(id string, keyFilePaths ...string) (*DockerBuildSSH, error) {
+	
+	var pemKeys = make([][]byte, 0)
+	for _, keyFilePath := range keyFilePaths {
+		var pemKey []byte
+		var err error
+		pemKey, err = os.ReadFile(keyFilePath)
+		if err != nil { return nil, utilities.ConstructUserError(fmt.Sprintf(
+			"Could not read SSH key file '%s': %s", keyFilePath, err.Error())) }
+		pemKeys = append(pemKeys, pemKey)
+	}
+	return NewDockerBuildSSHFromKeys(id, pemKeys...)
+}
+
+/*******************************************************************************
+ * Provide the specified private keys (PEM or OpenSSH format, not encrypted)
+ * via an in-memory agent.
+ */
+func NewDockerBuildSSHFromKeys(id string, pemKeys ...[]byte) (*DockerBuildSSH, error) {
+	
+	if len(pemKeys) == 0 { return nil, utilities.ConstructUserError("No SSH keys specified") }
+	var keys []*sshAgentKey
+	var err error
+	keys, err = parseSSHAgentKeys(pemKeys)
+	if err != nil { return nil, err }
+	return &DockerBuildSSH{ Id: sshIdOrDefault(id), keys: keys }, nil
+}
+
+func sshIdOrDefault(id string) string {
+	if id == "" { return "default" }
+	return id
+}
+
+/*******************************************************************************
+ * Return a connection to the agent.
+ */
+func (ssh *DockerBuildSSH) dialAgent() (net.Conn, error) {
+	
+	if ssh.AgentSocketPath != "" { return net.Dial("unix", ssh.AgentSocketPath) }
+	var agentEnd, clientEnd = net.Pipe()
+	go func() {
+		serveSSHAgent(agentEnd, ssh.keys)
+		agentEnd.Close()
+	}()
+	return clientEnd, nil
+}
+
+/*******************************************************************************
+ * A BuildKit build obtains secrets, SSH agents and registry credentials (see
+ * DockerBuildKitAuth.go) from the client by means of a session: the client opens a connection to the engine's /session endpoint,
+ * which upgrades it to HTTP/2; the engine then acts as a gRPC client over that
+ * connection, and the client serves the gRPC methods that it advertised when
+ * opening the session. The build request names the session via its "session"
+ * query parameter. See github.com/moby/buildkit/session.
+ */
+type buildKitSession struct {
+	id string
+	secrets map[string]*DockerBuildSecret
+	ssh map[string]*DockerBuildSSH
+	auths DockerRegistryAuths
+	conn net.Conn
+	server *http.Server
+	closeOnce sync.Once
+	stopContextWatch func() bool
+}
+
+const (
+	grpcHealthCheck = "/grpc.health.v1.Health/Check"
+	grpcGetSecret = "/moby.buildkit.secrets.v1.Secrets/GetSecret"
+	grpcCheckAgent = "/moby.sshforward.v1.SSH/CheckAgent"
+	grpcForwardAgent = "/moby.sshforward.v1.SSH/ForwardAgent"
+	grpcAuthCredentials = "/moby.filesync.v1.Auth/Credentials"
+	grpcAuthFetchToken = "/moby.filesync.v1.Auth/FetchToken"
+	
+	grpcStatusNotFound = 5
+	grpcStatusUnimplemented = 12
+	grpcStatusInternal = 13
+)
+
+/*******************************************************************************
+ * Return a session, not yet open, that serves the secrets, SSH agents and
+ * registry credentials of the options.
+ */
+func newBuildKitSession(options *DockerBuildOptions) (*buildKitSession, error) {
+	
+	var idBytes = make([]byte, 16)
+	var _, err = rand.Read(idBytes)
+	if err != nil { return nil, err }
+	var session = &buildKitSession{
+		id: hex.EncodeToString(idBytes),
+		secrets: make(map[string]*DockerBuildSecret),
+		ssh: make(map[string]*DockerBuildSSH),
+		auths: make(DockerRegistryAuths),
+	}
+	for _, secret := range options.Secrets { session.secrets[secret.Id] = secret }
+	for _, ssh := range options.SSH { session.ssh[ssh.Id] = ssh }
+	for key, auth := range options.RegistryAuths {
+		if auth != nil { session.auths[key] = auth }
+	}
+	return session, nil
+}
+
+/*******************************************************************************
+ * Return the gRPC methods that the session serves.
+ */
+func (session *buildKitSession) methods() []string {
+	
+	var methods = []string{ grpcHealthCheck }
+	if len(session.secrets) > 0 { methods = append(methods, grpcGetSecret) }
+	if len(session.ssh) > 0 { methods = append(methods, grpcCheckAgent, grpcForwardAgent) }
+	if len(session.auths) > 0 { methods = append(methods, grpcAuthCredentials, grpcAuthFetchToken) }
+	return methods
+}
+
+/*******************************************************************************
+ * Open a session with the engine, which serves the secrets, SSH agents and
+ * registry credentials of the options. The session must be closed when the
+ * build has completed.
+ */
+func (engine *DockerEngineImpl) startBuildKitSession(options *DockerBuildOptions) (*buildKitSession, error) {
+	
+	var session, err = newBuildKitSession(options)
+	if err != nil { return nil, err }
+	
+	// Open the connection directly, since it is hijacked for HTTP/2 when upgraded.
+	var conn net.Conn
+	conn, err = engine.unixDial("unix", "")
+	if err != nil { return nil, err }
+	var request *http.Request
+	request, err = http.NewRequest("POST", "http://docker/session", nil)
+	if err != nil { conn.Close(); return nil, err }
+	request.Header.Set("Upgrade", "h2c")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("X-Docker-Expose-Session-Uuid", session.id)
+	request.Header.Set("X-Docker-Expose-Session-Name", "docker-build")
+	request.Header.Set("X-Docker-Expose-Session-Sharedkey", session.id)
+	for _, method := range session.methods() {
+		request.Header.Add("X-Docker-Expose-Session-Grpc-Method", method)
+	}
+	err = request.Write(conn)
+	if err != nil { conn.Close(); return nil, err }
+	
+	var reader = bufio.NewReader(conn)
+	var response *http.Response
+	response, err = http.ReadResponse(reader, request)
+	if err != nil { conn.Close(); return nil, err }
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		err = generateResponseError(response, "BuildImage", response.Status + "; while opening build session")
+		if err == nil { err = utilities.ConstructServerError(
+			"Engine did not upgrade the build session connection: " + response.Status) }
+		return nil, err
+	}
+	
+	session.serve(&bufferedConn{ Conn: conn, reader: reader })
+	
+	// End the session if the build's context ends.
+	session.stopContextWatch = context.AfterFunc(engine.context(), session.close)
+	return session, nil
+}
+
+/*******************************************************************************
+ * Serve gRPC, i.e., HTTP/2 with prior knowledge, over the connection, which
+ * the engine has upgraded.
+ */
+func (session *buildKitSession) serve(conn net.Conn) {
+	
+	session.conn = conn
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	session.server = &http.Server{
+		Handler: http.HandlerFunc(session.serveGRPC),
+		Protocols: &protocols,
+	}
+	go session.server.Serve(newSingleConnListener(conn))
+}
+
+/*******************************************************************************
+ * End the session, closing its connection to the engine.
+ */
+func (session *buildKitSession) close() {
+	session.closeOnce.Do(func() {
+		if session.stopContextWatch != nil { session.stopContextWatch() }
+		session.server.Close()
+		session.conn.Close()
+	})
+}
+
+/*******************************************************************************
+ * Handle a gRPC request from the engine.
+ */
+func (session *buildKitSession) serveGRPC(writer http.ResponseWriter, request *http.Request) {
+	
+	writer.Header().Set("Content-Type", "application/grpc")
+	writer.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	
+	switch request.URL.Path {
+		
+		case grpcHealthCheck:
+			var _, err = readGRPCMessage(request.Body)
+			if err != nil { writeGRPCStatus(writer, grpcStatusInternal, err.Error()); return }
+			writeGRPCMessage(writer, appendProtobufVarint(nil, 1, 1))  // SERVING
+			writeGRPCStatus(writer, 0, "")
+		
+		case grpcGetSecret:
+			var message, err = readGRPCMessage(request.Body)
+			if err != nil { writeGRPCStatus(writer, grpcStatusInternal, err.Error()); return }
+			var id = protobufStringField(message, 1)
+			var secret = session.secrets[id]
+			if secret == nil { writeGRPCStatus(writer, grpcStatusNotFound, "secret " + id + " not found"); return }
+			var value []byte
+			value, err = secret.read()
+			if err != nil { writeGRPCStatus(writer, grpcStatusNotFound, err.Error()); return }
+			writeGRPCMessage(writer, appendProtobufBytes(nil, 1, value))
+			writeGRPCStatus(writer, 0, "")
+		
+		case grpcCheckAgent:
+			var message, err = readGRPCMessage(request.Body)
+			if err != nil { writeGRPCStatus(writer, grpcStatusInternal, err.Error()); return }
+			var id = sshIdOrDefault(protobufStringField(message, 1))
+			if session.ssh[id] == nil { writeGRPCStatus(writer, grpcStatusNotFound,
+				"no SSH agent with id " + id); return }
+			writeGRPCMessage(writer, nil)
+			writeGRPCStatus(writer, 0, "")
+		
+		case grpcForwardAgent:
+			var id = sshIdOrDefault(request.Header.Get("buildkit.ssh.id"))
+			var ssh = session.ssh[id]
+			if ssh == nil { writeGRPCStatus(writer, grpcStatusNotFound, "no SSH agent with id " + id); return }
+			var err = forwardSSHAgent(writer, request, ssh)
+			if err != nil { writeGRPCStatus(writer, grpcStatusInternal, err.Error()); return }
+			writeGRPCStatus(writer, 0, "")
+		
+		case grpcAuthCredentials:
+			var message, err = readGRPCMessage(request.Body)
+			if err != nil { writeGRPCStatus(writer, grpcStatusInternal, err.Error()); return }
+			writeGRPCMessage(writer, session.authCredentials(message))
+			writeGRPCStatus(writer, 0, "")
+		
+		case grpcAuthFetchToken:
+			var message, err = readGRPCMessage(request.Body)
+			if err != nil { writeGRPCStatus(writer, grpcStatusInternal, err.Error()); return }
+			message, err = session.authFetchToken(request.Context(), message)
+			if err != nil { writeGRPCStatus(writer, grpcStatusInternal, err.Error()); return }
+			writeGRPCMessage(writer, message)
+			writeGRPCStatus(writer, 0, "")
+		
+		default:
+			writeGRPCStatus(writer, grpcStatusUnimplemented, "unknown method " + request.URL.Path)
+	}
+}
+
+/*******************************************************************************
+ * Relay the bidirectional stream of BytesMessages between the engine and the
+ * SSH agent, until the engine closes its side of the stream.
+ */
+func forwardSSHAgent(writer http.ResponseWriter, request *http.Request, ssh *DockerBuildSSH) error {
+	
+	var controller = http.NewResponseController(writer)
+	controller.EnableFullDuplex()
+	var agent, err = ssh.dialAgent()
+	if err != nil { return err }
+	defer agent.Close()
+	writer.WriteHeader(http.StatusOK)
+	controller.Flush()
+	
+	var agentDone = make(chan error, 1)
+	go func() {
+		var buffer = make([]byte, 32 * 1024)
+		for {
+			var n, err = agent.Read(buffer)
+			if n > 0 {
+				var writeErr = writeGRPCMessage(writer, appendProtobufBytes(nil, 1, buffer[:n]))
+				if writeErr == nil { writeErr = controller.Flush() }
+				if writeErr != nil { agentDone <- writeErr; return }
+			}
+			if err != nil { agentDone <- nil; return }
+		}
+	}()
+	
+	for {
+		var message []byte
+		message, err = readGRPCMessage(request.Body)
+		if err == io.EOF { break }
+		if err != nil { return err }
+		_, err = agent.Write(protobufBytesField(message, 1))
+		if err != nil { return err }
+	}
+	agent.Close()
+	return <-agentDone
+}
+
+/*******************************************************************************
+ * Read a length-prefixed gRPC message. Returns io.EOF at the end of the stream.
+ */
+func readGRPCMessage(reader io.Reader) ([]byte, error) {
+	
+	var prefix = make([]byte, 5)
+	var _, err = io.ReadFull(reader, prefix)
+	if err != nil { return nil, err }
+	if prefix[0] != 0 { return nil, utilities.ConstructServerError(
+		"Compressed gRPC messages are not supported") }
+	var length = binary.BigEndian.Uint32(prefix[1:])
+	if length > 16 * 1024 * 1024 { return nil, utilities.ConstructServerError(
+		"gRPC message is too large") }
+	var message = make([]byte, length)
+	_, err = io.ReadFull(reader, message)
+	if err == io.EOF { err = io.ErrUnexpectedEOF }
+	return message, err
+}
+
+func writeGRPCMessage(writer io.Writer, message []byte) error {
+	var frame = []byte{ 0 }
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(message)))
+	var _, err = writer.Write(append(frame, message...))
+	return err
+}
+
+func writeGRPCStatus(writer http.ResponseWriter, code int, message string) {
+	writer.Header().Set("Grpc-Status", fmt.Sprintf("%d", code))
+	if message != "" { writer.Header().Set("Grpc-Message", grpcEncodeMessage(message)) }
+}
+
+/*******************************************************************************
+ * Percent-encode the status message, as gRPC requires.
+ */
+func grpcEncodeMessage(message string) string {
+	var builder strings.Builder
+	for i := 0; i < len(message); i++ {
+		var c = message[i]
+		if (c < 0x20) || (c > 0x7e) || (c == '%') {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		} else {
+			builder.WriteByte(c)
+		}
+	}
+	return builder.String()
+}
+
+func protobufBytesField(message []byte, fieldNo int) []byte {
+	var result []byte
+	forEachProtobufField(message, func(no int, wireType int, value []byte, varint uint64) error {
+		if (no == fieldNo) && (wireType == 2) { result = value }
+		return nil
+	})
+	return result
+}
+
+func protobufStringField(message []byte, fieldNo int) string {
+	return string(protobufBytesField(message, fieldNo))
+}
+
+/*******************************************************************************
+ * A connection whose initial input has been buffered by a reader.
+ */
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+/*******************************************************************************
+ * A listener that accepts a single, existing connection.
+ */
+type singleConnListener struct {
+	conns chan net.Conn
+	addr net.Addr
+	closeOnce sync.Once
+	closed chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	var listener = &singleConnListener{
+		conns: make(chan net.Conn, 1),
+		addr: conn.LocalAddr(),
+		closed: make(chan struct{}),
+	}
+	listener.conns <- conn
+	return listener
+}
+
+func (listener *singleConnListener) Accept() (net.Conn, error) {
+	select {
+		case conn := <-listener.conns: return conn, nil
+		case <-listener.closed: return nil, net.ErrClosed
+	}
+}
+
+func (listener *singleConnListener) Close() error {
+	listener.closeOnce.Do(func() { close(listener.closed) })
+	return nil
+}
+
+func (listener *singleConnListener) Addr() net.Addr {
+	return listener.addr
+}
+
+/*******************************************************************************
+ * The body of a build response, which ends the build's session when closed.
+ */
+type buildKitResponseBody struct {
+	io.ReadCloser
+	session *buildKitSession
+}
+
+func (body *buildKitResponseBody) Close() error {
+	var err = body.ReadCloser.Close()
+	body.session.close()
+	return err
+}
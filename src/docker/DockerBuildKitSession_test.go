@@ -0,0 +1,269 @@
+package docker
+
+import (
+	"io"
+	"net"
+	"sync"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"crypto/rand"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/binary"
+)
+
+/*******************************************************************************
+ * Serve a session for the options over one end of a pipe, and return an h2c
+ * client, playing the engine's part, whose requests are sent over the other.
+ */
+func startTestBuildKitSession(t *testing.T, options *DockerBuildOptions) (*buildKitSession, *http.Client) {
+	
+	var session, err = newBuildKitSession(options)
+	if err != nil { t.Fatal(err) }
+	var sessionEnd, engineEnd = net.Pipe()
+	session.serve(sessionEnd)
+	t.Cleanup(session.close)
+	
+	var dialOnce sync.Once
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	var transport = &http.Transport{
+		Protocols: &protocols,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var conn net.Conn = nil
+			dialOnce.Do(func() { conn = engineEnd })
+			if conn == nil { return nil, net.ErrClosed }
+			return conn, nil
+		},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return session, &http.Client{ Transport: transport }
+}
+
+/*******************************************************************************
+ * Call a unary gRPC method of the session, returning the response message (nil
+ * if there is none) and the gRPC status.
+ */
+func callTestGRPC(t *testing.T, client *http.Client, method string,
+	message []byte) ([]byte, string) {
+	
+	var frame bytes.Buffer
+	writeGRPCMessage(&frame, message)
+	var request, err = http.NewRequest("POST", "http://session" + method, &frame)
+	if err != nil { t.Fatal(err) }
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("Te", "trailers")
+	var response *http.Response
+	response, err = client.Do(request)
+	if err != nil { t.Fatal(err) }
+	defer response.Body.Close()
+	
+	var responseMessage []byte
+	responseMessage, err = readGRPCMessage(response.Body)
+	if err == io.EOF {
+		responseMessage = nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, response.Body)
+	var status = response.Trailer.Get("Grpc-Status")
+	if status == "" { status = response.Header.Get("Grpc-Status") }
+	return responseMessage, status
+}
+
+func TestBuildKitSessionHealthAndSecrets(t *testing.T) {
+	
+	var options = NewDockerBuildOptions("")
+	options.Secrets = []*DockerBuildSecret{ NewDockerBuildSecretFromValue("token", []byte("s3cr3t")) }
+	var session, client = startTestBuildKitSession(t, options)
+	var methods = strings.Join(session.methods(), " ")
+	if (! strings.Contains(methods, grpcGetSecret)) || strings.Contains(methods, grpcForwardAgent) ||
+		strings.Contains(methods, grpcAuthCredentials) {
+		t.Errorf("Unexpected methods: %s", methods)
+	}
+	
+	var message, status = callTestGRPC(t, client, grpcHealthCheck, nil)
+	if status != "0" { t.Fatalf("Health check status %s", status) }
+	var serving uint64
+	forEachProtobufField(message, func(fieldNo int, wireType int, value []byte, varint uint64) error {
+		if fieldNo == 1 { serving = varint }
+		return nil
+	})
+	if serving != 1 { t.Errorf("Health check did not report SERVING: %v", message) }
+	
+	message, status = callTestGRPC(t, client, grpcGetSecret, appendProtobufBytes(nil, 1, []byte("token")))
+	if (status != "0") || (string(protobufBytesField(message, 1)) != "s3cr3t") {
+		t.Errorf("GetSecret: status %s, message %q", status, message)
+	}
+	_, status = callTestGRPC(t, client, grpcGetSecret, appendProtobufBytes(nil, 1, []byte("other")))
+	if status != "5" { t.Errorf("GetSecret of unknown secret: expected status 5, got %s", status) }
+	_, status = callTestGRPC(t, client, "/moby.filesync.v1.FileSync/DiffCopy", nil)
+	if status != "12" { t.Errorf("Unknown method: expected status 12, got %s", status) }
+}
+
+func TestBuildKitSessionAuthCredentials(t *testing.T) {
+	
+	var options = NewDockerBuildOptions("")
+	options.RegistryAuths = DockerRegistryAuths{
+		"registry.example.com:5000": &DockerRegistryAuth{ Username: "builder", Password: "pw" },
+		DockerHubAuthKey: &DockerRegistryAuth{ Username: "hubuser", IdentityToken: "refresh-token" },
+	}
+	var session, client = startTestBuildKitSession(t, options)
+	if ! strings.Contains(strings.Join(session.methods(), " "), grpcAuthCredentials) {
+		t.Fatal("Auth methods are not advertised")
+	}
+	
+	var cases = []struct { host, username, secret string }{
+		{ "registry.example.com:5000", "builder", "pw" },
+		{ "registry-1.docker.io", "", "refresh-token" },
+		{ "other.example.com", "", "" },
+	}
+	for _, c := range cases {
+		var message, status = callTestGRPC(t, client, grpcAuthCredentials,
+			appendProtobufBytes(nil, 1, []byte(c.host)))
+		if status != "0" { t.Errorf("Credentials for %s: status %s", c.host, status); continue }
+		var username = protobufStringField(message, 1)
+		var secret = protobufStringField(message, 2)
+		if (username != c.username) || (secret != c.secret) {
+			t.Errorf("Credentials for %s: expected %q/%q, got %q/%q",
+				c.host, c.username, c.secret, username, secret)
+		}
+	}
+}
+
+func TestBuildKitSessionAuthFetchToken(t *testing.T) {
+	
+	var tokenServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var username, password, _ = request.BasicAuth()
+		if (username != "builder") || (password != "pw") { writer.WriteHeader(http.StatusUnauthorized); return }
+		var query = request.URL.Query()
+		if (query.Get("service") != "registry") || (query["scope"][0] != "repository:app:pull") ||
+			(len(query["scope"]) != 2) {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		io.WriteString(writer, `{"token":"tok","expires_in":300,"issued_at":"2026-01-02T03:04:05Z"}`)
+	}))
+	defer tokenServer.Close()
+	
+	var options = NewDockerBuildOptions("")
+	options.RegistryAuths = DockerRegistryAuths{
+		"registry.example.com": &DockerRegistryAuth{ Username: "builder", Password: "pw" },
+	}
+	var _, client = startTestBuildKitSession(t, options)
+	var request = appendProtobufBytes(nil, 2, []byte("registry.example.com"))
+	request = appendProtobufBytes(request, 3, []byte(tokenServer.URL + "/token"))
+	request = appendProtobufBytes(request, 4, []byte("registry"))
+	request = appendProtobufBytes(request, 5, []byte("repository:app:pull"))
+	request = appendProtobufBytes(request, 5, []byte("repository:base:pull"))
+	var message, status = callTestGRPC(t, client, grpcAuthFetchToken, request)
+	if status != "0" { t.Fatalf("FetchToken: status %s", status) }
+	var expiresIn, issuedAt uint64
+	forEachProtobufField(message, func(fieldNo int, wireType int, value []byte, varint uint64) error {
+		if fieldNo == 2 { expiresIn = varint }
+		if fieldNo == 3 { issuedAt = varint }
+		return nil
+	})
+	if (protobufStringField(message, 1) != "tok") || (expiresIn != 300) || (issuedAt != 1767323045) {
+		t.Errorf("FetchToken: unexpected response %q", message)
+	}
+	
+	// Without credentials, the token is requested anonymously, which the server refuses.
+	request = appendProtobufBytes(nil, 2, []byte("other.example.com"))
+	request = appendProtobufBytes(request, 3, []byte(tokenServer.URL + "/token"))
+	_, status = callTestGRPC(t, client, grpcAuthFetchToken, request)
+	if status != "13" { t.Errorf("Anonymous FetchToken: expected status 13, got %s", status) }
+}
+
+func TestBuildKitSessionForwardAgent(t *testing.T) {
+	
+	var publicKey, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil { t.Fatal(err) }
+	var der []byte
+	der, err = x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil { t.Fatal(err) }
+	var ssh *DockerBuildSSH
+	ssh, err = NewDockerBuildSSHFromKeys("", pem.EncodeToMemory(&pem.Block{ Type: "PRIVATE KEY", Bytes: der }))
+	if err != nil { t.Fatal(err) }
+	var options = NewDockerBuildOptions("")
+	options.SSH = []*DockerBuildSSH{ ssh }
+	var _, client = startTestBuildKitSession(t, options)
+	
+	var status string
+	_, status = callTestGRPC(t, client, grpcCheckAgent, nil)
+	if status != "0" { t.Errorf("CheckAgent of default agent: status %s", status) }
+	_, status = callTestGRPC(t, client, grpcCheckAgent, appendProtobufBytes(nil, 1, []byte("deploy")))
+	if status != "5" { t.Errorf("CheckAgent of unknown agent: expected status 5, got %s", status) }
+	
+	// Relay a signature request to the agent via the bidirectional stream.
+	var bodyReader, bodyWriter = io.Pipe()
+	var request *http.Request
+	request, err = http.NewRequest("POST", "http://session" + grpcForwardAgent, bodyReader)
+	if err != nil { t.Fatal(err) }
+	request.Header.Set("Content-Type", "application/grpc")
+	var response *http.Response
+	var responses = make(chan *http.Response, 1)
+	go func() {
+		var response, err = client.Do(request)
+		if err != nil { t.Error(err); close(responses); return }
+		responses <- response
+	}()
+	
+	var blob, _ = sshPublicKeyBlob(publicKey)
+	var data = []byte("session data to sign")
+	var agentRequest = appendSSHString(appendSSHString([]byte{ sshAgentSignRequest }, blob), data)
+	agentRequest = binary.BigEndian.AppendUint32(agentRequest, 0)
+	err = writeGRPCMessage(bodyWriter, appendProtobufBytes(nil, 1,
+		append(binary.BigEndian.AppendUint32(nil, uint32(len(agentRequest))), agentRequest...)))
+	if err != nil { t.Fatal(err) }
+	response = <-responses
+	if response == nil { t.FailNow() }
+	defer response.Body.Close()
+	
+	var message []byte
+	message, err = readGRPCMessage(response.Body)
+	if err != nil { t.Fatal(err) }
+	var agentResponse = protobufBytesField(message, 1)
+	var reader = &sshReader{ data: agentResponse[4:] }
+	if (len(agentResponse) < 5) || (agentResponse[4] != sshAgentSignResponse) {
+		t.Fatalf("Unexpected agent response %v", agentResponse)
+	}
+	reader.data = reader.data[1:]
+	var signature = &sshReader{ data: reader.readString() }
+	var algorithm = string(signature.readString())
+	if (algorithm != "ssh-ed25519") || (! ed25519.Verify(publicKey, data, signature.readString())) {
+		t.Errorf("Agent's signature (%s) does not verify", algorithm)
+	}
+	
+	bodyWriter.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("ForwardAgent: status %s", response.Trailer.Get("Grpc-Status"))
+	}
+}
+
+func TestGRPCFraming(t *testing.T) {
+	
+	var buffer bytes.Buffer
+	writeGRPCMessage(&buffer, []byte("first"))
+	writeGRPCMessage(&buffer, nil)
+	var message, err = readGRPCMessage(&buffer)
+	if (err != nil) || (string(message) != "first") { t.Errorf("First message: %q, %v", message, err) }
+	message, err = readGRPCMessage(&buffer)
+	if (err != nil) || (len(message) != 0) { t.Errorf("Empty message: %q, %v", message, err) }
+	_, err = readGRPCMessage(&buffer)
+	if err != io.EOF { t.Errorf("Expected io.EOF at end of stream, got %v", err) }
+	
+	_, err = readGRPCMessage(bytes.NewReader([]byte{ 1, 0, 0, 0, 1, 'x' }))
+	if err == nil { t.Error("Expected an error for a compressed message") }
+	_, err = readGRPCMessage(bytes.NewReader([]byte{ 0, 0, 0, 0, 5, 'x' }))
+	if err != io.ErrUnexpectedEOF { t.Errorf("Expected io.ErrUnexpectedEOF for a truncated message, got %v", err) }
+	
+	var encoded = grpcEncodeMessage("secret não encontrado: 100%")
+	if encoded != "secret n%C3%A3o encontrado: 100%25" { t.Errorf("grpcEncodeMessage: %s", encoded) }
+}
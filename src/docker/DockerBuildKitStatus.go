@@ -0,0 +1,223 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+	"encoding/binary"
+	"encoding/base64"
+	"encoding/json"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * A BuildKit build reports its progress as JSON messages of the form,
+	{"id":"moby.buildkit.trace","aux":"<base64 encoded protobuf StatusResponse>"}
+ * and the Id of the built image as,
+	{"id":"moby.image.id","aux":{"ID":"sha256:..."}}
+ * The parts of the StatusResponse message that we need are (see
+ * github.com/moby/buildkit/api/services/control/control.proto):
+	message StatusResponse {
+		repeated Vertex vertexes = 1;
+		repeated VertexStatus statuses = 2;
+		repeated VertexLog logs = 3;
+	}
+	message Vertex {
+		string digest = 1;
+		repeated string inputs = 2;
+		string name = 3;
+		bool cached = 4;
+		google.protobuf.Timestamp started = 5;
+		google.protobuf.Timestamp completed = 6;
+		string error = 7;
+	}
+	message VertexLog {
+		string vertex = 1;
+		google.protobuf.Timestamp timestamp = 2;
+		int64 stream = 3;
+		bytes msg = 4;
+	}
+ */
+const buildKitTraceId = "moby.buildkit.trace"
+
+type buildKitStatus struct {
+	vertexes []*buildKitVertex
+	logs []*buildKitVertexLog
+}
+
+type buildKitVertex struct {
+	digest string
+	name string
+	cached bool
+	started bool
+	completed bool
+	err string
+}
+
+type buildKitVertexLog struct {
+	vertex string
+	msg []byte
+}
+
+/*******************************************************************************
+ * Decode the aux value of a moby.buildkit.trace message.
+ */
+func parseBuildKitTrace(aux json.RawMessage) (*buildKitStatus, error) {
+	
+	var encoded string
+	var err error = json.Unmarshal(aux, &encoded)
+	if err != nil { return nil, err }
+	var bytes []byte
+	bytes, err = base64.StdEncoding.DecodeString(encoded)
+	if err != nil { return nil, err }
+	
+	var status = &buildKitStatus{}
+	err = forEachProtobufField(bytes, func(fieldNo int, wireType int, value []byte, varint uint64) error {
+		switch fieldNo {
+			case 1:
+				var vertex = &buildKitVertex{}
+				status.vertexes = append(status.vertexes, vertex)
+				return forEachProtobufField(value, func(fieldNo int, wireType int, value []byte, varint uint64) error {
+					switch fieldNo {
+						case 1: vertex.digest = string(value)
+						case 3: vertex.name = string(value)
+						case 4: vertex.cached = (varint != 0)
+						case 5: vertex.started = true
+						case 6: vertex.completed = true
+						case 7: vertex.err = string(value)
+					}
+					return nil
+				})
+			case 3:
+				var log = &buildKitVertexLog{}
+				status.logs = append(status.logs, log)
+				return forEachProtobufField(value, func(fieldNo int, wireType int, value []byte, varint uint64) error {
+					switch fieldNo {
+						case 1: log.vertex = string(value)
+						case 4: log.msg = value
+					}
+					return nil
+				})
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+	return status, nil
+}
+
+/*******************************************************************************
+ * Pass each field of the protobuf encoded message to the handler. For a
+ * length-delimited field, value is its content; for a varint field, varint is
+ * its value. Fixed width fields are passed as value.
+ */
+func forEachProtobufField(message []byte, handler func(fieldNo int, wireType int,
+	value []byte, varint uint64) error) error {
+	
+	for len(message) > 0 {
+		var key uint64
+		var n int
+		key, n = binary.Uvarint(message)
+		if n <= 0 { return utilities.ConstructServerError("Malformed protobuf field key") }
+		message = message[n:]
+		var fieldNo = int(key >> 3)
+		var wireType = int(key & 7)
+		var value []byte
+		var varint uint64
+		switch wireType {
+			case 0:
+				varint, n = binary.Uvarint(message)
+				if n <= 0 { return utilities.ConstructServerError("Malformed protobuf varint") }
+				message = message[n:]
+			case 1, 5:
+				var size = 8
+				if wireType == 5 { size = 4 }
+				if len(message) < size { return utilities.ConstructServerError("Truncated protobuf field") }
+				value = message[:size]
+				message = message[size:]
+			case 2:
+				var length uint64
+				length, n = binary.Uvarint(message)
+				if (n <= 0) || (uint64(len(message) - n) < length) {
+					return utilities.ConstructServerError("Malformed protobuf length") }
+				value = message[n:n + int(length)]
+				message = message[n + int(length):]
+			default:
+				return utilities.ConstructServerError(fmt.Sprintf(
+					"Unsupported protobuf wire type %d", wireType))
+		}
+		var err = handler(fieldNo, wireType, value, varint)
+		if err != nil { return err }
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Append a length-delimited protobuf field to the message.
+ */
+func appendProtobufBytes(message []byte, fieldNo int, value []byte) []byte {
+	message = binary.AppendUvarint(message, uint64(fieldNo << 3 | 2))
+	message = binary.AppendUvarint(message, uint64(len(value)))
+	return append(message, value...)
+}
+
+/*******************************************************************************
+ * Append a varint protobuf field to the message.
+ */
+func appendProtobufVarint(message []byte, fieldNo int, value uint64) []byte {
+	message = binary.AppendUvarint(message, uint64(fieldNo << 3))
+	return binary.AppendUvarint(message, value)
+}
+
+/*******************************************************************************
+ * Add the progress reported by a BuildKit status message to the build output.
+ * Dockerfile instructions are the vertexes whose names begin with "[n/m]" (or
+ * "[stage n/m]"); they become the steps of the output. Other vertexes (e.g.,
+ * "[internal] load build definition from Dockerfile") are reported only as
+ * stream text.
+ */
+func (parser *buildOutputParser) buildKitStatus(status *buildKitStatus) {
+	
+	if parser.buildKitSteps == nil { parser.buildKitSteps = make(map[string]*DockerBuildStep) }
+	for _, vertex := range status.vertexes {
+		var step = parser.buildKitSteps[vertex.digest]
+		var _, seen = parser.buildKitSteps[vertex.digest]
+		if (! seen) && (vertex.started || vertex.cached) {
+			var stepNo, cmd, isStep = parseBuildKitVertexName(vertex.name)
+			if isStep { step = parser.output.AddStep(stepNo, cmd) }
+			parser.buildKitSteps[vertex.digest] = step  // nil for a non-step vertex
+			parser.step = step
+			parser.emit(&DockerBuildEvent{ Kind: BuildEventStream, Step: step, Text: vertex.name })
+			if isStep { parser.emit(&DockerBuildEvent{ Kind: BuildEventStepStarted, Step: step }) }
+		}
+		if vertex.cached && (step != nil) && (! step.UsedCache) {
+			step.SetUsedCache()
+			parser.emit(&DockerBuildEvent{ Kind: BuildEventCacheHit, Step: step })
+		}
+		if vertex.err != "" {
+			parser.fail(utilities.ConstructUserError(vertex.name + ": " + vertex.err))
+		}
+	}
+	for _, log := range status.logs {
+		var step = parser.buildKitSteps[log.vertex]
+		for _, line := range strings.Split(strings.TrimRight(string(log.msg), "\n"), "\n") {
+			parser.emit(&DockerBuildEvent{ Kind: BuildEventStream, Step: step, Text: line })
+		}
+	}
+}
+
+/*******************************************************************************
+ * If the vertex name is that of a dockerfile instruction, e.g.,
+ * "[builder 2/5] RUN make", return the step number and the instruction.
+ */
+func parseBuildKitVertexName(name string) (stepNo int, cmd string, isStep bool) {
+	
+	if ! strings.HasPrefix(name, "[") { return 0, "", false }
+	var end = strings.Index(name, "]")
+	if end == -1 { return 0, "", false }
+	var fields = strings.Fields(name[1:end])
+	if len(fields) == 0 { return 0, "", false }
+	var stepCount int
+	var n, _ = fmt.Sscanf(fields[len(fields)-1], "%d/%d", &stepNo, &stepCount)
+	if n != 2 { return 0, "", false }
+	return stepNo, strings.TrimSpace(name[end+1:]), true
+}
@@ -0,0 +1,112 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"encoding/base64"
+)
+
+/*******************************************************************************
+ * Return a moby.buildkit.trace message of the build output, for a StatusResponse
+ * with the specified vertexes and logs (each already protobuf encoded).
+ */
+func buildKitTraceLine(vertexes, logs [][]byte) string {
+	
+	var status []byte
+	for _, vertex := range vertexes { status = appendProtobufBytes(status, 1, vertex) }
+	for _, log := range logs { status = appendProtobufBytes(status, 3, log) }
+	return fmt.Sprintf(`{"id":"%s","aux":"%s"}`, buildKitTraceId, base64.StdEncoding.EncodeToString(status))
+}
+
+func buildKitTestVertex(digest, name string, cached, started, completed bool, err string) []byte {
+	
+	var vertex = appendProtobufBytes(nil, 1, []byte(digest))
+	vertex = appendProtobufBytes(vertex, 2, []byte("sha256:input"))
+	vertex = appendProtobufBytes(vertex, 3, []byte(name))
+	if cached { vertex = appendProtobufVarint(vertex, 4, 1) }
+	var timestamp = appendProtobufVarint(nil, 1, 1767323045)
+	if started { vertex = appendProtobufBytes(vertex, 5, timestamp) }
+	if completed { vertex = appendProtobufBytes(vertex, 6, timestamp) }
+	if err != "" { vertex = appendProtobufBytes(vertex, 7, []byte(err)) }
+	return vertex
+}
+
+func buildKitTestLog(digest, msg string) []byte {
+	var log = appendProtobufBytes(nil, 1, []byte(digest))
+	log = appendProtobufVarint(log, 3, 1)
+	return appendProtobufBytes(log, 4, []byte(msg))
+}
+
+func TestParseBuildKitProgress(t *testing.T) {
+	
+	var lines = []string{
+		buildKitTraceLine([][]byte{
+			buildKitTestVertex("sha256:a", "[internal] load build definition from Dockerfile", false, true, true, ""),
+			buildKitTestVertex("sha256:b", "[1/3] FROM docker.io/library/alpine", false, true, false, ""),
+		}, nil),
+		buildKitTraceLine([][]byte{
+			buildKitTestVertex("sha256:c", "[2/3] COPY app /app", true, false, false, ""),
+			buildKitTestVertex("sha256:d", "[builder 3/3] RUN make", false, true, false, ""),
+		}, [][]byte{ buildKitTestLog("sha256:d", "compiling\nlinking\n") }),
+		buildKitTraceLine([][]byte{
+			buildKitTestVertex("sha256:d", "[builder 3/3] RUN make", false, true, true, ""),
+		}, nil),
+		`{"id":"moby.image.id","aux":{"ID":"sha256:0123456789ab"}}`,
+	}
+	var events = make([]string, 0)
+	var output, err = ParseBuildRESTOutputStream(strings.NewReader(strings.Join(lines, "\r\n")),
+		func(event *DockerBuildEvent) {
+			if event.Kind == BuildEventStream { events = append(events, event.Text) }
+		})
+	if err != nil { t.Fatal(err) }
+	
+	var steps = make([]string, 0)
+	for _, step := range output.Steps {
+		steps = append(steps, fmt.Sprintf("%d %s %v", step.StepNumber, step.Command, step.UsedCache))
+	}
+	var expected = "1 FROM docker.io/library/alpine false; 2 COPY app /app true; 3 RUN make false"
+	if strings.Join(steps, "; ") != expected {
+		t.Errorf("Expected steps %q, got %q", expected, strings.Join(steps, "; "))
+	}
+	if output.GetFinalDockerImageId() != "sha256:0123456789ab" {
+		t.Errorf("Unexpected image Id %q", output.GetFinalDockerImageId())
+	}
+	var text = strings.Join(events, "|")
+	if (! strings.Contains(text, "[internal] load build definition")) || (! strings.Contains(text, "compiling|linking")) {
+		t.Errorf("Unexpected stream text %q", text)
+	}
+}
+
+func TestParseBuildKitProgressError(t *testing.T) {
+	
+	var line = buildKitTraceLine([][]byte{
+		buildKitTestVertex("sha256:e", "[2/2] RUN false", false, true, true, "process did not complete successfully"),
+	}, nil)
+	var _, err = ParseBuildRESTOutputStream(strings.NewReader(line), nil)
+	if (err == nil) || (! strings.Contains(err.Error(), "did not complete successfully")) {
+		t.Errorf("Expected the vertex error, got %v", err)
+	}
+}
+
+func TestParseBuildKitVertexName(t *testing.T) {
+	
+	var cases = []struct {
+		name string
+		stepNo int
+		cmd string
+		isStep bool
+	}{
+		{ "[1/4] FROM alpine", 1, "FROM alpine", true },
+		{ "[builder 12/15] RUN go build ./...", 12, "RUN go build ./...", true },
+		{ "[internal] load metadata for docker.io/library/alpine:latest", 0, "", false },
+		{ "exporting to image", 0, "", false },
+		{ "[stage-1", 0, "", false },
+	}
+	for _, c := range cases {
+		var stepNo, cmd, isStep = parseBuildKitVertexName(c.name)
+		if (stepNo != c.stepNo) || (cmd != c.cmd) || (isStep != c.isStep) {
+			t.Errorf("parseBuildKitVertexName(%q): got %d, %q, %v", c.name, stepNo, cmd, isStep)
+		}
+	}
+}
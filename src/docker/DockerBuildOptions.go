@@ -0,0 +1,181 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+	"net/url"
+	"encoding/json"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * Options for a docker build, corresponding to the query parameters of the
+ * engine's build function. See,
+ * https://docs.docker.com/engine/api/v1.41/#operation/ImageBuild
+ * Zero values select the engine's defaults, except for Remove, which the engine
+ * defaults to true; use NewDockerBuildOptions to obtain options with the
+ * engine's defaults.
+ */
+type DockerBuildOptions struct {
+	Tags []string  // names (repo:tag) to give the image
+	Dockerfile string  // path of the dockerfile within the build context
+	BuildArgs map[string]string  // values for the dockerfile's ARGs
+	Target string  // the stage of a multi-stage dockerfile to build
+	Labels map[string]string  // labels to add to the image
+	Platform string  // e.g., "linux/amd64"
+	Pull bool  // always attempt to pull a newer version of the base images
+	NoCache bool  // do not use the cache
+	CacheFrom []string  // images to consider as cache sources
+	NetworkMode string  // network mode for RUN instructions, e.g., "host" or "none"
+	ExtraHosts []string  // "host:ip" entries to add to /etc/hosts of RUN containers
+	Memory int64  // memory limit of RUN containers, in bytes
+	MemorySwap int64  // total memory (memory + swap) limit; -1 disables swap limit
+	CPUShares int64  // relative CPU weight
+	CPUSetCPUs string  // CPUs on which RUN containers may execute, e.g., "0-3"
+	CPUPeriod int64  // length of a CPU period, in microseconds
+	CPUQuota int64  // CPU time that RUN containers may use per period, in microseconds
+	ShmSize int64  // size of /dev/shm of RUN containers, in bytes
+	Squash bool  // squash the new layers into a single layer (experimental)
+	Remove bool  // remove intermediate containers after a successful build
+	ForceRemove bool  // always remove intermediate containers, even if the build fails
+	ReproducibleContext bool  // zero the owner and modification time of build context entries
+	BuildKit bool  // build with BuildKit rather than the classic builder
+	Secrets []*DockerBuildSecret  // secrets for RUN --mount=type=secret (BuildKit only)
+	SSH []*DockerBuildSSH  // SSH agents for RUN --mount=type=ssh (BuildKit only)
+	RegistryAuths DockerRegistryAuths  // credentials for pulling FROM images, by registry host (for a
+		// BuildKit build, served via its session)
+}
+
+/*******************************************************************************
+ * Return options that build the dockerfile "Dockerfile" and name the image
+ * with the specified name, with the engine's defaults otherwise.
+ */
+func NewDockerBuildOptions(imageFullName string) *DockerBuildOptions {
+	
+	var tags = make([]string, 0)
+	if imageFullName != "" { tags = append(tags, imageFullName) }
+	return &DockerBuildOptions{
+		Tags: tags,
+		Dockerfile: "Dockerfile",
+		BuildArgs: make(map[string]string),
+		Labels: make(map[string]string),
+		Remove: true,
+	}
+}
+
+/*******************************************************************************
+ * Return the options that BuildImage uses for its parameters.
+ */
+func newDockerBuildOptionsFromParams(imageFullName, dockerfileName string,
+	paramNames, paramValues []string) (*DockerBuildOptions, error) {
+	
+	if len(paramNames) != len(paramValues) { return nil, utilities.ConstructServerError(
+		"Mismatch in number of param names and values") }
+	
+	var options = NewDockerBuildOptions(imageFullName)
+	options.Dockerfile = dockerfileName
+	for i, paramName := range paramNames {
+		options.BuildArgs[paramName] = paramValues[i]
+	}
+	
+	// Disable cache if there are build params, because they might be secret values
+	// and they would be maintained in the cache.
+	if len(paramNames) > 0 { options.NoCache = true }
+	
+	return options, nil
+}
+
+/*******************************************************************************
+ * Encode the options as the query string of a build request.
+ */
+func (options *DockerBuildOptions) queryString() (string, error) {
+	
+	if (! options.BuildKit) && ((len(options.Secrets) > 0) || (len(options.SSH) > 0)) {
+		return "", utilities.ConstructUserError(
+			"Build secrets and SSH agents require a BuildKit build")
+	}
+	
+	var query = url.Values{}
+	if options.BuildKit { query.Set("version", "2") }
+	for _, tag := range options.Tags {
+		query.Add("t", tag)
+	}
+	if options.Dockerfile != "" { query.Set("dockerfile", options.Dockerfile) }
+	if options.Target != "" { query.Set("target", options.Target) }
+	if options.Platform != "" { query.Set("platform", strings.ToLower(options.Platform)) }
+	if options.Pull { query.Set("pull", "1") }
+	if options.NoCache { query.Set("nocache", "1") }
+	if options.NetworkMode != "" { query.Set("networkmode", options.NetworkMode) }
+	for _, extraHost := range options.ExtraHosts {
+		query.Add("extrahosts", extraHost)
+	}
+	if options.Memory != 0 { query.Set("memory", fmt.Sprintf("%d", options.Memory)) }
+	if options.MemorySwap != 0 { query.Set("memswap", fmt.Sprintf("%d", options.MemorySwap)) }
+	if options.CPUShares != 0 { query.Set("cpushares", fmt.Sprintf("%d", options.CPUShares)) }
+	if options.CPUSetCPUs != "" { query.Set("cpusetcpus", options.CPUSetCPUs) }
+	if options.CPUPeriod != 0 { query.Set("cpuperiod", fmt.Sprintf("%d", options.CPUPeriod)) }
+	if options.CPUQuota != 0 { query.Set("cpuquota", fmt.Sprintf("%d", options.CPUQuota)) }
+	if options.ShmSize != 0 { query.Set("shmsize", fmt.Sprintf("%d", options.ShmSize)) }
+	if options.Squash { query.Set("squash", "1") }
+	if options.Remove { query.Set("rm", "1") } else { query.Set("rm", "0") }
+	if options.ForceRemove { query.Set("forcerm", "1") }
+	
+	// Parameters whose values are JSON.
+	var jsonParams = []struct {
+		name string
+		value interface{}
+		empty bool
+	}{
+		{ "buildargs", options.BuildArgs, len(options.BuildArgs) == 0 },
+		{ "labels", options.Labels, len(options.Labels) == 0 },
+		{ "cachefrom", options.CacheFrom, len(options.CacheFrom) == 0 },
+	}
+	for _, param := range jsonParams {
+		if param.empty { continue }
+		var bytes []byte
+		var err error
+		bytes, err = json.Marshal(param.value)
+		if err != nil { return "", err }
+		query.Set(param.name, string(bytes))
+	}
+	
+	return query.Encode(), nil
+}
+
+/*******************************************************************************
+ * Return the remote build context URL for the specified git repository, ref
+ * (a branch, tag or commit; empty for the default branch) and subdirectory of
+ * the repository (empty for the root), in the form the engine expects:
+ *	<repo URL>#<ref>:<subdirectory>
+ */
+func GitBuildContextURL(repoURL, ref, subdir string) string {
+	
+	var fragment = ref
+	if subdir != "" { fragment = fragment + ":" + strings.Trim(subdir, "/") }
+	if fragment == "" { return repoURL }
+	return repoURL + "#" + fragment
+}
+
+/*******************************************************************************
+ * Return true if the engine treats the specified remote build context as a git
+ * repository. These are the rules of the docker CLI.
+ */
+func IsGitURL(remote string) bool {
+	
+	if strings.HasPrefix(remote, "git://") || strings.HasPrefix(remote, "git@") ||
+		strings.HasPrefix(remote, "github.com/") {
+		return true
+	}
+	if ! IsHTTPURL(remote) { return false }
+	var repoURL = strings.SplitN(remote, "#", 2)[0]
+	return strings.HasSuffix(repoURL, ".git")
+}
+
+/*******************************************************************************
+ * Return true if the specified remote build context is an http or https URL.
+ */
+func IsHTTPURL(remote string) bool {
+	return strings.HasPrefix(remote, "http://") || strings.HasPrefix(remote, "https://")
+}
+
@@ -0,0 +1,52 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestGitBuildContextURL(t *testing.T) {
+	
+	var cases = []struct { repoURL, ref, subdir, expected string }{
+		{ "https://github.com/org/repo.git", "", "", "https://github.com/org/repo.git" },
+		{ "https://github.com/org/repo.git", "v1.2", "", "https://github.com/org/repo.git#v1.2" },
+		{ "https://github.com/org/repo.git", "main", "docker/app", "https://github.com/org/repo.git#main:docker/app" },
+		{ "https://github.com/org/repo.git", "", "/docker/", "https://github.com/org/repo.git#:docker" },
+		{ "git@github.com:org/repo.git", "3f4a9c1", "app", "git@github.com:org/repo.git#3f4a9c1:app" },
+		{ "git://example.com/repo", "dev", "", "git://example.com/repo#dev" },
+	}
+	for _, c := range cases {
+		var url = GitBuildContextURL(c.repoURL, c.ref, c.subdir)
+		if url != c.expected {
+			t.Errorf("GitBuildContextURL(%q, %q, %q): expected %q, got %q",
+				c.repoURL, c.ref, c.subdir, c.expected, url)
+		}
+	}
+}
+
+func TestRemoteBuildContextKind(t *testing.T) {
+	
+	var cases = []struct {
+		remote string
+		isGit bool
+		isHTTP bool
+	}{
+		{ "git@github.com:org/repo.git", true, false },
+		{ "git@github.com:org/repo", true, false },
+		{ "git://example.com/repo", true, false },
+		{ "git://example.com/repo.git#main:app", true, false },
+		{ "github.com/org/repo", true, false },
+		{ "https://github.com/org/repo.git", true, true },
+		{ "https://github.com/org/repo.git#main:docker/app", true, true },
+		{ "http://example.com/repo.git#v1", true, true },
+		{ "https://example.com/context.tar.gz", false, true },
+		{ "https://example.com/context.tar", false, true },
+		{ "https://example.com/Dockerfile", false, true },
+		{ "https://example.com/repo.git.tar.gz", false, true },
+		{ "ftp://example.com/repo.git", false, false },
+		{ "/home/me/repo.git", false, false },
+	}
+	for _, c := range cases {
+		if IsGitURL(c.remote) != c.isGit { t.Errorf("IsGitURL(%q): expected %v", c.remote, c.isGit) }
+		if IsHTTPURL(c.remote) != c.isHTTP { t.Errorf("IsHTTPURL(%q): expected %v", c.remote, c.isHTTP) }
+	}
+}
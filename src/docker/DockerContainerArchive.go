@@ -0,0 +1,271 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"strings"
+	pathpkg "path"
+	"archive/tar"
+	"path/filepath"
+	"encoding/base64"
+	"encoding/json"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * The engine returns the status of a container path in this header, as base64
+ * encoded JSON, in response to HEAD and GET /containers/{id}/archive.
+ */
+const containerPathStatHeader = "X-Docker-Container-Path-Stat"
+
+/*******************************************************************************
+ * Information about a file or directory within a container.
+ */
+type DockerContainerPathStat struct {
+	Name string `json:"name"`
+	Size int64 `json:"size"`
+	Mode os.FileMode `json:"mode"`
+	Mtime time.Time `json:"mtime"`
+	LinkTarget string `json:"linkTarget"`
+}
+
+/*******************************************************************************
+ * Decode the value of the X-Docker-Container-Path-Stat header.
+ */
+func parseContainerPathStat(headerValue string) (*DockerContainerPathStat, error) {
+	
+	if headerValue == "" { return nil, utilities.ConstructServerError(
+		"No " + containerPathStatHeader + " header in engine response") }
+	var bytes []byte
+	var err error
+	bytes, err = base64.StdEncoding.DecodeString(headerValue)
+	if err != nil { return nil, utilities.ConstructServerError(
+		"Ill-formed " + containerPathStatHeader + " header: " + err.Error()) }
+	var stat = &DockerContainerPathStat{}
+	err = json.Unmarshal(bytes, stat)
+	if err != nil { return nil, utilities.ConstructServerError(
+		"Ill-formed " + containerPathStatHeader + " header: " + err.Error()) }
+	return stat, nil
+}
+
+/*******************************************************************************
+ * Copy the specified file or directory from the specified container into the
+ * specified local directory, which must exist. As with "docker cp", a directory
+ * is copied with its base name, e.g., copying /etc from a container to /tmp/x
+ * produces /tmp/x/etc.
+ */
+func (dockerSvcs *DockerServices) CopyFromContainerToDir(containerId, srcPath,
+	destDirPath string) error {
+	
+	var reader io.ReadCloser
+	var err error
+	reader, _, err = dockerSvcs.Engine.CopyFromContainer(containerId, srcPath)
+	if err != nil { return err }
+	defer reader.Close()
+	return extractTar(reader, destDirPath)
+}
+
+/*******************************************************************************
+ * Copy the specified regular file from the specified container to the specified
+ * local file path, e.g., to retrieve /etc/os-release. If the path is a symbolic
+ * link, the file that it refers to is copied, as with "docker cp -L".
+ */
+func (dockerSvcs *DockerServices) CopyFileFromContainer(containerId, srcPath,
+	destFilePath string) error {
+	
+	var reader io.ReadCloser
+	var stat *DockerContainerPathStat
+	var err error
+	var filePath = srcPath
+	for links := 0; ; links++ {
+		reader, stat, err = dockerSvcs.Engine.CopyFromContainer(containerId, filePath)
+		if err != nil { return err }
+		if (stat.Mode & os.ModeSymlink) == 0 { break }
+		reader.Close()
+		if links == maxContainerSymlinks { return utilities.ConstructUserError(fmt.Sprintf(
+			"Too many levels of symbolic links at '%s' in container %s", srcPath, containerId)) }
+		filePath = resolveContainerLink(filePath, stat.LinkTarget)
+	}
+	defer reader.Close()
+	if ! stat.Mode.IsRegular() { return utilities.ConstructUserError(fmt.Sprintf(
+		"'%s' in container %s is not a regular file", srcPath, containerId)) }
+	
+	var tarReader = tar.NewReader(reader)
+	for {
+		var header *tar.Header
+		header, err = tarReader.Next()
+		if err == io.EOF { break }
+		if err != nil { return err }
+		if header.Typeflag != tar.TypeReg { continue }
+		
+		var file *os.File
+		file, err = os.OpenFile(destFilePath, os.O_CREATE | os.O_WRONLY | os.O_TRUNC, 0600)
+		if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
+			"When creating file '%s': %s", destFilePath, err.Error()))
+		}
+		_, err = io.Copy(file, tarReader)
+		file.Close()
+		if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
+			"When writing file '%s': %s", destFilePath, err.Error()))
+		}
+		return nil
+	}
+	return utilities.ConstructServerError(fmt.Sprintf(
+		"Archive of '%s' from container %s contained no file", srcPath, containerId))
+}
+
+/*******************************************************************************
+ * The number of symbolic links that CopyFileFromContainer follows, as the
+ * Linux kernel does.
+ */
+const maxContainerSymlinks = 40
+
+/*******************************************************************************
+ * Return the container path that the link at linkPath refers to. A relative
+ * target is relative to the link's directory.
+ */
+func resolveContainerLink(linkPath, linkTarget string) string {
+	
+	if pathpkg.IsAbs(linkTarget) { return pathpkg.Clean(linkTarget) }
+	return pathpkg.Join(pathpkg.Dir(linkPath), linkTarget)
+}
+
+/*******************************************************************************
+ * Copy the specified local file or directory into the specified directory of
+ * the specified container. The local path is tarred on the fly, so that it is
+ * never written to disk as an archive.
+ */
+func (dockerSvcs *DockerServices) CopyPathToContainer(localPath, containerId,
+	destDirPath string) error {
+	
+	var pipeReader, pipeWriter = io.Pipe()
+	go func() {
+		var tarWriter = tar.NewWriter(pipeWriter)
+		var err = writePathToTar(tarWriter, localPath, filepath.Base(localPath))
+		if err == nil { err = tarWriter.Close() }
+		pipeWriter.CloseWithError(err)
+	}()
+	var err = dockerSvcs.Engine.CopyToContainer(containerId, destDirPath, pipeReader)
+	pipeReader.Close()
+	return err
+}
+
+/*******************************************************************************
+ * Add the specified local file or directory (recursively) to the tar archive,
+ * naming it, within the archive, by the specified name. Symbolic links are
+ * stored as links.
+ */
+func writePathToTar(tarWriter *tar.Writer, localPath, nameInArchive string) error {
+	
+	return filepath.Walk(localPath,
+		func(path string, info os.FileInfo, err error) error {
+			
+			if err != nil { return err }
+			var relPath string
+			relPath, err = filepath.Rel(localPath, path)
+			if err != nil { return err }
+			var name = filepath.ToSlash(filepath.Join(nameInArchive, relPath))
+			
+			return writeTarEntry(tarWriter, path, name, info, false)
+		})
+}
+
+/*******************************************************************************
+ * Extract the tar archive that is read from the reader into the specified
+ * directory. The archive may come from an untrusted container, so entries that
+ * would be written outside of the directory are rejected: those whose names
+ * lead outside it, those that would be written through a symbolic link, and
+ * symbolic links whose targets are absolute or lead outside it.
+ */
+func extractTar(reader io.Reader, destDirPath string) error {
+	
+	var tarReader = tar.NewReader(reader)
+	for {
+		var header *tar.Header
+		var err error
+		header, err = tarReader.Next()
+		if err == io.EOF { return nil }
+		if err != nil { return err }
+		
+		var path = filepath.Join(destDirPath, filepath.FromSlash(header.Name))
+		if ! isWithinDir(destDirPath, path) { return utilities.ConstructServerError(
+			"Archive entry is outside of the destination directory: " + header.Name) }
+		err = checkNoSymlinkInPath(destDirPath, path, header.Typeflag == tar.TypeDir)
+		if err != nil { return err }
+		var mode = os.FileMode(header.Mode).Perm()
+		
+		switch header.Typeflag {
+			
+			case tar.TypeDir:
+				err = os.MkdirAll(path, mode | 0700)
+				if err != nil { return err }
+			
+			case tar.TypeReg:
+				err = os.MkdirAll(filepath.Dir(path), 0700)
+				if err != nil { return err }
+				var file *os.File
+				os.Remove(path)  // if it is a link, it is replaced rather than written through
+				file, err = os.OpenFile(path, os.O_CREATE | os.O_EXCL | os.O_WRONLY, mode)
+				if err != nil { return err }
+				_, err = io.Copy(file, tarReader)
+				file.Close()
+				if err != nil { return err }
+			
+			case tar.TypeSymlink:
+				if filepath.IsAbs(header.Linkname) ||
+					(! isWithinDir(destDirPath, filepath.Join(filepath.Dir(path),
+						filepath.FromSlash(header.Linkname)))) {
+					return utilities.ConstructServerError(fmt.Sprintf(
+						"Archive entry %s is a link outside of the destination directory: %s",
+						header.Name, header.Linkname))
+				}
+				err = os.MkdirAll(filepath.Dir(path), 0700)
+				if err != nil { return err }
+				os.Remove(path)
+				err = os.Symlink(header.Linkname, path)
+				if err != nil { return err }
+			
+			default:
+				// Device files, hard links, etc. are not needed by callers - skip.
+		}
+	}
+}
+
+/*******************************************************************************
+ * Return true if the path is the directory or is within it.
+ */
+func isWithinDir(dirPath, path string) bool {
+	
+	var cleanDirPath = filepath.Clean(dirPath)
+	path = filepath.Clean(path)
+	return (path == cleanDirPath) ||
+		strings.HasPrefix(path, cleanDirPath + string(os.PathSeparator))
+}
+
+/*******************************************************************************
+ * Return an error if any existing component of the path, below the directory,
+ * is a symbolic link - i.e., if writing to the path might be redirected. The
+ * final component is checked only if includeLast, since a file or link that is
+ * extracted replaces a link there.
+ */
+func checkNoSymlinkInPath(dirPath, path string, includeLast bool) error {
+	
+	var relPath, err = filepath.Rel(filepath.Clean(dirPath), path)
+	if (err != nil) || (relPath == ".") { return err }
+	var components = strings.Split(relPath, string(os.PathSeparator))
+	if ! includeLast { components = components[:len(components)-1] }
+	var componentPath = filepath.Clean(dirPath)
+	for _, component := range components {
+		componentPath = filepath.Join(componentPath, component)
+		var info os.FileInfo
+		info, err = os.Lstat(componentPath)
+		if os.IsNotExist(err) { return nil }
+		if err != nil { return err }
+		if (info.Mode() & os.ModeSymlink) != 0 { return utilities.ConstructServerError(
+			"Archive entry would be written through a symbolic link: " + componentPath) }
+	}
+	return nil
+}
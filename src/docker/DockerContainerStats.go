@@ -0,0 +1,140 @@
+package docker
+
+import (
+	"time"
+	"strings"
+)
+
+/*******************************************************************************
+ * A resource usage sample for a container, as returned by the engine's
+ * containers/{id}/stats function. Only the fields that we need are decoded.
+ * See,
+ * https://docs.docker.com/engine/api/v1.24/#get-container-stats-based-on-resource-usage
+ */
+type DockerContainerStats struct {
+	Read time.Time `json:"read"`
+	PreRead time.Time `json:"preread"`
+	PidsStats DockerPidsStats `json:"pids_stats"`
+	CPUStats DockerCPUStats `json:"cpu_stats"`
+	PreCPUStats DockerCPUStats `json:"precpu_stats"`  // the previous sample
+	MemoryStats DockerMemoryStats `json:"memory_stats"`
+	Networks map[string]DockerNetworkStats `json:"networks"`
+	BlkioStats DockerBlkioStats `json:"blkio_stats"`
+}
+
+type DockerPidsStats struct {
+	Current uint64 `json:"current"`
+	Limit uint64 `json:"limit"`
+}
+
+type DockerCPUStats struct {
+	CPUUsage DockerCPUUsage `json:"cpu_usage"`
+	SystemUsage uint64 `json:"system_cpu_usage"`
+	OnlineCPUs uint32 `json:"online_cpus"`
+}
+
+type DockerCPUUsage struct {
+	TotalUsage uint64 `json:"total_usage"`
+	PercpuUsage []uint64 `json:"percpu_usage"`
+	UsageInKernelmode uint64 `json:"usage_in_kernelmode"`
+	UsageInUsermode uint64 `json:"usage_in_usermode"`
+}
+
+type DockerMemoryStats struct {
+	Usage uint64 `json:"usage"`
+	MaxUsage uint64 `json:"max_usage"`
+	Limit uint64 `json:"limit"`
+	Failcnt uint64 `json:"failcnt"`
+	Stats map[string]uint64 `json:"stats"`
+}
+
+type DockerNetworkStats struct {
+	RxBytes uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	RxErrors uint64 `json:"rx_errors"`
+	RxDropped uint64 `json:"rx_dropped"`
+	TxBytes uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+	TxErrors uint64 `json:"tx_errors"`
+	TxDropped uint64 `json:"tx_dropped"`
+}
+
+type DockerBlkioStats struct {
+	IoServiceBytesRecursive []DockerBlkioStatEntry `json:"io_service_bytes_recursive"`
+}
+
+type DockerBlkioStatEntry struct {
+	Major uint64 `json:"major"`
+	Minor uint64 `json:"minor"`
+	Op string `json:"op"`
+	Value uint64 `json:"value"`
+}
+
+/*******************************************************************************
+ * Return the container's CPU usage since the previous sample, as a percentage
+ * of one CPU, computed the way "docker stats" does: the change in the
+ * container's CPU time relative to the change in the host's CPU time, scaled
+ * by the number of CPUs. A container that saturates two CPUs is at 200%.
+ */
+func (stats *DockerContainerStats) CPUPercent() float64 {
+	
+	var cpuDelta = float64(stats.CPUStats.CPUUsage.TotalUsage) -
+		float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	var systemDelta = float64(stats.CPUStats.SystemUsage) -
+		float64(stats.PreCPUStats.SystemUsage)
+	var onlineCPUs = float64(stats.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 { onlineCPUs = float64(len(stats.CPUStats.CPUUsage.PercpuUsage)) }
+	
+	if (systemDelta <= 0) || (cpuDelta <= 0) { return 0 }
+	return (cpuDelta / systemDelta) * onlineCPUs * 100.0
+}
+
+/*******************************************************************************
+ * Return the memory used by the container, excluding the page cache, as
+ * "docker stats" reports it. The cache is reported as "cache" by cgroup v1 and
+ * as "inactive_file" by cgroup v2.
+ */
+func (stats *DockerContainerStats) MemoryUsage() uint64 {
+	
+	var cache uint64 = stats.MemoryStats.Stats["total_inactive_file"]
+	if cache == 0 { cache = stats.MemoryStats.Stats["inactive_file"] }
+	if cache == 0 { cache = stats.MemoryStats.Stats["cache"] }
+	if cache > stats.MemoryStats.Usage { return stats.MemoryStats.Usage }
+	return stats.MemoryStats.Usage - cache
+}
+
+/*******************************************************************************
+ * Return the memory used by the container as a percentage of its limit.
+ */
+func (stats *DockerContainerStats) MemoryPercent() float64 {
+	
+	if stats.MemoryStats.Limit == 0 { return 0 }
+	return float64(stats.MemoryUsage()) / float64(stats.MemoryStats.Limit) * 100.0
+}
+
+/*******************************************************************************
+ * Return the total bytes received and transmitted over all of the container's
+ * network interfaces.
+ */
+func (stats *DockerContainerStats) NetworkIO() (rxBytes, txBytes uint64) {
+	
+	for _, netStats := range stats.Networks {
+		rxBytes = rxBytes + netStats.RxBytes
+		txBytes = txBytes + netStats.TxBytes
+	}
+	return rxBytes, txBytes
+}
+
+/*******************************************************************************
+ * Return the total bytes read from and written to block devices by the container.
+ */
+func (stats *DockerContainerStats) BlockIO() (readBytes, writeBytes uint64) {
+	
+	for _, entry := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+			case "read": readBytes = readBytes + entry.Value
+			case "write": writeBytes = writeBytes + entry.Value
+		}
+	}
+	return readBytes, writeBytes
+}
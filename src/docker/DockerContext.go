@@ -0,0 +1,280 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"context"
+	"strings"
+	"net/http"
+	"net/url"
+	
+	"rest"
+)
+
+/*******************************************************************************
+ * Context-aware operations. DockerEngine, DockerRegistry and DockerServices
+ * each have a WithContext method, which returns a copy whose operations are
+ * bound to the specified context: when the context is cancelled or its
+ * deadline passes, in-flight requests are aborted, reads of streamed responses
+ * (e.g., build output) fail, and the operation returns the context's error
+ * (context.Canceled or context.DeadlineExceeded). Aborting a request closes its
+ * connection, so that the engine stops a build whose client has gone. For
+ * example,
+	var ctx, cancel = context.WithTimeout(context.Background(), 10 * time.Minute)
+	defer cancel()
+	imageId, err = dockerSvcs.WithContext(ctx).BuildDockerfile(...)
+ *
+ * The bound copies send their requests via the methods below, which shadow the
+ * RestContext methods of the same names (which take no context). The methods
+ * also classify transport failures (see transportError), and retry GET and
+ * HEAD requests according to the connection's retry policy (see
+ * DockerRetryPolicy).
+ */
+
+/*******************************************************************************
+ * Return a copy of the engine connection whose operations are bound to ctx.
+ */
+func (engine *DockerEngineImpl) WithContext(ctx context.Context) DockerEngine {
+	return &DockerEngineImpl{ RestContext: engine.RestContext, socketPath: engine.socketPath, ctx: ctx,
+		retry: engine.retry }
+}
+
+/*******************************************************************************
+ * Return a copy of the registry connection whose operations are bound to ctx.
+ */
+func (registry *DockerRegistryImpl) WithContext(ctx context.Context) DockerRegistry {
+	return registry.withContext(ctx)
+}
+
+func (registry *DockerRegistryImpl) withContext(ctx context.Context) *DockerRegistryImpl {
+	return &DockerRegistryImpl{ RestContext: registry.RestContext, ctx: ctx, retry: registry.retry,
+		parallelism: registry.parallelism, cache: registry.cache }
+}
+
+/*******************************************************************************
+ * Return a copy of the services whose engine and registry operations are bound
+ * to ctx.
+ */
+func (dockerSvcs *DockerServices) WithContext(ctx context.Context) *DockerServices {
+	
+	var svcs = *dockerSvcs
+	if dockerSvcs.Engine != nil { svcs.Engine = dockerSvcs.Engine.WithContext(ctx) }
+	if dockerSvcs.Registry != nil { svcs.Registry = dockerSvcs.Registry.WithContext(ctx) }
+	return &svcs
+}
+
+/*******************************************************************************
+ * Return the context to which the engine's operations are bound.
+ */
+func (engine *DockerEngineImpl) context() context.Context {
+	if engine.ctx == nil { return context.Background() }
+	return engine.ctx
+}
+
+func (registry *DockerRegistryImpl) context() context.Context {
+	if registry.ctx == nil { return context.Background() }
+	return registry.ctx
+}
+
+/*******************************************************************************
+ * If the context has ended, return its error rather than the specified error,
+ * which is that of an operation that the end of the context interrupted.
+ */
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil { return ctx.Err() }
+	return err
+}
+
+/*******************************************************************************
+ * The engine is reached via its unix socket, so the host name of engine request
+ * URLs is immaterial.
+ */
+const engineBaseURL = "http://docker"
+
+func (engine *DockerEngineImpl) SendBasicGet(uri string) (*http.Response, error) {
+	return engine.retry.do(engine.context(), retryOperationName("GET", uri), func() (*http.Response, error) {
+		if engine.ctx == nil {
+			var response, err = engine.RestContext.SendBasicGet(uri)
+			return response, transportError(err, uri)
+		}
+		return engine.sendContextRequest("GET", uri, nil, nil)
+	})
+}
+
+func (engine *DockerEngineImpl) SendBasicHead(uri string) (*http.Response, error) {
+	return engine.retry.do(engine.context(), retryOperationName("HEAD", uri), func() (*http.Response, error) {
+		if engine.ctx == nil {
+			var response, err = engine.RestContext.SendBasicHead(uri)
+			return response, transportError(err, uri)
+		}
+		return engine.sendContextRequest("HEAD", uri, nil, nil)
+	})
+}
+
+func (engine *DockerEngineImpl) SendBasicDelete(uri string) (*http.Response, error) {
+	if engine.ctx == nil {
+		var response, err = engine.RestContext.SendBasicDelete(uri)
+		return response, transportError(err, uri)
+	}
+	return engine.sendContextRequest("DELETE", uri, nil, nil)
+}
+
+func (engine *DockerEngineImpl) SendBasicFormPost(uri string, names, values []string) (*http.Response, error) {
+	if engine.ctx == nil {
+		var response, err = engine.RestContext.SendBasicFormPost(uri, names, values)
+		return response, transportError(err, uri)
+	}
+	var body, formHeaders = encodeForm(names, values, nil)
+	return engine.sendContextRequest("POST", uri, formHeaders, body)
+}
+
+func (engine *DockerEngineImpl) SendBasicFormPostWithHeaders(uri string, names, values []string,
+	headers map[string]string) (*http.Response, error) {
+	if engine.ctx == nil {
+		var response, err = engine.RestContext.SendBasicFormPostWithHeaders(uri, names, values, headers)
+		return response, transportError(err, uri)
+	}
+	var body, formHeaders = encodeForm(names, values, headers)
+	return engine.sendContextRequest("POST", uri, formHeaders, body)
+}
+
+func (engine *DockerEngineImpl) SendBasicStreamPost(uri string, headers map[string]string,
+	body io.Reader) (*http.Response, error) {
+	if engine.ctx == nil {
+		var response, err = engine.RestContext.SendBasicStreamPost(uri, headers, body)
+		return response, transportError(err, uri)
+	}
+	return engine.sendContextRequest("POST", uri, headers, body)
+}
+
+func (engine *DockerEngineImpl) SendBasicStreamPut(uri string, headers map[string]string,
+	body io.Reader) (*http.Response, error) {
+	if engine.ctx == nil {
+		var response, err = engine.RestContext.SendBasicStreamPut(uri, headers, body)
+		return response, transportError(err, uri)
+	}
+	return engine.sendContextRequest("PUT", uri, headers, body)
+}
+
+func (engine *DockerEngineImpl) sendContextRequest(method, uri string, headers map[string]string,
+	body io.Reader) (*http.Response, error) {
+	return sendContextRequest(engine.ctx, &engine.RestContext, engineBaseURL, method, uri, headers, body)
+}
+
+/*******************************************************************************
+ * Return the URL of the registry, e.g., "http://localhost:5000".
+ */
+func (registry *DockerRegistryImpl) baseURL() string {
+	var url = registry.GetScheme() + "://" + registry.GetHostname()
+	if registry.GetPort() != 0 { url = url + fmt.Sprintf(":%d", registry.GetPort()) }
+	return url
+}
+
+func (registry *DockerRegistryImpl) SendBasicGet(uri string) (*http.Response, error) {
+	return registry.retry.do(registry.context(), retryOperationName("GET", uri), func() (*http.Response, error) {
+		if registry.ctx == nil {
+			var response, err = registry.RestContext.SendBasicGet(uri)
+			return response, transportError(err, uri)
+		}
+		return registry.sendContextRequest("GET", uri, nil, nil)
+	})
+}
+
+func (registry *DockerRegistryImpl) SendBasicHead(uri string) (*http.Response, error) {
+	return registry.retry.do(registry.context(), retryOperationName("HEAD", uri), func() (*http.Response, error) {
+		if registry.ctx == nil {
+			var response, err = registry.RestContext.SendBasicHead(uri)
+			return response, transportError(err, uri)
+		}
+		return registry.sendContextRequest("HEAD", uri, nil, nil)
+	})
+}
+
+func (registry *DockerRegistryImpl) SendBasicDelete(uri string) (*http.Response, error) {
+	if registry.ctx == nil {
+		var response, err = registry.RestContext.SendBasicDelete(uri)
+		return response, transportError(err, uri)
+	}
+	return registry.sendContextRequest("DELETE", uri, nil, nil)
+}
+
+func (registry *DockerRegistryImpl) SendBasicFormPost(uri string, names, values []string) (*http.Response, error) {
+	if registry.ctx == nil {
+		var response, err = registry.RestContext.SendBasicFormPost(uri, names, values)
+		return response, transportError(err, uri)
+	}
+	var body, formHeaders = encodeForm(names, values, nil)
+	return registry.sendContextRequest("POST", uri, formHeaders, body)
+}
+
+func (registry *DockerRegistryImpl) sendContextRequest(method, uri string, headers map[string]string,
+	body io.Reader) (*http.Response, error) {
+	return sendContextRequest(registry.ctx, &registry.RestContext, registry.baseURL(), method, uri, headers, body)
+}
+
+/*******************************************************************************
+ * Send a request that is bound to ctx. If the context ends before or during
+ * the request, or during the reading of the response body, the context's
+ * error is returned.
+ */
+func sendContextRequest(ctx context.Context, restContext *rest.RestContext, baseURL, method,
+	uri string, headers map[string]string, body io.Reader) (*http.Response, error) {
+	
+	var request *http.Request
+	var err error
+	request, err = http.NewRequestWithContext(ctx, method,
+		strings.TrimSuffix(baseURL, "/") + "/" + strings.TrimPrefix(uri, "/"), body)
+	if err != nil { return nil, err }
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	if restContext.GetUserId() != "" {
+		request.SetBasicAuth(restContext.GetUserId(), restContext.GetPassword())
+	}
+	return doContextRequest(ctx, restContext.GetHttpClient(), request)
+}
+
+/*******************************************************************************
+ * Perform the request, which must have been created with ctx, returning the
+ * context's error in place of the transport's if the context has ended.
+ */
+func doContextRequest(ctx context.Context, client *http.Client, request *http.Request) (*http.Response, error) {
+	
+	var response, err = client.Do(request)
+	if err != nil {
+		if ctx.Err() != nil { return nil, ctx.Err() }
+		return nil, transportError(err, request.Method + " " + request.URL.Path)
+	}
+	response.Body = &contextBody{ ReadCloser: response.Body, ctx: ctx }
+	return response, nil
+}
+
+/*******************************************************************************
+ * A response body whose reads return the context's error once the context has
+ * ended (the transport aborts the read).
+ */
+type contextBody struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (body *contextBody) Read(p []byte) (int, error) {
+	var n, err = body.ReadCloser.Read(p)
+	if (err != nil) && (err != io.EOF) && (body.ctx.Err() != nil) { err = body.ctx.Err() }
+	return n, err
+}
+
+/*******************************************************************************
+ * Encode the names and values as a form body, returning the body and the
+ * headers (a copy of the specified headers, which may be nil) to send it with.
+ */
+func encodeForm(names, values []string, headers map[string]string) (io.Reader, map[string]string) {
+	
+	var form = url.Values{}
+	for i, name := range names {
+		if i < len(values) { form.Add(name, values[i]) }
+	}
+	var formHeaders = map[string]string{ "Content-Type": "application/x-www-form-urlencoded" }
+	for name, value := range headers { formHeaders[name] = value }
+	return strings.NewReader(form.Encode()), formHeaders
+}
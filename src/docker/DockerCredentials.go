@@ -0,0 +1,281 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"bytes"
+	"sync"
+	"strings"
+	"path/filepath"
+	"encoding/base64"
+	"encoding/json"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * Resolves registry credentials by registry host, in the same way as the docker
+ * CLI, from its configuration file (config.json in $DOCKER_CONFIG, or in
+ * ~/.docker): a registry's credentials are obtained from the credential helper
+ * that "credHelpers" names for it, or else from the "credsStore" helper, or
+ * else from its "auths" entry. Helpers are the docker-credential-<name>
+ * programs, which must be on the PATH. See,
+ * https://docs.docker.com/engine/reference/commandline/login/#credential-stores
+ */
+type DockerCredentialsResolver struct {
+	configFilePath string
+	config *dockerConfigFile
+	lock sync.Mutex
+	cache map[string]*DockerRegistryAuth  // resolved credentials by auth key; nil values are cached too
+	forgetLogSecrets []func()  // of the cached credentials
+}
+
+type dockerConfigFile struct {
+	Auths map[string]*dockerConfigAuth `json:"auths"`
+	CredsStore string `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+type dockerConfigAuth struct {
+	Auth string `json:"auth"`  // base64 of "username:password"
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email string `json:"email"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+/*******************************************************************************
+ * Return a resolver for the docker CLI configuration of the current user. If
+ * there is no configuration file, the resolver resolves no credentials.
+ */
+func NewDockerCredentialsResolver() (*DockerCredentialsResolver, error) {
+	
+	var configDirPath = os.Getenv("DOCKER_CONFIG")
+	if configDirPath == "" {
+		var homeDirPath, err = os.UserHomeDir()
+		if err != nil { return nil, utilities.ConstructServerError(
+			"Could not determine the home directory: " + err.Error()) }
+		configDirPath = filepath.Join(homeDirPath, ".docker")
+	}
+	return NewDockerCredentialsResolverFromFile(filepath.Join(configDirPath, "config.json"))
+}
+
+/*******************************************************************************
+ * Return a resolver for the specified docker CLI configuration file. If the
+ * file does not exist, the resolver resolves no credentials.
+ */
+func NewDockerCredentialsResolverFromFile(configFilePath string) (*DockerCredentialsResolver, error) {
+	
+	var resolver = &DockerCredentialsResolver{
+		configFilePath: configFilePath,
+		config: &dockerConfigFile{},
+		cache: make(map[string]*DockerRegistryAuth),
+	}
+	var content, err = os.ReadFile(configFilePath)
+	if os.IsNotExist(err) { return resolver, nil }
+	if err != nil { return nil, utilities.ConstructServerError(fmt.Sprintf(
+		"Could not read docker config file '%s': %s", configFilePath, err.Error())) }
+	err = json.Unmarshal(content, resolver.config)
+	if err != nil { return nil, utilities.ConstructUserError(fmt.Sprintf(
+		"Ill-formed docker config file '%s': %s", configFilePath, err.Error())) }
+	return resolver, nil
+}
+
+/*******************************************************************************
+ * Return the credentials for the specified registry host (e.g. "localhost:5000"
+ * or "docker.io"), or nil if there are none.
+ */
+func (resolver *DockerCredentialsResolver) Resolve(registryHost string) (*DockerRegistryAuth, error) {
+	
+	var key = RegistryAuthKey(registryHost)
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+	var auth, cached = resolver.cache[key]
+	if cached { return auth, nil }
+	
+	var err error
+	var helper = resolver.helperFor(key)
+	if helper != "" {
+		auth, err = getHelperCredentials(helper, key)
+		if err != nil { return nil, err }
+	}
+	if auth == nil { auth = resolver.fileCredentials(key) }
+	resolver.forgetLogSecrets = append(resolver.forgetLogSecrets, registerAuthLogSecrets(auth))
+	resolver.cache[key] = auth
+	return auth, nil
+}
+
+/*******************************************************************************
+ * Discard the resolved credentials, which are redacted from log messages until
+ * the resolver is closed. A resolver that is used after it is closed resolves
+ * the credentials anew.
+ */
+func (resolver *DockerCredentialsResolver) Close() {
+	
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+	for _, forget := range resolver.forgetLogSecrets { forget() }
+	resolver.forgetLogSecrets = nil
+	resolver.cache = make(map[string]*DockerRegistryAuth)
+}
+
+/*******************************************************************************
+ * Return the credentials for the registry of the specified image name, or nil
+ * if there are none.
+ */
+func (resolver *DockerCredentialsResolver) ResolveForImage(imageName string) (*DockerRegistryAuth, error) {
+	return resolver.Resolve(RegistryHostOfImage(imageName))
+}
+
+/*******************************************************************************
+ * Return the credentials for every registry that the configuration knows of,
+ * e.g., for a build, whose FROM images may come from any registry.
+ */
+func (resolver *DockerCredentialsResolver) ResolveAll() (DockerRegistryAuths, error) {
+	
+	var hosts = make(map[string]bool)
+	for key, _ := range resolver.config.Auths { hosts[key] = true }
+	for key, _ := range resolver.config.CredHelpers { hosts[key] = true }
+	if resolver.config.CredsStore != "" {
+		var listed, err = listHelperCredentials(resolver.config.CredsStore)
+		if err != nil { return nil, err }
+		for _, key := range listed { hosts[key] = true }
+	}
+	
+	var auths = make(DockerRegistryAuths)
+	for host, _ := range hosts {
+		var auth, err = resolver.Resolve(configKeyToHost(host))
+		if err != nil { return nil, err }
+		if auth != nil { auths[RegistryAuthKey(configKeyToHost(host))] = auth }
+	}
+	return auths, nil
+}
+
+/*******************************************************************************
+ * Return the name of the credential helper for the registry, or "".
+ */
+func (resolver *DockerCredentialsResolver) helperFor(key string) string {
+	
+	for configKey, helper := range resolver.config.CredHelpers {
+		if RegistryAuthKey(configKeyToHost(configKey)) == key { return helper }
+	}
+	return resolver.config.CredsStore
+}
+
+/*******************************************************************************
+ * Return the credentials in the "auths" entry of the registry, or nil.
+ */
+func (resolver *DockerCredentialsResolver) fileCredentials(key string) *DockerRegistryAuth {
+	
+	for configKey, entry := range resolver.config.Auths {
+		if (entry == nil) || (RegistryAuthKey(configKeyToHost(configKey)) != key) { continue }
+		var auth = &DockerRegistryAuth{
+			Username: entry.Username,
+			Password: entry.Password,
+			Email: entry.Email,
+			ServerAddress: key,
+			IdentityToken: entry.IdentityToken,
+			RegistryToken: entry.RegistryToken,
+		}
+		if entry.Auth != "" {
+			var decoded, err = base64.StdEncoding.DecodeString(entry.Auth)
+			if err == nil {
+				var parts = strings.SplitN(string(decoded), ":", 2)
+				if len(parts) == 2 { auth.Username = parts[0]; auth.Password = parts[1] }
+			}
+		}
+		if (auth.Username == "") && (auth.IdentityToken == "") && (auth.RegistryToken == "") {
+			continue
+		}
+		return auth
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Convert a key of the configuration file to a registry host, e.g.,
+ * "https://registry.example.com:5000/v1/" to "registry.example.com:5000".
+ */
+func configKeyToHost(configKey string) string {
+	
+	if configKey == DockerHubAuthKey { return configKey }
+	var host = strings.TrimPrefix(strings.TrimPrefix(configKey, "https://"), "http://")
+	var slash = strings.Index(host, "/")
+	if slash != -1 { host = host[:slash] }
+	return host
+}
+
+/*******************************************************************************
+ * The credential helper protocol: the helper is run with the command ("get",
+ * "list") as its argument, and reads its input from stdin and writes its
+ * output, as JSON, to stdout. See github.com/docker/docker-credential-helpers.
+ */
+const credentialsNotFoundMessage = "credentials not found in native keychain"
+
+type helperCredentials struct {
+	ServerURL string
+	Username string
+	Secret string
+}
+
+/*******************************************************************************
+ * Obtain the credentials for the registry from the helper. Return nil if the
+ * helper has none.
+ */
+func getHelperCredentials(helper, key string) (*DockerRegistryAuth, error) {
+	
+	var output, err = runCredentialHelper(helper, "get", key)
+	if err != nil {
+		if strings.Contains(err.Error(), credentialsNotFoundMessage) { return nil, nil }
+		return nil, err
+	}
+	var creds = &helperCredentials{}
+	err = json.Unmarshal(output, creds)
+	if err != nil { return nil, utilities.ConstructServerError(fmt.Sprintf(
+		"Ill-formed output from docker-credential-%s: %s", helper, err.Error())) }
+	if creds.Secret == "" { return nil, nil }
+	
+	var auth = &DockerRegistryAuth{ ServerAddress: key }
+	if creds.Username == "<token>" {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username = creds.Username
+		auth.Password = creds.Secret
+	}
+	return auth, nil
+}
+
+/*******************************************************************************
+ * Return the registries for which the helper has credentials.
+ */
+func listHelperCredentials(helper string) ([]string, error) {
+	
+	var output, err = runCredentialHelper(helper, "list", "")
+	if err != nil { return nil, err }
+	var listed = make(map[string]string)  // server URL -> username
+	err = json.Unmarshal(output, &listed)
+	if err != nil { return nil, utilities.ConstructServerError(fmt.Sprintf(
+		"Ill-formed output from docker-credential-%s: %s", helper, err.Error())) }
+	var keys = make([]string, 0, len(listed))
+	for key, _ := range listed { keys = append(keys, key) }
+	return keys, nil
+}
+
+func runCredentialHelper(helper, command, input string) ([]byte, error) {
+	
+	var cmd = exec.Command("docker-credential-" + helper, command)
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	var err = cmd.Run()
+	if err != nil {
+		// Helpers report errors, such as credentialsNotFoundMessage, on stdout.
+		var message = strings.TrimSpace(stdout.String() + " " + stderr.String())
+		return nil, utilities.ConstructServerError(fmt.Sprintf(
+			"docker-credential-%s %s failed: %s: %s", helper, command, err.Error(), message))
+	}
+	return stdout.Bytes(), nil
+}
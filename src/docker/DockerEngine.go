@@ -1,13 +1,44 @@
 package docker
 
+import (
+	"io"
+	"context"
+)
+
 type DockerEngine interface {
+	WithContext(ctx context.Context) DockerEngine
 	Ping() error
 	GetImages() ([]map[string]interface{}, error)
 	GetImageInfo(imageName string) (map[string]interface{}, error)
 	GetImage(repoNameAndTag, filepath string) error
+	LoadImage(imageReader io.Reader) (*DockerLoadOutput, error)
+	ImportImage(rootfsReader io.Reader, repoName, tag, message string,
+		changes []string) (string, error)
+	CommitContainer(containerId, repoName, tag, author, comment string,
+		pause bool, changes []string) (string, error)
+	StatContainerPath(containerId, path string) (*DockerContainerPathStat, error)
+	CopyFromContainer(containerId, path string) (io.ReadCloser, *DockerContainerPathStat, error)
+	CopyToContainer(containerId, destDirPath string, tarReader io.Reader) error
+	GetContainerStats(containerId string) (*DockerContainerStats, error)
+	StreamContainerStats(containerId string, handler func(*DockerContainerStats) bool) error
+	PruneImages(filters *DockerPruneFilters) (*DockerPruneOutput, error)
+	PruneContainers(filters *DockerPruneFilters) (*DockerPruneOutput, error)
+	PruneVolumes(filters *DockerPruneFilters) (*DockerPruneOutput, error)
+	PruneBuildCache(filters *DockerPruneFilters) (*DockerPruneOutput, error)
 	BuildImage(buildDirPath, imageFullName string, dockerfileName string,
 		paramNames, paramValues []string) (string, error)
+	BuildImageStream(buildDirPath, imageFullName string, dockerfileName string,
+		paramNames, paramValues []string, handler func(*DockerBuildEvent)) (*DockerBuildOutput, error)
+	BuildImageWithOptions(buildDirPath string, options *DockerBuildOptions) (string, error)
+	BuildImageStreamWithOptions(buildDirPath string, options *DockerBuildOptions,
+		handler func(*DockerBuildEvent)) (*DockerBuildOutput, error)
+	BuildImageFromArchive(contextReader io.Reader, options *DockerBuildOptions,
+		handler func(*DockerBuildEvent)) (*DockerBuildOutput, error)
+	BuildImageFromRemote(remote string, options *DockerBuildOptions,
+		handler func(*DockerBuildEvent)) (*DockerBuildOutput, error)
 	TagImage(imageName, hostAndRepoName, tag string) error
 	PushImage(repoFullName, tag, regUserId, regPass, regEmail string) error
+	PushImageWithAuth(repoFullName, tag string, auth *DockerRegistryAuth,
+		handler func(*DockerPushEvent)) (*DockerPushOutput, error)
 	DeleteImage(repoName, tag string) error
 }
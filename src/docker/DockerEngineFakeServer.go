@@ -0,0 +1,574 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"net"
+	"sync"
+	"regexp"
+	"strings"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/json"
+	"encoding/base64"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * A fake docker engine, which serves the engine's REST API on a unix domain
+ * socket in a temporary directory, so that DockerEngineImpl - its URLs, its
+ * parsing of the engine's streamed JSON, and its handling of the engine's
+ * statuses - can be exercised without a daemon:
+	var server, err = NewFakeDockerEngineServer()
+	defer server.Close()
+	var engine DockerEngine
+	engine, err = OpenDockerEngineConnectionAt(server.SocketPath())
+ * The images, containers, builds and pushes are those of an
+ * InMemoryDockerEngine (see Engine), so images and containers may be added,
+ * and errors injected, as for it. The output of builds may instead be scripted
+ * (see ScriptBuild). The API served is:
+	GET /_ping
+	GET /images/json
+	GET /images/{name}/json
+	GET /images/{name}/get
+	POST /images/load
+	POST /build
+	POST /images/{name}/tag
+	POST /images/{name}/push
+	DELETE /images/{name}
+	POST /commit
+	HEAD, GET and PUT /containers/{id}/archive
+	POST /images/prune, /containers/prune, /volumes/prune and /build/prune
+ * A path may have an API version prefix, e.g., /v1.41/images/json.
+ */
+type FakeDockerEngineServer struct {
+	engine *InMemoryDockerEngine
+	dirPath string
+	socketPath string
+	httpServer *http.Server
+	lock sync.Mutex
+	requests []*FakeDockerEngineRequest
+	buildScript []string  // nil unless builds are scripted
+}
+
+/*******************************************************************************
+ * A request that the fake engine received.
+ */
+type FakeDockerEngineRequest struct {
+	Method string
+	Path string  // without any API version prefix
+	Query url.Values
+	Header http.Header
+}
+
+var engineAPIVersionPattern = regexp.MustCompile(`^v[0-9]+\.[0-9]+/`)
+
+const fakeDockerEngineAPIVersion = "1.41"
+
+/*******************************************************************************
+ * Start a fake engine, with no images, listening on a new socket.
+ */
+func NewFakeDockerEngineServer() (*FakeDockerEngineServer, error) {
+	
+	var dirPath, err = ioutil.TempDir("", "fake-docker-")
+	if err != nil { return nil, utilities.ConstructServerError(
+		"When creating directory for fake engine socket: " + err.Error()) }
+	var server = &FakeDockerEngineServer{
+		engine: NewInMemoryDockerEngine(),
+		dirPath: dirPath,
+		socketPath: filepath.Join(dirPath, "docker.sock"),
+		requests: make([]*FakeDockerEngineRequest, 0),
+	}
+	var listener net.Listener
+	listener, err = net.Listen("unix", server.socketPath)
+	if err != nil {
+		os.RemoveAll(dirPath)
+		return nil, utilities.ConstructServerError(fmt.Sprintf(
+			"When listening on '%s': %s", server.socketPath, err.Error()))
+	}
+	server.httpServer = &http.Server{ Handler: server }
+	go server.httpServer.Serve(listener)
+	return server, nil
+}
+
+/*******************************************************************************
+ * The path of the socket on which the fake engine listens.
+ */
+func (server *FakeDockerEngineServer) SocketPath() string {
+	return server.socketPath
+}
+
+/*******************************************************************************
+ * The in-memory engine that holds the fake engine's images, and performs its
+ * operations.
+ */
+func (server *FakeDockerEngineServer) Engine() *InMemoryDockerEngine {
+	return server.engine
+}
+
+/*******************************************************************************
+ * Stop the fake engine, and remove its socket.
+ */
+func (server *FakeDockerEngineServer) Close() {
+	server.httpServer.Close()
+	os.RemoveAll(server.dirPath)
+}
+
+/*******************************************************************************
+ * Return the requests that the fake engine has received, in order.
+ */
+func (server *FakeDockerEngineServer) Requests() []*FakeDockerEngineRequest {
+	
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append(make([]*FakeDockerEngineRequest, 0, len(server.requests)), server.requests...)
+}
+
+/*******************************************************************************
+ * Respond to each subsequent build request with the frames - JSON messages,
+ * e.g., from FakeBuildStreamFrame and FakeBuildErrorFrame - each of which is
+ * written, and flushed, in turn. No frames restores the in-memory engine's
+ * builds. The build context is read, but not used.
+ */
+func (server *FakeDockerEngineServer) ScriptBuild(frames ...string) {
+	
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if len(frames) == 0 { server.buildScript = nil; return }
+	server.buildScript = append(make([]string, 0, len(frames)), frames...)
+}
+
+/*
+ * Frames for ScriptBuild.
+ */
+func FakeBuildStreamFrame(text string) string {
+	return engineStreamFrame(&engineStreamMessage{ Stream: text })
+}
+
+func FakeBuildErrorFrame(message string) string {
+	return engineStreamFrame(&engineStreamMessage{ Error: message,
+		ErrorDetail: &engineErrorDetail{ Message: message } })
+}
+
+func FakeBuildImageIdFrame(imageId string) string {
+	var aux, _ = json.Marshal(map[string]string{ "ID": imageId })
+	return engineStreamFrame(&engineStreamMessage{ Aux: aux })
+}
+
+func engineStreamFrame(msg *engineStreamMessage) string {
+	var frame, _ = json.Marshal(msg)
+	return string(frame)
+}
+
+/*******************************************************************************
+ * Implement http.Handler.
+ */
+func (server *FakeDockerEngineServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	
+	var path = strings.TrimLeft(request.URL.Path, "/")
+	path = engineAPIVersionPattern.ReplaceAllString(path, "")
+	server.lock.Lock()
+	server.requests = append(server.requests, &FakeDockerEngineRequest{
+		Method: request.Method,
+		Path: "/" + path,
+		Query: request.URL.Query(),
+		Header: request.Header.Clone(),
+	})
+	server.lock.Unlock()
+	writer.Header().Set("Api-Version", fakeDockerEngineAPIVersion)
+	writer.Header().Set("Ostype", "linux")
+	
+	var err = server.route(writer, request, path)
+	if err != nil { writeEngineError(writer, err) }
+}
+
+func (server *FakeDockerEngineServer) route(writer http.ResponseWriter, request *http.Request,
+	path string) error {
+	
+	var engine = server.engine.WithContext(request.Context())
+	var method = request.Method
+	switch {
+		case path == "_ping":
+			var err = engine.Ping()
+			if err != nil { return err }
+			writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			writer.Write([]byte("OK"))
+			return nil
+		case (path == "build") && (method == "POST"):
+			return server.build(writer, request)
+		case (path == "commit") && (method == "POST"):
+			var query = request.URL.Query()
+			var imageId, err = engine.CommitContainer(query.Get("container"), query.Get("repo"),
+				query.Get("tag"), query.Get("author"), query.Get("comment"), query.Get("pause") != "0",
+				query["changes"])
+			if err != nil { return err }
+			return writeEngineJSON(writer, 201, map[string]string{ "Id": imageId })
+		case strings.HasPrefix(path, "containers/") && strings.HasSuffix(path, "/archive"):
+			var containerId = strings.TrimSuffix(strings.TrimPrefix(path, "containers/"), "/archive")
+			return server.containerArchive(writer, request, engine, containerId)
+		case strings.HasSuffix(path, "/prune") && (method == "POST"):
+			return server.prune(writer, request, engine, strings.TrimSuffix(path, "/prune"))
+		case (path == "images/json") && (method == "GET"):
+			var images, err = engine.GetImages()
+			if err != nil { return err }
+			return writeEngineJSON(writer, 200, images)
+		case (path == "images/load") && (method == "POST"):
+			return server.loadImage(writer, engine, request.Body)
+		case (! strings.HasPrefix(path, "images/")) || (path == "images/"):
+			return inMemoryEngineError(404, "", "page not found")
+		case method == "DELETE":
+			return server.deleteImage(writer, request, strings.TrimPrefix(path, "images/"))
+	}
+	
+	// The name of an image may have "/"s, so its action is the last element.
+	var name, action = strings.TrimPrefix(path, "images/"), ""
+	var slash = strings.LastIndex(name, "/")
+	if slash != -1 { name, action = name[:slash], name[slash+1:] }
+	switch {
+		case (action == "json") && (method == "GET"):
+			var imageInfo, err = engine.GetImageInfo(name)
+			if err != nil { return err }
+			return writeEngineJSON(writer, 200, imageInfo)
+		case (action == "get") && (method == "GET"):
+			return server.getImage(writer, engine, name)
+		case (action == "tag") && (method == "POST"):
+			var err = engine.TagImage(name, request.FormValue("repo"), request.FormValue("tag"))
+			if err != nil { return err }
+			writer.WriteHeader(201)
+			return nil
+		case (action == "push") && (method == "POST"):
+			return server.pushImage(writer, request, name)
+	}
+	return inMemoryEngineError(404, "", "page not found")
+}
+
+/*******************************************************************************
+ * Write the image, as a docker save archive.
+ */
+func (server *FakeDockerEngineServer) getImage(writer http.ResponseWriter, engine DockerEngine,
+	name string) error {
+	
+	var imageFile, err = ioutil.TempFile(server.dirPath, "image-")
+	if err != nil { return err }
+	imageFile.Close()
+	defer os.Remove(imageFile.Name())
+	err = engine.GetImage(name, imageFile.Name())
+	if err != nil { return err }
+	var image *os.File
+	image, err = os.Open(imageFile.Name())
+	if err != nil { return err }
+	defer image.Close()
+	writer.Header().Set("Content-Type", "application/x-tar")
+	io.Copy(writer, image)
+	return nil
+}
+
+/*******************************************************************************
+ * Load the image archive, and stream the images loaded, as the engine does. An
+ * archive that cannot be read is reported as an error frame.
+ */
+func (server *FakeDockerEngineServer) loadImage(writer http.ResponseWriter, engine DockerEngine,
+	imageReader io.Reader) error {
+	
+	var loadOutput, err = engine.LoadImage(imageReader)
+	var stream = newEngineStreamWriter(writer)
+	if streamErr, isStreamError := err.(*DockerEngineStreamError); isStreamError {
+		stream.writeFrame(FakeBuildErrorFrame(streamErr.Message))
+		return nil
+	}
+	if loadOutput == nil { return err }
+	stream.start()
+	for _, repoTag := range loadOutput.RepoTags {
+		stream.writeFrame(FakeBuildStreamFrame("Loaded image: " + repoTag + "\n"))
+	}
+	for _, imageId := range loadOutput.ImageIds {
+		stream.writeFrame(FakeBuildStreamFrame("Loaded image ID: " + imageId + "\n"))
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Report the status of a path in the container, and retrieve or extract an
+ * archive of it, as the engine does.
+ */
+func (server *FakeDockerEngineServer) containerArchive(writer http.ResponseWriter,
+	request *http.Request, engine DockerEngine, containerId string) error {
+	
+	var path = request.URL.Query().Get("path")
+	switch request.Method {
+		case "HEAD":
+			var stat, err = engine.StatContainerPath(containerId, path)
+			if err != nil { return err }
+			return writeContainerPathStat(writer, stat)
+		case "GET":
+			var reader, stat, err = engine.CopyFromContainer(containerId, path)
+			if err != nil { return err }
+			defer reader.Close()
+			err = writeContainerPathStat(writer, stat)
+			if err != nil { return err }
+			writer.Header().Set("Content-Type", "application/x-tar")
+			io.Copy(writer, reader)
+			return nil
+		case "PUT":
+			var err = engine.CopyToContainer(containerId, path, request.Body)
+			if err != nil { return err }
+			writer.WriteHeader(200)
+			return nil
+	}
+	return inMemoryEngineError(405, "", "method not allowed")
+}
+
+/*
+ * Set the header that reports the status of a container path. The status,
+ * 200, is written by the first write of the body, if there is one.
+ */
+func writeContainerPathStat(writer http.ResponseWriter, stat *DockerContainerPathStat) error {
+	
+	var content, err = json.Marshal(stat)
+	if err != nil { return err }
+	writer.Header().Set(containerPathStatHeader, base64.StdEncoding.EncodeToString(content))
+	return nil
+}
+
+/*******************************************************************************
+ * Prune the images, containers, volumes or build cache, with the filters that
+ * DockerPruneFilters.encode encodes, and report what was removed as the engine
+ * does.
+ */
+func (server *FakeDockerEngineServer) prune(writer http.ResponseWriter, request *http.Request,
+	engine DockerEngine, kind string) error {
+	
+	var query = request.URL.Query()
+	var filterMap = make(map[string][]string)
+	if query.Get("filters") != "" {
+		var err = json.Unmarshal([]byte(query.Get("filters")), &filterMap)
+		if err != nil { return inMemoryEngineError(400, "Prune", "invalid filters: " + err.Error()) }
+	}
+	var filters = &DockerPruneFilters{
+		Labels: filterMap["label"],
+		NotLabels: filterMap["label!"],
+	}
+	if len(filterMap["until"]) > 0 { filters.Until = filterMap["until"][0] }
+	
+	var pruneOutput *DockerPruneOutput
+	var err error
+	var response = &enginePruneResponse{}
+	switch kind {
+		case "images":
+			filters.All = (len(filterMap["dangling"]) > 0) && (filterMap["dangling"][0] == "false")
+			pruneOutput, err = engine.PruneImages(filters)
+			if err != nil { return err }
+			for _, repoTag := range pruneOutput.Untagged {
+				response.ImagesDeleted = append(response.ImagesDeleted,
+					engineDeletedImage{ Untagged: repoTag })
+			}
+			for _, imageId := range pruneOutput.Deleted {
+				response.ImagesDeleted = append(response.ImagesDeleted,
+					engineDeletedImage{ Deleted: imageId })
+			}
+		case "containers":
+			pruneOutput, err = engine.PruneContainers(filters)
+			if err != nil { return err }
+			response.ContainersDeleted = pruneOutput.Deleted
+		case "volumes":
+			filters.All = (len(filterMap["all"]) > 0) && (filterMap["all"][0] == "true")
+			pruneOutput, err = engine.PruneVolumes(filters)
+			if err != nil { return err }
+			response.VolumesDeleted = pruneOutput.Deleted
+		case "build":
+			filters.All = (query.Get("all") == "1") || (query.Get("all") == "true")
+			pruneOutput, err = engine.PruneBuildCache(filters)
+			if err != nil { return err }
+			response.CachesDeleted = pruneOutput.Deleted
+		default:
+			return inMemoryEngineError(404, "", "page not found")
+	}
+	response.SpaceReclaimed = pruneOutput.SpaceReclaimed
+	return writeEngineJSON(writer, 200, response)
+}
+
+/*******************************************************************************
+ * Build as the in-memory engine does, or as scripted, and stream the output.
+ */
+func (server *FakeDockerEngineServer) build(writer http.ResponseWriter, request *http.Request) error {
+	
+	var options, err = buildOptionsFromRequest(request)
+	if err != nil { return err }
+	var remote = request.URL.Query().Get("remote")
+	var dockerfile string
+	if remote != "" {
+		err = server.engine.record(request.Context(), "BuildImageFromRemote", remote, options)
+		dockerfile = "FROM scratch\nADD " + remote + " /\n"
+	} else {
+		err = server.engine.record(request.Context(), "BuildImageFromArchive", options)
+		if err == nil { dockerfile, err = readArchiveDockerfile(request.Body, options.Dockerfile) }
+	}
+	if err != nil { return err }
+	
+	server.lock.Lock()
+	var frames = server.buildScript
+	server.lock.Unlock()
+	if frames == nil {
+		var output string
+		output, err = server.engine.build(dockerfile, options)
+		if err != nil { return err }
+		frames = strings.Split(strings.TrimSpace(output), "\r\n")
+	}
+	var stream = newEngineStreamWriter(writer)
+	for _, frame := range frames { stream.writeFrame(frame) }
+	return nil
+}
+
+/*
+ * Return the build options that the request's query and headers specify, as
+ * DockerBuildOptions.queryString and postBuildRequest encode them.
+ */
+func buildOptionsFromRequest(request *http.Request) (*DockerBuildOptions, error) {
+	
+	var query = request.URL.Query()
+	var options = NewDockerBuildOptions("")
+	options.Tags = append(options.Tags, query["t"]...)
+	if query.Get("dockerfile") != "" { options.Dockerfile = query.Get("dockerfile") }
+	options.Target = query.Get("target")
+	options.NoCache = (query.Get("nocache") == "1")
+	options.Pull = (query.Get("pull") == "1")
+	options.Remove = (query.Get("rm") != "0")
+	options.BuildKit = (query.Get("version") == "2")
+	var jsonParams = []struct {
+		name string
+		value interface{}
+	}{
+		{ "buildargs", &options.BuildArgs },
+		{ "labels", &options.Labels },
+		{ "cachefrom", &options.CacheFrom },
+	}
+	for _, param := range jsonParams {
+		if query.Get(param.name) == "" { continue }
+		var err = json.Unmarshal([]byte(query.Get(param.name)), param.value)
+		if err != nil { return nil, inMemoryEngineError(400, "BuildImage",
+			"invalid " + param.name + ": " + err.Error()) }
+	}
+	
+	var registryConfig = request.Header.Get("X-Registry-Config")
+	if registryConfig != "" {
+		var err = decodeRegistryAuthHeader(registryConfig, &options.RegistryAuths)
+		if err != nil { return nil, err }
+	}
+	return options, nil
+}
+
+/*******************************************************************************
+ * Push as the in-memory engine does, and stream its progress. A failure after
+ * the push has begun is reported as an error frame, as the engine does.
+ */
+func (server *FakeDockerEngineServer) pushImage(writer http.ResponseWriter, request *http.Request,
+	name string) error {
+	
+	var tag = request.URL.Query().Get("tag")
+	var auth *DockerRegistryAuth
+	var err = decodeRegistryAuthHeader(request.Header.Get("X-Registry-Auth"), &auth)
+	if err != nil { return err }
+	err = server.engine.record(request.Context(), "PushImageWithAuth", name, tag, auth)
+	if err != nil { return err }
+	
+	var stream = newEngineStreamWriter(writer)
+	err = server.engine.pushMessages(name, tag, auth, func(msg *engineStreamMessage) {
+		stream.writeFrame(engineStreamFrame(msg))
+	})
+	if err == nil { return nil }
+	var streamErr, isStreamError = err.(*DockerEngineStreamError)
+	if (! isStreamError) || (! stream.started) { return err }
+	stream.writeFrame(FakeBuildErrorFrame(streamErr.Message))
+	return nil
+}
+
+/*
+ * Decode the value of an X-Registry-Auth or X-Registry-Config header, which is
+ * base64 (URL or standard encoding) JSON.
+ */
+func decodeRegistryAuthHeader(header string, value interface{}) error {
+	
+	if header == "" { return nil }
+	var content, err = base64.URLEncoding.DecodeString(header)
+	if err != nil { content, err = base64.StdEncoding.DecodeString(header) }
+	if err == nil { err = json.Unmarshal(content, value) }
+	if err != nil { return inMemoryEngineError(400, "", "invalid registry credentials: " + err.Error()) }
+	return nil
+}
+
+/*******************************************************************************
+ * Remove the tag, or the image, and report which as the engine does.
+ */
+func (server *FakeDockerEngineServer) deleteImage(writer http.ResponseWriter, request *http.Request,
+	name string) error {
+	
+	var repoName, tag = splitImageNameAndTag(name)
+	server.engine.store.lock.Lock()
+	var _, isTag = server.engine.store.tags[repoName + ":" + tag]
+	server.engine.store.lock.Unlock()
+	var err = server.engine.WithContext(request.Context()).DeleteImage(name, "")
+	if err != nil { return err }
+	if isTag { return writeEngineJSON(writer, 200, []map[string]string{ { "Untagged": name } }) }
+	return writeEngineJSON(writer, 200, []map[string]string{ { "Deleted": name } })
+}
+
+/*******************************************************************************
+ * Responses.
+ */
+
+/*
+ * Writes JSON messages, each flushed as it is written, as the engine streams
+ * them. The status, 200, is written with the first message.
+ */
+type engineStreamWriter struct {
+	writer http.ResponseWriter
+	started bool
+}
+
+func newEngineStreamWriter(writer http.ResponseWriter) *engineStreamWriter {
+	return &engineStreamWriter{ writer: writer }
+}
+
+func (stream *engineStreamWriter) start() {
+	
+	if stream.started { return }
+	stream.writer.Header().Set("Content-Type", "application/json")
+	stream.writer.WriteHeader(200)
+	stream.started = true
+}
+
+func (stream *engineStreamWriter) writeFrame(frame string) {
+	
+	stream.start()
+	io.WriteString(stream.writer, frame + "\r\n")
+	if flusher, isFlusher := stream.writer.(http.Flusher); isFlusher { flusher.Flush() }
+}
+
+func writeEngineJSON(writer http.ResponseWriter, statusCode int, value interface{}) error {
+	
+	var content, err = json.Marshal(value)
+	if err != nil { return err }
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	writer.Write(content)
+	return nil
+}
+
+/*
+ * Write the error as the engine's error response, {"message": "..."}. The
+ * status is that of a DockerError, or else 500.
+ */
+func writeEngineError(writer http.ResponseWriter, err error) {
+	
+	var statusCode = 500
+	var message = err.Error()
+	if dockerErr, isType := err.(*DockerError); isType && (dockerErr.StatusCode != 0) {
+		statusCode = dockerErr.StatusCode
+		message = strings.TrimPrefix(message, fmt.Sprintf("%d %s: ", statusCode, http.StatusText(statusCode)))
+	}
+	writeEngineJSON(writer, statusCode, map[string]string{ "message": message })
+}
@@ -0,0 +1,293 @@
+package docker
+
+import (
+	"io"
+	"os"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"archive/tar"
+	"path/filepath"
+)
+
+/*******************************************************************************
+ * Start a fake engine, and return it with a DockerEngineImpl connected to it.
+ */
+func startTestEngine(t *testing.T) (*FakeDockerEngineServer, DockerEngine) {
+	
+	var server, err = NewFakeDockerEngineServer()
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(server.Close)
+	var engine DockerEngine
+	engine, err = OpenDockerEngineConnectionAt(server.SocketPath())
+	if err != nil { t.Fatal(err) }
+	return server, engine
+}
+
+/*******************************************************************************
+ * Return the requests to the fake engine with the method and path.
+ */
+func testEngineRequests(server *FakeDockerEngineServer, method, path string) []*FakeDockerEngineRequest {
+	
+	var requests = make([]*FakeDockerEngineRequest, 0)
+	for _, request := range server.Requests() {
+		if (request.Method == method) && (request.Path == path) { requests = append(requests, request) }
+	}
+	return requests
+}
+
+/*******************************************************************************
+ * Return the content of each regular file of the tar archive, by name.
+ */
+func readTestArchive(t *testing.T, reader io.Reader) map[string]string {
+	
+	var files = make(map[string]string)
+	var tarReader = tar.NewReader(reader)
+	for {
+		var header, err = tarReader.Next()
+		if err == io.EOF { return files }
+		if err != nil { t.Fatal(err) }
+		if header.Typeflag != tar.TypeReg { continue }
+		var content []byte
+		content, err = ioutil.ReadAll(tarReader)
+		if err != nil { t.Fatal(err) }
+		files[header.Name] = string(content)
+	}
+}
+
+func TestFakeEngineBuild(t *testing.T) {
+	
+	var server, engine = startTestEngine(t)
+	server.Engine().AddImage("acme/base:1", []byte("base layer"))
+	var dirPath = t.TempDir()
+	writeTestFiles(t, dirPath, map[string]string{
+		"Dockerfile": "FROM acme/base:1\nARG VERSION=1\nRUN echo $VERSION\n",
+	})
+	var options = NewDockerBuildOptions("acme/app:v1")
+	options.BuildArgs["VERSION"] = "2"
+	var events = 0
+	var buildOutput, err = engine.BuildImageStreamWithOptions(dirPath, options,
+		func(event *DockerBuildEvent) { events++ })
+	if err != nil { t.Fatal(err) }
+	if (buildOutput.ErrorMessage != "") || (buildOutput.FinalDockerImageId == "") || (events == 0) {
+		t.Fatalf("Unexpected build output: %+v, %d events", buildOutput, events)
+	}
+	var imageInfo map[string]interface{}
+	imageInfo, err = engine.GetImageInfo("acme/app:v1")
+	if err != nil { t.Fatal(err) }
+	if ! strings.HasPrefix(strings.TrimPrefix(imageInfo["Id"].(string), "sha256:"), buildOutput.FinalDockerImageId) {
+		t.Errorf("Built image %s, but tag is of %v", buildOutput.FinalDockerImageId, imageInfo["Id"])
+	}
+	var requests = testEngineRequests(server, "POST", "/build")
+	if (len(requests) != 1) || (requests[0].Query.Get("t") != "acme/app:v1") ||
+		(! strings.Contains(requests[0].Query.Get("buildargs"), `"VERSION":"2"`)) {
+		t.Errorf("Unexpected build request: %+v", requests)
+	}
+	
+	// A failed build is reported by the engine's error frame.
+	server.ScriptBuild(FakeBuildStreamFrame("Step 1/2 : FROM acme/base:1\n"),
+		FakeBuildErrorFrame("The command '/bin/sh -c false' returned a non-zero code: 1"))
+	buildOutput, err = engine.BuildImageStreamWithOptions(dirPath, options, nil)
+	if (err == nil) && ((buildOutput == nil) || (buildOutput.ErrorMessage == "")) {
+		t.Errorf("Failed build was not reported")
+	}
+}
+
+func TestFakeEnginePush(t *testing.T) {
+	
+	var server, engine = startTestEngine(t)
+	server.Engine().AddImage("acme/app:v1", []byte("base layer"), []byte("app layer"))
+	var registry = NewInMemoryDockerRegistry("registry.local:5000", "user", "secret")
+	server.Engine().AddRegistry(registry)
+	var err = engine.TagImage("acme/app:v1", "registry.local:5000/acme/app", "v1")
+	if err != nil { t.Fatal(err) }
+	
+	_, err = engine.PushImageWithAuth("registry.local:5000/acme/app", "v1",
+		&DockerRegistryAuth{ Username: "user", Password: "wrong" }, nil)
+	var streamErr *DockerEngineStreamError
+	if ! errors.As(err, &streamErr) { t.Errorf("Push with wrong password returned %v", err) }
+	
+	var events = 0
+	var pushOutput *DockerPushOutput
+	pushOutput, err = engine.PushImageWithAuth("registry.local:5000/acme/app", "v1",
+		&DockerRegistryAuth{ Username: "user", Password: "secret" },
+		func(event *DockerPushEvent) { events++ })
+	if err != nil { t.Fatal(err) }
+	if (pushOutput.Digest == "") || (events == 0) {
+		t.Errorf("Unexpected push output: %+v, %d events", pushOutput, events)
+	}
+	var exists bool
+	exists, err = registry.ImageExists("acme/app", "v1")
+	if (err != nil) || (! exists) { t.Errorf("Pushed image is not in the registry: %v", err) }
+	
+	_, err = engine.PushImageWithAuth("registry.local:5000/acme/other", "v1", nil, nil)
+	var dockerErr *DockerError
+	if (! errors.As(err, &dockerErr)) || (dockerErr.StatusCode != 404) {
+		t.Errorf("Push of unknown image returned %v", err)
+	}
+}
+
+func TestFakeEngineLoad(t *testing.T) {
+	
+	var server, engine = startTestEngine(t)
+	var imageId = server.Engine().AddImage("acme/app:v1", []byte("app layer"))
+	var imagePath = filepath.Join(t.TempDir(), "image.tar")
+	var err = ioutil.WriteFile(imagePath, nil, 0600)
+	if err != nil { t.Fatal(err) }
+	err = engine.GetImage("acme/app:v1", imagePath)
+	if err != nil { t.Fatal(err) }
+	err = engine.DeleteImage("acme/app", "v1")
+	if err != nil { t.Fatal(err) }
+	_, err = engine.GetImageInfo("acme/app:v1")
+	if ! errors.Is(err, ErrNotFound) { t.Fatalf("Deleted image returned %v", err) }
+	
+	var imageFile *os.File
+	imageFile, err = os.Open(imagePath)
+	if err != nil { t.Fatal(err) }
+	defer imageFile.Close()
+	var loadOutput *DockerLoadOutput
+	loadOutput, err = engine.LoadImage(imageFile)
+	if err != nil { t.Fatal(err) }
+	if (len(loadOutput.RepoTags) != 1) || (loadOutput.RepoTags[0] != "acme/app:v1") {
+		t.Errorf("Unexpected load output: %+v", loadOutput)
+	}
+	var imageInfo map[string]interface{}
+	imageInfo, err = engine.GetImageInfo("acme/app:v1")
+	if err != nil { t.Fatal(err) }
+	if imageInfo["Id"] != imageId { t.Errorf("Loaded image %v, expected %s", imageInfo["Id"], imageId) }
+	
+	// An archive that is not an image is reported by the engine's error frame.
+	_, err = engine.LoadImage(strings.NewReader("not an archive"))
+	var streamErr *DockerEngineStreamError
+	if ! errors.As(err, &streamErr) { t.Errorf("Load of non-archive returned %v", err) }
+}
+
+func TestFakeEngineCommit(t *testing.T) {
+	
+	var server, engine = startTestEngine(t)
+	server.Engine().AddImage("acme/base:1", []byte("base layer"))
+	var err = server.Engine().AddContainer("c1", "acme/base:1", map[string]string{
+		"/app/config": "debug=true",
+	})
+	if err != nil { t.Fatal(err) }
+	
+	var imageId string
+	imageId, err = engine.CommitContainer("c1", "acme/snapshot", "v1", "tester", "snapshot",
+		true, []string{ "LABEL stage=debug" })
+	if err != nil { t.Fatal(err) }
+	var imageInfo map[string]interface{}
+	imageInfo, err = engine.GetImageInfo("acme/snapshot:v1")
+	if err != nil { t.Fatal(err) }
+	if imageInfo["Id"] != imageId { t.Errorf("Committed image %s, but tag is of %v", imageId, imageInfo["Id"]) }
+	var config, _ = imageInfo["Config"].(map[string]interface{})
+	var labels, _ = config["Labels"].(map[string]interface{})
+	if labels["stage"] != "debug" { t.Errorf("Unexpected config of committed image: %v", imageInfo["Config"]) }
+	var requests = testEngineRequests(server, "POST", "/commit")
+	if (len(requests) != 1) || (requests[0].Query.Get("container") != "c1") ||
+		(requests[0].Query.Get("pause") != "1") || (requests[0].Query.Get("author") != "tester") {
+		t.Errorf("Unexpected commit request: %+v", requests)
+	}
+	
+	_, err = engine.CommitContainer("c2", "acme/snapshot", "v2", "", "", false, nil)
+	if ! errors.Is(err, ErrNotFound) { t.Errorf("Commit of unknown container returned %v", err) }
+}
+
+func TestFakeEngineArchiveCopy(t *testing.T) {
+	
+	var server, engine = startTestEngine(t)
+	var err = server.Engine().AddContainer("c1", "", map[string]string{
+		"/etc/os-release": "ID=test",
+		"/app/bin/run": "#!/bin/sh",
+		"/app/config": "debug=true",
+	})
+	if err != nil { t.Fatal(err) }
+	
+	var stat *DockerContainerPathStat
+	stat, err = engine.StatContainerPath("c1", "/app")
+	if err != nil { t.Fatal(err) }
+	if (stat.Name != "app") || (! stat.Mode.IsDir()) { t.Errorf("Unexpected status of /app: %+v", stat) }
+	_, err = engine.StatContainerPath("c1", "/missing")
+	if ! errors.Is(err, ErrNotFound) { t.Errorf("Status of missing path returned %v", err) }
+	
+	// A directory is copied with its base name.
+	var dockerSvcs = NewDockerServices(nil, engine)
+	var destDirPath = t.TempDir()
+	err = dockerSvcs.CopyFromContainerToDir("c1", "/app", destDirPath)
+	if err != nil { t.Fatal(err) }
+	var content []byte
+	content, err = ioutil.ReadFile(filepath.Join(destDirPath, "app", "bin", "run"))
+	if (err != nil) || (string(content) != "#!/bin/sh") { t.Errorf("Unexpected copy of /app/bin/run: %q, %v", content, err) }
+	var filePath = filepath.Join(destDirPath, "os-release")
+	err = dockerSvcs.CopyFileFromContainer("c1", "/etc/os-release", filePath)
+	if err != nil { t.Fatal(err) }
+	content, err = ioutil.ReadFile(filePath)
+	if (err != nil) || (string(content) != "ID=test") { t.Errorf("Unexpected copy of /etc/os-release: %q, %v", content, err) }
+	
+	// A local directory is copied into a container directory.
+	var localDirPath = filepath.Join(t.TempDir(), "data")
+	writeTestFiles(t, localDirPath, map[string]string{ "a.txt": "a", "sub/b.txt": "b" })
+	err = dockerSvcs.CopyPathToContainer(localDirPath, "c1", "/app")
+	if err != nil { t.Fatal(err) }
+	var reader io.ReadCloser
+	reader, stat, err = engine.CopyFromContainer("c1", "/app/data")
+	if err != nil { t.Fatal(err) }
+	var files = readTestArchive(t, reader)
+	reader.Close()
+	if (len(files) != 2) || (files["data/a.txt"] != "a") || (files["data/sub/b.txt"] != "b") {
+		t.Errorf("Unexpected archive of /app/data: %v", files)
+	}
+	var requests = testEngineRequests(server, "PUT", "/containers/c1/archive")
+	if (len(requests) != 1) || (requests[0].Query.Get("path") != "/app") {
+		t.Errorf("Unexpected archive requests: %+v", requests)
+	}
+	
+	err = engine.CopyToContainer("c1", "/missing", bytes.NewReader(nil))
+	if ! errors.Is(err, ErrNotFound) { t.Errorf("Copy to missing directory returned %v", err) }
+	err = engine.CopyToContainer("c2", "/app", bytes.NewReader(nil))
+	if ! errors.Is(err, ErrNotFound) { t.Errorf("Copy to unknown container returned %v", err) }
+}
+
+func TestFakeEnginePrune(t *testing.T) {
+	
+	var server, engine = startTestEngine(t)
+	var danglingId = server.Engine().AddImage("", []byte("dangling layer"))
+	var taggedId = server.Engine().AddImage("acme/app:v1", []byte("app layer"))
+	
+	var pruneOutput, err = engine.PruneImages(nil)
+	if err != nil { t.Fatal(err) }
+	if (len(pruneOutput.Deleted) != 1) || (pruneOutput.Deleted[0] != danglingId) ||
+		(len(pruneOutput.Untagged) != 0) || (pruneOutput.SpaceReclaimed == 0) {
+		t.Errorf("Unexpected output of dangling image prune: %+v", pruneOutput)
+	}
+	pruneOutput, err = engine.PruneImages(&DockerPruneFilters{ All: true, NotLabels: []string{ "keep" } })
+	if err != nil { t.Fatal(err) }
+	if (len(pruneOutput.Deleted) != 1) || (pruneOutput.Deleted[0] != taggedId) ||
+		(len(pruneOutput.Untagged) != 1) || (pruneOutput.Untagged[0] != "acme/app:v1") {
+		t.Errorf("Unexpected output of image prune: %+v", pruneOutput)
+	}
+	var images []map[string]interface{}
+	images, err = engine.GetImages()
+	if (err != nil) || (len(images) != 0) { t.Errorf("Images remain after prune: %v, %v", images, err) }
+	
+	pruneOutput, err = engine.PruneContainers(&DockerPruneFilters{ Until: "24h" })
+	if (err != nil) || (len(pruneOutput.Deleted) != 0) { t.Errorf("Container prune returned %+v, %v", pruneOutput, err) }
+	pruneOutput, err = engine.PruneVolumes(&DockerPruneFilters{ All: true })
+	if (err != nil) || (len(pruneOutput.Deleted) != 0) { t.Errorf("Volume prune returned %+v, %v", pruneOutput, err) }
+	pruneOutput, err = engine.PruneBuildCache(&DockerPruneFilters{ All: true })
+	if (err != nil) || (len(pruneOutput.Deleted) != 0) { t.Errorf("Build cache prune returned %+v, %v", pruneOutput, err) }
+	
+	var calls = server.Engine().CallsOf("PruneImages")
+	if (len(calls) != 2) || (! calls[1].Args[0].(*DockerPruneFilters).All) {
+		t.Errorf("Unexpected image prune calls: %+v", calls)
+	}
+	calls = server.Engine().CallsOf("PruneVolumes")
+	if (len(calls) != 1) || (! calls[0].Args[0].(*DockerPruneFilters).All) {
+		t.Errorf("Unexpected volume prune calls: %+v", calls)
+	}
+	var requests = testEngineRequests(server, "POST", "/build/prune")
+	if (len(requests) != 1) || (requests[0].Query.Get("all") != "1") {
+		t.Errorf("Unexpected build cache prune requests: %+v", requests)
+	}
+}
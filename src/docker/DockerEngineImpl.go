@@ -9,15 +9,14 @@ package docker
 import (
 	"fmt"
 	"io"
+	"context"
 	"os"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
-	"archive/tar"
+	"strings"
 	//"errors"
-	"path/filepath"
-	"encoding/base64"
 	"encoding/json"
 	
 	"utilities"
@@ -26,27 +25,46 @@ import (
 
 type DockerEngineImpl struct {
 	rest.RestContext
+	socketPath string  // the engine's unix domain socket
+	ctx context.Context  // nil unless bound by WithContext
+	retry *DockerRetryPolicy  // nil if operations are not retried
 }
 
 var _ DockerEngine = &DockerEngineImpl{}
 
+/*******************************************************************************
+ * The engine's unix domain socket, unless another is specified.
+ */
+const DefaultDockerSocketPath = "/var/run/docker.sock"
+
 /*******************************************************************************
  * 
  */
 func OpenDockerEngineConnection() (DockerEngine, error) {
+	
+	// https://docs.docker.com/engine/quickstart/#bind-docker-to-another-host-port-or-a-unix-socket
+	// Note: When the SafeHarborServer container is run, it must mount the
+	// /var/run/docker.sock unix socket in the container:
+	//		-v /var/run/docker.sock:/var/run/docker.sock
+	return OpenDockerEngineConnectionAt(DefaultDockerSocketPath)
+}
+
+/*******************************************************************************
+ * Connect to the engine that listens on the specified unix domain socket - e.g.,
+ * a FakeDockerEngineServer.
+ */
+func OpenDockerEngineConnectionAt(socketPath string) (DockerEngine, error) {
 
 	var engine *DockerEngineImpl = &DockerEngineImpl{
-		// https://docs.docker.com/engine/quickstart/#bind-docker-to-another-host-port-or-a-unix-socket
-		// Note: When the SafeHarborServer container is run, it must mount the
-		// /var/run/docker.sock unix socket in the container:
-		//		-v /var/run/docker.sock:/var/run/docker.sock
-		RestContext: *rest.CreateUnixRestContext(
-			unixDial,
-			"", "",
-			func (req *http.Request, s string) {}),
+		socketPath: socketPath,
+		retry: DefaultDockerRetryPolicy(),
 	}
+	engine.RestContext = *rest.CreateUnixRestContext(
+		engine.unixDial,
+		"", "",
+		func (req *http.Request, s string) {})
 	
-	fmt.Println("Attempting to ping the engine...")
+	logDebug("Attempting to ping the engine...")
 	var err error = engine.Ping()
 	if err != nil {
 		return nil, err
@@ -58,8 +76,8 @@ func OpenDockerEngineConnection() (DockerEngine, error) {
 /*******************************************************************************
  * For connecting to docker''s unix domain socket.
  */
-func unixDial(network, addr string) (conn net.Conn, err error) {
-	return net.Dial("unix", "/var/run/docker.sock")
+func (engine *DockerEngineImpl) unixDial(network, addr string) (conn net.Conn, err error) {
+	return net.Dial("unix", engine.socketPath)
 }
 
 /*******************************************************************************
@@ -72,7 +90,7 @@ func (engine *DockerEngineImpl) Ping() error {
 	var err error
 	response, err = engine.SendBasicGet(uri)
 	if err != nil { return err }
-	err = utilities.GenerateError(response.StatusCode, response.Status + "; during Ping")
+	err = generateResponseError(response, "Ping", response.Status + "; during Ping")
 	if err != nil { return err }
 	return nil
 }
@@ -87,7 +105,7 @@ func (engine *DockerEngineImpl) GetImages() ([]map[string]interface{}, error) {
 	var err error
 	response, err = engine.SendBasicGet(uri)
 	if err != nil { return nil, err }
-	err = utilities.GenerateError(response.StatusCode, response.Status)
+	err = generateResponseError(response, "GetImages", response.Status)
 	if err != nil { return nil, err }
 	var imageMaps []map[string]interface{}
 	imageMaps, err = rest.ParseResponseBodyToMaps(response.Body)
@@ -106,7 +124,7 @@ func (engine *DockerEngineImpl) GetImageInfo(imageName string) (map[string]inter
 	var err error
 	response, err = engine.SendBasicGet(uri)
 	if err != nil { return nil, err }
-	err = utilities.GenerateError(response.StatusCode, response.Status)
+	err = generateResponseError(response, "GetImageInfo", response.Status)
 	if err != nil { return nil, err }
 	var imageMap map[string]interface{}
 	imageMap, err = rest.ParseResponseBodyToMap(response.Body)
@@ -125,7 +143,7 @@ func (engine *DockerEngineImpl) GetImage(repoNameAndTag, filepath string) error
 	var err error
 	response, err = engine.SendBasicGet(uri)
 	if err != nil { return err }
-	err = utilities.GenerateError(response.StatusCode, response.Status)
+	err = generateResponseError(response, "GetImage", response.Status)
 	if err != nil { return err }
 	
 	// Open the destination file to write the image to.
@@ -139,8 +157,8 @@ func (engine *DockerEngineImpl) GetImage(repoNameAndTag, filepath string) error
 	// Copy the response body to the destination image file.
 	var reader io.ReadCloser = response.Body
 	_, err = io.Copy(imageFile, reader)
-	if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
-		"When writing layer file '%s': %s", imageFile.Name(), err.Error()))
+	if err != nil { return contextError(engine.context(), utilities.ConstructServerError(fmt.Sprintf(
+		"When writing layer file '%s': %s", imageFile.Name(), err.Error())))
 	}
 	
 	// Verify that content was actually copied.
@@ -155,6 +173,328 @@ func (engine *DockerEngineImpl) GetImage(repoNameAndTag, filepath string) error
 	return nil
 }
 
+/*******************************************************************************
+ * Load the image tar archive that is read from the specified reader into the
+ * engine. The archive is in the format produced by GetImage (docker save).
+ * Return the images and tags that the engine reports were loaded.
+ */
+func (engine *DockerEngineImpl) LoadImage(imageReader io.Reader) (*DockerLoadOutput, error) {
+	
+	// POST /images/load
+	// {{ TAR STREAM }}
+	var headers = map[string]string{
+		"Content-Type": "application/x-tar",
+	}
+	var response *http.Response
+	var err error
+	response, err = engine.SendBasicStreamPost("images/load?quiet=1", headers, imageReader)
+	if err != nil { return nil, err }
+	defer response.Body.Close()
+	err = generateResponseError(response, "LoadImage", response.Status + "; during LoadImage")
+	if err != nil { return nil, err }
+	
+	// Parse the JSON stream, e.g.,
+	//	{"stream":"Loaded image: busybox:latest\n"}
+	var loadOutput = NewDockerLoadOutput()
+	err = readEngineStream(response.Body, "LoadImage",
+		func(msg *engineStreamMessage) error {
+			loadOutput.addLine(msg.Stream)
+			return nil
+		})
+	if err != nil { return loadOutput, err }
+	
+	if (len(loadOutput.ImageIds) == 0) && (len(loadOutput.RepoTags) == 0) {
+		return loadOutput, utilities.ConstructUserError(
+			"Engine did not report any images loaded from the archive")
+	}
+	return loadOutput, nil
+}
+
+/*******************************************************************************
+ * Create an image from the root filesystem tar archive that is read from the
+ * specified reader. The changes are Dockerfile instructions (e.g., ENV, CMD,
+ * LABEL) that are applied to the image's config. The repo, tag, message, and
+ * changes may be empty. Return the Id of the new image.
+ */
+func (engine *DockerEngineImpl) ImportImage(rootfsReader io.Reader, repoName, tag,
+	message string, changes []string) (string, error) {
+	
+	// POST /images/create?fromSrc=-&repo=...&tag=...&message=...&changes=...
+	// {{ TAR STREAM }}
+	var query = url.Values{}
+	query.Set("fromSrc", "-")
+	if repoName != "" { query.Set("repo", repoName) }
+	if tag != "" { query.Set("tag", tag) }
+	if message != "" { query.Set("message", message) }
+	for _, change := range changes {
+		query.Add("changes", change)
+	}
+	var headers = map[string]string{
+		"Content-Type": "application/x-tar",
+	}
+	var response *http.Response
+	var err error
+	response, err = engine.SendBasicStreamPost("images/create?" + query.Encode(),
+		headers, rootfsReader)
+	if err != nil { return "", err }
+	defer response.Body.Close()
+	err = generateResponseError(response, "ImportImage", response.Status + "; during ImportImage")
+	if err != nil { return "", err }
+	
+	// The last status message contains the Id of the new image, e.g.,
+	//	{"status":"sha256:2b8fd9751c4c0f5dd266fcae00707e67a2545ef34f9a29354585f93dac906749"}
+	var imageId string
+	err = readEngineStream(response.Body, "ImportImage",
+		func(msg *engineStreamMessage) error {
+			if strings.HasPrefix(msg.Status, "sha256:") { imageId = strings.TrimSpace(msg.Status) }
+			return nil
+		})
+	if err != nil { return "", err }
+	if imageId == "" { return "", utilities.ConstructServerError(
+		"Engine did not report the Id of the imported image") }
+	return imageId, nil
+}
+
+/*******************************************************************************
+ * Create a new image from the current state of the specified container. The
+ * changes are Dockerfile instructions (e.g., ENV, CMD, LABEL) that are applied
+ * to the image's config. If pause is true, the container is paused while it is
+ * committed. Return the Id of the new image.
+ */
+func (engine *DockerEngineImpl) CommitContainer(containerId, repoName, tag,
+	author, comment string, pause bool, changes []string) (string, error) {
+	
+	// POST /commit?container=...&repo=...&tag=...&author=...&comment=...&pause=...
+	// {{ CONTAINER CONFIG }}
+	var query = url.Values{}
+	query.Set("container", containerId)
+	if repoName != "" { query.Set("repo", repoName) }
+	if tag != "" { query.Set("tag", tag) }
+	if author != "" { query.Set("author", author) }
+	if comment != "" { query.Set("comment", comment) }
+	if pause { query.Set("pause", "1") } else { query.Set("pause", "0") }
+	for _, change := range changes {
+		query.Add("changes", change)
+	}
+	var headers = map[string]string{
+		"Content-Type": "application/json",
+	}
+	var response *http.Response
+	var err error
+	response, err = engine.SendBasicStreamPost("commit?" + query.Encode(),
+		headers, strings.NewReader("{}"))
+	if err != nil { return "", err }
+	defer response.Body.Close()
+	err = generateResponseError(response, "CommitContainer", response.Status + "; during CommitContainer")
+	if err != nil { return "", err }
+	
+	// Response is of the form {"Id": "sha256:..."}.
+	var responseMap map[string]interface{}
+	responseMap, err = rest.ParseResponseBodyToMap(response.Body)
+	if err != nil { return "", err }
+	var imageId string
+	var isType bool
+	imageId, isType = responseMap["Id"].(string)
+	if (! isType) || (imageId == "") { return "", utilities.ConstructServerError(
+		"Engine did not return the Id of the committed image") }
+	return imageId, nil
+}
+
+/*******************************************************************************
+ * Return information about the specified file or directory within the
+ * specified container, without retrieving its content.
+ */
+func (engine *DockerEngineImpl) StatContainerPath(containerId, path string) (*DockerContainerPathStat, error) {
+	
+	// HEAD /containers/{id}/archive?path=...
+	var uri = fmt.Sprintf("containers/%s/archive?path=%s", containerId, url.QueryEscape(path))
+	var response *http.Response
+	var err error
+	response, err = engine.SendBasicHead(uri)
+	if err != nil { return nil, err }
+	response.Body.Close()
+	err = generateResponseError(response, "StatContainerPath", response.Status +
+		"; while getting status of '" + path + "' in container " + containerId)
+	if err != nil { return nil, err }
+	return parseContainerPathStat(response.Header.Get(containerPathStatHeader))
+}
+
+/*******************************************************************************
+ * Retrieve the specified file or directory from the specified container, as a
+ * tar archive. The caller must close the returned reader.
+ */
+func (engine *DockerEngineImpl) CopyFromContainer(containerId, path string) (io.ReadCloser,
+	*DockerContainerPathStat, error) {
+	
+	// GET /containers/{id}/archive?path=...
+	var uri = fmt.Sprintf("containers/%s/archive?path=%s", containerId, url.QueryEscape(path))
+	var response *http.Response
+	var err error
+	response, err = engine.SendBasicGet(uri)
+	if err != nil { return nil, nil, err }
+	err = generateResponseError(response, "CopyFromContainer", response.Status +
+		"; while copying '" + path + "' from container " + containerId)
+	if err != nil { response.Body.Close(); return nil, nil, err }
+	var stat *DockerContainerPathStat
+	stat, err = parseContainerPathStat(response.Header.Get(containerPathStatHeader))
+	if err != nil { response.Body.Close(); return nil, nil, err }
+	return response.Body, stat, nil
+}
+
+/*******************************************************************************
+ * Extract the tar archive that is read from the specified reader into the
+ * specified directory of the specified container. The directory must exist.
+ */
+func (engine *DockerEngineImpl) CopyToContainer(containerId, destDirPath string,
+	tarReader io.Reader) error {
+	
+	// PUT /containers/{id}/archive?path=...
+	// {{ TAR STREAM }}
+	var uri = fmt.Sprintf("containers/%s/archive?path=%s", containerId, url.QueryEscape(destDirPath))
+	var headers = map[string]string{
+		"Content-Type": "application/x-tar",
+	}
+	var response *http.Response
+	var err error
+	response, err = engine.SendBasicStreamPut(uri, headers, tarReader)
+	if err != nil { return err }
+	response.Body.Close()
+	return generateResponseError(response, "CopyToContainer", response.Status +
+		"; while copying to '" + destDirPath + "' in container " + containerId)
+}
+
+/*******************************************************************************
+ * Return a single resource usage sample for the specified running container.
+ * The engine waits for two readings, so that CPUPercent can be computed.
+ */
+func (engine *DockerEngineImpl) GetContainerStats(containerId string) (*DockerContainerStats, error) {
+	
+	// GET /containers/{id}/stats?stream=0
+	var uri = fmt.Sprintf("containers/%s/stats?stream=0", containerId)
+	var response *http.Response
+	var err error
+	response, err = engine.SendBasicGet(uri)
+	if err != nil { return nil, err }
+	defer response.Body.Close()
+	err = generateResponseError(response, "GetContainerStats", response.Status +
+		"; while getting stats for container " + containerId)
+	if err != nil { return nil, err }
+	
+	var stats = &DockerContainerStats{}
+	err = json.NewDecoder(response.Body).Decode(stats)
+	if err != nil { return nil, contextError(engine.context(), utilities.ConstructServerError(
+		"While parsing container stats: " + err.Error())) }
+	return stats, nil
+}
+
+/*******************************************************************************
+ * Obtain resource usage samples for the specified running container as the
+ * engine produces them (about once a second), and pass each to the handler.
+ * Streaming stops when the handler returns false, when the container stops,
+ * or when an error occurs.
+ */
+func (engine *DockerEngineImpl) StreamContainerStats(containerId string,
+	handler func(*DockerContainerStats) bool) error {
+	
+	// GET /containers/{id}/stats?stream=1
+	var uri = fmt.Sprintf("containers/%s/stats?stream=1", containerId)
+	var response *http.Response
+	var err error
+	response, err = engine.SendBasicGet(uri)
+	if err != nil { return err }
+	defer response.Body.Close()  // closing the body ends the engine's stream
+	err = generateResponseError(response, "StreamContainerStats", response.Status +
+		"; while streaming stats for container " + containerId)
+	if err != nil { return err }
+	
+	var decoder = json.NewDecoder(response.Body)
+	for {
+		var stats = &DockerContainerStats{}
+		err = decoder.Decode(stats)
+		if err == io.EOF { return nil }
+		if err != nil { return contextError(engine.context(), utilities.ConstructServerError(
+			"While parsing container stats: " + err.Error())) }
+		if ! handler(stats) { return nil }
+	}
+}
+
+/*******************************************************************************
+ * Remove unused images. Unless filters.All is set, only dangling images
+ * (those with no tag, such as intermediate build images) are removed.
+ */
+func (engine *DockerEngineImpl) PruneImages(filters *DockerPruneFilters) (*DockerPruneOutput, error) {
+	
+	// POST /images/prune?filters=...
+	return engine.prune("images/prune", filters, "dangling", "false", "")
+}
+
+/*******************************************************************************
+ * Remove stopped containers.
+ */
+func (engine *DockerEngineImpl) PruneContainers(filters *DockerPruneFilters) (*DockerPruneOutput, error) {
+	
+	// POST /containers/prune?filters=...
+	return engine.prune("containers/prune", filters, "", "", "")
+}
+
+/*******************************************************************************
+ * Remove volumes that are not used by any container. Unless filters.All is
+ * set, only anonymous volumes are removed (by engines of API 1.42 and later;
+ * earlier engines remove named volumes too, and reject filters.All). The
+ * engine does not support the Until filter for volumes.
+ */
+func (engine *DockerEngineImpl) PruneVolumes(filters *DockerPruneFilters) (*DockerPruneOutput, error) {
+	
+	var err = filters.checkForVolumes()
+	if err != nil { return nil, err }
+	
+	// POST /volumes/prune?filters=...
+	return engine.prune("volumes/prune", filters, "all", "true", "")
+}
+
+/*******************************************************************************
+ * Remove the build cache. Unless filters.All is set, only cache that is not
+ * referenced by an image is removed.
+ */
+func (engine *DockerEngineImpl) PruneBuildCache(filters *DockerPruneFilters) (*DockerPruneOutput, error) {
+	
+	// POST /build/prune?all=1&filters=...
+	var extraQuery = ""
+	if (filters != nil) && filters.All { extraQuery = "all=1" }
+	return engine.prune("build/prune", filters, "", "", extraQuery)
+}
+
+/*******************************************************************************
+ * Common implementation of the prune functions.
+ */
+func (engine *DockerEngineImpl) prune(uri string, filters *DockerPruneFilters,
+	allFilter, allValue, extraQuery string) (*DockerPruneOutput, error) {
+	
+	var filterQuery string
+	var err error
+	filterQuery, err = filters.encode(allFilter, allValue)
+	if err != nil { return nil, err }
+	var query = filterQuery
+	if extraQuery != "" {
+		if query != "" { query = query + "&" }
+		query = query + extraQuery
+	}
+	if query != "" { uri = uri + "?" + query }
+	
+	var response *http.Response
+	response, err = engine.SendBasicFormPost(uri, []string{}, []string{})
+	if err != nil { return nil, err }
+	defer response.Body.Close()
+	err = generateResponseError(response, "Prune", response.Status + "; during " + uri)
+	if err != nil { return nil, err }
+	
+	var pruneResponse = &enginePruneResponse{}
+	err = json.NewDecoder(response.Body).Decode(pruneResponse)
+	if err != nil { return nil, utilities.ConstructServerError(
+		"While parsing response of " + uri + ": " + err.Error()) }
+	return pruneResponse.asOutput(), nil
+}
+
 /*******************************************************************************
  * Invoke the docker engine to build the image defined by the specified contents
  * of the build directory, which presumably contains a dockerfile. The textual
@@ -163,9 +503,88 @@ func (engine *DockerEngineImpl) GetImage(repoNameAndTag, filepath string) error
 func (engine *DockerEngineImpl) BuildImage(buildDirPath, imageFullName string,
 	dockerfileName string, paramNames, paramValues []string) (string, error) {
 
-	if len(paramNames) != len(paramValues) { return "", utilities.ConstructServerError(
-		"Mismatch in number of param names and values") }
+	var options *DockerBuildOptions
+	var err error
+	options, err = newDockerBuildOptionsFromParams(imageFullName, dockerfileName,
+		paramNames, paramValues)
+	if err != nil { return "", err }
+	return engine.BuildImageWithOptions(buildDirPath, options)
+}
+
+/*******************************************************************************
+ * Same as BuildImage, but the engine's response is parsed as it arrives, and
+ * each build event is passed to the handler (which may be nil) as it occurs.
+ * The parsed build output is returned; if the build fails, the partial output
+ * is returned with an error.
+ */
+func (engine *DockerEngineImpl) BuildImageStream(buildDirPath, imageFullName string,
+	dockerfileName string, paramNames, paramValues []string,
+	handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
+
+	var options *DockerBuildOptions
+	var err error
+	options, err = newDockerBuildOptionsFromParams(imageFullName, dockerfileName,
+		paramNames, paramValues)
+	if err != nil { return nil, err }
+	return engine.BuildImageStreamWithOptions(buildDirPath, options, handler)
+}
+
+/*******************************************************************************
+ * Invoke the docker engine to build the image defined by the specified contents
+ * of the build directory, using the specified options. The textual response
+ * from the docker engine is returned.
+ */
+func (engine *DockerEngineImpl) BuildImageWithOptions(buildDirPath string,
+	options *DockerBuildOptions) (string, error) {
+
+	var response *http.Response
+	var excluded []string
+	var err error
+	response, excluded, err = engine.postBuild(buildDirPath, options)
+	if err != nil { return "", err }
+	defer response.Body.Close()
+	for _, path := range excluded {
+		logDebug("Excluded from build context by .dockerignore", "path", path)
+	}
+	
+	var bytes []byte
+	bytes, err = ioutil.ReadAll(response.Body)
+	if err != nil { return "", err }
+	var responseStr = string(bytes)
+	
+	return responseStr, nil
+}
+
+/*******************************************************************************
+ * Same as BuildImageWithOptions, but the engine's response is parsed as it
+ * arrives, as for BuildImageStream.
+ */
+func (engine *DockerEngineImpl) BuildImageStreamWithOptions(buildDirPath string,
+	options *DockerBuildOptions, handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
+
+	var response *http.Response
+	var excluded []string
+	var err error
+	response, excluded, err = engine.postBuild(buildDirPath, options)
+	if err != nil { return nil, err }
+	defer response.Body.Close()
+	if handler != nil {
+		for _, path := range excluded {
+			handler(&DockerBuildEvent{ Kind: BuildEventContextExcluded, Text: path })
+		}
+	}
 	
+	return ParseBuildRESTOutputStream(response.Body, handler)
+}
+
+/*******************************************************************************
+ * Send the build request to the engine, with the contents of the build directory
+ * as the build context. The caller must close the body of the response. The
+ * paths that .dockerignore excluded from the build context are also returned.
+ */
+func (engine *DockerEngineImpl) postBuild(buildDirPath string,
+	options *DockerBuildOptions) (*http.Response, []string, error) {
+
 	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.23/#build-image-from-a-dockerfile
 	// POST /build HTTP/1.1
 	//
@@ -177,91 +596,143 @@ func (engine *DockerEngineImpl) BuildImage(buildDirPath, imageFullName string,
 	// For SSH key injection, see https://github.com/mdsol/docker-ssh-exec
 	// See also http://elasticcompute.io/2016/01/22/build-time-secrets-with-docker-containers/
 	
+	var dockerfileName = options.Dockerfile
+	if dockerfileName == "" { dockerfileName = "Dockerfile" }
+	
 	// Create a temporary tar file of the build directory contents.
 	var tarFile *os.File
 	var err error
 	var tempDirPath string
 	tempDirPath, err = utilities.MakeTempDir()
-	if err != nil { return "", err }
+	if err != nil { return nil, nil, err }
 	defer os.RemoveAll(tempDirPath)
 	tarFile, err = utilities.MakeTempFile(tempDirPath, "")
-	if err != nil { return "", utilities.ConstructServerError(fmt.Sprintf(
+	if err != nil { return nil, nil, utilities.ConstructServerError(fmt.Sprintf(
 		"When creating temp file '%s': %s", tarFile.Name(), err.Error()))
 	}
 	
-	// Walk the build directory and add each file to the tar.
-	var tarWriter = tar.NewWriter(tarFile)
-	err = filepath.Walk(buildDirPath,
-		func(path string, info os.FileInfo, err error) error {
-		
-			// Open the file to be written to the tar.
-			if info.Mode().IsDir() { return nil }
-			var new_path = path[len(buildDirPath):]
-			if len(new_path) == 0 { return nil }
-			var file *os.File
-			file, err = os.Open(path)
-			if err != nil { return err }
-			defer file.Close()
-			
-			// Write tar header for the file.
-			var header *tar.Header
-			header, err = tar.FileInfoHeader(info, new_path)
-			if err != nil { return err }
-			header.Name = new_path
-			err = tarWriter.WriteHeader(header)
-			if err != nil { return err }
-			
-			// Write the file contents to the tar.
-			_, err = io.Copy(tarWriter, file)
-			if err != nil { return err }
-			
-			return nil  // success - file was written to tar.
-		})
-	
-	if err != nil { return "", err }
-	tarWriter.Close()
+	// Write the build directory contents to the tar, less the files that are
+	// excluded by .dockerignore.
+	var excluded []string
+	excluded, err = WriteBuildContext(buildDirPath, dockerfileName, tarFile,
+		options.ReproducibleContext)
+	if err != nil { return nil, nil, err }
 	
 	// Send the request to the docker engine, with the tar file as the body content.
 	var tarReader io.ReadCloser
 	tarReader, err = os.Open(tarFile.Name())
+	if err != nil { return nil, nil, err }
 	defer tarReader.Close()
-	if err != nil { return "", err }
-	var headers = make(map[string]string)
-	headers["Content-Type"] = "application/tar"
-	headers["X-Registry-Config"] = base64.URLEncoding.EncodeToString([]byte("{}"))
-	var queryParamString = fmt.Sprintf("build?t=%s&dockerfile=%s", imageFullName, dockerfileName)
-	if len(paramNames) > 0 {
-		// Disable cache if there are build params, because they might be secret values
-		// and they would be maintained in the cache.
-		queryParamString = queryParamString + "&" + "nocache"
-		
-		// Add params to request. See
-		// https://github.com/docker/docker/blob/master/docs/reference/api/docker_remote_api_v1.24.md#build-image-from-a-dockerfile
-		
-		var paramMap = make(map[string]string)
-		for i, paramName := range paramNames {
-			paramMap[paramName] = paramValues[i]
-		}
-		var bytes []byte
-		bytes, err = json.Marshal(paramMap)
-		if err != nil { return "", err }
-		var buildargsJSON = string(bytes)
-		queryParamString = queryParamString + "&buildargs=" + url.QueryEscape(buildargsJSON)
-	}
 	var response *http.Response
-	response, err = engine.SendBasicStreamPost(queryParamString, headers, tarReader)
+	response, err = engine.sendBuildRequest(tarReader, "", options)
+	if err != nil { return nil, nil, err }
+	
+	return response, excluded, nil
+}
+
+/*******************************************************************************
+ * Invoke the docker engine to build an image from the build context that is
+ * read, as a tar archive (optionally compressed with gzip, bzip2 or xz), from
+ * the specified reader. The dockerfile named by the options must be within the
+ * archive. The engine's response is parsed as for BuildImageStream.
+ */
+func (engine *DockerEngineImpl) BuildImageFromArchive(contextReader io.Reader,
+	options *DockerBuildOptions, handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
+	
+	var response *http.Response
+	var err error
+	response, err = engine.sendBuildRequest(contextReader, "", options)
+	if err != nil { return nil, err }
 	defer response.Body.Close()
-	if err != nil { return "", err }
-	err = utilities.GenerateError(response.StatusCode, response.Status)
-	if err != nil { return "", err }
+	return ParseBuildRESTOutputStream(response.Body, handler)
+}
+
+/*******************************************************************************
+ * Invoke the docker engine to build an image from a remote build context, which
+ * the engine itself retrieves. The remote is one of,
+ *	- a git repository URL, optionally with a fragment that selects a ref and a
+ *		subdirectory: <repo URL>#<ref>:<subdirectory> (see GitBuildContextURL);
+ *	- the URL of a tar archive of the build context;
+ *	- the URL of a plain text dockerfile, in which case there is no other context.
+ * The engine's response is parsed as for BuildImageStream.
+ */
+func (engine *DockerEngineImpl) BuildImageFromRemote(remote string,
+	options *DockerBuildOptions, handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
 	
-	var bytes []byte
-	bytes, err = ioutil.ReadAll(response.Body)
-	response.Body.Close()
-	if err != nil { return "", err }
-	var responseStr = string(bytes)
+	if (! IsGitURL(remote)) && (! IsHTTPURL(remote)) { return nil, utilities.ConstructUserError(
+		"Remote build context is not a git or http(s) URL: " + remote) }
 	
-	return responseStr, nil
+	var response *http.Response
+	var err error
+	response, err = engine.sendBuildRequest(nil, remote, options)
+	if err != nil { return nil, err }
+	defer response.Body.Close()
+	return ParseBuildRESTOutputStream(response.Body, handler)
+}
+
+/*******************************************************************************
+ * Send a build request to the engine. The build context is either the body,
+ * which is a tar archive, or - if the body is nil - the remote URL. The caller
+ * must close the body of the response.
+ */
+func (engine *DockerEngineImpl) sendBuildRequest(body io.Reader, remote string,
+	options *DockerBuildOptions) (*http.Response, error) {
+	
+	// The build's arguments and secrets are redacted from log messages, including
+	// those of the build's output, until the output has been read.
+	var forgetLogSecrets = registerBuildLogSecrets(options)
+	var response, err = engine.postBuildRequest(body, remote, options)
+	if err != nil { forgetLogSecrets(); return nil, err }
+	response.Body = &logSecretsResponseBody{ ReadCloser: response.Body, forget: forgetLogSecrets }
+	return response, nil
+}
+
+func (engine *DockerEngineImpl) postBuildRequest(body io.Reader, remote string,
+	options *DockerBuildOptions) (*http.Response, error) {
+	
+	var headers = make(map[string]string)
+	var registryConfig string
+	var err error
+	registryConfig, err = options.RegistryAuths.encode()
+	if err != nil { return nil, err }
+	headers["X-Registry-Config"] = registryConfig
+	if body == nil {
+		body = strings.NewReader("")
+	} else {
+		headers["Content-Type"] = "application/tar"
+	}
+	
+	// Add options to request. See
+	// https://github.com/docker/docker/blob/master/docs/reference/api/docker_remote_api_v1.24.md#build-image-from-a-dockerfile
+	var queryString string
+	queryString, err = options.queryString()
+	if err != nil { return nil, err }
+	if remote != "" { queryString = queryString + "&remote=" + url.QueryEscape(remote) }
+	
+	// A BuildKit build obtains secrets, SSH agents and registry credentials via
+	// a session, which must remain open until the build's output has been read.
+	var session *buildKitSession
+	if options.BuildKit {
+		session, err = engine.startBuildKitSession(options)
+		if err != nil { return nil, err }
+		queryString = queryString + "&session=" + url.QueryEscape(session.id)
+	}
+	
+	var response *http.Response
+	response, err = engine.SendBasicStreamPost("build?" + queryString, headers, body)
+	if err == nil {
+		err = generateResponseError(response, "BuildImage", response.Status)
+		if err != nil { response.Body.Close() }
+	}
+	if err != nil {
+		if session != nil { session.close() }
+		return nil, err
+	}
+	
+	if session != nil {
+		response.Body = &buildKitResponseBody{ ReadCloser: response.Body, session: session }
+	}
+	return response, nil
 }
 
 /*******************************************************************************
@@ -276,45 +747,71 @@ func (engine *DockerEngineImpl) TagImage(imageName, hostAndRepoName, tag string)
 	var values = []string{ hostAndRepoName, tag }
 	response, err = engine.SendBasicFormPost(uri, names, values)
 	if err != nil { return err }
-	return utilities.GenerateError(response.StatusCode, response.Status)
+	return generateResponseError(response, "TagImage", response.Status)
 }
 
 
 /*******************************************************************************
- * The imageFullName must be the full registry host:port/repo name.
+ * Push the specified image to its registry, via the engine. The repoFullName
+ * must be the full registry host:port/repo name. See PushImageWithAuth, which
+ * also returns the digest of the pushed manifest and reports the progress.
  */
-func (engine *DockerEngineImpl) PushImage(repoFullName, tag, regUserId, regPass, regEmail string) error {
-	
-	// https://github.com/docker/docker/blob/681b5e0ed45f535d123d997884ce4ffb2907932f/daemon/image_push.go
-	// https://github.com/docker/docker/blob/master/daemon/daemon.go
-	// https://github.com/docker/docker/blob/7fd53f7c711474791ce4292326e0b1dc7d4d6b0f/vendor/src/github.com/docker/engine-api/client/image_push.go
+func (engine *DockerEngineImpl) PushImage(repoFullName, tag, regUserId, regPass,
+	regEmail string) error {
 	
-	var uri = fmt.Sprintf("images/%s/push", repoFullName)
-	//var uri = fmt.Sprintf("images/%s:%s/push", repoFullName, tag)
-	
-	var regCreds = fmt.Sprintf(
-		"{\"username\": \"%s\", \"password\": \"%s\", \"email\": \"%s\"}",
-			regUserId, regPass, regEmail)
-	var encodedRegCreds = base64.StdEncoding.EncodeToString([]byte(regCreds))
+	var auth = &DockerRegistryAuth{
+		Username: regUserId,
+		Password: regPass,
+		Email: regEmail,
+		ServerAddress: RegistryHostOfImage(repoFullName),
+	}
+	var _, err = engine.PushImageWithAuth(repoFullName, tag, auth, nil)
+	return err
+}
 
-	var parmNames = []string{ "tag" }
-	var parmValues = []string{ tag }
+/*******************************************************************************
+ * Push the specified image to its registry, via the engine, using the specified
+ * credentials (which may be nil if the registry does not require any). The
+ * handler, if not nil, is called with each event as the engine reports its
+ * progress. An error that the engine reports within its progress stream (it
+ * returns status 200 before it has begun to push) is returned as a
+ * DockerEngineStreamError.
+ */
+func (engine *DockerEngineImpl) PushImageWithAuth(repoFullName, tag string,
+	auth *DockerRegistryAuth, handler func(*DockerPushEvent)) (*DockerPushOutput, error) {
+	
+	// https://docs.docker.com/engine/api/v1.41/#operation/ImagePush
+	var forgetLogSecrets = registerAuthLogSecrets(auth)
+	defer forgetLogSecrets()
+	var encodedAuth string
+	var err error
+	encodedAuth, err = auth.encode()
+	if err != nil { return nil, err }
 	var headers = map[string]string{
-		"X-Registry-Auth": encodedRegCreds,
+		"X-Registry-Auth": encodedAuth,
 	}
 	
+	var uri = fmt.Sprintf("images/%s/push", repoFullName)
+	if tag != "" { uri = uri + "?tag=" + url.QueryEscape(tag) }
 	var response *http.Response
-	var err error
-	response, err = engine.SendBasicFormPostWithHeaders(uri, parmNames, parmValues, headers)
-	if err != nil { return err }
+	response, err = engine.SendBasicStreamPost(uri, headers, strings.NewReader(""))
+	if err != nil { return nil, err }
+	defer response.Body.Close()
+	err = generateResponseError(response, "PushImageWithAuth", response.Status + "; during PushImage")
+	if err != nil { return nil, err }
 	
-	return utilities.GenerateError(response.StatusCode, response.Status)
+	var pushOutput = NewDockerPushOutput()
+	err = readEngineStream(response.Body, "PushImage",
+		func(msg *engineStreamMessage) error {
+			var event = pushOutput.addMessage(msg)
+			if (event != nil) && (handler != nil) { handler(event) }
+			return nil
+		})
+	if err != nil { return pushOutput, err }
 	
-	// Apr 25 20:46:25 ip-172-31-41-187.us-west-2.compute.internal docker[1092]:
-	// time="2016-04-25T20:46:25.066856155Z" level=error
-	// msg="Handler for POST /images/:0/localhost:5000/myimage:alpha/push returned error:
-	// Error parsing reference: ":0/localhost:5000/myimage:alpha"
-	// is not a valid repository/tag"
+	if pushOutput.Digest == "" { return pushOutput, utilities.ConstructServerError(
+		"Engine did not report the digest of the pushed image") }
+	return pushOutput, nil
 }
 
 /*******************************************************************************
@@ -328,5 +825,5 @@ func (engine *DockerEngineImpl) DeleteImage(repoName, tag string) error {
 	var err error
 	response, err = engine.SendBasicDelete(uri)
 	if err != nil { return err }
-	return utilities.GenerateError(response.StatusCode, response.Status)
+	return generateResponseError(response, "DeleteImage", response.Status)
 }
@@ -0,0 +1,1164 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+	"io/ioutil"
+	pathpkg "path"
+	"path/filepath"
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * A DockerEngine that holds its images in memory (see DockerInMemory.go).
+ *
+ * A build is simulated from the dockerfile: each instruction is a step of the
+ * build output, as the engine's classic builder reports it, and each RUN, COPY
+ * and ADD adds a layer, whose content depends on the instruction and on the
+ * build arguments. A FROM image is taken from the engine's images, or pulled
+ * from a registry that was added with AddRegistry, using the credentials of
+ * the build options; other FROM images are simulated as they are "pulled".
+ * SetBuildError makes builds fail, as a failing RUN would. Images are pushed
+ * to the registries that were added with AddRegistry, and are reported as the
+ * engine reports a push.
+ *
+ * Containers are simulated only as the files that AddContainer gives them,
+ * for CommitContainer and the archive operations; the other container
+ * operations fail as they do for a container that does not exist. Containers
+ * are taken to be running, so there are no containers, volumes or build cache
+ * to prune.
+ */
+type InMemoryDockerEngine struct {
+	*inMemoryCalls
+	store *inMemoryEngineStore
+	ctx context.Context  // nil unless bound by WithContext
+	retry *DockerRetryPolicy
+}
+
+var _ DockerEngine = &InMemoryDockerEngine{}
+
+type inMemoryEngineStore struct {
+	lock sync.Mutex
+	images map[string]*inMemoryImage  // by Id
+	tags map[string]string  // image Ids, by "repo:tag"
+	containers map[string]*inMemoryContainer  // by Id
+	registries map[string]*InMemoryDockerRegistry  // by registry host (see RegistryAuthKey)
+	buildError string  // if not empty, builds fail with this message
+}
+
+func NewInMemoryDockerEngine() *InMemoryDockerEngine {
+	return &InMemoryDockerEngine{
+		inMemoryCalls: newInMemoryCalls(),
+		store: &inMemoryEngineStore{
+			images: make(map[string]*inMemoryImage),
+			tags: make(map[string]string),
+			containers: make(map[string]*inMemoryContainer),
+			registries: make(map[string]*InMemoryDockerRegistry),
+		},
+		retry: DefaultDockerRetryPolicy(),
+	}
+}
+
+/*******************************************************************************
+ * Add an image with the specified layers to the engine, with the specified
+ * name ("repo:tag"), unless the name is empty. Return the Id of the image.
+ */
+func (engine *InMemoryDockerEngine) AddImage(imageName string, layers ...[]byte) string {
+	
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var history = make([]string, len(layers))
+	for i, _ := range layers { history[i] = fmt.Sprintf("layer %d", i+1) }
+	var image = engine.store.addImage(newInMemoryImage(layers, nil, history,
+		time.Now().UTC().Truncate(time.Second)))
+	if imageName != "" { engine.store.tag(image, imageName) }
+	return image.id
+}
+
+/*******************************************************************************
+ * Add a container, with the specified Id, of the image with the specified name
+ * (or none, if the name is empty), whose files are those specified (content,
+ * by absolute path). The directories of the container are those of its files.
+ */
+func (engine *InMemoryDockerEngine) AddContainer(containerId, imageName string,
+	files map[string]string) error {
+	
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var container = &inMemoryContainer{
+		id: containerId,
+		files: make(map[string]string),
+		created: time.Now().UTC().Truncate(time.Second),
+	}
+	if imageName != "" {
+		container.image = engine.store.resolve(imageName)
+		if container.image == nil { return inMemoryEngineError(404, "AddContainer",
+			"No such image: " + imageName) }
+	}
+	for filePath, content := range files { container.files[containerFilePath(filePath)] = content }
+	engine.store.containers[containerId] = container
+	return nil
+}
+
+/*******************************************************************************
+ * Make the registry reachable from the engine, by the host of its image names,
+ * for pushes and for the FROM images of builds.
+ */
+func (engine *InMemoryDockerEngine) AddRegistry(registry *InMemoryDockerRegistry) {
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	engine.store.registries[RegistryAuthKey(registry.store.registryHost)] = registry
+}
+
+/*******************************************************************************
+ * Make subsequent builds fail at their last step, reporting the message as the
+ * engine reports a failed build. An empty message makes builds succeed again.
+ */
+func (engine *InMemoryDockerEngine) SetBuildError(message string) {
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	engine.store.buildError = message
+}
+
+func (engine *InMemoryDockerEngine) WithContext(ctx context.Context) DockerEngine {
+	var bound = *engine
+	bound.ctx = ctx
+	return &bound
+}
+
+func (engine *InMemoryDockerEngine) SetRetryPolicy(policy *DockerRetryPolicy) {
+	engine.retry = policy
+}
+
+func (engine *InMemoryDockerEngine) GetRetryPolicy() *DockerRetryPolicy {
+	return engine.retry
+}
+
+func (engine *InMemoryDockerEngine) Ping() error {
+	return engine.record(engine.ctx, "Ping")
+}
+
+/*******************************************************************************
+ * Return the images, newest first, as the engine's images/json function does.
+ */
+func (engine *InMemoryDockerEngine) GetImages() ([]map[string]interface{}, error) {
+	
+	var err = engine.record(engine.ctx, "GetImages")
+	if err != nil { return nil, err }
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var images = make([]*inMemoryImage, 0, len(engine.store.images))
+	for _, image := range engine.store.images { images = append(images, image) }
+	sort.Slice(images, func(i, j int) bool {
+		if ! images[i].created.Equal(images[j].created) { return images[i].created.After(images[j].created) }
+		return images[i].id < images[j].id
+	})
+	
+	var imageMaps = make([]map[string]interface{}, len(images))
+	for i, image := range images {
+		imageMaps[i], err = inMemoryJSONMap(map[string]interface{}{
+			"Id": image.id,
+			"ParentId": "",
+			"RepoTags": image.repoTags,
+			"RepoDigests": []string{},
+			"Created": image.created.Unix(),
+			"Size": image.size(),
+			"VirtualSize": image.size(),
+			"SharedSize": -1,
+			"Labels": image.labels,
+			"Containers": -1,
+		})
+		if err != nil { return nil, err }
+	}
+	return imageMaps, nil
+}
+
+/*******************************************************************************
+ * Return the description of the image - which is named by "repo:tag", by Id,
+ * or by a prefix of its Id - as the engine's images/{name}/json function does.
+ */
+func (engine *InMemoryDockerEngine) GetImageInfo(imageName string) (map[string]interface{}, error) {
+	
+	var err = engine.record(engine.ctx, "GetImageInfo", imageName)
+	if err != nil { return nil, err }
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var image = engine.store.resolve(imageName)
+	if image == nil { return nil, noSuchImageError("GetImageInfo", imageName) }
+	
+	var diffIds = make([]string, len(image.layers))
+	for i, layer := range image.layers { diffIds[i] = inMemoryDigest(layer) }
+	return inMemoryJSONMap(map[string]interface{}{
+		"Id": image.id,
+		"RepoTags": image.repoTags,
+		"RepoDigests": []string{},
+		"Parent": "",
+		"Comment": "",
+		"Created": image.created.Format(time.RFC3339Nano),
+		"Author": "",
+		"Architecture": "amd64",
+		"Os": "linux",
+		"Size": image.size(),
+		"VirtualSize": image.size(),
+		"Config": map[string]interface{}{ "Labels": image.labels },
+		"RootFS": map[string]interface{}{ "Type": "layers", "Layers": diffIds },
+	})
+}
+
+/*******************************************************************************
+ * Write the image archive of the image (see writeImageArchive) to the file,
+ * which must exist, as DockerEngineImpl.GetImage does.
+ */
+func (engine *InMemoryDockerEngine) GetImage(repoNameAndTag, filepath string) error {
+	
+	var err = engine.record(engine.ctx, "GetImage", repoNameAndTag, filepath)
+	if err != nil { return err }
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var image = engine.store.resolve(repoNameAndTag)
+	if image == nil { return noSuchImageError("GetImage", repoNameAndTag) }
+	var repoTags = make([]string, 0)
+	var repoName, tag = splitImageNameAndTag(repoNameAndTag)
+	if engine.store.tags[repoName + ":" + tag] == image.id { repoTags = append(repoTags, repoName + ":" + tag) }
+	
+	var imageFile *os.File
+	imageFile, err = os.OpenFile(filepath, os.O_WRONLY | os.O_TRUNC, 0600)
+	if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
+		"When opening file '%s': %s", filepath, err.Error()))
+	}
+	defer imageFile.Close()
+	err = writeImageArchive(imageFile, image, repoTags)
+	if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
+		"When writing image file '%s': %s", filepath, err.Error()))
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Add the images of the image archive that is read from the reader, as
+ * DockerEngineImpl.LoadImage does.
+ */
+func (engine *InMemoryDockerEngine) LoadImage(imageReader io.Reader) (*DockerLoadOutput, error) {
+	
+	var err = engine.record(engine.ctx, "LoadImage")
+	if err != nil { return nil, err }
+	var images []*inMemoryImage
+	images, err = readImageArchive(imageReader)
+	if err != nil { return nil, &DockerEngineStreamError{ Operation: "LoadImage", Message: err.Error() } }
+	
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var loadOutput = NewDockerLoadOutput()
+	for _, loaded := range images {
+		var image = engine.store.addImage(loaded)
+		for _, repoTag := range loaded.repoTags {
+			engine.store.tag(image, repoTag)
+			loadOutput.addLine("Loaded image: " + repoTag)
+		}
+		if len(loaded.repoTags) == 0 { loadOutput.addLine("Loaded image ID: " + image.id) }
+	}
+	if (len(loadOutput.ImageIds) == 0) && (len(loadOutput.RepoTags) == 0) {
+		return loadOutput, utilities.ConstructUserError(
+			"Engine did not report any images loaded from the archive")
+	}
+	return loadOutput, nil
+}
+
+/*******************************************************************************
+ * Add an image whose single layer is the root filesystem archive. Of the
+ * changes, only LABEL instructions affect the image.
+ */
+func (engine *InMemoryDockerEngine) ImportImage(rootfsReader io.Reader, repoName, tag,
+	message string, changes []string) (string, error) {
+	
+	var err = engine.record(engine.ctx, "ImportImage", repoName, tag, message, changes)
+	if err != nil { return "", err }
+	var rootfs []byte
+	rootfs, err = ioutil.ReadAll(rootfsReader)
+	if err != nil { return "", err }
+	var labels = make(map[string]string)
+	for _, change := range changes {
+		var keyword, args = splitDockerfileInstruction(change)
+		if keyword == "LABEL" { parseDockerfileLabels(args, labels) }
+	}
+	
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var image = engine.store.addImage(newInMemoryImage([][]byte{ rootfs }, labels,
+		[]string{ "Imported from -" }, time.Now().UTC().Truncate(time.Second)))
+	if repoName != "" {
+		if tag == "" { tag = "latest" }
+		engine.store.tag(image, repoName + ":" + tag)
+	}
+	return image.id, nil
+}
+
+/*******************************************************************************
+ * Create a new image from the container: the layers of its image and a layer
+ * of its files. Of the changes, only LABEL instructions affect the image.
+ */
+func (engine *InMemoryDockerEngine) CommitContainer(containerId, repoName, tag,
+	author, comment string, pause bool, changes []string) (string, error) {
+	
+	var err = engine.record(engine.ctx, "CommitContainer", containerId, repoName, tag,
+		author, comment, pause, changes)
+	if err != nil { return "", err }
+	
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var container = engine.store.containers[containerId]
+	if container == nil { return "", noSuchContainerError("CommitContainer", containerId) }
+	var labels = make(map[string]string)
+	var history = make([]string, 0)
+	var layers = make([][]byte, 0)
+	if container.image != nil {
+		for key, value := range container.image.labels { labels[key] = value }
+		var config inMemoryImageConfig
+		json.Unmarshal(container.image.config, &config)
+		for _, entry := range config.History { history = append(history, entry.CreatedBy) }
+		layers = append(layers, container.image.layers...)
+	}
+	for _, change := range changes {
+		var keyword, args = splitDockerfileInstruction(change)
+		if keyword == "LABEL" { parseDockerfileLabels(args, labels) }
+	}
+	layers = append(layers, container.filesLayer())
+	history = append(history, "commit " + containerId + ": " + comment)
+	var image = engine.store.addImage(newInMemoryImage(layers, labels, history,
+		time.Now().UTC().Truncate(time.Second)))
+	if repoName != "" {
+		if tag == "" { tag = "latest" }
+		engine.store.tag(image, repoName + ":" + tag)
+	}
+	return image.id, nil
+}
+
+func (engine *InMemoryDockerEngine) StatContainerPath(containerId, path string) (*DockerContainerPathStat, error) {
+	
+	var err = engine.record(engine.ctx, "StatContainerPath", containerId, path)
+	if err != nil { return nil, err }
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var container = engine.store.containers[containerId]
+	if container == nil { return nil, noSuchContainerError("StatContainerPath", containerId) }
+	return container.stat("StatContainerPath", path)
+}
+
+/*******************************************************************************
+ * Return a tar archive of the container's file, or of its directory and the
+ * files within it, named by its base name, as the engine does.
+ */
+func (engine *InMemoryDockerEngine) CopyFromContainer(containerId, path string) (io.ReadCloser,
+	*DockerContainerPathStat, error) {
+	
+	var err = engine.record(engine.ctx, "CopyFromContainer", containerId, path)
+	if err != nil { return nil, nil, err }
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var container = engine.store.containers[containerId]
+	if container == nil { return nil, nil, noSuchContainerError("CopyFromContainer", containerId) }
+	var stat *DockerContainerPathStat
+	stat, err = container.stat("CopyFromContainer", path)
+	if err != nil { return nil, nil, err }
+	
+	path = containerFilePath(path)
+	var buffer bytes.Buffer
+	var tarWriter = tar.NewWriter(&buffer)
+	if ! stat.Mode.IsDir() {
+		var content = container.files[path]
+		tarWriter.WriteHeader(&tar.Header{ Name: stat.Name, Mode: 0644, Size: int64(len(content)),
+			ModTime: stat.Mtime, Typeflag: tar.TypeReg })
+		tarWriter.Write([]byte(content))
+	} else {
+		var prefix = strings.TrimSuffix(path, "/") + "/"
+		var filePaths = make([]string, 0)
+		for filePath, _ := range container.files {
+			if strings.HasPrefix(filePath, prefix) { filePaths = append(filePaths, filePath) }
+		}
+		sort.Strings(filePaths)
+		var dirNames = map[string]bool{ stat.Name: true }
+		tarWriter.WriteHeader(&tar.Header{ Name: stat.Name + "/", Mode: 0755,
+			ModTime: stat.Mtime, Typeflag: tar.TypeDir })
+		for _, filePath := range filePaths {
+			var name = stat.Name + "/" + strings.TrimPrefix(filePath, prefix)
+			for dirName := pathpkg.Dir(name); ! dirNames[dirName]; dirName = pathpkg.Dir(dirName) {
+				dirNames[dirName] = true
+				tarWriter.WriteHeader(&tar.Header{ Name: dirName + "/", Mode: 0755,
+					ModTime: stat.Mtime, Typeflag: tar.TypeDir })
+			}
+			var content = container.files[filePath]
+			tarWriter.WriteHeader(&tar.Header{ Name: name, Mode: 0644, Size: int64(len(content)),
+				ModTime: stat.Mtime, Typeflag: tar.TypeReg })
+			tarWriter.Write([]byte(content))
+		}
+	}
+	tarWriter.Close()
+	return ioutil.NopCloser(&buffer), stat, nil
+}
+
+/*******************************************************************************
+ * Add the regular files of the tar archive to the container, within the
+ * directory, which must exist. Other entries are ignored.
+ */
+func (engine *InMemoryDockerEngine) CopyToContainer(containerId, destDirPath string,
+	tarReader io.Reader) error {
+	
+	var err = engine.record(engine.ctx, "CopyToContainer", containerId, destDirPath)
+	if err != nil { return err }
+	var files = make(map[string]string)
+	var archiveReader = tar.NewReader(tarReader)
+	for {
+		var header *tar.Header
+		header, err = archiveReader.Next()
+		if err == io.EOF { break }
+		if err != nil { return inMemoryEngineError(400, "CopyToContainer", err.Error()) }
+		if header.Typeflag != tar.TypeReg { continue }
+		var content []byte
+		content, err = ioutil.ReadAll(archiveReader)
+		if err != nil { return inMemoryEngineError(400, "CopyToContainer", err.Error()) }
+		files[pathpkg.Join(containerFilePath(destDirPath), header.Name)] = string(content)
+	}
+	
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var container = engine.store.containers[containerId]
+	if container == nil { return noSuchContainerError("CopyToContainer", containerId) }
+	var stat *DockerContainerPathStat
+	stat, err = container.stat("CopyToContainer", destDirPath)
+	if err != nil { return err }
+	if ! stat.Mode.IsDir() { return inMemoryEngineError(400, "CopyToContainer",
+		"extraction point is not a directory") }
+	for filePath, content := range files { container.files[filePath] = content }
+	return nil
+}
+
+func (engine *InMemoryDockerEngine) GetContainerStats(containerId string) (*DockerContainerStats, error) {
+	
+	var err = engine.record(engine.ctx, "GetContainerStats", containerId)
+	if err != nil { return nil, err }
+	return nil, noSuchContainerError("GetContainerStats", containerId)
+}
+
+func (engine *InMemoryDockerEngine) StreamContainerStats(containerId string,
+	handler func(*DockerContainerStats) bool) error {
+	
+	var err = engine.record(engine.ctx, "StreamContainerStats", containerId)
+	if err != nil { return err }
+	return noSuchContainerError("StreamContainerStats", containerId)
+}
+
+/*******************************************************************************
+ * Remove the images that have no tag or, if filters.All is set, all images
+ * (as there are no containers to use them), that the filters' labels and
+ * Until select.
+ */
+func (engine *InMemoryDockerEngine) PruneImages(filters *DockerPruneFilters) (*DockerPruneOutput, error) {
+	
+	var err = engine.record(engine.ctx, "PruneImages", filters)
+	if err != nil { return nil, err }
+	if filters == nil { filters = &DockerPruneFilters{} }
+	var until time.Time
+	if filters.Until != "" {
+		var duration time.Duration
+		duration, err = time.ParseDuration(filters.Until)
+		if err == nil {
+			until = time.Now().Add(-duration)
+		} else {
+			until, err = time.Parse(time.RFC3339, filters.Until)
+			if err != nil { return nil, inMemoryEngineError(400, "Prune",
+				"invalid until filter: " + filters.Until) }
+		}
+	}
+	
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var output = &DockerPruneOutput{ Deleted: make([]string, 0), Untagged: make([]string, 0) }
+	var ids = make([]string, 0, len(engine.store.images))
+	for id, _ := range engine.store.images { ids = append(ids, id) }
+	sort.Strings(ids)
+	for _, id := range ids {
+		var image = engine.store.images[id]
+		if (! filters.All) && (len(image.repoTags) > 0) { continue }
+		if (! until.IsZero()) && (! image.created.Before(until)) { continue }
+		if ! labelsMatch(image.labels, filters.Labels, filters.NotLabels) { continue }
+		output.Untagged = append(output.Untagged, image.repoTags...)
+		output.Deleted = append(output.Deleted, id)
+		output.SpaceReclaimed = output.SpaceReclaimed + uint64(image.size())
+		engine.store.remove(image)
+	}
+	return output, nil
+}
+
+func (engine *InMemoryDockerEngine) PruneContainers(filters *DockerPruneFilters) (*DockerPruneOutput, error) {
+	return engine.pruneNothing("PruneContainers", filters)
+}
+
+func (engine *InMemoryDockerEngine) PruneVolumes(filters *DockerPruneFilters) (*DockerPruneOutput, error) {
+	var err = filters.checkForVolumes()
+	if err != nil { return nil, err }
+	return engine.pruneNothing("PruneVolumes", filters)
+}
+
+func (engine *InMemoryDockerEngine) PruneBuildCache(filters *DockerPruneFilters) (*DockerPruneOutput, error) {
+	return engine.pruneNothing("PruneBuildCache", filters)
+}
+
+func (engine *InMemoryDockerEngine) pruneNothing(operation string, filters *DockerPruneFilters) (*DockerPruneOutput, error) {
+	var err = engine.record(engine.ctx, operation, filters)
+	if err != nil { return nil, err }
+	return &DockerPruneOutput{ Deleted: make([]string, 0), Untagged: make([]string, 0) }, nil
+}
+
+/*******************************************************************************
+ * Builds. The output of each is that of the engine's build function.
+ */
+func (engine *InMemoryDockerEngine) BuildImage(buildDirPath, imageFullName string,
+	dockerfileName string, paramNames, paramValues []string) (string, error) {
+	
+	var err = engine.record(engine.ctx, "BuildImage", buildDirPath, imageFullName,
+		dockerfileName, paramNames, paramValues)
+	if err != nil { return "", err }
+	var options *DockerBuildOptions
+	options, err = newDockerBuildOptionsFromParams(imageFullName, dockerfileName,
+		paramNames, paramValues)
+	if err != nil { return "", err }
+	return engine.buildFromDir(buildDirPath, options)
+}
+
+func (engine *InMemoryDockerEngine) BuildImageStream(buildDirPath, imageFullName string,
+	dockerfileName string, paramNames, paramValues []string,
+	handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
+	
+	var err = engine.record(engine.ctx, "BuildImageStream", buildDirPath, imageFullName,
+		dockerfileName, paramNames, paramValues)
+	if err != nil { return nil, err }
+	var options *DockerBuildOptions
+	options, err = newDockerBuildOptionsFromParams(imageFullName, dockerfileName,
+		paramNames, paramValues)
+	if err != nil { return nil, err }
+	var output string
+	output, err = engine.buildFromDir(buildDirPath, options)
+	if err != nil { return nil, err }
+	return ParseBuildRESTOutputStream(strings.NewReader(output), handler)
+}
+
+func (engine *InMemoryDockerEngine) BuildImageWithOptions(buildDirPath string,
+	options *DockerBuildOptions) (string, error) {
+	
+	var err = engine.record(engine.ctx, "BuildImageWithOptions", buildDirPath, options)
+	if err != nil { return "", err }
+	return engine.buildFromDir(buildDirPath, options)
+}
+
+func (engine *InMemoryDockerEngine) BuildImageStreamWithOptions(buildDirPath string,
+	options *DockerBuildOptions, handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
+	
+	var err = engine.record(engine.ctx, "BuildImageStreamWithOptions", buildDirPath, options)
+	if err != nil { return nil, err }
+	var output string
+	output, err = engine.buildFromDir(buildDirPath, options)
+	if err != nil { return nil, err }
+	return ParseBuildRESTOutputStream(strings.NewReader(output), handler)
+}
+
+/*******************************************************************************
+ * Build from the dockerfile in the build context archive, which may be
+ * compressed with gzip.
+ */
+func (engine *InMemoryDockerEngine) BuildImageFromArchive(contextReader io.Reader,
+	options *DockerBuildOptions, handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
+	
+	var err = engine.record(engine.ctx, "BuildImageFromArchive", options)
+	if err != nil { return nil, err }
+	if options == nil { options = NewDockerBuildOptions("") }
+	var dockerfile string
+	dockerfile, err = readArchiveDockerfile(contextReader, options.Dockerfile)
+	if err != nil { return nil, err }
+	var output string
+	output, err = engine.build(dockerfile, options)
+	if err != nil { return nil, err }
+	return ParseBuildRESTOutputStream(strings.NewReader(output), handler)
+}
+
+/*******************************************************************************
+ * Return the named dockerfile ("Dockerfile" if the name is empty) from the
+ * build context archive, which may be compressed with gzip.
+ */
+func readArchiveDockerfile(contextReader io.Reader, dockerfileName string) (string, error) {
+	
+	if dockerfileName == "" { dockerfileName = "Dockerfile" }
+	var err error
+	var bufferedReader = bufio.NewReader(contextReader)
+	var reader io.Reader = bufferedReader
+	var magic, _ = bufferedReader.Peek(2)
+	if bytes.Equal(magic, []byte{ 0x1f, 0x8b }) {
+		var gzipReader *gzip.Reader
+		gzipReader, err = gzip.NewReader(bufferedReader)
+		if err != nil { return "", inMemoryEngineError(500, "BuildImage", err.Error()) }
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	var dockerfile []byte
+	var tarReader = tar.NewReader(reader)
+	for {
+		var header *tar.Header
+		header, err = tarReader.Next()
+		if err == io.EOF { break }
+		if err != nil { return "", inMemoryEngineError(500, "BuildImage",
+			"failed to read build context: " + err.Error()) }
+		if pathpkg.Clean(header.Name) == pathpkg.Clean(dockerfileName) {
+			dockerfile, err = ioutil.ReadAll(tarReader)
+			if err != nil { return "", err }
+		}
+	}
+	if dockerfile == nil { return "", inMemoryEngineError(500, "BuildImage",
+		"Cannot locate specified Dockerfile: " + dockerfileName) }
+	return string(dockerfile), nil
+}
+
+/*******************************************************************************
+ * Build from a remote build context, which, as it is not retrieved, is taken
+ * to have the dockerfile "FROM scratch", "ADD <remote> /".
+ */
+func (engine *InMemoryDockerEngine) BuildImageFromRemote(remote string,
+	options *DockerBuildOptions, handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
+	
+	var err = engine.record(engine.ctx, "BuildImageFromRemote", remote, options)
+	if err != nil { return nil, err }
+	if (! IsGitURL(remote)) && (! IsHTTPURL(remote)) { return nil, utilities.ConstructUserError(
+		"Remote build context is not a git or http(s) URL: " + remote) }
+	var output string
+	output, err = engine.build("FROM scratch\nADD " + remote + " /\n", options)
+	if err != nil { return nil, err }
+	return ParseBuildRESTOutputStream(strings.NewReader(output), handler)
+}
+
+func (engine *InMemoryDockerEngine) buildFromDir(buildDirPath string,
+	options *DockerBuildOptions) (string, error) {
+	
+	if options == nil { options = NewDockerBuildOptions("") }
+	var dockerfileName = options.Dockerfile
+	if dockerfileName == "" { dockerfileName = "Dockerfile" }
+	var dockerfile, err = ioutil.ReadFile(filepath.Join(buildDirPath, dockerfileName))
+	if err != nil { return "", inMemoryEngineError(500, "BuildImage",
+		"Cannot locate specified Dockerfile: " + dockerfileName) }
+	return engine.build(string(dockerfile), options)
+}
+
+/*******************************************************************************
+ * Simulate the build of the dockerfile, and return the engine's output - a
+ * stream of JSON messages. A failure of the build is reported in the output,
+ * as the engine reports it, rather than as an error.
+ */
+func (engine *InMemoryDockerEngine) build(dockerfile string, options *DockerBuildOptions) (string, error) {
+	
+	if options == nil { options = NewDockerBuildOptions("") }
+	var instructions = dockerfileInstructions(dockerfile)
+	if len(instructions) == 0 { return "", inMemoryEngineError(400, "BuildImage",
+		"the Dockerfile cannot be empty") }
+	
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var output bytes.Buffer
+	var write = func(msg *engineStreamMessage) {
+		var line, _ = json.Marshal(msg)
+		output.Write(line)
+		output.WriteString("\r\n")
+	}
+	var fail = func(message string) (string, error) {
+		write(&engineStreamMessage{ Error: message, ErrorDetail: &engineErrorDetail{ Message: message } })
+		return output.String(), nil
+	}
+	
+	var layers = make([][]byte, 0)
+	var history = make([]string, 0)
+	var labels = make(map[string]string)
+	var args = make(map[string]string)
+	var stepId = ""
+	for i, instruction := range instructions {
+		write(&engineStreamMessage{ Stream: fmt.Sprintf("Step %d/%d : %s\n", i+1, len(instructions), instruction) })
+		var keyword, arguments = splitDockerfileInstruction(instruction)
+		var stepKey = instruction
+		var containerId = inMemoryShortDigest(stepId + " " + instruction + " container")
+		switch keyword {
+			case "FROM":
+				var fields = strings.Fields(arguments)
+				if len(fields) == 0 { return fail("FROM requires either one or three arguments") }
+				if fields[0] == "scratch" {
+					layers = make([][]byte, 0)
+					break
+				}
+				var base, message = engine.store.pull(fields[0], options, write)
+				if base == nil { return fail(message) }
+				layers = append(make([][]byte, 0), base.layers...)
+				for key, value := range base.labels { labels[key] = value }
+				stepKey = base.id
+			case "ARG":
+				var name, value = arguments, ""
+				var equals = strings.Index(arguments, "=")
+				if equals != -1 { name, value = arguments[:equals], arguments[equals+1:] }
+				if buildArg, isSet := options.BuildArgs[name]; isSet { value = buildArg }
+				args[name] = value
+			case "LABEL":
+				parseDockerfileLabels(arguments, labels)
+			case "RUN", "COPY", "ADD":
+				if keyword == "RUN" {
+					write(&engineStreamMessage{ Stream: " ---> Running in " +
+						containerId + "\n" })
+				}
+				// The content of the layer depends on the build arguments, as a
+				// RUN step's environment does.
+				var argNames = make([]string, 0, len(args))
+				for name, _ := range args { argNames = append(argNames, name) }
+				sort.Strings(argNames)
+				var content = instruction
+				for _, name := range argNames { content = content + "\n" + name + "=" + args[name] }
+				layers = append(layers, inMemoryLayer(fmt.Sprintf("step-%d", i+1), content))
+				stepKey = content
+		}
+		history = append(history, instruction)
+		stepId = inMemoryShortDigest(stepId + " " + stepKey)
+		write(&engineStreamMessage{ Stream: " ---> " + stepId + "\n" })
+		if keyword == "RUN" {
+			write(&engineStreamMessage{ Stream: "Removing intermediate container " +
+				containerId + "\n" })
+		}
+	}
+	if engine.store.buildError != "" { return fail(engine.store.buildError) }
+	
+	for key, value := range options.Labels { labels[key] = value }
+	var image = engine.store.addImage(newInMemoryImage(layers, labels, history,
+		time.Now().UTC().Truncate(time.Second)))
+	var aux, _ = json.Marshal(map[string]string{ "ID": image.id })
+	write(&engineStreamMessage{ Aux: aux })
+	write(&engineStreamMessage{ Stream: "Successfully built " + image.shortId() + "\n" })
+	for _, imageName := range options.Tags {
+		var repoName, tag = splitImageNameAndTag(imageName)
+		engine.store.tag(image, repoName + ":" + tag)
+		write(&engineStreamMessage{ Stream: "Successfully tagged " + repoName + ":" + tag + "\n" })
+	}
+	return output.String(), nil
+}
+
+func (engine *InMemoryDockerEngine) TagImage(imageName, hostAndRepoName, tag string) error {
+	
+	var err = engine.record(engine.ctx, "TagImage", imageName, hostAndRepoName, tag)
+	if err != nil { return err }
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var image = engine.store.resolve(imageName)
+	if image == nil { return noSuchImageError("TagImage", imageName) }
+	if tag == "" { tag = "latest" }
+	engine.store.tag(image, hostAndRepoName + ":" + tag)
+	return nil
+}
+
+func (engine *InMemoryDockerEngine) PushImage(repoFullName, tag, regUserId, regPass,
+	regEmail string) error {
+	
+	var err = engine.record(engine.ctx, "PushImage", repoFullName, tag, regUserId, regPass, regEmail)
+	if err != nil { return err }
+	var auth = &DockerRegistryAuth{
+		Username: regUserId,
+		Password: regPass,
+		Email: regEmail,
+		ServerAddress: RegistryHostOfImage(repoFullName),
+	}
+	_, err = engine.push(repoFullName, tag, auth, nil)
+	return err
+}
+
+func (engine *InMemoryDockerEngine) PushImageWithAuth(repoFullName, tag string,
+	auth *DockerRegistryAuth, handler func(*DockerPushEvent)) (*DockerPushOutput, error) {
+	
+	var err = engine.record(engine.ctx, "PushImageWithAuth", repoFullName, tag, auth)
+	if err != nil { return nil, err }
+	return engine.push(repoFullName, tag, auth, handler)
+}
+
+/*******************************************************************************
+ * Push the image - or, if the tag is empty, each tag of the repo - to the
+ * registry of the image's name, which must have been added with AddRegistry.
+ */
+func (engine *InMemoryDockerEngine) push(repoFullName, tag string, auth *DockerRegistryAuth,
+	handler func(*DockerPushEvent)) (*DockerPushOutput, error) {
+	
+	var pushOutput = NewDockerPushOutput()
+	var err = engine.pushMessages(repoFullName, tag, auth, func(msg *engineStreamMessage) {
+		var event = pushOutput.addMessage(msg)
+		if (event != nil) && (handler != nil) { handler(event) }
+	})
+	var _, isStreamError = err.(*DockerEngineStreamError)
+	if (err != nil) && (! isStreamError) { return nil, err }
+	return pushOutput, err
+}
+
+/*
+ * Push as for push, and report the progress of the push as the engine's
+ * messages. A failure after the push has begun is a DockerEngineStreamError.
+ */
+func (engine *InMemoryDockerEngine) pushMessages(repoFullName, tag string, auth *DockerRegistryAuth,
+	report func(*engineStreamMessage)) error {
+	
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var tags = []string{ tag }
+	if tag == "" {
+		tags = make([]string, 0)
+		for repoTag, _ := range engine.store.tags {
+			var repoName, repoTagTag = splitImageNameAndTag(repoTag)
+			if repoName == repoFullName { tags = append(tags, repoTagTag) }
+		}
+		sort.Strings(tags)
+	}
+	var images = make([]*inMemoryImage, len(tags))
+	for i, t := range tags {
+		images[i] = engine.store.images[engine.store.tags[repoFullName + ":" + t]]
+	}
+	if (len(images) == 0) || (images[0] == nil) { return inMemoryEngineError(404,
+		"PushImageWithAuth", "An image does not exist locally with the tag: " + repoFullName) }
+	
+	report(&engineStreamMessage{ Status: "The push refers to repository [" + repoFullName + "]" })
+	var registryHost = RegistryHostOfImage(repoFullName)
+	var registry = engine.store.registries[registryHost]
+	if registry == nil { return &DockerEngineStreamError{ Operation: "PushImage",
+		Message: "dial tcp: lookup " + registryHost + ": no such host" } }
+	if ! registry.store.authorizes(auth) { return &DockerEngineStreamError{
+		Operation: "PushImage", Message: "unauthorized: authentication required" } }
+	
+	var repoName = repoNameInRegistry(repoFullName)
+	for i, image := range images {
+		var layerDigests = make([]string, len(image.layers))
+		for j, layer := range image.layers {
+			var digest = inMemoryDigest(layer)
+			var layerId = strings.TrimPrefix(digest, "sha256:")[:12]
+			report(&engineStreamMessage{ Status: "Preparing", Id: layerId })
+			if registry.store.hasBlob(repoName, digest) {
+				report(&engineStreamMessage{ Status: "Layer already exists", Id: layerId })
+			} else {
+				registry.store.putBlob(repoName, layer)
+				report(&engineStreamMessage{ Status: "Pushed", Id: layerId })
+			}
+			layerDigests[j] = strings.TrimPrefix(digest, "sha256:")
+		}
+		var digest, size, err = registry.store.putManifest(repoName, tags[i], layerDigests, "PushImage")
+		if err != nil { return &DockerEngineStreamError{ Operation: "PushImage",
+			Message: err.Error() } }
+		report(&engineStreamMessage{ Status: fmt.Sprintf("%s: digest: %s size: %d", tags[i], digest, size) })
+		var aux, _ = json.Marshal(map[string]interface{}{ "Tag": tags[i], "Digest": digest, "Size": size })
+		report(&engineStreamMessage{ Aux: aux })
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Remove the tag from its image, and remove the image if that was its last
+ * tag. An image that is named by its Id is removed, unless it has more than
+ * one tag, as the engine does.
+ */
+func (engine *InMemoryDockerEngine) DeleteImage(repoName, tag string) error {
+	
+	var err = engine.record(engine.ctx, "DeleteImage", repoName, tag)
+	if err != nil { return err }
+	var imageName = repoName
+	if tag != "" { imageName = imageName + ":" + tag }
+	
+	engine.store.lock.Lock()
+	defer engine.store.lock.Unlock()
+	var image = engine.store.resolve(imageName)
+	if image == nil { return noSuchImageError("DeleteImage", imageName) }
+	var name, nameTag = splitImageNameAndTag(imageName)
+	var repoTag = name + ":" + nameTag
+	if engine.store.tags[repoTag] == image.id {
+		engine.store.untag(repoTag)
+		if len(image.repoTags) == 0 { engine.store.remove(image) }
+		return nil
+	}
+	if len(image.repoTags) > 1 { return inMemoryEngineError(409, "DeleteImage", fmt.Sprintf(
+		"conflict: unable to delete %s (must be forced) - image is referenced in multiple repositories",
+		image.shortId())) }
+	engine.store.remove(image)
+	return nil
+}
+
+/*******************************************************************************
+ * Errors, as DockerEngineImpl reports the engine's responses.
+ */
+func noSuchImageError(operation, imageName string) error {
+	return inMemoryEngineError(404, operation, "No such image: " + imageName)
+}
+
+func noSuchContainerError(operation, containerId string) error {
+	return inMemoryEngineError(404, operation, "No such container: " + containerId)
+}
+
+/*******************************************************************************
+ * A container, which is simply its files.
+ */
+type inMemoryContainer struct {
+	id string
+	image *inMemoryImage  // nil if the container has no image
+	files map[string]string  // the content of each regular file, by absolute path
+	created time.Time
+}
+
+/*
+ * Return a path within a container as an absolute path: as the engine does, a
+ * relative path is relative to the root directory.
+ */
+func containerFilePath(filePath string) string {
+	return pathpkg.Join("/", filePath)
+}
+
+/*
+ * Return the status of the file or directory, or the engine's error if there
+ * is neither. The engine's lock must be held.
+ */
+func (container *inMemoryContainer) stat(operation, filePath string) (*DockerContainerPathStat, error) {
+	
+	filePath = containerFilePath(filePath)
+	var stat = &DockerContainerPathStat{ Name: pathpkg.Base(filePath), Mtime: container.created }
+	if filePath == "/" { stat.Name = "." }
+	var content, isFile = container.files[filePath]
+	if isFile {
+		stat.Size = int64(len(content))
+		stat.Mode = 0644
+		return stat, nil
+	}
+	var prefix = strings.TrimSuffix(filePath, "/") + "/"
+	for otherPath, _ := range container.files {
+		if ! strings.HasPrefix(otherPath, prefix) { continue }
+		stat.Mode = os.ModeDir | 0755
+		return stat, nil
+	}
+	if filePath == "/" { stat.Mode = os.ModeDir | 0755; return stat, nil }
+	return nil, inMemoryEngineError(404, operation, fmt.Sprintf(
+		"Could not find the file %s in container %s", filePath, container.id))
+}
+
+/*
+ * Return a layer of all of the container's files. The engine's lock must be
+ * held.
+ */
+func (container *inMemoryContainer) filesLayer() []byte {
+	
+	var filePaths = make([]string, 0, len(container.files))
+	for filePath, _ := range container.files { filePaths = append(filePaths, filePath) }
+	sort.Strings(filePaths)
+	var buffer bytes.Buffer
+	var tarWriter = tar.NewWriter(&buffer)
+	for _, filePath := range filePaths {
+		var content = container.files[filePath]
+		tarWriter.WriteHeader(&tar.Header{ Name: strings.TrimPrefix(filePath, "/"), Mode: 0644,
+			Size: int64(len(content)), Typeflag: tar.TypeReg })
+		tarWriter.Write([]byte(content))
+	}
+	tarWriter.Close()
+	return buffer.Bytes()
+}
+
+/*******************************************************************************
+ * Image table operations. The lock must be held.
+ */
+
+/*
+ * Return the image that is named by "repo:tag" (the tag defaults to "latest"),
+ * by its Id, or by an unambiguous prefix of its Id; or nil.
+ */
+func (store *inMemoryEngineStore) resolve(imageName string) *inMemoryImage {
+	
+	var repoName, tag = splitImageNameAndTag(imageName)
+	var image = store.images[store.tags[repoName + ":" + tag]]
+	if image != nil { return image }
+	var idPrefix = strings.TrimPrefix(imageName, "sha256:")
+	if idPrefix == "" { return nil }
+	for id, candidate := range store.images {
+		if ! strings.HasPrefix(strings.TrimPrefix(id, "sha256:"), idPrefix) { continue }
+		if image != nil { return nil }  // ambiguous
+		image = candidate
+	}
+	return image
+}
+
+/*
+ * Add the image, unless there is already an image with its Id; return the
+ * engine's image.
+ */
+func (store *inMemoryEngineStore) addImage(image *inMemoryImage) *inMemoryImage {
+	
+	var existing = store.images[image.id]
+	if existing != nil { return existing }
+	store.images[image.id] = &inMemoryImage{
+		id: image.id,
+		config: image.config,
+		layers: image.layers,
+		created: image.created,
+		labels: image.labels,
+		repoTags: make([]string, 0),
+	}
+	return store.images[image.id]
+}
+
+/*
+ * Give the image the name "repo:tag", taking it from any other image.
+ */
+func (store *inMemoryEngineStore) tag(image *inMemoryImage, repoTag string) {
+	
+	if store.tags[repoTag] == image.id { return }
+	store.untag(repoTag)
+	store.tags[repoTag] = image.id
+	image.repoTags = append(image.repoTags, repoTag)
+	sort.Strings(image.repoTags)
+}
+
+func (store *inMemoryEngineStore) untag(repoTag string) {
+	
+	var image = store.images[store.tags[repoTag]]
+	delete(store.tags, repoTag)
+	if image == nil { return }
+	var repoTags = make([]string, 0, len(image.repoTags))
+	for _, t := range image.repoTags {
+		if t != repoTag { repoTags = append(repoTags, t) }
+	}
+	image.repoTags = repoTags
+}
+
+func (store *inMemoryEngineStore) remove(image *inMemoryImage) {
+	for _, repoTag := range image.repoTags { delete(store.tags, repoTag) }
+	delete(store.images, image.id)
+}
+
+/*
+ * Return the FROM image of a build, pulling it if the engine does not have it:
+ * from its registry, if the registry was added with AddRegistry, or otherwise
+ * as a simulated image with a single layer. The progress of a pull is written
+ * as the engine reports it. If the image cannot be pulled, return nil and the
+ * message of the failure.
+ */
+func (store *inMemoryEngineStore) pull(imageName string, options *DockerBuildOptions,
+	write func(*engineStreamMessage)) (*inMemoryImage, string) {
+	
+	var image = store.resolve(imageName)
+	if image != nil { return image, "" }
+	
+	var repoName, tag = splitImageNameAndTag(imageName)
+	write(&engineStreamMessage{ Status: "Pulling from " + repoName, Id: tag })
+	var registryHost = RegistryHostOfImage(imageName)
+	var registry = store.registries[registryHost]
+	if registry == nil {
+		image = newInMemoryImage([][]byte{ inMemoryLayer("base", repoName + ":" + tag) },
+			nil, []string{ "pulled " + repoName + ":" + tag }, time.Time{})
+	} else {
+		if ! registry.store.authorizes(options.RegistryAuths.Lookup(registryHost)) {
+			return nil, "Get https://" + registryHost + "/v2/: unauthorized: authentication required"
+		}
+		var layers, err = registry.store.layers(repoNameInRegistry(repoName), tag, "BuildImage")
+		if err != nil { return nil, "manifest for " + repoName + ":" + tag + " not found: " + err.Error() }
+		image = newInMemoryImage(layers, nil, nil, time.Time{})
+	}
+	write(&engineStreamMessage{ Status: "Pull complete", Id: image.shortId() })
+	write(&engineStreamMessage{ Status: "Status: Downloaded newer image for " + repoName + ":" + tag })
+	image = store.addImage(image)
+	store.tag(image, repoName + ":" + tag)
+	return image, ""
+}
+
+/*******************************************************************************
+ * Return the name of the image's repository within its registry, i.e., the
+ * image name without its registry host, if it has one.
+ */
+func repoNameInRegistry(imageName string) string {
+	
+	var slash = strings.Index(imageName, "/")
+	if slash == -1 { return imageName }
+	var first = imageName[:slash]
+	if (! strings.ContainsAny(first, ".:")) && (first != "localhost") { return imageName }
+	return imageName[slash+1:]
+}
+
+/*******************************************************************************
+ * Return the instructions of the dockerfile, with continuation lines joined,
+ * and without comments and empty lines.
+ */
+func dockerfileInstructions(dockerfile string) []string {
+	
+	var instructions = make([]string, 0)
+	var current = ""
+	for _, line := range strings.Split(dockerfile, "\n") {
+		line = strings.TrimSpace(line)
+		if (line == "") || strings.HasPrefix(line, "#") { continue }
+		if strings.HasSuffix(line, "\\") {
+			current = current + strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		instructions = append(instructions, current + line)
+		current = ""
+	}
+	if strings.TrimSpace(current) != "" { instructions = append(instructions, strings.TrimSpace(current)) }
+	return instructions
+}
+
+/*******************************************************************************
+ * Return the keyword of the instruction, in upper case, and its arguments.
+ */
+func splitDockerfileInstruction(instruction string) (keyword, arguments string) {
+	
+	var fields = strings.SplitN(strings.TrimSpace(instruction), " ", 2)
+	keyword = strings.ToUpper(fields[0])
+	if len(fields) > 1 { arguments = strings.TrimSpace(fields[1]) }
+	return keyword, arguments
+}
+
+/*******************************************************************************
+ * Add the labels of a LABEL instruction's arguments, key=value or key="value",
+ * to the map.
+ */
+func parseDockerfileLabels(arguments string, labels map[string]string) {
+	
+	for _, field := range strings.Fields(arguments) {
+		var equals = strings.Index(field, "=")
+		if equals == -1 { continue }
+		labels[strings.Trim(field[:equals], "\"")] = strings.Trim(field[equals+1:], "\"")
+	}
+}
+
+/*******************************************************************************
+ * Return true if the labels have each of the labels ("key" or "key=value") of
+ * withLabels, and none of those of withoutLabels.
+ */
+func labelsMatch(labels map[string]string, withLabels, withoutLabels []string) bool {
+	
+	var has = func(filter string) bool {
+		var key, value = filter, ""
+		var equals = strings.Index(filter, "=")
+		if equals != -1 { key, value = filter[:equals], filter[equals+1:] }
+		var actual, isSet = labels[key]
+		return isSet && ((equals == -1) || (actual == value))
+	}
+	for _, filter := range withLabels {
+		if ! has(filter) { return false }
+	}
+	for _, filter := range withoutLabels {
+		if has(filter) { return false }
+	}
+	return true
+}
+
+func inMemoryShortDigest(text string) string {
+	var sum = sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])[:12]
+}
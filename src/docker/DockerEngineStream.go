@@ -0,0 +1,100 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"encoding/json"
+)
+
+/*******************************************************************************
+ * The docker engine returns the progress of long running operations (build,
+ * push, pull, load, import) as a stream of concatenated JSON objects, e.g.,
+	{"status":"Loading layer","progressDetail":{"current":32768,"total":1292800},"id":"8ac8bfaff55a"}
+	{"stream":"Loaded image: busybox:latest\n"}
+	{"errorDetail":{"message":"open /var/lib/docker/tmp/...: no such file or directory"},"error":"open ..."}
+ * An engineStreamMessage holds one of those objects.
+ */
+type engineStreamMessage struct {
+	Stream string `json:"stream,omitempty"`
+	Status string `json:"status,omitempty"`
+	Id string `json:"id,omitempty"`
+	Progress string `json:"progress,omitempty"`
+	ProgressDetail *engineProgressDetail `json:"progressDetail,omitempty"`
+	Error string `json:"error,omitempty"`
+	ErrorDetail *engineErrorDetail `json:"errorDetail,omitempty"`
+	Aux json.RawMessage `json:"aux,omitempty"`
+}
+
+type engineProgressDetail struct {
+	Current int64 `json:"current,omitempty"`
+	Total int64 `json:"total,omitempty"`
+}
+
+type engineErrorDetail struct {
+	Code int `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+/*******************************************************************************
+ * An error that the engine reported within a JSON stream. The engine usually
+ * returns a 200 status for streamed operations before it knows the outcome, so
+ * failures arrive as an "error" message in the body rather than as a status.
+ */
+type DockerEngineStreamError struct {
+	Operation string
+	Code int
+	Message string
+	Detail string
+}
+
+func (streamErr *DockerEngineStreamError) Error() string {
+	var s = streamErr.Message
+	if (streamErr.Detail != "") && (streamErr.Detail != streamErr.Message) {
+		s = s + "; " + streamErr.Detail
+	}
+	if streamErr.Code != 0 { s = fmt.Sprintf("%s (code %d)", s, streamErr.Code) }
+	if streamErr.Operation != "" { s = s + "; during " + streamErr.Operation }
+	return s
+}
+
+/*******************************************************************************
+ * If the message is an error message, return it as a DockerEngineStreamError;
+ * otherwise return nil.
+ */
+func (msg *engineStreamMessage) asError(operation string) error {
+	if (msg.Error == "") && (msg.ErrorDetail == nil) { return nil }
+	var streamErr = &DockerEngineStreamError{
+		Operation: operation,
+		Message: msg.Error,
+	}
+	if msg.ErrorDetail != nil {
+		streamErr.Code = msg.ErrorDetail.Code
+		streamErr.Detail = msg.ErrorDetail.Message
+		if streamErr.Message == "" { streamErr.Message = msg.ErrorDetail.Message }
+	}
+	return streamErr
+}
+
+/*******************************************************************************
+ * Decode each JSON message in the specified engine response stream, and pass
+ * it to the handler. Decoding stops at the end of the stream, when the handler
+ * returns an error, or when the engine reports an error in the stream - in
+ * which case a DockerEngineStreamError is returned.
+ */
+func readEngineStream(body io.Reader, operation string,
+	handler func(*engineStreamMessage) error) error {
+	
+	var decoder = json.NewDecoder(body)
+	for {
+		var msg = &engineStreamMessage{}
+		var err error = decoder.Decode(msg)
+		if err == io.EOF { return nil }
+		if err != nil { return err }
+		
+		err = msg.asError(operation)
+		if err != nil { return err }
+		
+		err = handler(msg)
+		if err != nil { return err }
+	}
+}
@@ -0,0 +1,213 @@
+package docker
+
+import (
+	"io"
+	"net"
+	"bytes"
+	"errors"
+	"context"
+	"strings"
+	"syscall"
+	"time"
+	"net/http"
+	"encoding/json"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * Errors returned by engine and registry operations are classified by kind, so
+ * that callers can distinguish, e.g., an image that does not exist from a
+ * registry that is down. Test for a kind with errors.Is,
+	if errors.Is(err, docker.ErrNotFound) { ... }
+ * and obtain the details (HTTP status, registry error codes, operation) with
+ * errors.As,
+	var dockerErr *docker.DockerError
+	if errors.As(err, &dockerErr) { ... dockerErr.StatusCode ... }
+ */
+var (
+	ErrNotFound = errors.New("not found")  // image, manifest, blob, repository or container does not exist
+	ErrUnauthorized = errors.New("unauthorized")  // credentials are missing or were rejected
+	ErrDenied = errors.New("denied")  // the credentials do not permit the operation
+	ErrConflict = errors.New("conflict")  // e.g., an image is in use, or a name is taken
+	ErrDigestMismatch = errors.New("digest mismatch")  // content does not match its digest or size
+	ErrUnsupported = errors.New("unsupported")  // the server does not support the operation
+	ErrTransient = errors.New("transient")  // the server is unavailable or busy; a retry may succeed
+)
+
+/*******************************************************************************
+ * A failed engine or registry operation. Kind is one of the Err... values
+ * above, or nil if the failure is of none of those kinds.
+ */
+type DockerError struct {
+	Kind error
+	Operation string  // e.g., "GetImageInfo"
+	StatusCode int  // HTTP status of the response, or 0 if there was no response
+	Codes []string  // registry error codes, e.g., "MANIFEST_UNKNOWN"
+	Message string
+	Err error  // the underlying error
+	RetryAfter time.Duration  // how long the server asked that a retry wait, or 0 (see serverRetryDelay)
+}
+
+func (dockerErr *DockerError) Error() string {
+	if (dockerErr.Message == "") && (dockerErr.Err != nil) { return dockerErr.Err.Error() }
+	return dockerErr.Message
+}
+
+/*******************************************************************************
+ * A DockerError is its kind, for errors.Is.
+ */
+func (dockerErr *DockerError) Is(target error) bool {
+	return (dockerErr.Kind != nil) && (target == dockerErr.Kind)
+}
+
+func (dockerErr *DockerError) Unwrap() error {
+	return dockerErr.Err
+}
+
+/*******************************************************************************
+ * Return true if the error is of a kind for which retrying the operation may
+ * succeed.
+ */
+func IsTransientError(err error) bool {
+	return errors.Is(err, ErrTransient)
+}
+
+/*******************************************************************************
+ * The error body of a registry response. See,
+ * https://github.com/docker/distribution/blob/master/docs/spec/api.md#errors
+	{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown","detail":{...}}]}
+ * The engine's error body is,
+	{"message":"No such image: busybox:foo"}
+ */
+type responseErrorBody struct {
+	Errors []struct {
+		Code string `json:"code"`
+		Message string `json:"message"`
+		Detail json.RawMessage `json:"detail"`
+	} `json:"errors"`
+	Message string `json:"message"`
+}
+
+/*******************************************************************************
+ * Return nil if the response has a success status; otherwise return a
+ * DockerError that describes the failure, classified by the registry error
+ * codes of the body, if any, or else by the HTTP status. The message is as
+ * for utilities.GenerateError, followed by the server's explanation. The
+ * response body is read, but remains readable by the caller.
+ */
+func generateResponseError(response *http.Response, operation, message string) error {
+	
+	var err = utilities.GenerateError(response.StatusCode, message)
+	if err == nil { return nil }
+	
+	var dockerErr = &DockerError{
+		Kind: kindForStatus(response.StatusCode),
+		Operation: operation,
+		StatusCode: response.StatusCode,
+		Codes: make([]string, 0),
+		Message: message,
+		Err: err,
+		RetryAfter: serverRetryDelay(response.Header, time.Now()),
+	}
+	if response.Body == nil { return dockerErr }
+	
+	var body []byte
+	body, _ = io.ReadAll(io.LimitReader(response.Body, 64 * 1024))
+	response.Body.Close()
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	
+	var errorBody = &responseErrorBody{}
+	if json.Unmarshal(body, errorBody) != nil {
+		var text = strings.TrimSpace(string(body))
+		if text != "" { dockerErr.Message = message + ": " + text }
+		return dockerErr
+	}
+	var explanations = make([]string, 0)
+	if errorBody.Message != "" { explanations = append(explanations, errorBody.Message) }
+	for _, registryErr := range errorBody.Errors {
+		dockerErr.Codes = append(dockerErr.Codes, registryErr.Code)
+		var explanation = registryErr.Code + ": " + registryErr.Message
+		if (len(registryErr.Detail) > 0) && (string(registryErr.Detail) != "null") {
+			explanation = explanation + " (" + string(registryErr.Detail) + ")"
+		}
+		explanations = append(explanations, explanation)
+	}
+	if len(explanations) > 0 { dockerErr.Message = message + ": " + strings.Join(explanations, "; ") }
+	for _, code := range dockerErr.Codes {
+		var kind = kindForRegistryCode(code)
+		if kind != nil { dockerErr.Kind = kind; break }
+	}
+	return dockerErr
+}
+
+func kindForStatus(statusCode int) error {
+	switch statusCode {
+		case http.StatusNotFound: return ErrNotFound
+		case http.StatusUnauthorized: return ErrUnauthorized
+		case http.StatusForbidden: return ErrDenied
+		case http.StatusConflict: return ErrConflict
+		case http.StatusMethodNotAllowed, http.StatusNotImplemented: return ErrUnsupported
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout: return ErrTransient
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Classify a registry error code. See the error codes of the registry API spec.
+ */
+func kindForRegistryCode(code string) error {
+	switch code {
+		case "BLOB_UNKNOWN", "BLOB_UPLOAD_UNKNOWN", "MANIFEST_UNKNOWN", "NAME_UNKNOWN":
+			return ErrNotFound
+		case "UNAUTHORIZED": return ErrUnauthorized
+		case "DENIED": return ErrDenied
+		case "DIGEST_INVALID", "SIZE_INVALID", "MANIFEST_BLOB_UNKNOWN": return ErrDigestMismatch
+		case "UNSUPPORTED": return ErrUnsupported
+		case "TOOMANYREQUESTS", "UNAVAILABLE": return ErrTransient
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Classify an error that occurred in sending a request or receiving its
+ * response: failures to connect, resets and timeouts are transient. Context
+ * errors, and nil, are returned unchanged, as is a missing socket file (the
+ * engine is not installed or not running, which a retry will not change).
+ */
+func transportError(err error, operation string) error {
+	
+	if err == nil { return nil }
+	var dockerErr *DockerError
+	if errors.As(err, &dockerErr) { return err }
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) { return err }
+	if errors.Is(err, syscall.ENOENT) { return err }
+	
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return &DockerError{
+			Kind: ErrTransient,
+			Operation: operation,
+			Codes: make([]string, 0),
+			Message: err.Error() + "; during " + operation,
+			Err: err,
+		}
+	}
+	return err
+}
+
+/*******************************************************************************
+ * Return an error of the specified kind.
+ */
+func newDockerError(kind error, operation, message string) *DockerError {
+	return &DockerError{
+		Kind: kind,
+		Operation: operation,
+		Codes: make([]string, 0),
+		Message: message,
+		Err: utilities.ConstructServerError(message),
+	}
+}
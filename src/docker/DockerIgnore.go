@@ -0,0 +1,190 @@
+package docker
+
+import (
+	"io"
+	"os"
+	"bufio"
+	"regexp"
+	"strings"
+	"path/filepath"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * The exclusion patterns of a .dockerignore file. The semantics are those of
+ * the docker CLI (see github.com/moby/patternmatcher):
+ *	- Each line is a pattern. Lines beginning with '#' are comments.
+ *	- Patterns are relative to the root of the build context; a leading '/'
+ *		is ignored, and each pattern is cleaned as a file path is.
+ *	- '*' matches any sequence of characters other than '/', '?' matches any
+ *		one character other than '/', and [...] matches a character class.
+ *	- "**" matches any number of directories, including none.
+ *	- A pattern that matches a directory matches everything within it.
+ *	- A pattern that begins with '!' is an exception: it re-includes files
+ *		that an earlier pattern excluded. The last matching pattern wins.
+ */
+type DockerIgnore struct {
+	patterns []*dockerignorePattern
+	hasExceptions bool
+}
+
+type dockerignorePattern struct {
+	text string
+	exception bool
+	dirCount int  // number of path components in the pattern
+	regexp *regexp.Regexp
+}
+
+/*******************************************************************************
+ * Parse the content of a .dockerignore file.
+ */
+func ParseDockerIgnore(reader io.Reader) (*DockerIgnore, error) {
+	
+	var dockerIgnore = &DockerIgnore{
+		patterns: make([]*dockerignorePattern, 0),
+	}
+	var scanner = bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var line = strings.TrimSpace(scanner.Text())
+		if line == "" { continue }
+		if strings.HasPrefix(line, "#") { continue }
+		
+		var exception = false
+		if strings.HasPrefix(line, "!") {
+			exception = true
+			line = strings.TrimSpace(line[1:])
+			if line == "" { return nil, utilities.ConstructUserError(
+				"Illegal exclusion pattern in .dockerignore: \"!\"") }
+		}
+		line = filepath.ToSlash(filepath.Clean(line))
+		line = strings.TrimPrefix(line, "/")
+		if line == "" { line = "." }
+		
+		var re *regexp.Regexp
+		var err error
+		re, err = regexp.Compile(dockerignorePatternToRegexp(line))
+		if err != nil { return nil, utilities.ConstructUserError(
+			"Illegal pattern in .dockerignore: '" + line + "': " + err.Error()) }
+		
+		dockerIgnore.patterns = append(dockerIgnore.patterns, &dockerignorePattern{
+			text: line,
+			exception: exception,
+			dirCount: len(strings.Split(line, "/")),
+			regexp: re,
+		})
+		if exception { dockerIgnore.hasExceptions = true }
+	}
+	var err = scanner.Err()
+	if err != nil { return nil, err }
+	return dockerIgnore, nil
+}
+
+/*******************************************************************************
+ * Read the .dockerignore file that applies to the specified build directory and
+ * dockerfile: <dockerfile>.dockerignore if it exists, otherwise .dockerignore at
+ * the root of the build directory. If there is neither, an empty DockerIgnore
+ * (which excludes nothing) is returned.
+ */
+func ReadDockerIgnore(buildDirPath, dockerfileName string) (*DockerIgnore, error) {
+	
+	var paths = []string{
+		filepath.Join(buildDirPath, filepath.FromSlash(dockerfileName) + ".dockerignore"),
+		filepath.Join(buildDirPath, ".dockerignore"),
+	}
+	for _, path := range paths {
+		var file *os.File
+		var err error
+		file, err = os.Open(path)
+		if os.IsNotExist(err) { continue }
+		if err != nil { return nil, err }
+		defer file.Close()
+		return ParseDockerIgnore(file)
+	}
+	return &DockerIgnore{ patterns: make([]*dockerignorePattern, 0) }, nil
+}
+
+/*******************************************************************************
+ * Return true if the specified path, relative to the root of the build context
+ * and using '/' as the separator, is excluded.
+ */
+func (dockerIgnore *DockerIgnore) Excludes(relPath string) bool {
+	
+	relPath = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(relPath)), "/")
+	var parentDirs = strings.Split(relPath, "/")
+	var excluded = false
+	for _, pattern := range dockerIgnore.patterns {
+		// An exclusion cannot change an excluded path, and an exception cannot
+		// change an included one.
+		if pattern.exception != excluded { continue }
+		
+		var matched = pattern.regexp.MatchString(relPath)
+		if (! matched) && (pattern.dirCount < len(parentDirs)) {
+			// Check whether the pattern matches one of the path's parent directories.
+			matched = pattern.regexp.MatchString(strings.Join(parentDirs[:pattern.dirCount], "/"))
+		}
+		if matched { excluded = ! pattern.exception }
+	}
+	return excluded
+}
+
+/*******************************************************************************
+ * Return true if there are exception ("!") patterns, in which case a file
+ * within an excluded directory might be re-included.
+ */
+func (dockerIgnore *DockerIgnore) HasExceptions() bool {
+	return dockerIgnore.hasExceptions
+}
+
+/*******************************************************************************
+ * Translate a dockerignore pattern into an anchored regular expression.
+ */
+func dockerignorePatternToRegexp(pattern string) string {
+	
+	var regStr = "^"
+	var runes = []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		var ch = runes[i]
+		switch {
+			case ch == '*':
+				if (i+1 < len(runes)) && (runes[i+1] == '*') {
+					i++
+					// Treat "**/" as "**", so that it matches zero directories too.
+					if (i+1 < len(runes)) && (runes[i+1] == '/') { i++ }
+					if i+1 == len(runes) {
+						regStr = regStr + ".*"
+					} else {
+						regStr = regStr + "(.*/)?"
+					}
+				} else {
+					regStr = regStr + "[^/]*"
+				}
+				
+			case ch == '?':
+				regStr = regStr + "[^/]"
+				
+			case ch == '[':
+				// Character class: pass through, translating a leading '!' to '^'.
+				var end = strings.IndexRune(string(runes[i+1:]), ']')
+				if end == -1 {
+					regStr = regStr + "\\["
+					continue
+				}
+				var class = string(runes[i+1:])[:end]
+				if strings.HasPrefix(class, "!") { class = "^" + class[1:] }
+				regStr = regStr + "[" + strings.Replace(class, "\\", "\\\\", -1) + "]"
+				i = i + len([]rune(string(runes[i+1:])[:end])) + 1
+				
+			case ch == '\\':
+				// Escape the next character.
+				if i+1 < len(runes) {
+					i++
+					regStr = regStr + regexp.QuoteMeta(string(runes[i]))
+				}
+				
+			default:
+				regStr = regStr + regexp.QuoteMeta(string(ch))
+		}
+	}
+	return regStr + "$"
+}
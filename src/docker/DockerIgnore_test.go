@@ -0,0 +1,36 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+)
+
+/*******************************************************************************
+ * Check which paths a .dockerignore file excludes.
+ */
+func TestDockerIgnoreExcludes(t *testing.T) {
+	
+	var dockerIgnore, err = ParseDockerIgnore(strings.NewReader(
+		"# comment\n.git\n**/*.key\nsecrets/\n!secrets/public.key\n/build/*.o\nlog?.txt\n"))
+	if err != nil { t.Fatal(err) }
+	if ! dockerIgnore.HasExceptions() { t.Error("HasExceptions: expected true") }
+	
+	var cases = map[string]bool{
+		".git": true,
+		".git/config": true,
+		"c.key": true,
+		"a/b/c.key": true,
+		"secrets/x": true,
+		"secrets/public.key": false,
+		"build/a.o": true,
+		"build/sub/a.o": false,
+		"log1.txt": true,
+		"log12.txt": false,
+		"src/main.go": false,
+	}
+	for relPath, expected := range cases {
+		if dockerIgnore.Excludes(relPath) != expected {
+			t.Errorf("Excludes(%q): expected %v", relPath, expected)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+	"bytes"
+	"context"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * InMemoryDockerEngine and InMemoryDockerRegistry implement DockerEngine and
+ * DockerRegistry without a docker daemon or a registry, for testing code that
+ * uses those interfaces, such as DockerServices. Each records the calls that
+ * are made to it, and can be made to fail any operation with a specified
+ * error. For example,
+	var registry = docker.NewInMemoryDockerRegistry("registry.example.com:5000", "", "")
+	var engine = docker.NewInMemoryDockerEngine()
+	registry.InjectErrorOnce("PushManifest", someErr)
+	var dockerSvcs = docker.NewDockerServices(registry, engine)
+	_, err = dockerSvcs.BuildDockerfile(...)
+	... engine.CallsOf("BuildImageWithOptions") ...
+ * Operations are named as the methods that perform them. Failures that the
+ * real implementations report - an image that does not exist, a tag that is
+ * taken, a blob that a manifest refers to but the registry does not have - are
+ * reported by the in-memory ones as a DockerError of the same kind and HTTP
+ * status. Copies that are made with WithContext share the content, calls and
+ * injected errors of the original.
+ */
+
+/*******************************************************************************
+ * A call made to an in-memory engine or registry.
+ */
+type DockerCall struct {
+	Operation string  // the method, e.g., "GetImageInfo"
+	Args []interface{}  // the arguments, other than readers and handlers
+}
+
+/*******************************************************************************
+ * The calls made to an in-memory engine or registry, and the errors to inject.
+ */
+type inMemoryCalls struct {
+	lock sync.Mutex
+	calls []DockerCall
+	errors map[string]error  // returned by every call of the operation
+	onceErrors map[string][]error  // returned by the next calls of the operation, in turn
+}
+
+func newInMemoryCalls() *inMemoryCalls {
+	return &inMemoryCalls{
+		calls: make([]DockerCall, 0),
+		errors: make(map[string]error),
+		onceErrors: make(map[string][]error),
+	}
+}
+
+/*******************************************************************************
+ * Return the calls made so far, in the order in which they were made.
+ */
+func (calls *inMemoryCalls) Calls() []DockerCall {
+	calls.lock.Lock()
+	defer calls.lock.Unlock()
+	return append([]DockerCall{}, calls.calls...)
+}
+
+/*******************************************************************************
+ * Return the calls made so far of the specified operation.
+ */
+func (calls *inMemoryCalls) CallsOf(operation string) []DockerCall {
+	
+	calls.lock.Lock()
+	defer calls.lock.Unlock()
+	var result = make([]DockerCall, 0)
+	for _, call := range calls.calls {
+		if call.Operation == operation { result = append(result, call) }
+	}
+	return result
+}
+
+func (calls *inMemoryCalls) ResetCalls() {
+	calls.lock.Lock()
+	defer calls.lock.Unlock()
+	calls.calls = make([]DockerCall, 0)
+}
+
+/*******************************************************************************
+ * Make every call of the specified operation fail with the error, until
+ * ClearInjectedErrors is called. A nil error ends the failures.
+ */
+func (calls *inMemoryCalls) InjectError(operation string, err error) {
+	calls.lock.Lock()
+	defer calls.lock.Unlock()
+	if err == nil { delete(calls.errors, operation) } else { calls.errors[operation] = err }
+}
+
+/*******************************************************************************
+ * Make the next call of the specified operation fail with the error. If this
+ * is called several times, the next calls fail with the errors in turn. Errors
+ * injected with InjectErrorOnce take precedence over those of InjectError.
+ */
+func (calls *inMemoryCalls) InjectErrorOnce(operation string, err error) {
+	calls.lock.Lock()
+	defer calls.lock.Unlock()
+	calls.onceErrors[operation] = append(calls.onceErrors[operation], err)
+}
+
+func (calls *inMemoryCalls) ClearInjectedErrors() {
+	calls.lock.Lock()
+	defer calls.lock.Unlock()
+	calls.errors = make(map[string]error)
+	calls.onceErrors = make(map[string][]error)
+}
+
+/*******************************************************************************
+ * Record a call of the operation, and return the error with which it is to
+ * fail, if any: the context's error, if the context has ended, or else an
+ * injected error.
+ */
+func (calls *inMemoryCalls) record(ctx context.Context, operation string, args ...interface{}) error {
+	
+	calls.lock.Lock()
+	defer calls.lock.Unlock()
+	calls.calls = append(calls.calls, DockerCall{ Operation: operation, Args: args })
+	if (ctx != nil) && (ctx.Err() != nil) { return ctx.Err() }
+	var queued = calls.onceErrors[operation]
+	if len(queued) > 0 {
+		calls.onceErrors[operation] = queued[1:]
+		return queued[0]
+	}
+	return calls.errors[operation]
+}
+
+/*******************************************************************************
+ * Return an error as the engine's response of the specified status would be
+ * reported, e.g., "404 Not Found: No such image: busybox:foo".
+ */
+func inMemoryEngineError(statusCode int, operation, explanation string) *DockerError {
+	
+	var dockerErr = newDockerError(kindForStatus(statusCode), operation,
+		fmt.Sprintf("%d %s: %s", statusCode, http.StatusText(statusCode), explanation))
+	dockerErr.StatusCode = statusCode
+	return dockerErr
+}
+
+/*******************************************************************************
+ * Return an error as the registry's response of the specified status and
+ * registry error code would be reported.
+ */
+func inMemoryRegistryError(statusCode int, code, operation, message, explanation string) *DockerError {
+	
+	var dockerErr = newDockerError(kindForRegistryCode(code), operation,
+		fmt.Sprintf("%d %s; %s: %s: %s", statusCode, http.StatusText(statusCode),
+			message, code, explanation))
+	dockerErr.StatusCode = statusCode
+	dockerErr.Codes = []string{ code }
+	return dockerErr
+}
+
+/*******************************************************************************
+ * Return the digest, "sha256:<hex>", of the content.
+ */
+func inMemoryDigest(content []byte) string {
+	var sum = sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+/*******************************************************************************
+ * Return a layer: a tar archive that contains a single file.
+ */
+func inMemoryLayer(fileName string, content string) []byte {
+	
+	var buffer bytes.Buffer
+	var tarWriter = tar.NewWriter(&buffer)
+	tarWriter.WriteHeader(&tar.Header{
+		Name: fileName,
+		Mode: 0644,
+		Size: int64(len(content)),
+		Typeflag: tar.TypeReg,
+	})
+	tarWriter.Write([]byte(content))
+	tarWriter.Close()
+	return buffer.Bytes()
+}
+
+/*******************************************************************************
+ * Return the value as it would be decoded from its JSON encoding by
+ * rest.ParseResponseBodyToMap - i.e., with numbers as float64 and arrays as
+ * []interface{}.
+ */
+func inMemoryJSONMap(value interface{}) (map[string]interface{}, error) {
+	
+	var encoded, err = json.Marshal(value)
+	if err != nil { return nil, err }
+	var decoded map[string]interface{}
+	err = json.Unmarshal(encoded, &decoded)
+	if err != nil { return nil, err }
+	return decoded, nil
+}
+
+/*******************************************************************************
+ * An image, as the in-memory engine holds it, and as it is written to and read
+ * from an image archive.
+ */
+type inMemoryImage struct {
+	id string  // "sha256:<hex digest of config>"
+	config []byte  // the image config, in JSON
+	layers [][]byte  // the tar archive of each layer, base layer first
+	created time.Time
+	labels map[string]string
+	repoTags []string  // "repo:tag"
+}
+
+/*******************************************************************************
+ * The image config, as in an image archive. See,
+ * https://github.com/moby/moby/blob/master/image/spec/v1.2.md
+ */
+type inMemoryImageConfig struct {
+	Architecture string `json:"architecture"`
+	OS string `json:"os"`
+	Created time.Time `json:"created"`
+	Config struct {
+		Labels map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type string `json:"type"`
+		DiffIds []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []inMemoryImageHistory `json:"history,omitempty"`
+}
+
+type inMemoryImageHistory struct {
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+/*******************************************************************************
+ * Return a new image with the specified layers. The history lists the command
+ * that created each step of the image.
+ */
+func newInMemoryImage(layers [][]byte, labels map[string]string, history []string,
+	created time.Time) *inMemoryImage {
+	
+	var config = &inMemoryImageConfig{ Architecture: "amd64", OS: "linux", Created: created }
+	config.Config.Labels = labels
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIds = make([]string, len(layers))
+	for i, layer := range layers { config.RootFS.DiffIds[i] = inMemoryDigest(layer) }
+	for _, createdBy := range history {
+		config.History = append(config.History, inMemoryImageHistory{ CreatedBy: createdBy })
+	}
+	var configBytes, _ = json.Marshal(config)
+	return &inMemoryImage{
+		id: inMemoryDigest(configBytes),
+		config: configBytes,
+		layers: layers,
+		created: created,
+		labels: labels,
+		repoTags: make([]string, 0),
+	}
+}
+
+/*******************************************************************************
+ * Return the image that is described by an image archive's config.
+ */
+func inMemoryImageFromConfig(configBytes []byte, layers [][]byte) (*inMemoryImage, error) {
+	
+	var config = &inMemoryImageConfig{}
+	var err = json.Unmarshal(configBytes, config)
+	if err != nil { return nil, utilities.ConstructUserError(
+		"Image config in archive is not valid: " + err.Error()) }
+	return &inMemoryImage{
+		id: inMemoryDigest(configBytes),
+		config: configBytes,
+		layers: layers,
+		created: config.Created,
+		labels: config.Config.Labels,
+		repoTags: make([]string, 0),
+	}, nil
+}
+
+func (image *inMemoryImage) size() int64 {
+	var size int64 = 0
+	for _, layer := range image.layers { size = size + int64(len(layer)) }
+	return size
+}
+
+func (image *inMemoryImage) shortId() string {
+	var id = strings.TrimPrefix(image.id, "sha256:")
+	if len(id) > 12 { return id[:12] }
+	return id
+}
+
+/*******************************************************************************
+ * Return the names of the layer directories of the image's archive: the
+ * digest of the layer's diff Id and that of its parent, as in the archives of
+ * "docker save".
+ */
+func (image *inMemoryImage) layerDirNames() []string {
+	
+	var names = make([]string, len(image.layers))
+	var parent = ""
+	for i, layer := range image.layers {
+		var sum = sha256.Sum256([]byte(parent + " " + inMemoryDigest(layer)))
+		names[i] = hex.EncodeToString(sum[:])
+		parent = names[i]
+	}
+	return names
+}
+
+/*******************************************************************************
+ * Write the image as an image archive, in the format of "docker save" (and of
+ * DockerEngine.GetImage), with the specified names ("repo:tag"):
+	<layer>/VERSION, <layer>/json, <layer>/layer.tar - for each layer
+	<image Id>.json - the image config
+	manifest.json - [{"Config":"<image Id>.json","RepoTags":[...],"Layers":[...]}]
+	repositories - {"<repo>":{"<tag>":"<top layer>"}}
+ */
+func writeImageArchive(writer io.Writer, image *inMemoryImage, repoTags []string) error {
+	
+	var tarWriter = tar.NewWriter(writer)
+	var writeFile = func(name string, content []byte) error {
+		var err = tarWriter.WriteHeader(&tar.Header{ Name: name, Mode: 0644,
+			Size: int64(len(content)), Typeflag: tar.TypeReg, ModTime: image.created })
+		if err != nil { return err }
+		_, err = tarWriter.Write(content)
+		return err
+	}
+	
+	var dirNames = image.layerDirNames()
+	var layerPaths = make([]string, len(dirNames))
+	var err error
+	for i, dirName := range dirNames {
+		err = tarWriter.WriteHeader(&tar.Header{ Name: dirName + "/", Mode: 0755,
+			Typeflag: tar.TypeDir, ModTime: image.created })
+		if err != nil { return err }
+		err = writeFile(dirName + "/VERSION", []byte("1.0"))
+		if err != nil { return err }
+		var layerJSON = map[string]string{ "id": dirName }
+		if i > 0 { layerJSON["parent"] = dirNames[i-1] }
+		var layerJSONBytes, _ = json.Marshal(layerJSON)
+		err = writeFile(dirName + "/json", layerJSONBytes)
+		if err != nil { return err }
+		layerPaths[i] = dirName + "/layer.tar"
+		err = writeFile(layerPaths[i], image.layers[i])
+		if err != nil { return err }
+	}
+	
+	var configName = strings.TrimPrefix(image.id, "sha256:") + ".json"
+	err = writeFile(configName, image.config)
+	if err != nil { return err }
+	var manifest = []map[string]interface{}{{
+		"Config": configName,
+		"RepoTags": repoTags,
+		"Layers": layerPaths,
+	}}
+	var manifestBytes, _ = json.Marshal(manifest)
+	err = writeFile("manifest.json", manifestBytes)
+	if err != nil { return err }
+	
+	if (len(repoTags) > 0) && (len(dirNames) > 0) {
+		var repositories = make(map[string]map[string]string)
+		for _, repoTag := range repoTags {
+			var repoName, tag = splitImageNameAndTag(repoTag)
+			if repositories[repoName] == nil { repositories[repoName] = make(map[string]string) }
+			repositories[repoName][tag] = dirNames[len(dirNames)-1]
+		}
+		var repositoriesBytes, _ = json.Marshal(repositories)
+		err = writeFile("repositories", repositoriesBytes)
+		if err != nil { return err }
+	}
+	return tarWriter.Close()
+}
+
+/*******************************************************************************
+ * Read the images of an image archive. The images are described by the
+ * archive's manifest.json, if it has one (as archives of docker 1.10 and later
+ * do); otherwise the archive must be of the older format, with a repositories
+ * file, and the layers are ordered by the parents that their json files name.
+ */
+func readImageArchive(reader io.Reader) ([]*inMemoryImage, error) {
+	
+	var files = make(map[string][]byte)
+	var tarReader = tar.NewReader(reader)
+	for {
+		var header, err = tarReader.Next()
+		if err == io.EOF { break }
+		if err != nil { return nil, utilities.ConstructUserError(
+			"Image archive is not a valid tar archive: " + err.Error()) }
+		if header.Typeflag != tar.TypeReg { continue }
+		var content []byte
+		content, err = ioutil.ReadAll(tarReader)
+		if err != nil { return nil, err }
+		files[strings.TrimPrefix(header.Name, "./")] = content
+	}
+	
+	if files["manifest.json"] != nil {
+		var manifest []struct {
+			Config string
+			RepoTags []string
+			Layers []string
+		}
+		var err = json.Unmarshal(files["manifest.json"], &manifest)
+		if err != nil { return nil, utilities.ConstructUserError(
+			"manifest.json of image archive is not valid: " + err.Error()) }
+		var images = make([]*inMemoryImage, 0)
+		for _, entry := range manifest {
+			var layers = make([][]byte, len(entry.Layers))
+			for i, layerPath := range entry.Layers {
+				layers[i] = files[layerPath]
+				if layers[i] == nil { return nil, utilities.ConstructUserError(
+					"Image archive does not contain layer " + layerPath) }
+			}
+			if files[entry.Config] == nil { return nil, utilities.ConstructUserError(
+				"Image archive does not contain config " + entry.Config) }
+			var image *inMemoryImage
+			image, err = inMemoryImageFromConfig(files[entry.Config], layers)
+			if err != nil { return nil, err }
+			image.repoTags = append(image.repoTags, entry.RepoTags...)
+			images = append(images, image)
+		}
+		return images, nil
+	}
+	
+	if files["repositories"] == nil { return nil, utilities.ConstructUserError(
+		"Image archive has neither a manifest.json nor a repositories file") }
+	var repositories map[string]map[string]string
+	var err = json.Unmarshal(files["repositories"], &repositories)
+	if err != nil { return nil, utilities.ConstructUserError(
+		"repositories file of image archive is not valid: " + err.Error()) }
+	
+	// Order the layers from the base layer, whose json names no parent.
+	var parents = make(map[string]string)
+	var dirNames = make([]string, 0)
+	for name, _ := range files {
+		if ! strings.HasSuffix(name, "/layer.tar") { continue }
+		var dirName = strings.TrimSuffix(name, "/layer.tar")
+		dirNames = append(dirNames, dirName)
+		var layerJSON struct { Parent string `json:"parent"` }
+		json.Unmarshal(files[dirName + "/json"], &layerJSON)
+		parents[dirName] = layerJSON.Parent
+	}
+	sort.Strings(dirNames)
+	var children = make(map[string]string)
+	for _, dirName := range dirNames { children[parents[dirName]] = dirName }
+	var layers = make([][]byte, 0, len(dirNames))
+	var history = make([]string, 0, len(dirNames))
+	for dirName := children[""]; dirName != ""; dirName = children[dirName] {
+		layers = append(layers, files[dirName + "/layer.tar"])
+		history = append(history, dirName)
+		if len(layers) > len(dirNames) { break }  // the parents form a cycle
+	}
+	if len(layers) != len(dirNames) {  // the parents are not recorded
+		layers = layers[:0]
+		for _, dirName := range dirNames { layers = append(layers, files[dirName + "/layer.tar"]) }
+	}
+	
+	var image = newInMemoryImage(layers, nil, history, time.Time{})
+	var repoNames = make([]string, 0, len(repositories))
+	for repoName, _ := range repositories { repoNames = append(repoNames, repoName) }
+	sort.Strings(repoNames)
+	for _, repoName := range repoNames {
+		for tag, _ := range repositories[repoName] {
+			image.repoTags = append(image.repoTags, repoName + ":" + tag)
+		}
+	}
+	sort.Strings(image.repoTags)
+	return []*inMemoryImage{ image }, nil
+}
+
+/*******************************************************************************
+ * Split an image name into its repo and its tag, which is "latest" if the name
+ * has none. A registry host's port is not taken as a tag.
+ */
+func splitImageNameAndTag(imageName string) (repoName, tag string) {
+	
+	var colon = strings.LastIndex(imageName, ":")
+	if (colon == -1) || strings.Contains(imageName[colon+1:], "/") { return imageName, "latest" }
+	return imageName[:colon], imageName[colon+1:]
+}
@@ -0,0 +1,40 @@
+package docker
+
+import (
+	"strings"
+)
+
+/*******************************************************************************
+ * The result of loading an image tar archive into the engine. Produced by
+ * parsing the JSON stream returned by the engine's images/load function.
+ */
+type DockerLoadOutput struct {
+	ImageIds []string  // images that were loaded without a repo tag
+	RepoTags []string  // repo:tag names of the images that were loaded
+}
+
+func NewDockerLoadOutput() *DockerLoadOutput {
+	return &DockerLoadOutput{
+		ImageIds: make([]string, 0),
+		RepoTags: make([]string, 0),
+	}
+}
+
+/*******************************************************************************
+ * Record the image or tag reported by a line of load output, which is of the
+ * form "Loaded image: <repo>:<tag>" or "Loaded image ID: <id>". Other lines
+ * are ignored.
+ */
+func (loadOutput *DockerLoadOutput) addLine(line string) {
+	
+	line = strings.TrimSpace(line)
+	var therest = strings.TrimPrefix(line, "Loaded image ID: ")
+	if len(therest) < len(line) {
+		loadOutput.ImageIds = append(loadOutput.ImageIds, therest)
+		return
+	}
+	therest = strings.TrimPrefix(line, "Loaded image: ")
+	if len(therest) < len(line) {
+		loadOutput.RepoTags = append(loadOutput.RepoTags, therest)
+	}
+}
@@ -0,0 +1,98 @@
+package docker
+
+import (
+	"net/url"
+	"encoding/json"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * Selects what is removed by the engine prune functions. An empty filter
+ * selects everything that the engine considers unused.
+ */
+type DockerPruneFilters struct {
+	All bool  // images: also remove unused tagged images, not only dangling ones;
+		// volumes: also remove named volumes, not only anonymous ones (engine API 1.42 and later);
+		// build cache: remove all cache, not only dangling cache
+	Labels []string  // only remove objects with these labels ("key" or "key=value")
+	NotLabels []string  // only remove objects without these labels
+	Until string  // only remove objects created before this time - a timestamp or a Go duration such as "24h";
+		// not supported for volumes
+}
+
+/*******************************************************************************
+ * Encode the filters as the value of the "filters" query parameter, e.g.,
+	{"dangling":["false"],"label":["stage=build"],"until":["24h"]}
+ * If allFilter is not empty, All is encoded as that filter, e.g., "dangling"
+ * with the value "false" for images; otherwise All is not part of the filters.
+ */
+func (filters *DockerPruneFilters) encode(allFilter, allValue string) (string, error) {
+	
+	var filterMap = make(map[string][]string)
+	if filters != nil {
+		if (allFilter != "") && filters.All { filterMap[allFilter] = []string{ allValue } }
+		if len(filters.Labels) > 0 { filterMap["label"] = filters.Labels }
+		if len(filters.NotLabels) > 0 { filterMap["label!"] = filters.NotLabels }
+		if filters.Until != "" { filterMap["until"] = []string{ filters.Until } }
+	}
+	if len(filterMap) == 0 { return "", nil }
+	var bytes []byte
+	var err error
+	bytes, err = json.Marshal(filterMap)
+	if err != nil { return "", err }
+	return "filters=" + url.QueryEscape(string(bytes)), nil
+}
+
+/*******************************************************************************
+ * Return a user error if the filters include one that the engine rejects when
+ * pruning volumes.
+ */
+func (filters *DockerPruneFilters) checkForVolumes() error {
+	if (filters != nil) && (filters.Until != "") { return utilities.ConstructUserError(
+		"The until filter is not supported when pruning volumes") }
+	return nil
+}
+
+/*******************************************************************************
+ * The result of an engine prune function.
+ */
+type DockerPruneOutput struct {
+	Deleted []string  // Ids (or names, for volumes) of the objects that were removed
+	Untagged []string  // image references that were untagged (image prune only)
+	SpaceReclaimed uint64  // bytes freed
+}
+
+/*******************************************************************************
+ * The JSON response of each of the prune functions. Each function sets only
+ * the fields that pertain to it.
+ */
+type enginePruneResponse struct {
+	ImagesDeleted []engineDeletedImage `json:"ImagesDeleted"`
+	ContainersDeleted []string `json:"ContainersDeleted"`
+	VolumesDeleted []string `json:"VolumesDeleted"`
+	CachesDeleted []string `json:"CachesDeleted"`
+	SpaceReclaimed uint64 `json:"SpaceReclaimed"`
+}
+
+type engineDeletedImage struct {
+	Untagged string `json:"Untagged,omitempty"`
+	Deleted string `json:"Deleted,omitempty"`
+}
+
+func (response *enginePruneResponse) asOutput() *DockerPruneOutput {
+	
+	var output = &DockerPruneOutput{
+		Deleted: make([]string, 0),
+		Untagged: make([]string, 0),
+		SpaceReclaimed: response.SpaceReclaimed,
+	}
+	for _, item := range response.ImagesDeleted {
+		if item.Untagged != "" { output.Untagged = append(output.Untagged, item.Untagged) }
+		if item.Deleted != "" { output.Deleted = append(output.Deleted, item.Deleted) }
+	}
+	output.Deleted = append(output.Deleted, response.ContainersDeleted...)
+	output.Deleted = append(output.Deleted, response.VolumesDeleted...)
+	output.Deleted = append(output.Deleted, response.CachesDeleted...)
+	return output
+}
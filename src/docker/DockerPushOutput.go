@@ -0,0 +1,142 @@
+package docker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"encoding/json"
+)
+
+/*******************************************************************************
+ * The kinds of event that occur during an engine push.
+ */
+type DockerPushEventKind int
+
+const (
+	PushEventStatus DockerPushEventKind = iota  // a status message that is not about a layer
+	PushEventLayerPreparing  // the engine is preparing to push the layer
+	PushEventLayerWaiting  // the layer is waiting for another upload to complete
+	PushEventLayerPushing  // progress of the layer's upload
+	PushEventLayerPushed  // the layer was uploaded
+	PushEventLayerExists  // the registry already had the layer
+	PushEventLayerMounted  // the layer was mounted from another repository of the registry
+	PushEventLayerRetrying  // the layer's upload failed and will be retried
+	PushEventPushed  // the manifest was pushed; the event has its digest
+)
+
+func (kind DockerPushEventKind) String() string {
+	switch kind {
+		case PushEventStatus: return "Status"
+		case PushEventLayerPreparing: return "LayerPreparing"
+		case PushEventLayerWaiting: return "LayerWaiting"
+		case PushEventLayerPushing: return "LayerPushing"
+		case PushEventLayerPushed: return "LayerPushed"
+		case PushEventLayerExists: return "LayerExists"
+		case PushEventLayerMounted: return "LayerMounted"
+		case PushEventLayerRetrying: return "LayerRetrying"
+		case PushEventPushed: return "Pushed"
+		default: return fmt.Sprintf("DockerPushEventKind(%d)", int(kind))
+	}
+}
+
+/*******************************************************************************
+ * An event that occurs during an engine push, reported as the push progress
+ * is received from the engine.
+ */
+type DockerPushEvent struct {
+	Kind DockerPushEventKind
+	LayerId string  // the short Id of the layer, for the layer events
+	Status string  // the engine's status text
+	Current int64  // bytes uploaded so far, for PushEventLayerPushing
+	Total int64  // size of the layer, for PushEventLayerPushing, if known
+	Digest string  // for PushEventPushed
+}
+
+/*******************************************************************************
+ * The result of pushing an image via the engine.
+ */
+type DockerPushOutput struct {
+	Tag string
+	Digest string  // digest of the pushed manifest
+	Size int64  // size of the pushed manifest
+	PushedLayers []string  // short Ids of the layers that were uploaded
+	ExistingLayers []string  // short Ids of the layers that the registry already had (or mounted)
+}
+
+func NewDockerPushOutput() *DockerPushOutput {
+	return &DockerPushOutput{
+		PushedLayers: make([]string, 0),
+		ExistingLayers: make([]string, 0),
+	}
+}
+
+/*******************************************************************************
+ * The final status message of a push, e.g.,
+ *	latest: digest: sha256:0a1b... size: 1362
+ */
+var pushDigestPattern = regexp.MustCompile(`^(\S+): digest: (sha256:[0-9a-f]+) size: (\d+)`)
+
+/*******************************************************************************
+ * Record the progress reported by a push stream message, and return the event
+ * that it represents. For example,
+	{"status":"The push refers to repository [localhost:5000/myimage]"}
+	{"status":"Preparing","progressDetail":{},"id":"8ac8bfaff55a"}
+	{"status":"Pushing","progressDetail":{"current":512,"total":1292800},"progress":"[>  ]","id":"8ac8bfaff55a"}
+	{"status":"Pushed","progressDetail":{},"id":"8ac8bfaff55a"}
+	{"status":"latest: digest: sha256:0a1b... size: 527"}
+	{"progressDetail":{},"aux":{"Tag":"latest","Digest":"sha256:0a1b...","Size":527}}
+ */
+func (pushOutput *DockerPushOutput) addMessage(msg *engineStreamMessage) *DockerPushEvent {
+	
+	if len(msg.Aux) > 0 {
+		var aux struct {
+			Tag string
+			Digest string
+			Size int64
+		}
+		if (json.Unmarshal(msg.Aux, &aux) == nil) && (aux.Digest != "") {
+			var reported = (pushOutput.Digest == aux.Digest)  // by the preceding status message
+			pushOutput.Tag = aux.Tag
+			pushOutput.Digest = aux.Digest
+			pushOutput.Size = aux.Size
+			if reported { return nil }
+			return &DockerPushEvent{ Kind: PushEventPushed, Status: aux.Tag, Digest: aux.Digest }
+		}
+		return nil
+	}
+	
+	var event = &DockerPushEvent{ Kind: PushEventStatus, LayerId: msg.Id, Status: msg.Status }
+	if msg.Id == "" {
+		var match = pushDigestPattern.FindStringSubmatch(msg.Status)
+		if match != nil {
+			pushOutput.Tag = match[1]
+			pushOutput.Digest = match[2]
+			fmt.Sscanf(match[3], "%d", &pushOutput.Size)
+			event.Kind = PushEventPushed
+			event.Digest = match[2]
+		}
+		return event
+	}
+	
+	switch {
+		case msg.Status == "Preparing": event.Kind = PushEventLayerPreparing
+		case msg.Status == "Waiting": event.Kind = PushEventLayerWaiting
+		case msg.Status == "Pushing":
+			event.Kind = PushEventLayerPushing
+			if msg.ProgressDetail != nil {
+				event.Current = msg.ProgressDetail.Current
+				event.Total = msg.ProgressDetail.Total
+			}
+		case msg.Status == "Pushed":
+			event.Kind = PushEventLayerPushed
+			pushOutput.PushedLayers = append(pushOutput.PushedLayers, msg.Id)
+		case msg.Status == "Layer already exists":
+			event.Kind = PushEventLayerExists
+			pushOutput.ExistingLayers = append(pushOutput.ExistingLayers, msg.Id)
+		case strings.HasPrefix(msg.Status, "Mounted from"):
+			event.Kind = PushEventLayerMounted
+			pushOutput.ExistingLayers = append(pushOutput.ExistingLayers, msg.Id)
+		case strings.HasPrefix(msg.Status, "Retrying"): event.Kind = PushEventLayerRetrying
+	}
+	return event
+}
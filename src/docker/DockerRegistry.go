@@ -1,6 +1,12 @@
 package docker
 
+import (
+	"io"
+	"context"
+)
+
 type DockerRegistry interface {
+	WithContext(ctx context.Context) DockerRegistry
 	Close()
 	Ping() error
 	ImageExists(repoName, tag string) (bool, error)
@@ -8,8 +14,10 @@ type DockerRegistry interface {
 	GetImageInfo(repoName, tag string) (digest string, 
 		layerAr []map[string]interface{}, err error)
 	GetImage(repoName, tag, filepath string) error
+	GetBlob(repoName, digest string) (io.ReadCloser, error)
 	DeleteImage(repoName, tag string) error
 	PushImage(repoName, tag, imageFilePath string) error
 	PushLayer(layerFilePath, repoName string) (string, error)
 	PushManifest(repoName, tag, imageDigestString string, layerDigestStrings []string) error
+	GetRegistryAuth() (registryHost string, auth *DockerRegistryAuth)
 }
@@ -0,0 +1,111 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+	"encoding/base64"
+	"encoding/json"
+)
+
+/*******************************************************************************
+ * Credentials for a registry, in the form the engine accepts them in its
+ * X-Registry-Auth and X-Registry-Config headers. Either a user Id and password,
+ * or an identity token (an OAuth refresh token, which takes precedence), is
+ * required.
+ */
+type DockerRegistryAuth struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Email string `json:"email,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+/*******************************************************************************
+ * Credentials for a set of registries, keyed by registry host, i.e., the
+ * hostname and - if not the default - port, as they appear in image names,
+ * e.g. "registry.example.com:5000". Docker Hub's key is DockerHubAuthKey.
+ */
+type DockerRegistryAuths map[string]*DockerRegistryAuth
+
+/*******************************************************************************
+ * The key under which Docker Hub credentials are held, as with the docker CLI.
+ */
+const DockerHubAuthKey = "https://index.docker.io/v1/"
+
+/*******************************************************************************
+ * Return the key by which credentials for the specified registry host (which
+ * may include a port) are held.
+ */
+func RegistryAuthKey(registryHost string) string {
+	
+	switch registryHost {
+		case "", "docker.io", "index.docker.io", "registry-1.docker.io", DockerHubAuthKey:
+			return DockerHubAuthKey
+	}
+	return registryHost
+}
+
+/*******************************************************************************
+ * Return the registry host for the specified hostname and port: the port is
+ * omitted if it is the default (zero, or the https port).
+ */
+func registryHostForPort(hostname string, port int) string {
+	
+	if (port == 0) || (port == 443) { return hostname }
+	return fmt.Sprintf("%s:%d", hostname, port)
+}
+
+/*******************************************************************************
+ * Return the registry host of the specified image name, e.g. "localhost:5000"
+ * for "localhost:5000/ubuntu:14.04", or Docker Hub's key if the name has no
+ * registry host.
+ */
+func RegistryHostOfImage(imageName string) string {
+	
+	var slash = strings.Index(imageName, "/")
+	if slash == -1 { return DockerHubAuthKey }
+	var first = imageName[:slash]
+	if (! strings.ContainsAny(first, ".:")) && (first != "localhost") { return DockerHubAuthKey }
+	return RegistryAuthKey(first)
+}
+
+/*******************************************************************************
+ * Return the credentials for the specified registry host, or nil.
+ */
+func (auths DockerRegistryAuths) Lookup(registryHost string) *DockerRegistryAuth {
+	return auths[RegistryAuthKey(registryHost)]
+}
+
+/*******************************************************************************
+ * Encode the credentials as the value of an X-Registry-Auth header: JSON, with
+ * base64url encoding (RFC 4648 section 5), which is the base64 alphabet that the
+ * engine decodes.
+ */
+func (auth *DockerRegistryAuth) encode() (string, error) {
+	
+	if auth == nil { auth = &DockerRegistryAuth{} }
+	var bytes, err = json.Marshal(auth)
+	if err != nil { return "", err }
+	return base64.URLEncoding.EncodeToString(bytes), nil
+}
+
+/*******************************************************************************
+ * Encode the credentials as the value of an X-Registry-Config header, which
+ * maps registry hosts to credentials. Each entry's ServerAddress defaults to
+ * its key.
+ */
+func (auths DockerRegistryAuths) encode() (string, error) {
+	
+	var config = make(map[string]*DockerRegistryAuth)
+	for key, auth := range auths {
+		if auth == nil { continue }
+		var entry = *auth
+		if entry.ServerAddress == "" { entry.ServerAddress = key }
+		config[key] = &entry
+	}
+	var bytes, err = json.Marshal(config)
+	if err != nil { return "", err }
+	return base64.URLEncoding.EncodeToString(bytes), nil
+}
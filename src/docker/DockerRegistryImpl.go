@@ -44,6 +44,7 @@ package docker
 import (
 	"fmt"
 	"io"
+	"context"
 	"os"
 	"io/ioutil"
 	"net/http"
@@ -52,8 +53,11 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"crypto/sha256"
+	"hash"
+	"errors"
 	"reflect"
 	"strings"
+	"path"
 	
 	"utilities"
 	"rest"
@@ -61,6 +65,11 @@ import (
 
 type DockerRegistryImpl struct {
 	rest.RestContext
+	ctx context.Context  // nil unless bound by WithContext
+	retry *DockerRetryPolicy  // nil if operations are not retried
+	parallelism int  // the maximum number of layers transferred at a time
+	cache *DockerBlobCache  // nil if blobs are not cached
+	forgetLogSecrets func()  // called by Close
 }
 
 var _ DockerRegistry = &DockerRegistryImpl{}
@@ -71,29 +80,68 @@ var _ DockerRegistry = &DockerRegistryImpl{}
 func OpenDockerRegistryConnection(host string, port int, userId string,
 	password string) (DockerRegistry, error) {
 	
-	fmt.Println(fmt.Sprintf("Opening connection to registry %s:%s@%s:%d",
-		userId, password, host, port))
+	var forgetLogSecrets = registerLogSecrets(nil, []string{ password })
+	logInfo("Opening connection to registry", "host", host, "port", port, "user", userId)
 	
 	var registry *DockerRegistryImpl = &DockerRegistryImpl{
 		RestContext: *rest.CreateTCPRestContext("http", host, port, userId, password, nil, noop),
+		retry: DefaultDockerRetryPolicy(),
+		parallelism: defaultTransferParallelism,
+		forgetLogSecrets: forgetLogSecrets,
 	}
 	
-	fmt.Println("Pinging registry...")
+	logDebug("Pinging registry...")
 	
 	var err error = registry.Ping()
 	if err != nil {
+		forgetLogSecrets()
 		return nil, err
 	}
 	
-	fmt.Println("...received response.")
+	logDebug("...received response.")
 	
 	return registry, nil
 }
 
 /*******************************************************************************
- * 
+ * Same as OpenDockerRegistryConnection, but the credentials for the registry
+ * are obtained from the resolver (none, if it has none).
+ */
+func OpenDockerRegistryConnectionWithResolver(host string, port int,
+	resolver *DockerCredentialsResolver) (DockerRegistry, error) {
+	
+	var auth *DockerRegistryAuth
+	var err error
+	auth, err = resolver.Resolve(registryHostForPort(host, port))
+	if err != nil { return nil, err }
+	if auth == nil { return OpenDockerRegistryConnection(host, port, "", "") }
+	if auth.Username == "" { return nil, utilities.ConstructUserError(
+		"Registry connections require a user Id and password, but only a token is " +
+		"configured for " + registryHostForPort(host, port)) }
+	return OpenDockerRegistryConnection(host, port, auth.Username, auth.Password)
+}
+
+/*******************************************************************************
+ * Forget the connection's password, which is redacted from log messages until
+ * the connection is closed.
  */
 func (registry *DockerRegistryImpl) Close() {
+	if registry.forgetLogSecrets != nil { registry.forgetLogSecrets() }
+}
+
+/*******************************************************************************
+ * Return the host of the registry, as it appears in image names, and the
+ * credentials with which the connection was opened (nil if none).
+ */
+func (registry *DockerRegistryImpl) GetRegistryAuth() (string, *DockerRegistryAuth) {
+	
+	var registryHost = registryHostForPort(registry.GetHostname(), registry.GetPort())
+	if registry.GetUserId() == "" { return registryHost, nil }
+	return registryHost, &DockerRegistryAuth{
+		Username: registry.GetUserId(),
+		Password: registry.GetPassword(),
+		ServerAddress: registryHost,
+	}
 }
 
 /*******************************************************************************
@@ -107,7 +155,7 @@ func (registry *DockerRegistryImpl) Ping() error {
 	var err error
 	response, err = registry.SendBasicGet(uri)
 	if err != nil { return err }
-	err = utilities.GenerateError(response.StatusCode, response.Status + "; in Ping")
+	err = generateResponseError(response, "Ping", response.Status + "; in Ping")
 	if err != nil { return err }
 	return nil
 }
@@ -128,7 +176,7 @@ func (registry *DockerRegistryImpl) ImageExists(repoName string, tag string) (bo
 	response, err = registry.SendBasicHead(uri)
 	if err != nil { return false, err }
 	if response.StatusCode == 404 { return false, nil }
-	err = utilities.GenerateError(response.StatusCode, response.Status + "; while checking if image exists")
+	err = generateResponseError(response, "ImageExists", response.Status + "; while checking if image exists")
 	if err != nil { return false, err }
 	return true, nil
 }
@@ -144,7 +192,7 @@ func (registry *DockerRegistryImpl) LayerExistsInRepo(repoName, digest string) (
 	response, err = registry.SendBasicHead(uri)
 	if err != nil { return false, err }
 	if response.StatusCode == 404 { return false, nil }
-	err = utilities.GenerateError(response.StatusCode, response.Status + "; while checking if layer exists")
+	err = generateResponseError(response, "LayerExistsInRepo", response.Status + "; while checking if layer exists")
 	if err != nil { return false, err }
 	return true, nil
 }
@@ -161,7 +209,7 @@ func (registry *DockerRegistryImpl) GetImageInfo(repoName string, tag string) (d
 	var resp *http.Response
 	resp, err = registry.SendBasicGet(uri)
 	if err != nil { return "", nil, err }
-	err = utilities.GenerateError(resp.StatusCode, resp.Status + "; while getting image info")
+	err = generateResponseError(resp, "GetImageInfo", resp.Status + "; while getting image info")
 	if err != nil { return "", nil, err }
 	
 	// Parse description of each layer.
@@ -190,7 +238,7 @@ func (registry *DockerRegistryImpl) GetImage(repoName string, tag string, filepa
 	var err error
 	resp, err = registry.SendBasicGet(uri)
 	if err != nil { return err }
-	err = utilities.GenerateError(resp.StatusCode, resp.Status + "; while getting image")
+	err = generateResponseError(resp, "GetImage", resp.Status + "; while getting image")
 	if err != nil { return err }
 	
 	// Parse description of each layer.
@@ -212,7 +260,9 @@ func (registry *DockerRegistryImpl) GetImage(repoName string, tag string, filepa
 		"When creating temp directory for writing layer files: %s", err.Error()))
 	}
 	defer os.RemoveAll(tempDirPath)
-	for _, layerDesc := range layerAr {
+	var layerDigests = make([]string, len(layerAr))
+	var layerFilePaths = make([]string, len(layerAr))
+	for i, layerDesc := range layerAr {
 		
 		var layerDigest = layerDesc["blobSum"]
 		if layerDigest == nil {
@@ -224,13 +274,6 @@ func (registry *DockerRegistryImpl) GetImage(repoName string, tag string, filepa
 		if ! isType { return utilities.ConstructServerError("blogSum field is not a string - it is a " +
 			reflect.TypeOf(layerDigest).String())
 		}
-		uri = "v2/" + repoName + "/blobs/" + digest
-		resp, err = registry.SendBasicGet(uri)
-		if err != nil { return err }
-		defer resp.Body.Close()
-		err = utilities.GenerateError(resp.StatusCode, resp.Status + 
-			fmt.Sprintf("when requesting uri: '%s'", uri))
-		if err != nil { return err }
 
 		// Create temporary file in which to write layer.
 		var layerFile *os.File
@@ -238,15 +281,31 @@ func (registry *DockerRegistryImpl) GetImage(repoName string, tag string, filepa
 		if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
 			"When creating layer file: %s", err.Error()))
 		}
+		layerFile.Close()
+		layerDigests[i] = digest
+		layerFilePaths[i] = layerFile.Name()
+	}
 		
-		var reader io.ReadCloser = resp.Body
-		layerFile, err = os.OpenFile(layerFile.Name(), os.O_WRONLY, 0600)
-		if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
-			"When opening layer file '%s': %s", layerFile.Name(), err.Error()))
-		}
-		_, err = io.Copy(layerFile, reader)
+	// Download the layers, several at a time. A download that fails transiently
+	// is restarted.
+	err = runTransfers(registry.context(), registry.GetParallelism(), len(layerAr),
+		func(ctx context.Context, i int) error {
+			var unretried = registry.withContext(ctx).withoutRetry()
+			return registry.retry.retry(ctx, "GetImage", func(attemptNo int) error {
+				return unretried.getLayer("GetImage", repoName, layerDigests[i], layerFilePaths[i])
+			})
+		})
+	if err != nil { return err }
+	
+	// Add the layers to the archive, base layer first. The manifest lists the
+	// top layer first.
+	for i := len(layerFilePaths) - 1; i >= 0; i-- {
+		
+		var layerFilePath = layerFilePaths[i]
+		var layerFile *os.File
+		layerFile, err = os.Open(layerFilePath)
 		if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
-			"When writing layer file '%s': %s", layerFile.Name(), err.Error()))
+			"When opening layer file '%s': %s", layerFilePath, err.Error()))
 		}
 		var fileInfo os.FileInfo
 		fileInfo, err = layerFile.Stat()
@@ -286,6 +345,120 @@ func (registry *DockerRegistryImpl) GetImage(repoName string, tag string, filepa
 	return nil
 }
 
+/*******************************************************************************
+ * Download the layer with the specified digest to the file, replacing its
+ * content, and verify the content against the digest. If the connection has a
+ * blob cache, the layer is copied from the cache if it is there, and otherwise
+ * added to it.
+ */
+func (registry *DockerRegistryImpl) getLayer(operation, repoName, digest, layerFilePath string) error {
+	
+	var layerFile *os.File
+	var err error
+	if registry.cache != nil {
+		var cached *os.File
+		cached, err = registry.cache.Open(digest)
+		if err == nil {
+			defer cached.Close()
+			layerFile, err = os.OpenFile(layerFilePath, os.O_WRONLY | os.O_TRUNC, 0600)
+			if err == nil {
+				_, err = io.Copy(layerFile, cached)
+				var closeErr = layerFile.Close()
+				if err == nil { err = closeErr }
+			}
+			if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
+				"When copying cached layer %s to '%s': %s", digest, layerFilePath, err.Error()))
+			}
+			return nil
+		}
+		if ! errors.Is(err, ErrNotFound) { logWarn("Could not read cached layer", "digest", digest, "error", err) }
+	}
+	
+	var uri = "v2/" + repoName + "/blobs/" + digest
+	var resp *http.Response
+	resp, err = registry.SendBasicGet(uri)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	err = generateResponseError(resp, operation, resp.Status + 
+		fmt.Sprintf("when requesting uri: '%s'", uri))
+	if err != nil { return err }
+	
+	layerFile, err = os.OpenFile(layerFilePath, os.O_WRONLY | os.O_TRUNC, 0600)
+	if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
+		"When opening layer file '%s': %s", layerFilePath, err.Error()))
+	}
+	defer layerFile.Close()
+	var hasher hash.Hash
+	hasher, _, _, err = parseDigest(digest)
+	if err != nil { hasher = nil }  // content with an unknown digest is neither verified nor cached
+	var writer io.Writer = layerFile
+	if hasher != nil { writer = io.MultiWriter(layerFile, hasher) }
+	_, err = io.Copy(writer, resp.Body)
+	if err != nil {
+		var transportErr = transportError(err, operation)
+		if IsTransientError(transportErr) { return contextError(registry.context(), transportErr) }
+		return contextError(registry.context(), utilities.ConstructServerError(fmt.Sprintf(
+			"When writing layer file '%s': %s", layerFilePath, err.Error())))
+	}
+	if hasher == nil { return nil }
+	if ! digestMatches(digest, hasher) {
+		return newDockerError(ErrDigestMismatch, operation, fmt.Sprintf(
+			"Content of layer %s does not match its digest", digest))
+	}
+	
+	if registry.cache != nil {
+		err = layerFile.Close()
+		if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
+			"When closing layer file '%s': %s", layerFilePath, err.Error()))
+		}
+		err = registry.cache.putVerifiedFile(digest, layerFilePath)
+		if err != nil { logWarn("Could not cache layer", "digest", digest, "error", err) }  // not a failure of the pull
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Return a reader of the content of the blob with the specified digest, which
+ * is verified against the digest. If the connection has a blob cache, the blob
+ * is read from the cache if it is there, and otherwise added to it. The caller
+ * must close the reader.
+ */
+func (registry *DockerRegistryImpl) GetBlob(repoName, digest string) (io.ReadCloser, error) {
+	
+	if registry.cache != nil {
+		var cached, err = registry.cache.Open(digest)
+		if err == nil { return cached, nil }
+	}
+	
+	var tempFile *os.File
+	var err error
+	tempFile, err = utilities.MakeTempFile("", "blob")
+	if err != nil { return nil, utilities.ConstructServerError(fmt.Sprintf(
+		"When creating blob file: %s", err.Error()))
+	}
+	tempFile.Close()
+	var unretried = registry.withoutRetry()
+	err = registry.retry.retry(registry.context(), "GetBlob", func(attemptNo int) error {
+		return unretried.getLayer("GetBlob", repoName, digest, tempFile.Name())
+	})
+	if err == nil { tempFile, err = os.Open(tempFile.Name()) }
+	if err != nil { os.Remove(tempFile.Name()); return nil, err }
+	return &tempFileReader{ File: tempFile }, nil
+}
+
+/*******************************************************************************
+ * A temporary file that is removed when it is closed.
+ */
+type tempFileReader struct {
+	*os.File
+}
+
+func (reader *tempFileReader) Close() error {
+	var err = reader.File.Close()
+	os.Remove(reader.File.Name())
+	return err
+}
+
 /*******************************************************************************
  * 
  */
@@ -301,9 +474,8 @@ func (registry *DockerRegistryImpl) DeleteImage(repoName, tag string) error {
 	var err error
 	resp, err = registry.SendBasicGet(uri)
 	if err != nil { return err }
-	resp.Body.Close()
-	err = utilities.GenerateError(resp.StatusCode, resp.Status + "; while deleting image")
-	if err != nil { return err }
+	err = generateResponseError(resp, "DeleteImage", resp.Status + "; while deleting image")
+	if err != nil { resp.Body.Close(); return err }
 	
 	// Parse description of each layer.
 	var layerAr []map[string]interface{}
@@ -329,7 +501,7 @@ func (registry *DockerRegistryImpl) DeleteImage(repoName, tag string) error {
 		var err error
 		response, err = registry.SendBasicDelete(uri)
 		if err != nil { return err }
-		err = utilities.GenerateError(response.StatusCode, response.Status + "; while deleting layer")
+		err = generateResponseError(response, "DeleteImage", response.Status + "; while deleting layer")
 		if err != nil { return err }
 	}
 	
@@ -367,19 +539,27 @@ func (registry *DockerRegistryImpl) PushImage(repoName, tag, imageFilePath strin
 		if err == io.EOF { break }
 		if err != nil { return err }
 		
+		if strings.Contains(header.Name, "..") { return utilities.ConstructUserError(
+			"Image archive contains an invalid entry: " + header.Name) }
+		if (header.Typeflag == tar.TypeSymlink) || (header.Typeflag == tar.TypeLink) { continue }
+		
 		if strings.HasSuffix(header.Name, "/") {  // a directory
 			
 			var dirname = tempDirPath + "/" + header.Name
-			err = os.Mkdir(dirname, 0770)
+			err = os.MkdirAll(dirname, 0770)
 			if err != nil { return err }
 			
-		} else if (header.Name == "repositories") ||
-				strings.HasSuffix(header.Name, "/layer.tar") {
+		} else if (header.Name == "repositories") || (header.Name == "manifest.json") ||
+				strings.HasSuffix(header.Name, "/layer.tar") || strings.HasSuffix(header.Name, "/json") ||
+				strings.HasPrefix(header.Name, "blobs/") {
 			
-			// Write entry to a file.
+			// Write entry to a file. In an archive in the OCI layout (docker 25 and
+			// later), the layers are blobs, to which the layer.tar entries link.
 			var nWritten int64
 			var outfile *os.File
 			var filename = tempDirPath + "/" + header.Name
+			err = os.MkdirAll(path.Dir(filename), 0770)
+			if err != nil { return err }
 			outfile, err = os.OpenFile(filename, os.O_CREATE | os.O_RDWR, 0770)
 			if err != nil { return err }
 			nWritten, err = io.Copy(outfile, tarReader)
@@ -444,27 +624,21 @@ func (registry *DockerRegistryImpl) PushImage(repoName, tag, imageFilePath strin
 		}
 	}
 	
-	// Obtain digest strings and layer paths.
-	var scratchDir *os.File
-	scratchDir, err = os.Open(tempDirPath)
-	if err != nil { return err }
-	var layerFilenames []string
-	layerFilenames, err = scratchDir.Readdirnames(0)
+	// Obtain the layer paths, in order from the base layer.
+	var layerFilePaths []string
+	layerFilePaths, err = savedImageLayerPaths(tempDirPath, imageDigest)
 	if err != nil { return err }
 	
-	// Send each layer to the registry.
-	var layerDigests = make([]string, 0)
-	for _, layerFilename := range layerFilenames {  // layer files are named by their digest
-
-		if layerFilename == "repositories" { continue } // not a layer
-		
-		var layerFilePath = tempDirPath + "/" + layerFilename + "/layer.tar"
-		var layerDigest string
-		layerDigest, err = registry.PushLayer(layerFilePath, repoName)
-		//err = registry.PushLayer(layerFilePath, repoName, layerDigest)
-		if err != nil { return err }
-		layerDigests = append(layerDigests, layerDigest)
-	}
+	// Send the layers to the registry, several at a time. The digests are listed
+	// in the order of the layers, regardless of the order in which they are sent.
+	var layerDigests = make([]string, len(layerFilePaths))
+	err = runTransfers(registry.context(), registry.GetParallelism(), len(layerFilePaths),
+		func(ctx context.Context, i int) error {
+			var err error
+			layerDigests[i], err = registry.withContext(ctx).PushLayer(layerFilePaths[i], repoName)
+			return err
+		})
+	if err != nil { return err }
 	
 	// Send a manifest to the registry.
 	err = registry.PushManifest(repoName, tag, imageDigest, layerDigests)
@@ -475,6 +649,62 @@ func (registry *DockerRegistryImpl) PushImage(repoName, tag, imageFilePath strin
 	return nil
 }
 
+/*******************************************************************************
+ * Return the paths of the layer files of an image archive (as written by
+ * "docker save") that has been expanded in imageDirPath, in order from the base
+ * layer. The order, and the paths, are those of the archive's manifest.json,
+ * if it has one (as archives of docker 1.10 and later do) - e.g.,
+ * "<id>/layer.tar", or "blobs/sha256/<digest>" in the OCI layout; otherwise the
+ * layers are ordered by the parents that their json files name, starting from
+ * the top layer, whose id is topLayerId.
+ */
+func savedImageLayerPaths(imageDirPath, topLayerId string) ([]string, error) {
+	
+	var layerFilePaths = make([]string, 0)
+	var bytes []byte
+	var err error
+	bytes, err = ioutil.ReadFile(imageDirPath + "/manifest.json")
+	if err == nil {
+		var manifest []struct { Layers []string }
+		err = json.Unmarshal(bytes, &manifest)
+		if err != nil { return nil, utilities.ConstructUserError(
+			"manifest.json of image archive is not valid: " + err.Error()) }
+		if len(manifest) != 1 { return nil, utilities.ConstructUserError(fmt.Sprintf(
+			"manifest.json of image archive describes %d images; expected one", len(manifest))) }
+		for _, layerPath := range manifest[0].Layers {
+			if (layerPath == "") || strings.HasPrefix(layerPath, "/") || strings.Contains(layerPath, "..") {
+				return nil, utilities.ConstructUserError(
+					"manifest.json of image archive names an invalid layer: " + layerPath)
+			}
+			layerFilePaths = append(layerFilePaths, imageDirPath + "/" + layerPath)
+		}
+		return layerFilePaths, nil
+	}
+	if ! os.IsNotExist(err) { return nil, err }
+	
+	// Follow the parents from the top layer down to the base layer, whose json
+	// names no parent.
+	var visited = make(map[string]bool)
+	for layerId := topLayerId; layerId != ""; {
+		if visited[layerId] || strings.Contains(layerId, "/") || strings.Contains(layerId, "..") {
+			return nil, utilities.ConstructUserError(
+				"Layer parents of image archive are not valid at layer " + layerId)
+		}
+		visited[layerId] = true
+		bytes, err = ioutil.ReadFile(imageDirPath + "/" + layerId + "/json")
+		if err != nil { return nil, utilities.ConstructUserError(
+			"Image archive does not contain the json of layer " + layerId) }
+		var layerJSON struct { Parent string `json:"parent"` }
+		err = json.Unmarshal(bytes, &layerJSON)
+		if err != nil { return nil, utilities.ConstructUserError(
+			"json of layer " + layerId + " is not valid: " + err.Error()) }
+		layerFilePaths = append([]string{ imageDirPath + "/" + layerId + "/layer.tar" },
+			layerFilePaths...)
+		layerId = layerJSON.Parent
+	}
+	return layerFilePaths, nil
+}
+
 /*******************************************************************************
  * Push a layer, using the "chunked" upload registry protocol.
  * Registry 2 layer push protocol:
@@ -504,7 +734,7 @@ func (registry *DockerRegistryImpl) PushLayer(layerFilePath, repoName string) (s
 	digest, err = utilities.ComputeFileDigest(sha256.New(), layerFilePath)
 	if err != nil { return "", err }
 	var digestString = hex.EncodeToString(digest)
-	fmt.Println("Computed digest: " + digestString)
+	logDebug("Computed layer digest", "digest", digestString)
 	
 	// Check if layer already exists in repo.
 	var exists bool
@@ -512,16 +742,36 @@ func (registry *DockerRegistryImpl) PushLayer(layerFilePath, repoName string) (s
 	if err != nil { return digestString, err }
 	if exists { return digestString, nil }
 	
+	// Upload the layer. If the upload fails transiently, it is restarted in a new
+	// upload session - unless the layer was received before the failure.
+	var unretried = registry.withoutRetry()
+	err = registry.retry.retry(registry.context(), "PushLayer", func(attemptNo int) error {
+		if attemptNo > 1 {
+			var exists, err = unretried.LayerExistsInRepo(repoName, digestString)
+			if err != nil { return err }
+			if exists { return nil }
+		}
+		return unretried.uploadLayer(layerFilePath, repoName, digestString)
+	})
+	return digestString, err
+}
+
+/*******************************************************************************
+ * Perform an upload session for the layer (see PushLayer).
+ */
+func (registry *DockerRegistryImpl) uploadLayer(layerFilePath, repoName, digestString string) error {
+	
 	// Get Location header.
 	var response *http.Response
+	var err error
 	var uri = fmt.Sprintf("v2/%s/blobs/uploads/", repoName)
 	response, err = registry.SendBasicFormPost(uri, []string{}, []string{})
-	if err != nil { return digestString, err }
-	err = utilities.GenerateError(response.StatusCode, response.Status + "; while starting layer upload")
-	if err != nil { return digestString, err }
+	if err != nil { return err }
+	err = generateResponseError(response, "PushLayer", response.Status + "; while starting layer upload")
+	if err != nil { return err }
 	var locations []string = response.Header["Location"]
-	if locations == nil { return digestString, utilities.ConstructServerError("No Location header") }
-	if len(locations) != 1 { return digestString, utilities.ConstructServerError("Unexpected Location header") }
+	if locations == nil { return utilities.ConstructServerError("No Location header") }
+	if len(locations) != 1 { return utilities.ConstructServerError("Unexpected Location header") }
 	var location string = locations[0]
 	//var uuid string = response.Header.Get("Docker-Upload-UUID")
 	
@@ -534,10 +784,11 @@ func (registry *DockerRegistryImpl) PushLayer(layerFilePath, repoName string) (s
 	
 	var layerFile *os.File
 	layerFile, err = os.Open(layerFilePath)
-	if err != nil { return digestString, err }
+	if err != nil { return err }
+	defer layerFile.Close()
 	var fileInfo os.FileInfo
 	fileInfo, err = layerFile.Stat()
-	if err != nil { return digestString, err }
+	if err != nil { return err }
 	
 	//location = strings.TrimPrefix(location, "/")
 	
@@ -562,7 +813,7 @@ func (registry *DockerRegistryImpl) PushLayer(layerFilePath, repoName string) (s
 	// Construct request.
 	var request *http.Request
 	request, err = http.NewRequest("PATCH", url, layerFile)
-	if err != nil { return digestString, err }
+	if err != nil { return err }
 	
 	for name, value := range headers {
 		request.Header.Set(name, value)
@@ -604,7 +855,7 @@ func (registry *DockerRegistryImpl) PushLayer(layerFilePath, repoName string) (s
 	//uri = fmt.Sprintf("/v2/%s/blob/uploads/%s?digest=%s", repoName, uuid, digestString)
 	
 	request, err = http.NewRequest("PUT", url, layerFile)
-	if err != nil { return digestString, err }
+	if err != nil { return err }
 
 	headers = map[string]string{
 		"Content-Length": fmt.Sprintf("%d", fileSize),
@@ -621,21 +872,22 @@ func (registry *DockerRegistryImpl) PushLayer(layerFilePath, repoName string) (s
 		request.Header.Set(name, value)
 	}
 	
-	response, err = registry.GetHttpClient().Do(request)
-	if err != nil { return digestString, err }
-	err = utilities.GenerateError(response.StatusCode, response.Status)
+	response, err = doContextRequest(registry.context(), registry.GetHttpClient(),
+		request.WithContext(registry.context()))
+	if err != nil { return err }
+	err = generateResponseError(response, "PushLayer", response.Status)
 
 	if err != nil {
 		var bytes []byte
 		var err2 error
 		bytes, err2 = ioutil.ReadAll(response.Body)
-		if err2 != nil { fmt.Println(err2.Error()); return digestString, err }
-		fmt.Println(string(bytes))
+		if err2 != nil { logWarn("While reading response body", "error", err2); return err }
+		logWarn("Layer upload failed", "status", response.Status, "body", string(bytes))
 	}
 		
-	if err != nil { return digestString, err }
+	if err != nil { return err }
 	
-	return digestString, nil
+	return nil
 }
 
 /*
@@ -655,7 +907,8 @@ func sanitizeLocation(location, base string) (string, error) {
 */
 
 /*******************************************************************************
- * 
+ * Put a manifest for the layers, whose digests are listed in order from the
+ * base layer (see composeManifest), and tag it.
  */
 func (registry *DockerRegistryImpl) PushManifest(repoName, tag, imageDigestString string,
 	layerDigestStrings []string) error {
@@ -664,14 +917,9 @@ func (registry *DockerRegistryImpl) PushManifest(repoName, tag, imageDigestStrin
 	//var uri = fmt.Sprintf("v2/%s/manifests/sha256:%s", repoName, imageDigestString)
 	//var uri = fmt.Sprintf("v2/%s/manifests/sha256:%s", repoName + ":" + tag, imageDigestString)
 	
-	var url = registry.GetScheme() + "://" + registry.GetHostname()
-	if registry.GetPort() != 0 { url = url + fmt.Sprintf(":%d", registry.GetPort()) }
-	url = url + "/" + uri
-	
-	fmt.Println("url=" + url)
+	var url = registry.baseURL() + "/" + uri
 	
-	var manifest = fmt.Sprintf("{" +
-		"\"name\": \"%s\", \"tag\": \"%s\", \"fsLayers\": [", repoName, tag)
+	logDebug("Pushing manifest", "url", url)
 	
 	// Info on JSON Web Tokens:
 	// https://jwt.io/introduction/
@@ -679,17 +927,9 @@ func (registry *DockerRegistryImpl) PushManifest(repoName, tag, imageDigestStrin
 	// Issue posted to github docker/distribution project:
 	// https://github.com/docker/distribution/pull/1702#issuecomment-219178800
 	
+	var manifest = composeManifest(repoName, tag, layerDigestStrings)
 	
-	for i, layerDigestString := range layerDigestStrings {
-		if i > 0 { manifest = manifest + ",\n" }
-		manifest = manifest + fmt.Sprintf("{\"blobSum\": \"sha256:%s\"}", layerDigestString)
-	}
-	
-	manifest = manifest + "]}"
-	
-	fmt.Println("manifest:")
-	fmt.Println(manifest)
-	fmt.Println()
+	logDebug("Manifest", "manifest", manifest)
 	
 	var stringReader *strings.Reader = strings.NewReader(manifest)
 	
@@ -703,30 +943,34 @@ func (registry *DockerRegistryImpl) PushManifest(repoName, tag, imageDigestStrin
 		"Authorization": authHeaderValue,
 	}
 	
-	var request *http.Request
+	// Putting a manifest is idempotent, so a transient failure is retried.
+	var response *http.Response
 	var err error
-	request, err = http.NewRequest("PUT", url, stringReader)
-	if err != nil { return err }
+	response, err = registry.retry.do(registry.context(), "PushManifest", func() (*http.Response, error) {
+		var request *http.Request
+		var err error
+		stringReader.Seek(0, io.SeekStart)
+		request, err = http.NewRequest("PUT", url, stringReader)
+		if err != nil { return nil, err }
 	
-	for name, value := range headers {
-		request.Header.Set(name, value)
-	}
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
 	
-	var response *http.Response
-	response, err = registry.GetHttpClient().Do(request)
+		return doContextRequest(registry.context(), registry.GetHttpClient(),
+			request.WithContext(registry.context()))
+	})
 	if err != nil { return err }
 	
 	//response, err = registry.SendBasicStreamPut(uri, headers, stringReader)
 	if err != nil { return err }
-	err = utilities.GenerateError(response.StatusCode, response.Status + "; while putting manifest")
+	err = generateResponseError(response, "PushManifest", response.Status + "; while putting manifest")
 	if err != nil {
 		var bytes []byte
 		var err2 error
 		bytes, err2 = ioutil.ReadAll(response.Body)
-		if err2 != nil { fmt.Println("While readoing response body, " + err2.Error()); } else {
-			fmt.Println("Response body:")
-			fmt.Println(string(bytes))
-			fmt.Println("\nEnd of Response body.")
+		if err2 != nil { logWarn("While reading response body", "error", err2) } else {
+			logWarn("Manifest upload failed", "status", response.Status, "body", string(bytes))
 		}
 	}
 	if err != nil { return err }
@@ -734,6 +978,23 @@ func (registry *DockerRegistryImpl) PushManifest(repoName, tag, imageDigestStrin
 	return nil
 }
 
+/*******************************************************************************
+ * Return the manifest that PushManifest sends, listing the layers with the
+ * specified digests (hex, without the "sha256:" prefix), which are in order
+ * from the base layer. As schema 1 requires, fsLayers lists them the other way
+ * round, top layer first.
+ */
+func composeManifest(repoName, tag string, layerDigestStrings []string) string {
+	
+	var manifest = fmt.Sprintf("{" +
+		"\"name\": \"%s\", \"tag\": \"%s\", \"fsLayers\": [", repoName, tag)
+	for i := len(layerDigestStrings) - 1; i >= 0; i-- {
+		if i < len(layerDigestStrings) - 1 { manifest = manifest + ",\n" }
+		manifest = manifest + fmt.Sprintf("{\"blobSum\": \"sha256:%s\"}", layerDigestStrings[i])
+	}
+	return manifest + "]}"
+}
+
 /*******************************************************************************
  * Return an array of maps, one for each layer, and each containing the attributes
  * of the layer.
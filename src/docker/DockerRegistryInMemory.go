@@ -0,0 +1,488 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"bytes"
+	"context"
+	"strings"
+	"path"
+	"io/ioutil"
+	"archive/tar"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * A DockerRegistry that holds its blobs and manifests in memory (see
+ * DockerInMemory.go). Manifests are those that DockerRegistryImpl pushes, and
+ * are identified by the same digests. The retry policy, parallelism and blob
+ * cache are held, as they are by DockerRegistryImpl; the parallelism is that of
+ * the layer pushes of PushImage, but the retry policy and blob cache are not
+ * used, as there is nothing to retry or to cache.
+ */
+type InMemoryDockerRegistry struct {
+	*inMemoryCalls
+	store *inMemoryRegistryStore
+	ctx context.Context  // nil unless bound by WithContext
+	retry *DockerRetryPolicy
+	parallelism int
+	cache *DockerBlobCache
+}
+
+var _ DockerRegistry = &InMemoryDockerRegistry{}
+
+type inMemoryRegistryStore struct {
+	lock sync.Mutex
+	registryHost string
+	userId string
+	password string
+	blobs map[string][]byte  // by digest
+	repos map[string]*inMemoryRepository  // by name
+}
+
+type inMemoryRepository struct {
+	blobs map[string]bool  // digests of the blobs that were pushed to the repository
+	manifests map[string][]byte  // by digest
+	tags map[string]string  // manifest digests, by tag
+}
+
+/*******************************************************************************
+ * Return an empty registry, which image names refer to by the specified host
+ * (e.g., "registry.example.com:5000"). If the user Id is not empty, those are
+ * the credentials that GetRegistryAuth returns, and that an InMemoryDockerEngine
+ * requires of pushes to, and pulls from, the registry.
+ */
+func NewInMemoryDockerRegistry(registryHost, userId, password string) *InMemoryDockerRegistry {
+	return &InMemoryDockerRegistry{
+		inMemoryCalls: newInMemoryCalls(),
+		store: &inMemoryRegistryStore{
+			registryHost: registryHost,
+			userId: userId,
+			password: password,
+			blobs: make(map[string][]byte),
+			repos: make(map[string]*inMemoryRepository),
+		},
+		retry: DefaultDockerRetryPolicy(),
+		parallelism: defaultTransferParallelism,
+	}
+}
+
+/*******************************************************************************
+ * Add an image with the specified layers to the registry, as if it had been
+ * pushed, and return the digest of its manifest.
+ */
+func (registry *InMemoryDockerRegistry) AddImage(repoName, tag string, layers ...[]byte) string {
+	
+	var layerDigests = make([]string, len(layers))
+	for i, layer := range layers {
+		layerDigests[i] = strings.TrimPrefix(registry.store.putBlob(repoName, layer), "sha256:")
+	}
+	var digest, _, _ = registry.store.putManifest(repoName, tag, layerDigests, "AddImage")
+	return digest
+}
+
+/*******************************************************************************
+ * Return the names of the repositories that have an image, in order.
+ */
+func (registry *InMemoryDockerRegistry) Repositories() []string {
+	
+	registry.store.lock.Lock()
+	defer registry.store.lock.Unlock()
+	var names = make([]string, 0)
+	for name, repo := range registry.store.repos {
+		if len(repo.manifests) > 0 { names = append(names, name) }
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*******************************************************************************
+ * Return the tags of the specified repository, in order.
+ */
+func (registry *InMemoryDockerRegistry) Tags(repoName string) []string {
+	
+	registry.store.lock.Lock()
+	defer registry.store.lock.Unlock()
+	var tags = make([]string, 0)
+	var repo = registry.store.repos[repoName]
+	if repo == nil { return tags }
+	for tag, _ := range repo.tags { tags = append(tags, tag) }
+	sort.Strings(tags)
+	return tags
+}
+
+func (registry *InMemoryDockerRegistry) WithContext(ctx context.Context) DockerRegistry {
+	var bound = *registry
+	bound.ctx = ctx
+	return &bound
+}
+
+func (registry *InMemoryDockerRegistry) SetRetryPolicy(policy *DockerRetryPolicy) {
+	registry.retry = policy
+}
+
+func (registry *InMemoryDockerRegistry) GetRetryPolicy() *DockerRetryPolicy {
+	return registry.retry
+}
+
+func (registry *InMemoryDockerRegistry) SetParallelism(parallelism int) {
+	if parallelism < 1 { parallelism = 1 }
+	registry.parallelism = parallelism
+}
+
+func (registry *InMemoryDockerRegistry) GetParallelism() int {
+	if registry.parallelism < 1 { return 1 }
+	return registry.parallelism
+}
+
+func (registry *InMemoryDockerRegistry) SetBlobCache(cache *DockerBlobCache) {
+	registry.cache = cache
+}
+
+func (registry *InMemoryDockerRegistry) GetBlobCache() *DockerBlobCache {
+	return registry.cache
+}
+
+func (registry *InMemoryDockerRegistry) Close() {
+	registry.record(nil, "Close")
+}
+
+func (registry *InMemoryDockerRegistry) Ping() error {
+	return registry.record(registry.ctx, "Ping")
+}
+
+func (registry *InMemoryDockerRegistry) ImageExists(repoName, tag string) (bool, error) {
+	
+	var err = registry.record(registry.ctx, "ImageExists", repoName, tag)
+	if err != nil { return false, err }
+	var _, _, found = registry.store.manifest(repoName, tag)
+	return found, nil
+}
+
+func (registry *InMemoryDockerRegistry) LayerExistsInRepo(repoName, digest string) (bool, error) {
+	
+	var err = registry.record(registry.ctx, "LayerExistsInRepo", repoName, digest)
+	if err != nil { return false, err }
+	return registry.store.hasBlob(repoName, digest), nil
+}
+
+func (registry *InMemoryDockerRegistry) GetImageInfo(repoName, tag string) (string,
+	[]map[string]interface{}, error) {
+	
+	var err = registry.record(registry.ctx, "GetImageInfo", repoName, tag)
+	if err != nil { return "", nil, err }
+	var manifest, digest, found = registry.store.manifest(repoName, tag)
+	if ! found { return "", nil, manifestUnknownError("GetImageInfo", "while getting image info") }
+	var layerAr []map[string]interface{}
+	layerAr, err = parseManifest(ioutil.NopCloser(bytes.NewReader(manifest)))
+	if err != nil { return "", nil, err }
+	return digest, layerAr, nil
+}
+
+/*******************************************************************************
+ * Write the layers of the image to a tar archive at the specified path, as
+ * DockerRegistryImpl.GetImage does.
+ */
+func (registry *InMemoryDockerRegistry) GetImage(repoName, tag, filepath string) error {
+	
+	var err = registry.record(registry.ctx, "GetImage", repoName, tag, filepath)
+	if err != nil { return err }
+	var layers [][]byte
+	layers, err = registry.store.layers(repoName, tag, "GetImage")
+	if err != nil { return err }
+	
+	var tarFile *os.File
+	tarFile, err = os.Create(filepath)
+	if err != nil { return utilities.ConstructServerError(fmt.Sprintf(
+		"When creating image file '%s': %s", filepath, err.Error()))
+	}
+	defer tarFile.Close()
+	var tarWriter = tar.NewWriter(tarFile)
+	for _, layer := range layers {
+		err = tarWriter.WriteHeader(&tar.Header{
+			Name: strings.TrimPrefix(inMemoryDigest(layer), "sha256:"),
+			Mode: 0600,
+			Size: int64(len(layer)),
+		})
+		if err != nil {	return utilities.ConstructServerError(fmt.Sprintf(
+			"While writing layer header to tar archive: , %s", err.Error()))
+		}
+		_, err = tarWriter.Write(layer)
+		if err != nil {	return utilities.ConstructServerError(fmt.Sprintf(
+			"While writing layer content to tar archive: , %s", err.Error()))
+		}
+	}
+	return tarWriter.Close()
+}
+
+func (registry *InMemoryDockerRegistry) GetBlob(repoName, digest string) (io.ReadCloser, error) {
+	
+	var err = registry.record(registry.ctx, "GetBlob", repoName, digest)
+	if err != nil { return nil, err }
+	var content, found = registry.store.blob(repoName, digest)
+	if ! found { return nil, blobUnknownError("GetBlob", digest) }
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+/*******************************************************************************
+ * Delete the manifest of the image, and its layers from the repository.
+ */
+func (registry *InMemoryDockerRegistry) DeleteImage(repoName, tag string) error {
+	
+	var err = registry.record(registry.ctx, "DeleteImage", repoName, tag)
+	if err != nil { return err }
+	return registry.store.deleteImage(repoName, tag)
+}
+
+/*******************************************************************************
+ * Push the image in the image archive at the specified path (in the format of
+ * DockerEngine.GetImage), as DockerRegistryImpl.PushImage does: each layer is
+ * written to a file and pushed with PushLayer, and then the manifest is pushed
+ * with PushManifest, so that those calls are recorded, and fail with the
+ * errors injected for them.
+ */
+func (registry *InMemoryDockerRegistry) PushImage(repoName, tag, imageFilePath string) error {
+	
+	var err = registry.record(registry.ctx, "PushImage", repoName, tag, imageFilePath)
+	if err != nil { return err }
+	var imageFile *os.File
+	imageFile, err = os.Open(imageFilePath)
+	if err != nil { return err }
+	defer imageFile.Close()
+	var images []*inMemoryImage
+	images, err = readImageArchive(imageFile)
+	if err != nil { return err }
+	if len(images) == 0 { return utilities.ConstructServerError(
+		"No entries found in repository map for image") }
+	if len(images) > 1 { return utilities.ConstructServerError(
+		"More than one entry found in repository map for image") }
+	var layers = images[0].layers
+	
+	var tempDirPath string
+	tempDirPath, err = utilities.MakeTempDir()
+	if err != nil { return err }
+	defer os.RemoveAll(tempDirPath)
+	var layerFilePaths = make([]string, len(layers))
+	for i, layer := range layers {
+		layerFilePaths[i] = fmt.Sprintf("%s/%d/layer.tar", tempDirPath, i)
+		err = os.Mkdir(path.Dir(layerFilePaths[i]), 0770)
+		if err == nil { err = ioutil.WriteFile(layerFilePaths[i], layer, 0660) }
+		if err != nil { return err }
+	}
+	
+	var ctx = registry.ctx
+	if ctx == nil { ctx = context.Background() }
+	var layerDigests = make([]string, len(layers))
+	err = runTransfers(ctx, registry.GetParallelism(), len(layers),
+		func(ctx context.Context, i int) error {
+			var err error
+			layerDigests[i], err = registry.WithContext(ctx).PushLayer(layerFilePaths[i], repoName)
+			return err
+		})
+	if err != nil { return err }
+	return registry.PushManifest(repoName, tag, strings.TrimPrefix(images[0].id, "sha256:"), layerDigests)
+}
+
+/*******************************************************************************
+ * Push the layer in the specified file, and return its digest - hex, without
+ * the "sha256:" prefix, as DockerRegistryImpl.PushLayer does.
+ */
+func (registry *InMemoryDockerRegistry) PushLayer(layerFilePath, repoName string) (string, error) {
+	
+	var err = registry.record(registry.ctx, "PushLayer", layerFilePath, repoName)
+	if err != nil { return "", err }
+	var content []byte
+	content, err = ioutil.ReadFile(layerFilePath)
+	if err != nil { return "", err }
+	return strings.TrimPrefix(registry.store.putBlob(repoName, content), "sha256:"), nil
+}
+
+/*******************************************************************************
+ * Store the manifest that DockerRegistryImpl.PushManifest would send. Each
+ * layer must have been pushed to the repository.
+ */
+func (registry *InMemoryDockerRegistry) PushManifest(repoName, tag, imageDigestString string,
+	layerDigestStrings []string) error {
+	
+	var err = registry.record(registry.ctx, "PushManifest", repoName, tag,
+		imageDigestString, layerDigestStrings)
+	if err != nil { return err }
+	_, _, err = registry.store.putManifest(repoName, tag, layerDigestStrings, "PushManifest")
+	return err
+}
+
+func (registry *InMemoryDockerRegistry) GetRegistryAuth() (string, *DockerRegistryAuth) {
+	
+	var registryHost = registry.store.registryHost
+	if registry.store.userId == "" { return registryHost, nil }
+	return registryHost, &DockerRegistryAuth{
+		Username: registry.store.userId,
+		Password: registry.store.password,
+		ServerAddress: registryHost,
+	}
+}
+
+/*******************************************************************************
+ * Errors, as DockerRegistryImpl reports the registry's responses.
+ */
+func manifestUnknownError(operation, message string) error {
+	return inMemoryRegistryError(404, "MANIFEST_UNKNOWN", operation, message, "manifest unknown")
+}
+
+func blobUnknownError(operation, digest string) error {
+	return inMemoryRegistryError(404, "BLOB_UNKNOWN", operation,
+		"when requesting blob " + digest, "blob unknown to registry")
+}
+
+/*******************************************************************************
+ * Store operations. Digests are accepted with or without the "sha256:" prefix.
+ */
+func normalizeBlobDigest(digest string) string {
+	if strings.Contains(digest, ":") { return digest }
+	return "sha256:" + digest
+}
+
+/*******************************************************************************
+ * Return true if the credentials are those that the registry requires, if any.
+ */
+func (store *inMemoryRegistryStore) authorizes(auth *DockerRegistryAuth) bool {
+	if store.userId == "" { return true }
+	return (auth != nil) && (auth.Username == store.userId) && (auth.Password == store.password)
+}
+
+/*
+ * Return the named repository, creating it if it does not exist. The lock
+ * must be held.
+ */
+func (store *inMemoryRegistryStore) repository(repoName string) *inMemoryRepository {
+	
+	var repo = store.repos[repoName]
+	if repo == nil {
+		repo = &inMemoryRepository{
+			blobs: make(map[string]bool),
+			manifests: make(map[string][]byte),
+			tags: make(map[string]string),
+		}
+		store.repos[repoName] = repo
+	}
+	return repo
+}
+
+func (store *inMemoryRegistryStore) putBlob(repoName string, content []byte) string {
+	
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var digest = inMemoryDigest(content)
+	store.blobs[digest] = content
+	store.repository(repoName).blobs[digest] = true
+	return digest
+}
+
+func (store *inMemoryRegistryStore) hasBlob(repoName, digest string) bool {
+	
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var repo = store.repos[repoName]
+	return (repo != nil) && repo.blobs[normalizeBlobDigest(digest)]
+}
+
+func (store *inMemoryRegistryStore) blob(repoName, digest string) ([]byte, bool) {
+	
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	digest = normalizeBlobDigest(digest)
+	var repo = store.repos[repoName]
+	if (repo == nil) || (! repo.blobs[digest]) { return nil, false }
+	return store.blobs[digest], true
+}
+
+/*******************************************************************************
+ * Store the manifest of the layers, whose digests are hex, without the
+ * "sha256:" prefix, and tag it. Return the manifest's digest and size.
+ */
+func (store *inMemoryRegistryStore) putManifest(repoName, tag string, layerDigests []string,
+	operation string) (string, int, error) {
+	
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var repo = store.repository(repoName)
+	for _, layerDigest := range layerDigests {
+		if ! repo.blobs[normalizeBlobDigest(layerDigest)] {
+			return "", 0, inMemoryRegistryError(400, "MANIFEST_BLOB_UNKNOWN", operation,
+				"while putting manifest", "blob unknown to registry: " + layerDigest)
+		}
+	}
+	var manifest = []byte(composeManifest(repoName, tag, layerDigests))
+	var digest = inMemoryDigest(manifest)
+	repo.manifests[digest] = manifest
+	repo.tags[tag] = digest
+	return digest, len(manifest), nil
+}
+
+/*******************************************************************************
+ * Return the manifest that the reference - a tag or a digest - identifies,
+ * and its digest.
+ */
+func (store *inMemoryRegistryStore) manifest(repoName, reference string) ([]byte, string, bool) {
+	
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var repo = store.repos[repoName]
+	if repo == nil { return nil, "", false }
+	var digest = reference
+	if ! strings.HasPrefix(reference, "sha256:") { digest = repo.tags[reference] }
+	var manifest = repo.manifests[digest]
+	if manifest == nil { return nil, "", false }
+	return manifest, digest, true
+}
+
+/*******************************************************************************
+ * Return the content of the layers of the image, base layer first.
+ */
+func (store *inMemoryRegistryStore) layers(repoName, reference, operation string) ([][]byte, error) {
+	
+	var manifest, _, found = store.manifest(repoName, reference)
+	if ! found { return nil, manifestUnknownError(operation, "while getting image") }
+	var layerAr, err = parseManifest(ioutil.NopCloser(bytes.NewReader(manifest)))
+	if err != nil { return nil, err }
+	var layers = make([][]byte, len(layerAr))
+	for i, layerDesc := range layerAr {  // top layer first
+		var digest, _ = layerDesc["blobSum"].(string)
+		var content, found = store.blob(repoName, digest)
+		if ! found { return nil, blobUnknownError(operation, digest) }
+		layers[len(layerAr) - 1 - i] = content
+	}
+	return layers, nil
+}
+
+/*******************************************************************************
+ * Delete the manifest that the reference identifies, the tags of that manifest,
+ * and its layers from the repository. Blobs that no repository has are removed.
+ */
+func (store *inMemoryRegistryStore) deleteImage(repoName, reference string) error {
+	
+	var manifest, digest, found = store.manifest(repoName, reference)
+	if ! found { return manifestUnknownError("DeleteImage", "while deleting image") }
+	var layerAr, err = parseManifest(ioutil.NopCloser(bytes.NewReader(manifest)))
+	if err != nil { return err }
+	
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var repo = store.repos[repoName]
+	for _, layerDesc := range layerAr {
+		var layerDigest, _ = layerDesc["blobSum"].(string)
+		delete(repo.blobs, layerDigest)
+		var held = false
+		for _, otherRepo := range store.repos { held = held || otherRepo.blobs[layerDigest] }
+		if ! held { delete(store.blobs, layerDigest) }
+	}
+	delete(repo.manifests, digest)
+	for tag, tagDigest := range repo.tags {
+		if tagDigest == digest { delete(repo.tags, tag) }
+	}
+	return nil
+}
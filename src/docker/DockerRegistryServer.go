@@ -0,0 +1,514 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"bytes"
+	"strings"
+	"strconv"
+	"net/http"
+	"io/ioutil"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+)
+
+/*******************************************************************************
+ * An http.Handler that implements the Docker Registry v2 (OCI distribution)
+ * API, backed by a directory of the local filesystem. It may be embedded in a
+ * process - e.g., to exercise DockerRegistryImpl over real HTTP, or to serve
+ * images at a site without access to another registry:
+	var server, err = NewDockerRegistryServer("/var/lib/registry")
+	server.SetCredentials("user", "secret")
+	http.ListenAndServe(":5000", server)
+ * The API supported is:
+	GET /v2/ - ping
+	GET /v2/_catalog[?n=<n>&last=<name>]
+	GET /v2/<name>/tags/list[?n=<n>&last=<tag>]
+	GET, HEAD, PUT, DELETE /v2/<name>/manifests/<tag or digest>
+	GET, HEAD, DELETE /v2/<name>/blobs/<digest>
+	POST /v2/<name>/blobs/uploads/[?digest=<digest> | ?mount=<digest>&from=<name>]
+	GET, PATCH, PUT, DELETE /v2/<name>/blobs/uploads/<uuid>[?digest=<digest>]
+ * Deleting a manifest by tag removes only the tag.
+ */
+type DockerRegistryServer struct {
+	store *registryServerStore
+	userId string
+	password string
+}
+
+const (
+	maxRegistryManifestSize = 4 * 1024 * 1024
+	defaultRegistryManifestMediaType = "application/vnd.docker.distribution.manifest.v1+json"
+)
+
+/*******************************************************************************
+ * Create a registry server whose content is stored in the directory, which is
+ * created if it does not exist. Content already in the directory is served.
+ */
+func NewDockerRegistryServer(dirPath string) (*DockerRegistryServer, error) {
+	
+	var store, err = newRegistryServerStore(dirPath)
+	if err != nil { return nil, err }
+	return &DockerRegistryServer{ store: store }, nil
+}
+
+/*******************************************************************************
+ * Require HTTP basic authentication with the credentials for every request. An
+ * empty userId removes the requirement. Call before the server is serving.
+ */
+func (server *DockerRegistryServer) SetCredentials(userId, password string) {
+	server.userId = userId
+	server.password = password
+}
+
+/*******************************************************************************
+ * Implement http.Handler.
+ */
+func (server *DockerRegistryServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	
+	logDebug("Registry request", "method", request.Method, "path", request.URL.Path)
+	writer.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if ! server.authorized(request) {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="Registry"`)
+		writeRegistryServerError(writer, newRegistryServerError(401, "UNAUTHORIZED",
+			"authentication required", nil))
+		return
+	}
+	
+	var err = server.route(writer, request)
+	if err != nil { writeRegistryServerError(writer, err) }
+}
+
+func (server *DockerRegistryServer) authorized(request *http.Request) bool {
+	
+	if server.userId == "" { return true }
+	var userId, password, ok = request.BasicAuth()
+	if ! ok { return false }
+	var userIdMatches = subtle.ConstantTimeCompare([]byte(userId), []byte(server.userId))
+	var passwordMatches = subtle.ConstantTimeCompare([]byte(password), []byte(server.password))
+	return (userIdMatches & passwordMatches) == 1
+}
+
+/*******************************************************************************
+ * Dispatch the request by its path. A repository name may contain "/", so the
+ * path is split at the last of the API's own path elements.
+ */
+func (server *DockerRegistryServer) route(writer http.ResponseWriter, request *http.Request) error {
+	
+	var method = request.Method
+	if ! strings.HasPrefix(request.URL.Path, "/v2/") { return registryPathUnknownError(request) }
+	var path = strings.TrimPrefix(request.URL.Path, "/v2/")
+	
+	if path == "" {
+		if (method != "GET") && (method != "HEAD") { return registryMethodUnsupportedError(request) }
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(200)
+		if method == "GET" { writer.Write([]byte("{}")) }
+		return nil
+	}
+	if path == "_catalog" {
+		if method != "GET" { return registryMethodUnsupportedError(request) }
+		return server.getCatalog(writer, request)
+	}
+	if strings.HasSuffix(path, "/tags/list") {
+		if method != "GET" { return registryMethodUnsupportedError(request) }
+		var name = strings.TrimSuffix(path, "/tags/list")
+		var err = validateRegistryRepoName(name)
+		if err != nil { return err }
+		return server.getTags(writer, request, name)
+	}
+	
+	var name, kind, reference string
+	var kindIndex = -1
+	for _, element := range []string{ "/blobs/uploads/", "/manifests/", "/blobs/" } {
+		var index = strings.LastIndex(path, element)
+		if index <= kindIndex { continue }
+		name, kind, reference = path[:index], strings.Trim(element, "/"), path[index+len(element):]
+		kindIndex = index
+	}
+	if (kind == "") && strings.HasSuffix(path, "/blobs/uploads") {
+		name, kind = strings.TrimSuffix(path, "/blobs/uploads"), "blobs/uploads"
+	}
+	if kind == "" { return registryPathUnknownError(request) }
+	var err = validateRegistryRepoName(name)
+	if err != nil { return err }
+	
+	switch kind + " " + method {
+	case "manifests GET", "manifests HEAD": return server.getManifest(writer, request, name, reference)
+	case "manifests PUT": return server.putManifest(writer, request, name, reference)
+	case "manifests DELETE": return server.deleteManifest(writer, name, reference)
+	case "blobs GET", "blobs HEAD": return server.getBlob(writer, request, name, reference)
+	case "blobs DELETE": return server.deleteBlob(writer, name, reference)
+	case "blobs/uploads POST":
+		if reference != "" { return registryMethodUnsupportedError(request) }
+		return server.startUpload(writer, request, name)
+	case "blobs/uploads GET": return server.getUpload(writer, request, name, reference)
+	case "blobs/uploads PATCH": return server.patchUpload(writer, request, name, reference)
+	case "blobs/uploads PUT": return server.putUpload(writer, request, name, reference)
+	case "blobs/uploads DELETE": return server.cancelUpload(writer, name, reference)
+	}
+	return registryMethodUnsupportedError(request)
+}
+
+/*******************************************************************************
+ * Catalog and tags.
+ */
+func (server *DockerRegistryServer) getCatalog(writer http.ResponseWriter, request *http.Request) error {
+	
+	var names, err = server.store.repositories()
+	if err != nil { return err }
+	names, err = paginateRegistryList(writer, request, names)
+	if err != nil { return err }
+	return writeRegistryJSON(writer, 200, map[string]interface{}{ "repositories": names })
+}
+
+func (server *DockerRegistryServer) getTags(writer http.ResponseWriter, request *http.Request,
+	name string) error {
+	
+	var tags, err = server.store.tags(name)
+	if err != nil { return err }
+	tags, err = paginateRegistryList(writer, request, tags)
+	if err != nil { return err }
+	return writeRegistryJSON(writer, 200, map[string]interface{}{ "name": name, "tags": tags })
+}
+
+/*
+ * Return the part of the ordered list that the request's "n" and "last"
+ * parameters select, and if more of the list remains, set a Link header for
+ * the next part.
+ */
+func paginateRegistryList(writer http.ResponseWriter, request *http.Request,
+	list []string) ([]string, error) {
+	
+	var query = request.URL.Query()
+	var last = query.Get("last")
+	if last != "" {
+		list = list[sort.Search(len(list), func(i int) bool { return list[i] > last }):]
+	}
+	if query.Get("n") == "" { return list, nil }
+	var n, err = strconv.Atoi(query.Get("n"))
+	if (err != nil) || (n < 0) { return nil, newRegistryServerError(400, "PAGINATION_NUMBER_INVALID",
+		"invalid number of results requested", map[string]string{ "n": query.Get("n") }) }
+	if n >= len(list) { return list, nil }
+	list = list[:n]
+	if n > 0 {
+		writer.Header().Set("Link", fmt.Sprintf(`<%s?last=%s&n=%d>; rel="next"`,
+			request.URL.Path, list[n-1], n))
+	}
+	return list, nil
+}
+
+/*******************************************************************************
+ * Manifests.
+ */
+func (server *DockerRegistryServer) getManifest(writer http.ResponseWriter, request *http.Request,
+	name, reference string) error {
+	
+	var content, mediaType, digest, err = server.store.getManifest(name, reference)
+	if err != nil { return err }
+	writer.Header().Set("Content-Type", mediaType)
+	writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	writer.Header().Set("Docker-Content-Digest", digest)
+	writer.Header().Set("ETag", `"` + digest + `"`)
+	writer.WriteHeader(200)
+	if request.Method == "GET" { writer.Write(content) }
+	return nil
+}
+
+/*
+ * Store the manifest that is the request body. The blobs that it refers to must
+ * already be in the repository, as must the manifests that an index refers to.
+ */
+func (server *DockerRegistryServer) putManifest(writer http.ResponseWriter, request *http.Request,
+	name, reference string) error {
+	
+	var err error
+	if ! strings.Contains(reference, ":") {
+		err = validateRegistryTag(reference)
+		if err != nil { return err }
+	}
+	var content []byte
+	content, err = ioutil.ReadAll(io.LimitReader(request.Body, maxRegistryManifestSize + 1))
+	if err != nil { return err }
+	if len(content) > maxRegistryManifestSize { return newRegistryServerError(413, "SIZE_INVALID",
+		"manifest is too large", map[string]int{ "limit": maxRegistryManifestSize }) }
+	
+	var sum = sha256.Sum256(content)
+	var digest = "sha256:" + hex.EncodeToString(sum[:])
+	if strings.Contains(reference, ":") && (reference != digest) {
+		return newRegistryServerError(400, "DIGEST_INVALID",
+			"provided digest did not match uploaded content",
+			map[string]string{ "expected": reference, "actual": digest })
+	}
+	err = server.checkManifestReferences(name, content)
+	if err != nil { return err }
+	
+	var mediaType = request.Header.Get("Content-Type")
+	if mediaType == "" { mediaType = defaultRegistryManifestMediaType }
+	err = server.store.putManifest(name, reference, digest, mediaType, content)
+	if err != nil { return err }
+	writer.Header().Set("Location", "/v2/" + name + "/manifests/" + digest)
+	writer.Header().Set("Docker-Content-Digest", digest)
+	writer.Header().Set("Content-Length", "0")
+	writer.WriteHeader(201)
+	return nil
+}
+
+/*
+ * Verify that what the manifest refers to is in the repository. Schema 1
+ * manifests list layers as fsLayers; schema 2 and OCI manifests as a config
+ * and layers; indexes and manifest lists as manifests. Layers that have URLs
+ * are foreign, and need not be in the repository.
+ */
+func (server *DockerRegistryServer) checkManifestReferences(name string, content []byte) error {
+	
+	type descriptor struct {
+		Digest string `json:"digest"`
+		URLs []string `json:"urls"`
+	}
+	var references struct {
+		FSLayers []struct{ BlobSum string `json:"blobSum"` } `json:"fsLayers"`
+		Config *descriptor `json:"config"`
+		Layers []descriptor `json:"layers"`
+		Manifests []descriptor `json:"manifests"`
+	}
+	var err = json.Unmarshal(content, &references)
+	if err != nil { return newRegistryServerError(400, "MANIFEST_INVALID", "manifest invalid",
+		err.Error()) }
+	
+	var blobDigests = make([]string, 0)
+	for _, layer := range references.FSLayers { blobDigests = append(blobDigests, layer.BlobSum) }
+	if references.Config != nil { blobDigests = append(blobDigests, references.Config.Digest) }
+	for _, layer := range references.Layers {
+		if len(layer.URLs) == 0 { blobDigests = append(blobDigests, layer.Digest) }
+	}
+	for _, digest := range blobDigests {
+		if ! server.store.hasBlob(name, digest) {
+			return newRegistryServerError(400, "MANIFEST_BLOB_UNKNOWN",
+				"blob unknown to registry", map[string]string{ "digest": digest })
+		}
+	}
+	for _, manifest := range references.Manifests {
+		var _, _, _, err = server.store.getManifest(name, manifest.Digest)
+		if err != nil { return newRegistryServerError(400, "MANIFEST_BLOB_UNKNOWN",
+			"manifest unknown to registry", map[string]string{ "digest": manifest.Digest }) }
+	}
+	return nil
+}
+
+func (server *DockerRegistryServer) deleteManifest(writer http.ResponseWriter, name, reference string) error {
+	
+	var err = server.store.deleteManifest(name, reference)
+	if err != nil { return err }
+	writer.Header().Set("Content-Length", "0")
+	writer.WriteHeader(202)
+	return nil
+}
+
+/*******************************************************************************
+ * Blobs. A digest that is not well formed identifies no blob.
+ */
+func (server *DockerRegistryServer) getBlob(writer http.ResponseWriter, request *http.Request,
+	name, digest string) error {
+	
+	var file, err = server.store.openBlob(name, digest)
+	if err != nil { return err }
+	defer file.Close()
+	var info os.FileInfo
+	info, err = file.Stat()
+	if err != nil { return err }
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Header().Set("Docker-Content-Digest", digest)
+	writer.Header().Set("ETag", `"` + digest + `"`)
+	writer.Header().Set("Cache-Control", "max-age=31536000")
+	http.ServeContent(writer, request, "", info.ModTime(), file)
+	return nil
+}
+
+func (server *DockerRegistryServer) deleteBlob(writer http.ResponseWriter, name, digest string) error {
+	
+	var err = server.store.unlinkBlob(name, digest)
+	if err != nil { return err }
+	writer.Header().Set("Content-Length", "0")
+	writer.WriteHeader(202)
+	return nil
+}
+
+/*******************************************************************************
+ * Uploads. An upload is started with a POST, which may also complete it: as a
+ * monolithic upload, if a digest is specified, or as a mount of a blob that
+ * another repository has. Otherwise, the upload receives chunks with PATCH,
+ * and is completed with a PUT that specifies the digest, and may have the final
+ * chunk.
+ */
+func (server *DockerRegistryServer) startUpload(writer http.ResponseWriter, request *http.Request,
+	name string) error {
+	
+	var query = request.URL.Query()
+	var mountDigest, fromName = query.Get("mount"), query.Get("from")
+	if (mountDigest != "") && (validateRegistryRepoName(fromName) == nil) {
+		var mounted, err = server.store.mountBlob(name, fromName, mountDigest)
+		if err != nil { return err }
+		if mounted { return writeBlobCreated(writer, name, mountDigest) }
+	}
+	
+	var uploadId, err = server.store.startUpload(name)
+	if err != nil { return err }
+	var digest = query.Get("digest")
+	if digest == "" { return writeUploadAccepted(writer, request, name, uploadId, 0) }
+	err = server.store.completeUpload(name, uploadId, digest, request.Body, -1, -1)
+	if err != nil { return err }
+	return writeBlobCreated(writer, name, digest)
+}
+
+func (server *DockerRegistryServer) getUpload(writer http.ResponseWriter, request *http.Request,
+	name, uploadId string) error {
+	
+	var size, err = server.store.uploadSize(name, uploadId)
+	if err != nil { return err }
+	setUploadHeaders(writer, request, name, uploadId, size)
+	writer.WriteHeader(204)
+	return nil
+}
+
+func (server *DockerRegistryServer) patchUpload(writer http.ResponseWriter, request *http.Request,
+	name, uploadId string) error {
+	
+	var start, end, err = parseUploadContentRange(request)
+	if err != nil { return err }
+	var size int64
+	size, err = server.store.appendUpload(name, uploadId, request.Body, start, end)
+	if err == errRegistryRangeInvalid { setUploadHeaders(writer, request, name, uploadId, size) }
+	if err != nil { return err }
+	return writeUploadAccepted(writer, request, name, uploadId, size)
+}
+
+func (server *DockerRegistryServer) putUpload(writer http.ResponseWriter, request *http.Request,
+	name, uploadId string) error {
+	
+	var digest = request.URL.Query().Get("digest")
+	if digest == "" { return newRegistryServerError(400, "DIGEST_INVALID",
+		"provided digest did not match uploaded content", "digest parameter is missing") }
+	var start, end, err = parseUploadContentRange(request)
+	if err != nil { return err }
+	err = server.store.completeUpload(name, uploadId, digest, request.Body, start, end)
+	if err != nil { return err }
+	return writeBlobCreated(writer, name, digest)
+}
+
+func (server *DockerRegistryServer) cancelUpload(writer http.ResponseWriter, name, uploadId string) error {
+	
+	var err = server.store.cancelUpload(name, uploadId)
+	if err != nil { return err }
+	writer.Header().Set("Content-Length", "0")
+	writer.WriteHeader(204)
+	return nil
+}
+
+/*
+ * Return the offsets of the chunk that the request's Content-Range header
+ * specifies, as "<start>-<end>", or -1 for each if there is no header.
+ */
+func parseUploadContentRange(request *http.Request) (int64, int64, error) {
+	
+	var contentRange = request.Header.Get("Content-Range")
+	if contentRange == "" { return -1, -1, nil }
+	contentRange = strings.TrimPrefix(strings.TrimPrefix(contentRange, "bytes="), "bytes ")
+	var bounds = strings.SplitN(contentRange, "-", 2)
+	if len(bounds) == 2 {
+		var start, startErr = strconv.ParseInt(bounds[0], 10, 64)
+		var end, endErr = strconv.ParseInt(bounds[1], 10, 64)
+		if (startErr == nil) && (endErr == nil) && (start >= 0) && (end >= start - 1) {
+			return start, end, nil
+		}
+	}
+	return 0, 0, newRegistryServerError(416, "BLOB_UPLOAD_INVALID", "blob upload invalid",
+		map[string]string{ "Content-Range": request.Header.Get("Content-Range") })
+}
+
+/*
+ * The Location of an upload is absolute, and has a query, so that a client may
+ * append "&digest=..." to it.
+ */
+func setUploadHeaders(writer http.ResponseWriter, request *http.Request, name, uploadId string,
+	size int64) {
+	
+	var scheme = "http"
+	if request.TLS != nil { scheme = "https" }
+	writer.Header().Set("Location", fmt.Sprintf("%s://%s/v2/%s/blobs/uploads/%s?_state=%s",
+		scheme, request.Host, name, uploadId, uploadId))
+	writer.Header().Set("Docker-Upload-UUID", uploadId)
+	var lastOffset = size - 1
+	if lastOffset < 0 { lastOffset = 0 }
+	writer.Header().Set("Range", fmt.Sprintf("0-%d", lastOffset))
+}
+
+func writeUploadAccepted(writer http.ResponseWriter, request *http.Request, name, uploadId string,
+	size int64) error {
+	
+	setUploadHeaders(writer, request, name, uploadId, size)
+	writer.Header().Set("Content-Length", "0")
+	writer.WriteHeader(202)
+	return nil
+}
+
+func writeBlobCreated(writer http.ResponseWriter, name, digest string) error {
+	
+	writer.Header().Set("Location", "/v2/" + name + "/blobs/" + digest)
+	writer.Header().Set("Docker-Content-Digest", digest)
+	writer.Header().Set("Content-Length", "0")
+	writer.WriteHeader(201)
+	return nil
+}
+
+/*******************************************************************************
+ * Responses.
+ */
+func writeRegistryJSON(writer http.ResponseWriter, statusCode int, value interface{}) error {
+	
+	var content, err = json.Marshal(value)
+	if err != nil { return err }
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	writer.WriteHeader(statusCode)
+	writer.Write(content)
+	return nil
+}
+
+/*
+ * Write the error as a registry error response. An error that is not a
+ * registry error is reported as UNKNOWN, with status 500.
+ */
+func writeRegistryServerError(writer http.ResponseWriter, err error) {
+	
+	var serverErr, isType = err.(*registryServerError)
+	if ! isType {
+		logWarn("Registry server error", "error", err.Error())
+		serverErr = newRegistryServerError(500, "UNKNOWN", "unknown error", err.Error())
+	}
+	var body = map[string]interface{}{
+		"errors": []map[string]interface{}{
+			{ "code": serverErr.code, "message": serverErr.message, "detail": serverErr.detail },
+		},
+	}
+	var content, _ = json.Marshal(body)
+	writer.Header().Del("Docker-Content-Digest")
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	writer.WriteHeader(serverErr.statusCode)
+	io.Copy(writer, bytes.NewReader(content))
+}
+
+func registryPathUnknownError(request *http.Request) error {
+	return newRegistryServerError(404, "NOT_FOUND", "no such API endpoint",
+		map[string]string{ "path": request.URL.Path })
+}
+
+func registryMethodUnsupportedError(request *http.Request) error {
+	return newRegistryServerError(405, "UNSUPPORTED", "the operation is unsupported",
+		map[string]string{ "method": request.Method, "path": request.URL.Path })
+}
@@ -0,0 +1,584 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"hash"
+	"sort"
+	"sync"
+	"regexp"
+	"strings"
+	"io/ioutil"
+	"crypto/rand"
+	"encoding/hex"
+	"path/filepath"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * The filesystem store of a DockerRegistryServer. Blob content is held once,
+ * by digest, however many repositories have the blob; a repository has a link
+ * to each of its blobs, and holds its manifests and tags:
+	blobs/<algorithm>/<hex>
+	repositories/<name>/_layers/<algorithm>/<hex> - an empty link file
+	repositories/<name>/_manifests/revisions/<algorithm>/<hex>/data
+	repositories/<name>/_manifests/revisions/<algorithm>/<hex>/mediatype
+	repositories/<name>/_manifests/tags/<tag> - the digest of the tagged manifest
+	uploads/<uuid>/data, uploads/<uuid>/repository - an upload in progress
+ * Content is written to a temporary file and then renamed, so that a blob or
+ * manifest is never seen partly written. Names, tags, digests and upload Ids
+ * are validated before they are used in paths. The number of links to each
+ * blob is counted when the store is opened, and kept up to date, so that a
+ * blob can be removed when its last link is, without searching the
+ * repositories.
+ */
+type registryServerStore struct {
+	dirPath string
+	lock sync.Mutex  // for blobs, links, manifests and tags
+	linkCounts map[string]int  // the number of links to each blob, by digest path
+	uploadLocks map[string]*sync.Mutex  // by upload Id, while the upload is in progress
+}
+
+var (
+	// Repository names, as the registry API defines them.
+	registryRepoNamePattern = regexp.MustCompile(
+		`^[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*)*$`)
+	registryTagPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	registryUploadIdPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+const maxRegistryRepoNameLength = 255
+
+/*******************************************************************************
+ * An error response of the registry API, e.g.,
+	{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown","detail":{...}}]}
+ */
+type registryServerError struct {
+	statusCode int
+	code string
+	message string
+	detail interface{}
+}
+
+func (serverErr *registryServerError) Error() string {
+	return serverErr.code + ": " + serverErr.message
+}
+
+func newRegistryServerError(statusCode int, code, message string, detail interface{}) *registryServerError {
+	return &registryServerError{ statusCode: statusCode, code: code, message: message, detail: detail }
+}
+
+func newRegistryServerStore(dirPath string) (*registryServerStore, error) {
+	
+	for _, subdir := range []string{ "blobs", "repositories", "uploads" } {
+		var err = os.MkdirAll(filepath.Join(dirPath, subdir), 0700)
+		if err != nil { return nil, utilities.ConstructServerError(fmt.Sprintf(
+			"Could not create registry directory '%s': %s", dirPath, err.Error())) }
+	}
+	var store = &registryServerStore{
+		dirPath: dirPath,
+		linkCounts: make(map[string]int),
+		uploadLocks: make(map[string]*sync.Mutex),
+	}
+	var err = store.countLinks()
+	if err != nil { return nil, utilities.ConstructServerError(fmt.Sprintf(
+		"Could not read registry directory '%s': %s", dirPath, err.Error())) }
+	return store, nil
+}
+
+/*
+ * Count the links to each blob, i.e., the files _layers/<algorithm>/<hex> of
+ * the repositories. (A repository name cannot have a component "_layers".)
+ */
+func (store *registryServerStore) countLinks() error {
+	
+	return filepath.Walk(filepath.Join(store.dirPath, "repositories"),
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil { return err }
+			if info.IsDir() { return nil }
+			var parts = strings.Split(filepath.ToSlash(path), "/")
+			if (len(parts) < 3) || (parts[len(parts)-3] != "_layers") { return nil }
+			store.linkCounts[filepath.Join(parts[len(parts)-2], parts[len(parts)-1])]++
+			return nil
+		})
+}
+
+/*******************************************************************************
+ * Validation.
+ */
+func validateRegistryRepoName(name string) error {
+	if (len(name) > maxRegistryRepoNameLength) || (! registryRepoNamePattern.MatchString(name)) {
+		return newRegistryServerError(400, "NAME_INVALID", "invalid repository name", map[string]string{ "name": name })
+	}
+	return nil
+}
+
+func validateRegistryTag(tag string) error {
+	if ! registryTagPattern.MatchString(tag) {
+		return newRegistryServerError(400, "TAG_INVALID", "manifest tag did not match URI", map[string]string{ "tag": tag })
+	}
+	return nil
+}
+
+/*
+ * Return the path, relative to a directory of digests, of the content with the
+ * specified digest, and a hasher with which to verify the content.
+ */
+func registryDigestPath(digest string) (string, hash.Hash, error) {
+	var hasher, algorithm, hexDigest, err = parseDigest(digest)
+	if err != nil { return "", nil, newRegistryServerError(400, "DIGEST_INVALID",
+		"provided digest did not match uploaded content", map[string]string{ "digest": digest }) }
+	return filepath.Join(algorithm, hexDigest), hasher, nil
+}
+
+func (store *registryServerStore) repoDirPath(name string) string {
+	return filepath.Join(store.dirPath, "repositories", filepath.FromSlash(name))
+}
+
+func (store *registryServerStore) blobPath(digestPath string) string {
+	return filepath.Join(store.dirPath, "blobs", digestPath)
+}
+
+func (store *registryServerStore) linkPath(name, digestPath string) string {
+	return filepath.Join(store.repoDirPath(name), "_layers", digestPath)
+}
+
+/*******************************************************************************
+ * Move the temporary file, whose content is that of the digest, into place as
+ * the content of the digest, unless it is already there. The lock must be
+ * held, and kept until the blob is linked, lest the blob be removed meanwhile.
+ */
+func (store *registryServerStore) installBlob(digestPath, tempFilePath string) error {
+	
+	var blobPath = store.blobPath(digestPath)
+	var err = os.MkdirAll(filepath.Dir(blobPath), 0700)
+	if err != nil { return err }
+	if _, statErr := os.Stat(blobPath); statErr == nil {
+		os.Remove(tempFilePath)
+		return nil
+	}
+	return os.Rename(tempFilePath, blobPath)
+}
+
+/*******************************************************************************
+ * Blobs of repositories.
+ */
+
+/*
+ * Link the blob, which must be in the store, to the repository. The lock must
+ * be held.
+ */
+func (store *registryServerStore) linkBlob(name, digestPath string) error {
+	
+	var linkPath = store.linkPath(name, digestPath)
+	if _, statErr := os.Stat(linkPath); statErr == nil { return nil }
+	var err = os.MkdirAll(filepath.Dir(linkPath), 0700)
+	if err != nil { return err }
+	err = ioutil.WriteFile(linkPath, []byte{}, 0600)
+	if err != nil { return err }
+	store.linkCounts[digestPath]++
+	return nil
+}
+
+/*
+ * Link the blob that the repository fromName has to the repository name.
+ * Return false if fromName does not have the blob.
+ */
+func (store *registryServerStore) mountBlob(name, fromName, digest string) (bool, error) {
+	
+	var digestPath, _, err = registryDigestPath(digest)
+	if err != nil { return false, nil }
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if ! store.hasLinkedBlob(fromName, digestPath) { return false, nil }
+	return true, store.linkBlob(name, digestPath)
+}
+
+func (store *registryServerStore) hasBlob(name, digest string) bool {
+	
+	var digestPath, _, err = registryDigestPath(digest)
+	if err != nil { return false }
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.hasLinkedBlob(name, digestPath)
+}
+
+/*
+ * The lock must be held.
+ */
+func (store *registryServerStore) hasLinkedBlob(name, digestPath string) bool {
+	var _, linkErr = os.Stat(store.linkPath(name, digestPath))
+	var _, blobErr = os.Stat(store.blobPath(digestPath))
+	return (linkErr == nil) && (blobErr == nil)
+}
+
+/*******************************************************************************
+ * Open the content of the repository's blob. The caller must close the file.
+ */
+func (store *registryServerStore) openBlob(name, digest string) (*os.File, error) {
+	
+	if ! store.hasBlob(name, digest) { return nil, blobUnknownServerError(digest) }
+	var digestPath, _, _ = registryDigestPath(digest)
+	var file, err = os.Open(store.blobPath(digestPath))
+	if os.IsNotExist(err) { return nil, blobUnknownServerError(digest) }
+	return file, err
+}
+
+/*******************************************************************************
+ * Remove the blob from the repository, and its content if no other repository
+ * has it.
+ */
+func (store *registryServerStore) unlinkBlob(name, digest string) error {
+	
+	var digestPath, _, err = registryDigestPath(digest)
+	if err != nil { return blobUnknownServerError(digest) }
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	err = os.Remove(store.linkPath(name, digestPath))
+	if os.IsNotExist(err) { return blobUnknownServerError(digest) }
+	if err != nil { return err }
+	
+	store.linkCounts[digestPath]--
+	if store.linkCounts[digestPath] > 0 { return nil }
+	delete(store.linkCounts, digestPath)
+	os.Remove(store.blobPath(digestPath))
+	return nil
+}
+
+func blobUnknownServerError(digest string) error {
+	return newRegistryServerError(404, "BLOB_UNKNOWN", "blob unknown to registry",
+		map[string]string{ "digest": digest })
+}
+
+/*******************************************************************************
+ * Repositories and tags.
+ */
+
+/*
+ * Return the names of the repositories that have a blob or a manifest, in
+ * order.
+ */
+func (store *registryServerStore) repositories() ([]string, error) {
+	
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var reposDirPath = filepath.Join(store.dirPath, "repositories")
+	var names = make([]string, 0)
+	var err = filepath.Walk(reposDirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil { return err }
+		if ! info.IsDir() { return nil }
+		var base = filepath.Base(path)
+		if (base != "_layers") && (base != "_manifests") { return nil }
+		var name, _ = filepath.Rel(reposDirPath, filepath.Dir(path))
+		names = append(names, filepath.ToSlash(name))
+		return filepath.SkipDir
+	})
+	if err != nil { return nil, err }
+	sort.Strings(names)
+	var unique = make([]string, 0, len(names))
+	for i, name := range names {
+		if (i == 0) || (names[i-1] != name) { unique = append(unique, name) }
+	}
+	return unique, nil
+}
+
+/*
+ * Return the tags of the repository, in order. Return a NAME_UNKNOWN error if
+ * there is no such repository.
+ */
+func (store *registryServerStore) tags(name string) ([]string, error) {
+	
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var _, layersErr = os.Stat(filepath.Join(store.repoDirPath(name), "_layers"))
+	var _, manifestsErr = os.Stat(filepath.Join(store.repoDirPath(name), "_manifests"))
+	if (layersErr != nil) && (manifestsErr != nil) { return nil, newRegistryServerError(404, "NAME_UNKNOWN",
+		"repository name not known to registry", map[string]string{ "name": name }) }
+	var entries []os.FileInfo
+	var err error
+	entries, err = ioutil.ReadDir(filepath.Join(store.repoDirPath(name), "_manifests", "tags"))
+	if os.IsNotExist(err) { return []string{}, nil }
+	if err != nil { return nil, err }
+	var tags = make([]string, 0, len(entries))
+	for _, entry := range entries { tags = append(tags, entry.Name()) }
+	sort.Strings(tags)
+	return tags, nil
+}
+
+/*******************************************************************************
+ * Manifests.
+ */
+func (store *registryServerStore) revisionDirPath(name, digestPath string) string {
+	return filepath.Join(store.repoDirPath(name), "_manifests", "revisions", digestPath)
+}
+
+func (store *registryServerStore) tagPath(name, tag string) string {
+	return filepath.Join(store.repoDirPath(name), "_manifests", "tags", tag)
+}
+
+/*
+ * Return the digest of the manifest that the reference - a digest or a tag -
+ * identifies. The lock must be held.
+ */
+func (store *registryServerStore) resolveManifest(name, reference string) (string, error) {
+	
+	var digest = reference
+	if ! strings.Contains(reference, ":") {
+		var err = validateRegistryTag(reference)
+		if err != nil { return "", err }
+		var content []byte
+		content, err = ioutil.ReadFile(store.tagPath(name, reference))
+		if err != nil { return "", manifestUnknownServerError(reference) }
+		digest = strings.TrimSpace(string(content))
+	}
+	var digestPath, _, err = registryDigestPath(digest)
+	if err != nil { return "", manifestUnknownServerError(reference) }
+	_, err = os.Stat(filepath.Join(store.revisionDirPath(name, digestPath), "data"))
+	if err != nil { return "", manifestUnknownServerError(reference) }
+	return digest, nil
+}
+
+/*
+ * Return the manifest that the reference identifies, its media type, and its
+ * digest.
+ */
+func (store *registryServerStore) getManifest(name, reference string) ([]byte, string, string, error) {
+	
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var digest, err = store.resolveManifest(name, reference)
+	if err != nil { return nil, "", "", err }
+	var digestPath, _, _ = registryDigestPath(digest)
+	var revisionDirPath = store.revisionDirPath(name, digestPath)
+	var content, mediaType []byte
+	content, err = ioutil.ReadFile(filepath.Join(revisionDirPath, "data"))
+	if err != nil { return nil, "", "", err }
+	mediaType, err = ioutil.ReadFile(filepath.Join(revisionDirPath, "mediatype"))
+	if err != nil { return nil, "", "", err }
+	return content, string(mediaType), digest, nil
+}
+
+/*
+ * Store the manifest, whose digest has been computed, and tag it if the
+ * reference is a tag.
+ */
+func (store *registryServerStore) putManifest(name, reference, digest, mediaType string,
+	content []byte) error {
+	
+	var digestPath, _, err = registryDigestPath(digest)
+	if err != nil { return err }
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var revisionDirPath = store.revisionDirPath(name, digestPath)
+	err = os.MkdirAll(revisionDirPath, 0700)
+	if err == nil { err = writeFileAtomically(filepath.Join(revisionDirPath, "mediatype"), []byte(mediaType)) }
+	if err == nil { err = writeFileAtomically(filepath.Join(revisionDirPath, "data"), content) }
+	if (err != nil) || strings.Contains(reference, ":") { return err }
+	err = os.MkdirAll(filepath.Dir(store.tagPath(name, reference)), 0700)
+	if err != nil { return err }
+	return writeFileAtomically(store.tagPath(name, reference), []byte(digest))
+}
+
+/*
+ * Delete the reference: if it is a tag, only the tag is deleted; if it is a
+ * digest, the manifest, and any tags of it, are deleted.
+ */
+func (store *registryServerStore) deleteManifest(name, reference string) error {
+	
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var digest, err = store.resolveManifest(name, reference)
+	if err != nil { return err }
+	if ! strings.Contains(reference, ":") { return os.Remove(store.tagPath(name, reference)) }
+	
+	var digestPath, _, _ = registryDigestPath(digest)
+	err = os.RemoveAll(store.revisionDirPath(name, digestPath))
+	if err != nil { return err }
+	var tagsDirPath = filepath.Join(store.repoDirPath(name), "_manifests", "tags")
+	var entries, _ = ioutil.ReadDir(tagsDirPath)
+	for _, entry := range entries {
+		var tagged, _ = ioutil.ReadFile(filepath.Join(tagsDirPath, entry.Name()))
+		if strings.TrimSpace(string(tagged)) == digest { os.Remove(filepath.Join(tagsDirPath, entry.Name())) }
+	}
+	return nil
+}
+
+func manifestUnknownServerError(reference string) error {
+	return newRegistryServerError(404, "MANIFEST_UNKNOWN", "manifest unknown",
+		map[string]string{ "reference": reference })
+}
+
+/*******************************************************************************
+ * Uploads.
+ */
+func (store *registryServerStore) uploadDirPath(uploadId string) string {
+	return filepath.Join(store.dirPath, "uploads", uploadId)
+}
+
+/*
+ * Start an upload to the repository, and return its Id.
+ */
+func (store *registryServerStore) startUpload(name string) (string, error) {
+	
+	var random = make([]byte, 16)
+	var _, err = rand.Read(random)
+	if err != nil { return "", err }
+	var uploadId = hex.EncodeToString(random)
+	var uploadDirPath = store.uploadDirPath(uploadId)
+	err = os.MkdirAll(uploadDirPath, 0700)
+	if err == nil { err = ioutil.WriteFile(filepath.Join(uploadDirPath, "repository"), []byte(name), 0600) }
+	if err == nil { err = ioutil.WriteFile(filepath.Join(uploadDirPath, "data"), []byte{}, 0600) }
+	if err != nil { os.RemoveAll(uploadDirPath); return "", err }
+	return uploadId, nil
+}
+
+/*
+ * Lock the upload, which must be to the repository, and return the path of its
+ * data and a function that unlocks it.
+ */
+func (store *registryServerStore) lockUpload(name, uploadId string) (string, func(), error) {
+	
+	var unknown = newRegistryServerError(404, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry",
+		map[string]string{ "uuid": uploadId })
+	if ! registryUploadIdPattern.MatchString(uploadId) { return "", nil, unknown }
+	store.lock.Lock()
+	var uploadLock = store.uploadLocks[uploadId]
+	if uploadLock == nil {
+		uploadLock = &sync.Mutex{}
+		store.uploadLocks[uploadId] = uploadLock
+	}
+	store.lock.Unlock()
+	uploadLock.Lock()
+	var unlock = uploadLock.Unlock
+	
+	var repoName, err = ioutil.ReadFile(filepath.Join(store.uploadDirPath(uploadId), "repository"))
+	if (err != nil) || (string(repoName) != name) { unlock(); return "", nil, unknown }
+	return filepath.Join(store.uploadDirPath(uploadId), "data"), unlock, nil
+}
+
+/*
+ * Return the number of bytes received by the upload.
+ */
+func (store *registryServerStore) uploadSize(name, uploadId string) (int64, error) {
+	
+	var dataPath, unlock, err = store.lockUpload(name, uploadId)
+	if err != nil { return 0, err }
+	defer unlock()
+	var info os.FileInfo
+	info, err = os.Stat(dataPath)
+	if err != nil { return 0, err }
+	return info.Size(), nil
+}
+
+/*
+ * Append the chunk to the upload, and return the number of bytes received so
+ * far. If start is not negative, it is the offset of the chunk, which must be
+ * the number of bytes received; if end is not negative, the chunk must end at
+ * that offset (inclusive). A chunk that is not received in full is discarded.
+ */
+func (store *registryServerStore) appendUpload(name, uploadId string, chunk io.Reader,
+	start, end int64) (int64, error) {
+	
+	var dataPath, unlock, err = store.lockUpload(name, uploadId)
+	if err != nil { return 0, err }
+	defer unlock()
+	return appendUploadData(dataPath, chunk, start, end)
+}
+
+func appendUploadData(dataPath string, chunk io.Reader, start, end int64) (int64, error) {
+	
+	var dataFile, err = os.OpenFile(dataPath, os.O_WRONLY, 0600)
+	if err != nil { return 0, err }
+	defer dataFile.Close()
+	var size int64
+	size, err = dataFile.Seek(0, io.SeekEnd)
+	if err != nil { return 0, err }
+	if (start >= 0) && (start != size) { return size, errRegistryRangeInvalid }
+	
+	var written int64
+	written, err = io.Copy(dataFile, chunk)
+	if (err == nil) && (end >= 0) && (size + written != end + 1) { err = errRegistryRangeInvalid }
+	if err != nil {
+		dataFile.Truncate(size)
+		return size, err
+	}
+	return size + written, nil
+}
+
+/*
+ * The Content-Range of a chunk does not start where the upload ended, or the
+ * chunk does not end where its Content-Range says.
+ */
+var errRegistryRangeInvalid = newRegistryServerError(416, "BLOB_UPLOAD_INVALID",
+	"blob upload invalid", "content range does not follow the data received")
+
+/*
+ * Complete the upload with the final chunk, which may be empty: verify the
+ * upload against the digest, and add it to the repository. The upload ends,
+ * whether or not it is verified.
+ */
+func (store *registryServerStore) completeUpload(name, uploadId, digest string,
+	chunk io.Reader, start, end int64) error {
+	
+	var dataPath, unlock, err = store.lockUpload(name, uploadId)
+	if err != nil { return err }
+	defer unlock()
+	var digestPath string
+	var hasher hash.Hash
+	digestPath, hasher, err = registryDigestPath(digest)
+	if err != nil { return err }
+	_, err = appendUploadData(dataPath, chunk, start, end)
+	if err == errRegistryRangeInvalid { return err }  // the client may resend the chunk
+	defer store.endUpload(uploadId)
+	if err != nil { return err }
+	
+	var dataFile *os.File
+	dataFile, err = os.Open(dataPath)
+	if err != nil { return err }
+	_, err = io.Copy(hasher, dataFile)
+	dataFile.Close()
+	if err != nil { return err }
+	if ! digestMatches(digest, hasher) { return newRegistryServerError(400, "DIGEST_INVALID",
+		"provided digest did not match uploaded content", map[string]string{ "digest": digest }) }
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	err = store.installBlob(digestPath, dataPath)
+	if err != nil { return err }
+	return store.linkBlob(name, digestPath)
+}
+
+func (store *registryServerStore) cancelUpload(name, uploadId string) error {
+	
+	var _, unlock, err = store.lockUpload(name, uploadId)
+	if err != nil { return err }
+	defer unlock()
+	return store.endUpload(uploadId)
+}
+
+/*
+ * Remove the upload, whose lock must be held.
+ */
+func (store *registryServerStore) endUpload(uploadId string) error {
+	
+	store.lock.Lock()
+	delete(store.uploadLocks, uploadId)
+	store.lock.Unlock()
+	return os.RemoveAll(store.uploadDirPath(uploadId))
+}
+
+/*******************************************************************************
+ * Replace the file's content, via a temporary file that is renamed.
+ */
+func writeFileAtomically(path string, content []byte) error {
+	
+	var tempFile, err = ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil { return err }
+	_, err = tempFile.Write(content)
+	var closeErr = tempFile.Close()
+	if err == nil { err = closeErr }
+	if err == nil { err = os.Rename(tempFile.Name(), path) }
+	if err != nil { os.Remove(tempFile.Name()) }
+	return err
+}
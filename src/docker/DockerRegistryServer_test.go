@@ -0,0 +1,241 @@
+package docker
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"sync"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"net/http/httptest"
+)
+
+/*******************************************************************************
+ * Serve a registry from a new directory, and return its URL and directory.
+ */
+func startTestRegistryServer(t *testing.T) (string, string) {
+	
+	var dirPath = t.TempDir()
+	var server, err = NewDockerRegistryServer(dirPath)
+	if err != nil { t.Fatal(err) }
+	var httpServer = httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return httpServer.URL, dirPath
+}
+
+func testBlobDigest(content string) string {
+	var digest = sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(digest[:])
+}
+
+/*******************************************************************************
+ * Upload the blob to the repository, monolithically, and return its digest.
+ * Failures are reported with t.Errorf, so that goroutines may call this.
+ */
+func uploadTestBlob(t *testing.T, baseURL, repoName, content string) string {
+	
+	var digest = testBlobDigest(content)
+	var response, err = http.Post(baseURL + "/v2/" + repoName + "/blobs/uploads/?digest=" + digest,
+		"application/octet-stream", strings.NewReader(content))
+	if err != nil { t.Errorf("Upload of %s to %s: %v", digest, repoName, err); return digest }
+	response.Body.Close()
+	if response.StatusCode != 201 { t.Errorf("Upload of %s to %s: %s", digest, repoName, response.Status) }
+	return digest
+}
+
+/*******************************************************************************
+ * Return the status and body of the response to the request; the status is 0
+ * if there is no response (as reported with t.Errorf).
+ */
+func sendTestRequest(t *testing.T, method, url string) (int, string) {
+	
+	var request, err = http.NewRequest(method, url, nil)
+	if err != nil { t.Errorf("%s %s: %v", method, url, err); return 0, "" }
+	var response *http.Response
+	response, err = http.DefaultClient.Do(request)
+	if err != nil { t.Errorf("%s %s: %v", method, url, err); return 0, "" }
+	defer response.Body.Close()
+	var body []byte
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil { t.Errorf("%s %s: %v", method, url, err) }
+	return response.StatusCode, string(body)
+}
+
+/*******************************************************************************
+ * Write an image archive, as "docker save" does, of an image with the layers
+ * (base layer first), and return its path.
+ */
+func writeTestImageArchive(t *testing.T, repoName, tag string, layers ...string) string {
+	
+	var buffer bytes.Buffer
+	var tarWriter = tar.NewWriter(&buffer)
+	var add = func(name, content string) {
+		var err = tarWriter.WriteHeader(&tar.Header{ Name: name, Mode: 0644, Size: int64(len(content)) })
+		if err == nil { _, err = tarWriter.Write([]byte(content)) }
+		if err != nil { t.Fatal(err) }
+	}
+	var layerPaths = make([]string, len(layers))
+	for i, layer := range layers {
+		layerPaths[i] = fmt.Sprintf("%d/layer.tar", i)
+		add(layerPaths[i], layer)
+	}
+	add("config.json", "{}")
+	add("manifest.json", fmt.Sprintf(`[{"Config":"config.json","RepoTags":["%s:%s"],"Layers":["%s"]}]`,
+		repoName, tag, strings.Join(layerPaths, `","`)))
+	add("repositories", fmt.Sprintf(`{"%s":{"%s":"%d"}}`, repoName, tag, len(layers) - 1))
+	var err = tarWriter.Close()
+	if err != nil { t.Fatal(err) }
+	
+	var path = filepath.Join(t.TempDir(), "image.tar")
+	err = ioutil.WriteFile(path, buffer.Bytes(), 0644)
+	if err != nil { t.Fatal(err) }
+	return path
+}
+
+func TestDockerRegistryServerPushPull(t *testing.T) {
+	
+	var baseURL, _ = startTestRegistryServer(t)
+	var serverURL, _ = url.Parse(baseURL)
+	var port, _ = strconv.Atoi(serverURL.Port())
+	var registry, err = OpenDockerRegistryConnection(serverURL.Hostname(), port, "", "")
+	if err != nil { t.Fatal(err) }
+	defer registry.Close()
+	
+	err = registry.PushImage("team/app", "v1", writeTestImageArchive(t, "team/app", "v1", "base", "middle", "top"))
+	if err != nil { t.Fatal(err) }
+	var exists bool
+	exists, err = registry.ImageExists("team/app", "v1")
+	if (err != nil) || (! exists) { t.Fatalf("Pushed image does not exist: %v", err) }
+	
+	// The manifest lists the layers top first; the pulled archive has them base first.
+	var layerAr []map[string]interface{}
+	_, layerAr, err = registry.GetImageInfo("team/app", "v1")
+	if err != nil { t.Fatal(err) }
+	if (len(layerAr) != 3) || (layerAr[0]["blobSum"] != testBlobDigest("top")) {
+		t.Errorf("Unexpected layers in manifest: %v", layerAr)
+	}
+	var imagePath = filepath.Join(t.TempDir(), "pulled.tar")
+	err = registry.GetImage("team/app", "v1", imagePath)
+	if err != nil { t.Fatal(err) }
+	var imageFile *os.File
+	imageFile, err = os.Open(imagePath)
+	if err != nil { t.Fatal(err) }
+	defer imageFile.Close()
+	var contents = make([]string, 0)
+	var tarReader = tar.NewReader(imageFile)
+	for {
+		_, err = tarReader.Next()
+		if err == io.EOF { break }
+		if err != nil { t.Fatal(err) }
+		var content []byte
+		content, err = ioutil.ReadAll(tarReader)
+		if err != nil { t.Fatal(err) }
+		contents = append(contents, string(content))
+	}
+	if strings.Join(contents, " ") != "base middle top" {
+		t.Errorf("Expected layers \"base middle top\", got %q", strings.Join(contents, " "))
+	}
+	
+	var status, body = sendTestRequest(t, "GET", baseURL + "/v2/team/app/tags/list")
+	if (status != 200) || (! strings.Contains(body, `"v1"`)) { t.Errorf("Unexpected tags list: %d %s", status, body) }
+}
+
+func TestDockerRegistryServerDelete(t *testing.T) {
+	
+	var baseURL, dirPath = startTestRegistryServer(t)
+	var digest = uploadTestBlob(t, baseURL, "one", "shared")
+	uploadTestBlob(t, baseURL, "two", "shared")
+	var blobPath = filepath.Join(dirPath, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+	
+	// The content remains until no repository has the blob.
+	var status, _ = sendTestRequest(t, "DELETE", baseURL + "/v2/one/blobs/" + digest)
+	if status != 202 { t.Fatalf("Delete returned %d", status) }
+	status, _ = sendTestRequest(t, "GET", baseURL + "/v2/one/blobs/" + digest)
+	if status != 404 { t.Errorf("Deleted blob returned %d", status) }
+	var body string
+	status, body = sendTestRequest(t, "GET", baseURL + "/v2/two/blobs/" + digest)
+	if (status != 200) || (body != "shared") { t.Errorf("Blob of other repository returned %d %q", status, body) }
+	
+	status, _ = sendTestRequest(t, "DELETE", baseURL + "/v2/two/blobs/" + digest)
+	if status != 202 { t.Fatalf("Delete returned %d", status) }
+	if _, err := os.Stat(blobPath); ! os.IsNotExist(err) { t.Errorf("Content of unlinked blob was not removed") }
+	status, _ = sendTestRequest(t, "DELETE", baseURL + "/v2/two/blobs/" + digest)
+	if status != 404 { t.Errorf("Second delete returned %d", status) }
+	
+	// Links that are on disk when the store is opened are counted.
+	uploadTestBlob(t, baseURL, "three", "kept")
+	uploadTestBlob(t, baseURL, "four", "kept")
+	var server, err = NewDockerRegistryServer(dirPath)
+	if err != nil { t.Fatal(err) }
+	var reopened = httptest.NewServer(server)
+	defer reopened.Close()
+	status, _ = sendTestRequest(t, "DELETE", reopened.URL + "/v2/three/blobs/" + testBlobDigest("kept"))
+	if status != 202 { t.Fatalf("Delete returned %d", status) }
+	status, body = sendTestRequest(t, "GET", reopened.URL + "/v2/four/blobs/" + testBlobDigest("kept"))
+	if (status != 200) || (body != "kept") { t.Errorf("Blob of other repository returned %d %q", status, body) }
+}
+
+/*******************************************************************************
+ * Repositories upload and delete the same blob at once: a blob that has just
+ * been uploaded is never removed by the deletion in another repository.
+ */
+func TestDockerRegistryServerConcurrentUpload(t *testing.T) {
+	
+	var baseURL, _ = startTestRegistryServer(t)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		waitGroup.Add(1)
+		go func(repoName string) {
+			defer waitGroup.Done()
+			for j := 0; j < 50; j++ {
+				var digest = uploadTestBlob(t, baseURL, repoName, "layer content")
+				var status, body = sendTestRequest(t, "GET", baseURL + "/v2/" + repoName + "/blobs/" + digest)
+				if (status != 200) || (body != "layer content") {
+					t.Errorf("Uploaded blob of %s returned %d %q", repoName, status, body)
+					return
+				}
+				status, _ = sendTestRequest(t, "DELETE", baseURL + "/v2/" + repoName + "/blobs/" + digest)
+				if status != 202 { t.Errorf("Delete from %s returned %d", repoName, status); return }
+			}
+		}(fmt.Sprintf("repo%d", i))
+	}
+	waitGroup.Wait()
+}
+
+/*******************************************************************************
+ * As above, but without HTTP, so that an upload is far more likely to complete
+ * just as the other repository deletes the blob.
+ */
+func TestRegistryServerStoreConcurrentUpload(t *testing.T) {
+	
+	var store, err = newRegistryServerStore(t.TempDir())
+	if err != nil { t.Fatal(err) }
+	var digest = testBlobDigest("layer content")
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		waitGroup.Add(1)
+		go func(repoName string) {
+			defer waitGroup.Done()
+			for j := 0; j < 1000; j++ {
+				var uploadId, err = store.startUpload(repoName)
+				if err == nil {
+					err = store.completeUpload(repoName, uploadId, digest, strings.NewReader("layer content"), -1, -1)
+				}
+				if err != nil { t.Errorf("Upload to %s: %v", repoName, err); return }
+				if ! store.hasBlob(repoName, digest) { t.Errorf("Uploaded blob of %s was removed", repoName); return }
+				err = store.unlinkBlob(repoName, digest)
+				if err != nil { t.Errorf("Delete from %s: %v", repoName, err); return }
+			}
+		}(fmt.Sprintf("repo%d", i))
+	}
+	waitGroup.Wait()
+}
@@ -0,0 +1,355 @@
+package docker
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"strconv"
+	"strings"
+	"math/rand"
+	"net/http"
+)
+
+/*******************************************************************************
+ * Retry policy for idempotent engine and registry operations: HEAD and GET
+ * requests, manifest PUTs, and the download and upload of layers. An operation
+ * that fails transiently (see IsTransientError) - e.g., with a 429, 502 or 503
+ * response, or a connection reset - is retried, after a delay that grows
+ * exponentially with each attempt, with random jitter, until it succeeds or
+ * MaxAttempts attempts have been made. If the server specifies how long to wait
+ * (with a Retry-After or rate limit header), the delay is at least that long;
+ * if the server asks for a wait longer than MaxDelay, the operation is not
+ * retried. A layer upload that fails is restarted in a new upload session, so
+ * that a push resumes at the layer that failed rather than starting over. The
+ * requests of a layer download or upload are not retried individually: the
+ * download or upload is retried as a whole.
+ *
+ * Zero fields take the values of DefaultDockerRetryPolicy. Engine and registry
+ * connections are opened with the default policy; to disable retries, set a
+ * nil policy, or one with a MaxAttempts of 1, with the SetRetryPolicy method
+ * of the connection's type (DockerEngineImpl, DockerRegistryImpl, or their
+ * in-memory fakes). A policy must not be copied once it has been used, and may
+ * be shared by several connections.
+ */
+type DockerRetryPolicy struct {
+	MaxAttempts int  // including the first
+	InitialDelay time.Duration  // before the first retry
+	MaxDelay time.Duration  // the longest delay before a retry
+	Multiplier float64  // by which the delay grows with each retry
+	Jitter float64  // the fraction, 0 to 1, of each delay that is randomized
+	
+	// If not nil, called before each retry, e.g., to log it. The attempt is the
+	// number of the attempt that failed, starting at 1.
+	OnRetry func(operation string, attempt int, delay time.Duration, err error)
+	
+	lock sync.Mutex
+	stats map[string]*DockerRetryStats
+}
+
+/*******************************************************************************
+ * The attempts made for an operation, since the policy was created or its
+ * stats were reset. Operations are named either by request, e.g.,
+ * "HEAD v2/{name}/blobs/{digest}" or "GET images/{name}/json", or, for
+ * those that span several requests, by method, e.g., "PushLayer".
+ */
+type DockerRetryStats struct {
+	Operation string
+	Calls int  // times the operation was performed
+	Attempts int  // including the first attempt of each call
+	Retries int
+	GaveUp int  // calls that failed transiently on their final attempt
+}
+
+const (
+	defaultRetryMaxAttempts = 5
+	defaultRetryInitialDelay = 500 * time.Millisecond
+	defaultRetryMaxDelay = 30 * time.Second
+	defaultRetryMultiplier = 2.0
+	defaultRetryJitter = 0.5
+)
+
+/*******************************************************************************
+ * Return a new policy with the default settings: five attempts, with delays
+ * of between half and all of 0.5, 1, 2 and 4 seconds, and no delay longer
+ * than 30 seconds.
+ */
+func DefaultDockerRetryPolicy() *DockerRetryPolicy {
+	return &DockerRetryPolicy{
+		MaxAttempts: defaultRetryMaxAttempts,
+		InitialDelay: defaultRetryInitialDelay,
+		MaxDelay: defaultRetryMaxDelay,
+		Multiplier: defaultRetryMultiplier,
+		Jitter: defaultRetryJitter,
+	}
+}
+
+/*******************************************************************************
+ * Return the attempt counts of each operation, ordered by operation name.
+ */
+func (policy *DockerRetryPolicy) Stats() []DockerRetryStats {
+	
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+	var statsAr = make([]DockerRetryStats, 0, len(policy.stats))
+	for _, stats := range policy.stats { statsAr = append(statsAr, *stats) }
+	sort.Slice(statsAr, func(i, j int) bool { return statsAr[i].Operation < statsAr[j].Operation })
+	return statsAr
+}
+
+/*******************************************************************************
+ * Discard the attempt counts.
+ */
+func (policy *DockerRetryPolicy) ResetStats() {
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+	policy.stats = nil
+}
+
+/*******************************************************************************
+ * Set the retry policy of the connection; nil disables retries. Copies made
+ * by WithContext after the call share the policy.
+ */
+func (engine *DockerEngineImpl) SetRetryPolicy(policy *DockerRetryPolicy) {
+	engine.retry = policy
+}
+
+func (engine *DockerEngineImpl) GetRetryPolicy() *DockerRetryPolicy {
+	return engine.retry
+}
+
+func (registry *DockerRegistryImpl) SetRetryPolicy(policy *DockerRetryPolicy) {
+	registry.retry = policy
+}
+
+func (registry *DockerRegistryImpl) GetRetryPolicy() *DockerRetryPolicy {
+	return registry.retry
+}
+
+/*******************************************************************************
+ * Return a copy of the registry connection whose requests are not retried, for
+ * the requests of an operation that is retried as a whole (e.g., the download
+ * of a layer), so that the policy is not applied twice.
+ */
+func (registry *DockerRegistryImpl) withoutRetry() *DockerRegistryImpl {
+	var unretried = registry.withContext(registry.ctx)
+	unretried.retry = nil
+	return unretried
+}
+
+/*******************************************************************************
+ * Perform the operation, retrying it as the policy allows. The attempt
+ * function is called with the number of the attempt, starting at 1. If the
+ * policy is nil, the operation is attempted once. If ctx ends during a delay,
+ * its error is returned.
+ */
+func (policy *DockerRetryPolicy) retry(ctx context.Context, operation string,
+	attempt func(attemptNo int) error) error {
+	
+	if policy == nil { return attempt(1) }
+	policy.update(operation, func(stats *DockerRetryStats) { stats.Calls++ })
+	for attemptNo := 1; ; attemptNo++ {
+		
+		policy.update(operation, func(stats *DockerRetryStats) { stats.Attempts++ })
+		var err = attempt(attemptNo)
+		if err == nil { return nil }
+		
+		var delay, retryable = policy.delayAfter(attemptNo, err)
+		if ! retryable {
+			if IsTransientError(err) { policy.update(operation, func(stats *DockerRetryStats) { stats.GaveUp++ }) }
+			return err
+		}
+		policy.update(operation, func(stats *DockerRetryStats) { stats.Retries++ })
+		logInfo("Retrying " + operation, "attempt", attemptNo, "delay", delay, "error", err)
+		if policy.OnRetry != nil { policy.OnRetry(operation, attemptNo, delay, err) }
+		
+		var timer = time.NewTimer(delay)
+		select {
+			case <-timer.C:
+			case <-ctx.Done(): timer.Stop(); return ctx.Err()
+		}
+	}
+}
+
+/*******************************************************************************
+ * Send a request, retrying it as the policy allows. A response with a
+ * transient status is retried; if the final attempt has such a response, it is
+ * returned (with a nil error), for the caller to handle as it would any other
+ * failure status.
+ */
+func (policy *DockerRetryPolicy) do(ctx context.Context, operation string,
+	send func() (*http.Response, error)) (*http.Response, error) {
+	
+	var response *http.Response
+	var err = policy.retry(ctx, operation, func(attemptNo int) error {
+		if response != nil { discardResponse(response); response = nil }
+		var err error
+		response, err = send()
+		if err != nil { response = nil; return err }
+		if kindForStatus(response.StatusCode) != ErrTransient { return nil }
+		return generateResponseError(response, operation, response.Status + "; during " + operation)
+	})
+	if err == nil { return response, nil }
+	if response != nil {
+		if ctx.Err() == nil { return response, nil }
+		discardResponse(response)
+	}
+	return nil, err
+}
+
+/*******************************************************************************
+ * Return the delay before the retry of an attempt that failed with err, and
+ * false if the attempt should not be retried.
+ */
+func (policy *DockerRetryPolicy) delayAfter(attemptNo int, err error) (time.Duration, bool) {
+	
+	var maxAttempts = policy.MaxAttempts
+	if maxAttempts <= 0 { maxAttempts = defaultRetryMaxAttempts }
+	if (attemptNo >= maxAttempts) || (! IsTransientError(err)) { return 0, false }
+	
+	var maxDelay = policy.MaxDelay
+	if maxDelay <= 0 { maxDelay = defaultRetryMaxDelay }
+	var delay = policy.backoff(attemptNo, maxDelay)
+	var dockerErr *DockerError
+	if errors.As(err, &dockerErr) && (dockerErr.RetryAfter > 0) {
+		if dockerErr.RetryAfter > maxDelay { return 0, false }
+		if dockerErr.RetryAfter > delay { delay = dockerErr.RetryAfter }
+	}
+	return delay, true
+}
+
+/*******************************************************************************
+ * Return the exponential delay after the specified attempt, less a random
+ * part of up to Jitter of it.
+ */
+func (policy *DockerRetryPolicy) backoff(attemptNo int, maxDelay time.Duration) time.Duration {
+	
+	var initialDelay = policy.InitialDelay
+	if initialDelay <= 0 { initialDelay = defaultRetryInitialDelay }
+	var multiplier = policy.Multiplier
+	if multiplier < 1 { multiplier = defaultRetryMultiplier }
+	
+	var delay = float64(initialDelay)
+	for i := 1; (i < attemptNo) && (delay < float64(maxDelay)); i++ { delay = delay * multiplier }
+	if delay > float64(maxDelay) { delay = float64(maxDelay) }
+	var jitter = policy.Jitter
+	if jitter < 0 { jitter = 0 }
+	if jitter > 1 { jitter = 1 }
+	return time.Duration(delay - (delay * jitter * rand.Float64()))
+}
+
+func (policy *DockerRetryPolicy) update(operation string, change func(*DockerRetryStats)) {
+	
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+	if policy.stats == nil { policy.stats = make(map[string]*DockerRetryStats) }
+	var stats = policy.stats[operation]
+	if stats == nil {
+		stats = &DockerRetryStats{ Operation: operation }
+		policy.stats[operation] = stats
+	}
+	change(stats)
+}
+
+/*******************************************************************************
+ * Read the rest of a response that is being abandoned, so that its connection
+ * can be reused, and close it.
+ */
+func discardResponse(response *http.Response) {
+	if response.Body == nil { return }
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64 * 1024))
+	response.Body.Close()
+}
+
+/*******************************************************************************
+ * Return how long the server asks that a client wait before retrying, or 0 if
+ * it does not say. The headers consulted are Retry-After (seconds, or an HTTP
+ * date); RateLimit-Reset and X-RateLimit-Reset (seconds, or a unix time);
+ * and, if they report that no requests remain, RateLimit-Remaining and
+ * X-RateLimit-Remaining, whose "w" parameter (as Docker Hub sends, e.g.,
+ * "0;w=21600") is the length of the rate limit window in seconds.
+ */
+func serverRetryDelay(header http.Header, now time.Time) time.Duration {
+	
+	var value = strings.TrimSpace(header.Get("Retry-After"))
+	if value != "" {
+		var seconds, err = strconv.ParseInt(value, 10, 64)
+		if err == nil { return secondsDelay(seconds) }
+		var at time.Time
+		at, err = http.ParseTime(value)
+		if (err == nil) && at.After(now) { return at.Sub(now) }
+	}
+	
+	for _, name := range []string{ "RateLimit-Reset", "X-RateLimit-Reset" } {
+		var seconds, found = headerInt(header.Get(name))
+		if ! found { continue }
+		if seconds > 1000000000 {  // a unix time
+			var at = time.Unix(seconds, 0)
+			if at.After(now) { return at.Sub(now) }
+			return 0
+		}
+		return secondsDelay(seconds)
+	}
+	
+	for _, name := range []string{ "RateLimit-Remaining", "X-RateLimit-Remaining" } {
+		value = header.Get(name)
+		var remaining, found = headerInt(value)
+		if (! found) || (remaining > 0) { continue }
+		for _, param := range strings.Split(value, ";")[1:] {
+			var window int64
+			window, found = headerInt(strings.TrimPrefix(strings.TrimSpace(param), "w="))
+			if found && strings.HasPrefix(strings.TrimSpace(param), "w=") { return secondsDelay(window) }
+		}
+	}
+	return 0
+}
+
+/*******************************************************************************
+ * Parse the integer at the start of a header value, which may be followed by
+ * parameters (";...") or further values (",...").
+ */
+func headerInt(value string) (int64, bool) {
+	
+	var end = strings.IndexAny(value, ";,")
+	if end != -1 { value = value[:end] }
+	value = strings.TrimSpace(value)
+	if value == "" { return 0, false }
+	var n, err = strconv.ParseInt(value, 10, 64)
+	if err != nil { return 0, false }
+	return n, true
+}
+
+func secondsDelay(seconds int64) time.Duration {
+	if seconds <= 0 { return 0 }
+	if seconds > int64(24 * time.Hour / time.Second) { return 24 * time.Hour }
+	return time.Duration(seconds) * time.Second
+}
+
+/*******************************************************************************
+ * Return the name under which the attempts of a request are counted: the method
+ * and the form of the URI, e.g., "GET v2/{name}/manifests/{reference}" or
+ * "GET images/{name}/json".
+ */
+func retryOperationName(method, uri string) string {
+	
+	var path = strings.TrimPrefix(strings.SplitN(uri, "?", 2)[0], "/")
+	var segments = strings.Split(path, "/")
+	if segments[0] == "v2" {
+		for i := 1; i < len(segments); i++ {
+			switch segments[i] {
+				case "manifests": return method + " v2/{name}/manifests/{reference}"
+				case "tags": return method + " v2/{name}/tags/list"
+				case "blobs":
+					if (i + 1 < len(segments)) && (segments[i+1] == "uploads") {
+						return method + " v2/{name}/blobs/uploads"
+					}
+					return method + " v2/{name}/blobs/{digest}"
+			}
+		}
+		return method + " " + path
+	}
+	if len(segments) > 2 { return method + " " + segments[0] + "/{name}/" + segments[len(segments)-1] }
+	return method + " " + path
+}
@@ -16,7 +16,7 @@ import (
 	"unicode/utf8"
 	"encoding/json"
 	//"os/exec"
-	//"errors"
+	"errors"
 	"regexp"
 	"reflect"
 	
@@ -47,6 +47,7 @@ https://github.com/docker/docker/blob/master/image/spec/v1.md
 type DockerServices struct {
 	Registry DockerRegistry
 	Engine DockerEngine
+	Credentials *DockerCredentialsResolver  // optional; resolves credentials for other registries
 }
 
 /*******************************************************************************
@@ -66,23 +67,25 @@ func (dockerSvcs *DockerServices) BuildDockerfile(dockerfileExternalFilePath,
 	dockerfileName, dockerImageName, tag string,
 	paramNames, paramValues []string) (string, error) {
 	
-	var exists bool = false
-	var err error = nil
-	var fullName = dockerImageName
-	if dockerSvcs.Registry == nil {  // no registry
-		// Check if image exists in engine.
-		if tag != "" { fullName = fullName + ":" + tag }
-		_, err = dockerSvcs.Engine.GetImageInfo(fullName)
-		if err == nil { exists = true }
-	} else {
-		exists, err = dockerSvcs.Registry.ImageExists(dockerImageName, tag)
-		//exists, err = dockerSvcs.Registry.ImageExists(realmName + "/" + repoName, imageName)
-	}
+	var options *DockerBuildOptions
+	var err error
+	options, err = newDockerBuildOptionsFromParams(dockerImageName + ":" + tag,
+		dockerfileName, paramNames, paramValues)
+	if err != nil { return "", err }
+	return dockerSvcs.BuildDockerfileWithOptions(dockerfileExternalFilePath,
+		dockerImageName, tag, options)
+}
+
+/*******************************************************************************
+ * Same as BuildDockerfile, but the build is performed with the specified options.
+ * The image is named dockerImageName:tag, in addition to any tags in the options.
+ */
+func (dockerSvcs *DockerServices) BuildDockerfileWithOptions(dockerfileExternalFilePath,
+	dockerImageName, tag string, options *DockerBuildOptions) (string, error) {
 	
-	if exists {
-		return "", utilities.ConstructUserError(
-			"Image with name " + dockerImageName + ":" + tag + " already exists.")
-	}
+	if options == nil { options = NewDockerBuildOptions("") }
+	var err error = dockerSvcs.checkImageDoesNotExist(dockerImageName, tag)
+	if err != nil { return "", err }
 	
 	// Create a temporary directory to serve as the build context.
 	var tempDirPath string
@@ -91,15 +94,18 @@ func (dockerSvcs *DockerServices) BuildDockerfile(dockerfileExternalFilePath,
 	//....TO DO: Is the above a security problem? Do we need to use a private
 	// directory? I think so.
 	defer func() {
-		fmt.Println("Removing all files at " + tempDirPath)
+		logDebug("Removing all files at " + tempDirPath)
 		os.RemoveAll(tempDirPath)
 	}()
-	fmt.Println("Temp directory = ", tempDirPath)
-
+	logDebug("Temp directory", "path", tempDirPath)
+	
 	// Copy dockerfile to that directory.
+	var dockerfileName = options.Dockerfile
+	if dockerfileName == "" { dockerfileName = "Dockerfile" }
 	var in, out *os.File
 	in, err = os.Open(dockerfileExternalFilePath)
 	if err != nil { return "", err }
+	defer in.Close()
 	var dockerfileCopyPath string = tempDirPath + "/" + dockerfileName
 	out, err = os.Create(dockerfileCopyPath)
 	if err != nil { return "", err }
@@ -107,7 +113,7 @@ func (dockerSvcs *DockerServices) BuildDockerfile(dockerfileExternalFilePath,
 	if err != nil { return "", err }
 	err = out.Close()
 	if err != nil { return "", err }
-	fmt.Println("Copied Dockerfile to " + dockerfileCopyPath)
+	logDebug("Copied Dockerfile to " + dockerfileCopyPath)
 	
 //	fmt.Println("Changing directory to '" + tempDirPath + "'")
 //	err = os.Chdir(tempDirPath)
@@ -119,59 +125,294 @@ func (dockerSvcs *DockerServices) BuildDockerfile(dockerfileExternalFilePath,
 	// docker.io/cesanta/docker_auth   latest              3d31749deac5        3 months ago        528 MB
 	// Image id format: <hash>[:TAG]
 	
-	var imageFullName = dockerImageName + ":" + tag
+	var buildOptions *DockerBuildOptions
+	buildOptions, err = dockerSvcs.namedBuildOptions(options, dockerImageName, tag)
+	if err != nil { return "", err }
+	buildOptions.Dockerfile = dockerfileName
 	var outputStr string
-	outputStr, err = dockerSvcs.Engine.BuildImage(tempDirPath, imageFullName, 
-		dockerfileName, paramNames, paramValues)
+	outputStr, err = dockerSvcs.Engine.BuildImageWithOptions(tempDirPath, buildOptions)
 	if err != nil { return outputStr, err }
 	
 	if dockerSvcs.Registry != nil {  // a registry
-		// Push new image to registry. Use the engine's push image feature.
-		// Have not been able to get the engine push command to work. The docker client
-		// end up reporting "Pull session cancelled".
-		//err = dockerSvcs.Engine.PushImage(imageRegistryTag)
-		
-		// Obtain image as a file.
-		var tempDirPath2 string
-		tempDirPath2, err = utilities.MakeTempDir()
-		if err != nil { return outputStr, err }
-		defer os.RemoveAll(tempDirPath2)
-		var imageFile *os.File
-		imageFile, err = utilities.MakeTempFile(tempDirPath2, "")
-		if err != nil { return outputStr, err }
-		var imageFilePath = imageFile.Name()
-		err = dockerSvcs.Engine.GetImage(imageFullName, imageFilePath)
-		if err != nil { return outputStr, err }
-		
-		// Obtain the image digest.
-		var info map[string]interface{}
-		info, err = dockerSvcs.Engine.GetImageInfo(imageFullName)
+		err = dockerSvcs.PushImageToRegistry(dockerImageName, tag)
 		if err != nil { return outputStr, err }
-		var digest = info["Id"]
-		var digestString string
-		var isType bool
-		digestString, isType = digest.(string)
-		if digest == nil {
-			fmt.Println("Digest is nil; map returned from GetImageInfo:")
-			rest.PrintMap(info)
-			return outputStr, utilities.ConstructServerError("Digest is nil") }
-		if ! isType { return outputStr, utilities.ConstructServerError(
-			"checksum is not a string: it is a " + reflect.TypeOf(digest).String())
+	}
+	
+	return outputStr, err
+}
+
+/*******************************************************************************
+ * Build an image from a remote build context - a git repository or the URL of
+ * a tar archive (see DockerEngine.BuildImageFromRemote) - and, if there is a
+ * registry, push it to the registry. The image is named dockerImageName:tag, in
+ * addition to any tags in the options. Build events are passed to the handler,
+ * which may be nil.
+ */
+func (dockerSvcs *DockerServices) BuildDockerfileFromRemote(remote, dockerImageName,
+	tag string, options *DockerBuildOptions,
+	handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
+	
+	return dockerSvcs.buildAndPush(dockerImageName, tag, options,
+		func(buildOptions *DockerBuildOptions) (*DockerBuildOutput, error) {
+			return dockerSvcs.Engine.BuildImageFromRemote(remote, buildOptions, handler)
+		})
+}
+
+/*******************************************************************************
+ * Build an image from the build context that is read, as a tar archive, from the
+ * specified reader - e.g., an uploaded archive - and, if there is a registry,
+ * push it to the registry. Otherwise the same as BuildDockerfileFromRemote.
+ */
+func (dockerSvcs *DockerServices) BuildDockerfileFromArchive(contextReader io.Reader,
+	dockerImageName, tag string, options *DockerBuildOptions,
+	handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
+	
+	return dockerSvcs.buildAndPush(dockerImageName, tag, options,
+		func(buildOptions *DockerBuildOptions) (*DockerBuildOutput, error) {
+			return dockerSvcs.Engine.BuildImageFromArchive(contextReader, buildOptions, handler)
+		})
+}
+
+/*******************************************************************************
+ * Build an image from a complete build context directory, using the dockerfile
+ * at the specified path within it, and, if there is a registry, push it to the
+ * registry. Before the build is sent, every file that the dockerfile's COPY and
+ * ADD instructions reference is checked to be in the context, and any that are
+ * missing are reported as a user error. Otherwise the same as
+ * BuildDockerfileFromRemote.
+ */
+func (dockerSvcs *DockerServices) BuildDockerfileFromContextDir(contextDirPath,
+	dockerfilePath, dockerImageName, tag string, options *DockerBuildOptions,
+	handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
+	
+	return dockerSvcs.buildAndPush(dockerImageName, tag, options,
+		func(buildOptions *DockerBuildOptions) (*DockerBuildOutput, error) {
+			var err = CheckBuildContextDir(contextDirPath, dockerfilePath)
+			if err != nil { return nil, err }
+			buildOptions.Dockerfile = dockerfilePath
+			return dockerSvcs.Engine.BuildImageStreamWithOptions(contextDirPath, buildOptions, handler)
+		})
+}
+
+/*******************************************************************************
+ * Same as BuildDockerfileFromContextDir, but the build context is a tar archive
+ * that is read from the specified reader. The archive is saved to a temporary
+ * file so that it can be checked before it is sent.
+ */
+func (dockerSvcs *DockerServices) BuildDockerfileFromContextArchive(contextReader io.Reader,
+	dockerfilePath, dockerImageName, tag string, options *DockerBuildOptions,
+	handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
+	
+	return dockerSvcs.buildAndPush(dockerImageName, tag, options,
+		func(buildOptions *DockerBuildOptions) (*DockerBuildOutput, error) {
+			
+			// Save the archive.
+			var tempDirPath string
+			var err error
+			tempDirPath, err = utilities.MakeTempDir()
+			if err != nil { return nil, err }
+			defer os.RemoveAll(tempDirPath)
+			var archiveFile *os.File
+			archiveFile, err = utilities.MakeTempFile(tempDirPath, "")
+			if err != nil { return nil, err }
+			defer archiveFile.Close()
+			_, err = io.Copy(archiveFile, contextReader)
+			if err != nil { return nil, err }
+			
+			err = CheckBuildContextArchive(archiveFile.Name(), dockerfilePath)
+			if err != nil { return nil, err }
+			
+			_, err = archiveFile.Seek(0, io.SeekStart)
+			if err != nil { return nil, err }
+			buildOptions.Dockerfile = dockerfilePath
+			return dockerSvcs.Engine.BuildImageFromArchive(archiveFile, buildOptions, handler)
+		})
+}
+
+/*******************************************************************************
+ * Common implementation of the BuildDockerfileFrom functions: check that the
+ * image does not exist yet, build it by calling build with the options (see
+ * namedBuildOptions), which build may modify, and push it to the registry, if
+ * there is one.
+ */
+func (dockerSvcs *DockerServices) buildAndPush(dockerImageName, tag string,
+	options *DockerBuildOptions,
+	build func(*DockerBuildOptions) (*DockerBuildOutput, error)) (*DockerBuildOutput, error) {
+	
+	var err error = dockerSvcs.checkImageDoesNotExist(dockerImageName, tag)
+	if err != nil { return nil, err }
+	
+	var buildOptions *DockerBuildOptions
+	buildOptions, err = dockerSvcs.namedBuildOptions(options, dockerImageName, tag)
+	if err != nil { return nil, err }
+	var buildOutput *DockerBuildOutput
+	buildOutput, err = build(buildOptions)
+	if err != nil { return buildOutput, err }
+	
+	err = dockerSvcs.PushImageToRegistry(dockerImageName, tag)
+	return buildOutput, err
+}
+
+/*******************************************************************************
+ * Return a user error if an image with the specified name and tag already exists
+ * in the registry or - if there is no registry - in the engine.
+ */
+func (dockerSvcs *DockerServices) checkImageDoesNotExist(dockerImageName, tag string) error {
+	
+	var exists bool = false
+	var fullName = dockerImageName
+	var err error
+	if dockerSvcs.Registry == nil {  // no registry
+		// Check if image exists in engine. Only a "not found" error means that
+		// it does not; any other error (e.g., the engine is down) is returned.
+		if tag != "" { fullName = fullName + ":" + tag }
+		_, err = dockerSvcs.Engine.GetImageInfo(fullName)
+		if err == nil {
+			exists = true
+		} else if ! errors.Is(err, ErrNotFound) {
+			return err
 		}
-		if digestString == "" { return outputStr, utilities.ConstructServerError(
-			"No checksum field found for image")
+	} else {
+		exists, err = dockerSvcs.Registry.ImageExists(dockerImageName, tag)
+		if err != nil { return err }
+	}
+	
+	if exists {
+		return utilities.ConstructUserError(
+			"Image with name " + dockerImageName + ":" + tag + " already exists.")
+	}
+	return nil
+}
+
+/*******************************************************************************
+ * Return a copy of the options (or default options, if nil) that also names
+ * the image dockerImageName:tag. Credentials are added to those of the options
+ * (for registries that the options have no credentials for), so that FROM
+ * images can be pulled: those of the registry, if there is one, and those that
+ * the credentials resolver, if there is one, knows of.
+ */
+func (dockerSvcs *DockerServices) namedBuildOptions(options *DockerBuildOptions,
+	dockerImageName, tag string) (*DockerBuildOptions, error) {
+	
+	var imageFullName = dockerImageName + ":" + tag
+	if options == nil { options = NewDockerBuildOptions("") }
+	var buildOptions = *options
+	buildOptions.Tags = []string{ imageFullName }
+	for _, t := range options.Tags {
+		if t != imageFullName { buildOptions.Tags = append(buildOptions.Tags, t) }
+	}
+	
+	buildOptions.RegistryAuths = make(DockerRegistryAuths)
+	for key, value := range options.RegistryAuths { buildOptions.RegistryAuths[key] = value }
+	if dockerSvcs.Registry != nil {
+		var registryHost, auth = dockerSvcs.Registry.GetRegistryAuth()
+		if (auth != nil) && (buildOptions.RegistryAuths.Lookup(registryHost) == nil) {
+			buildOptions.RegistryAuths[RegistryAuthKey(registryHost)] = auth
+		}
+	}
+	if dockerSvcs.Credentials != nil {
+		var resolved DockerRegistryAuths
+		var err error
+		resolved, err = dockerSvcs.Credentials.ResolveAll()
+		if err != nil { return nil, err }
+		for key, auth := range resolved {
+			if buildOptions.RegistryAuths[key] == nil { buildOptions.RegistryAuths[key] = auth }
 		}
-		
-		// Push image to registry - all layers and manifest.
-		err = dockerSvcs.Registry.PushImage(dockerImageName, tag, imageFilePath)
-		if err != nil { return outputStr, err }
-		
-		// Tag the uploaded image with its name.
-		//err = dockerSvcs.Registry.TagImage(digestString, ....repoName, ....tag)
-		if err != nil { return outputStr, err }
 	}
+	return &buildOptions, nil
+}
+
+/*******************************************************************************
+ * Push the specified image from the engine to its registry (given by the image
+ * name, e.g. "registry.example.com:5000/myrepo"), via the engine, using the
+ * credentials for that registry that the credentials resolver provides, if
+ * there is a resolver. Unlike PushImageToRegistry, the registry must be
+ * reachable from the engine's host.
+ */
+func (dockerSvcs *DockerServices) PushImageViaEngine(repoFullName, tag string,
+	handler func(*DockerPushEvent)) (*DockerPushOutput, error) {
 	
-	return outputStr, err
+	var auth *DockerRegistryAuth
+	var err error
+	if dockerSvcs.Credentials != nil {
+		auth, err = dockerSvcs.Credentials.ResolveForImage(repoFullName)
+		if err != nil { return nil, err }
+	}
+	return dockerSvcs.Engine.PushImageWithAuth(repoFullName, tag, auth, handler)
+}
+
+/*******************************************************************************
+ * Copy the specified image from the engine to the registry - all layers and
+ * manifest. Does nothing if there is no registry.
+ */
+func (dockerSvcs *DockerServices) PushImageToRegistry(dockerImageName, tag string) error {
+	
+	if dockerSvcs.Registry == nil { return nil }
+	
+	// The image is pushed from a saved copy rather than with Engine.PushImage,
+	// because the registry need not be reachable from the engine's host.
+	
+	// Obtain image as a file.
+	var imageFullName = dockerImageName
+	if tag != "" { imageFullName = imageFullName + ":" + tag }
+	var tempDirPath string
+	var err error
+	tempDirPath, err = utilities.MakeTempDir()
+	if err != nil { return err }
+	defer os.RemoveAll(tempDirPath)
+	var imageFile *os.File
+	imageFile, err = utilities.MakeTempFile(tempDirPath, "")
+	if err != nil { return err }
+	var imageFilePath = imageFile.Name()
+	err = dockerSvcs.Engine.GetImage(imageFullName, imageFilePath)
+	if err != nil { return err }
+	
+	// Obtain the image digest.
+	var info map[string]interface{}
+	info, err = dockerSvcs.Engine.GetImageInfo(imageFullName)
+	if err != nil { return err }
+	var digest = info["Id"]
+	var digestString string
+	var isType bool
+	digestString, isType = digest.(string)
+	if digest == nil {
+		logError("Digest is nil; map returned from GetImageInfo", "info", info)
+		return utilities.ConstructServerError("Digest is nil") }
+	if ! isType { return utilities.ConstructServerError(
+		"checksum is not a string: it is a " + reflect.TypeOf(digest).String())
+	}
+	if digestString == "" { return utilities.ConstructServerError(
+		"No checksum field found for image")
+	}
+	
+	// Push image to registry - all layers and manifest.
+	err = dockerSvcs.Registry.PushImage(dockerImageName, tag, imageFilePath)
+	if err != nil { return err }
+	
+	// Tag the uploaded image with its name.
+	//err = dockerSvcs.Registry.TagImage(digestString, ....repoName, ....tag)
+	
+	return nil
+}
+
+/*******************************************************************************
+ * Snapshot the specified container as a new image with the specified name and
+ * tag, and (if there is a registry) push the new image to the registry. Return
+ * the Id of the new image.
+ */
+func (dockerSvcs *DockerServices) CommitContainer(containerId, dockerImageName, tag,
+	author, comment string, pause bool, changes []string) (string, error) {
+	
+	var imageId string
+	var err error
+	imageId, err = dockerSvcs.Engine.CommitContainer(containerId, dockerImageName, tag,
+		author, comment, pause, changes)
+	if err != nil { return "", err }
+	
+	err = dockerSvcs.PushImageToRegistry(dockerImageName, tag)
+	if err != nil { return imageId, err }
+	
+	return imageId, nil
 }
 
 /*******************************************************************************
@@ -276,96 +517,32 @@ func (dockerSvcs *DockerServices) BuildDockerfile(dockerfileExternalFilePath,
  */
 func ParseBuildCommandOutput(buildOutputStr string) (*DockerBuildOutput, error) {
 	
-	fmt.Println("ParseBuildCommandOutput: A")  // debug
-	fmt.Println("Build output:")  // debug
-	fmt.Println(buildOutputStr)  // debug
-	fmt.Println("End of build output.")  // debug
+	logDebug("Build output", "output", buildOutputStr)
 	
-	var output *DockerBuildOutput = NewDockerBuildOutput()
+	var parser = newBuildOutputParser(nil)
+	parser.write(buildOutputStr)
+	return parser.finish()
+}
+
+/*******************************************************************************
+ * Same as ParseBuildCommandOutput, but the output is parsed as it is read from
+ * the reader, and each build event is passed to the handler (which may be nil)
+ * as it occurs.
+ */
+func ParseBuildCommandOutputStream(buildOutput io.Reader,
+	handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
 	
-	var lines = strings.Split(buildOutputStr, "\n")
-	var state int = 1
-	var step *DockerBuildStep
-	var lineNo int = 0
+	var parser = newBuildOutputParser(handler)
+	var reader = bufio.NewReader(buildOutput)
 	for {
-		
-		if lineNo >= len(lines) {
-			return output, utilities.ConstructServerError("Incomplete")
-		}
-		
-		var line string = lines[lineNo]
-		
-		switch state {
-			
-		case 1: // Looking for next step
-			
-			var therest = strings.TrimPrefix(line, "Step ")
-			if len(therest) < len(line) {
-				// Syntax is: number space colon space command
-				var stepNo int
-				var cmd string
-				fmt.Sscanf(therest, "%d", &stepNo)
-				
-				var separator = " : "
-				var seppos int = strings.Index(therest, separator)
-				if seppos != -1 { // found
-					cmd = therest[seppos + len(separator):] // portion from seppos on
-					step = output.AddStep(stepNo, cmd)
-				}
-				
-				lineNo++
-				state = 2
-				continue
-			}
-			
-			therest = strings.TrimPrefix(line, "Successfully built ")
-			if len(therest) < len(line) {
-				var id = therest
-				output.SetFinalImageId(id)
-				return output, nil
-			}
-			
-			therest = strings.TrimPrefix(line, "Error")
-			if len(therest) < len(line) {
-				output.ErrorMessage = therest
-				return output, utilities.ConstructServerError(output.ErrorMessage)
-			}
-			
-			lineNo++
-			state = 1
-			continue
-			
-		case 2: // Looking for step parts
-			
-			if step == nil {
-				output.ErrorMessage = "Internal error: should not happen"
-				return output, utilities.ConstructServerError(output.ErrorMessage)
-			}
-
-			var therest = strings.TrimPrefix(line, " ---> ")
-			if len(therest) < len(line) {
-				if strings.HasPrefix(therest, "Using cache") {
-					step.SetUsedCache()
-				} else {
-					if strings.Contains(" ", therest) {
-						// Unrecognized line - skip it but stay in the current state.
-					} else {
-						step.SetProducedImageId(therest)
-					}
-				}
-				lineNo++
-				continue
-			}
-			
-			state = 1
-			
-		default:
-			output.ErrorMessage = "Internal error: Unrecognized state"
-			return output, utilities.ConstructServerError(output.ErrorMessage)
-		}
+		var text string
+		var err error
+		text, err = reader.ReadString('\n')
+		parser.write(text)
+		if err == io.EOF { break }
+		if err != nil { return parser.output, err }
 	}
-	output.ErrorMessage = "Did not find a final image Id"
-	return output, utilities.ConstructServerError(output.ErrorMessage)
+	return parser.finish()
 }
 
 /*******************************************************************************
@@ -374,19 +551,29 @@ func ParseBuildCommandOutput(buildOutputStr string) (*DockerBuildOutput, error)
  */
 func ParseBuildRESTOutput(restResponse string) (*DockerBuildOutput, error) {
 	
-	fmt.Println("ParseBuildRESTOutput: A")  // debug
 	var outputstr string
 	var err error
 	outputstr, err = extractBuildOutputFromRESTResponse(restResponse)
-	fmt.Println("ParseBuildRESTOutput: B")  // debug
 	if err != nil { return nil, err }
-	fmt.Println("ParseBuildRESTOutput: C")  // debug
 	var buildOutput *DockerBuildOutput
 	buildOutput, err = ParseBuildCommandOutput(outputstr)
-	fmt.Println("ParseBuildRESTOutput: D")  // debug
 	return buildOutput, err
 }
 
+/*******************************************************************************
+ * Same as ParseBuildRESTOutput, but the response is parsed as it is read from
+ * the reader, and each build event is passed to the handler (which may be nil)
+ * as it occurs. Partial results are returned, but with an error.
+ */
+func ParseBuildRESTOutputStream(restResponse io.Reader,
+	handler func(*DockerBuildEvent)) (*DockerBuildOutput, error) {
+	
+	var parser = newBuildOutputParser(handler)
+	var err = extractBuildOutputFromRESTStream(restResponse, parser)
+	if err != nil { parser.fail(err) }
+	return parser.finish()
+}
+
 /*******************************************************************************
  * Parse the specified dockerfile and return any ARGs that it has.
  * Syntax:
@@ -495,8 +682,8 @@ func ParseDockerfile(dockerfileContent string) ([]*DockerfileExecParameterValueD
  * Return the file path.
  */
 func (dockerSvcs *DockerServices) SaveImage(imageName, tag string) (string, error) {
-
-	fmt.Println("Creating temp file to save the image to...")
+	
+	logDebug("Creating temp file to save the image to...")
 	var tempFile *os.File
 	var err error
 	tempFile, err = utilities.MakeTempFile("", "")
@@ -602,7 +789,7 @@ func NamePartConformsToDockerRules(part string) error {
  */
 func ConstructDockerImageName(shRealmName,
 	shRepoName, shImageName, version string) (imageName, tag string) {
-
+	
 	return (shRealmName + "/" + shRepoName + "/" + shImageName), version
 }
 
@@ -657,7 +844,6 @@ func (desc *DockerfileExecParameterValueDesc) AsJSON() string {
  */
 func extractBuildOutputFromRESTResponse(restResponse string) (string, error) {
 	
-	fmt.Println("extractBuildOutputFromRESTResponse: A")  // debug
 	
 	var reader = bufio.NewReader(strings.NewReader(restResponse))
 	
@@ -667,16 +853,13 @@ func extractBuildOutputFromRESTResponse(restResponse string) (string, error) {
 		var isPrefix bool
 		var err error
 		lineBytes, isPrefix, err = reader.ReadLine()
-		fmt.Println("extractBuildOutputFromRESTResponse: A.1")  // debug
 		if err == io.EOF { break }
 		if err != nil { return "", err }
-		fmt.Println("extractBuildOutputFromRESTResponse: A.2")  // debug
-		if isPrefix { fmt.Println("Warning - only part of string was read") }
+		if isPrefix { logWarn("Only part of build output line was read") }
 		
 		var obj interface{}
 		err = json.Unmarshal(lineBytes, &obj)
 		if err != nil { return "", err }
-		fmt.Println("extractBuildOutputFromRESTResponse: A.3")  // debug
 		
 		var isType bool
 		var msgMap map[string]interface{}
@@ -684,7 +867,6 @@ func extractBuildOutputFromRESTResponse(restResponse string) (string, error) {
 		if ! isType { return "", utilities.ConstructServerError(
 			"Unexpected format for json build output: " + string(lineBytes))
 		}
-		fmt.Println("extractBuildOutputFromRESTResponse: A.4")  // debug
 		var value string
 		
 		for key, obj := range msgMap {
@@ -713,27 +895,23 @@ func extractBuildOutputFromRESTResponse(restResponse string) (string, error) {
 					if ! isType { return "", utilities.ConstructServerError(
 						"Unexpected data in json error value; line: " + string(lineBytes))
 					}
-					fmt.Println("extractBuildOutputFromRESTResponse: A.4.2")  // debug
 		
 					// Get error detail message.
 					obj = msgMap["errorDetail"]
 					if obj == nil { return "", utilities.ConstructServerError(
 						"Unexpected JSON field in errorDetail message: " + string(lineBytes))
 					}
-					fmt.Println("extractBuildOutputFromRESTResponse: A.4.3")  // debug
 	
 					var errDetailMsgJSON map[string]interface{}
 					errDetailMsgJSON, isType = obj.(map[string]interface{})
 					if ! isType { return "", utilities.ConstructServerError(
 						"Unexpected data in json errorDetail value; line: " + string(lineBytes))
 					}
-					fmt.Println("extractBuildOutputFromRESTResponse: A.4.4")  // debug
 	
 					obj = errDetailMsgJSON["message"]
 					if obj == nil { return "", utilities.ConstructServerError(
 						"No message field in errorDetail message: " + string(lineBytes))
 					}
-					fmt.Println("extractBuildOutputFromRESTResponse: A.4.5")  // debug
 	
 					var errDetailMsg string
 					errDetailMsg, isType = obj.(string)
@@ -741,14 +919,51 @@ func extractBuildOutputFromRESTResponse(restResponse string) (string, error) {
 					return "", utilities.ConstructUserError(errMsg + "; " + errDetailMsg)
 				
 				default:
-					fmt.Println("Warning: ignoring message: " + string(lineBytes))
+					logWarn("Ignoring build output message", "message", string(lineBytes))
 					
 			}
 		}
 		
-		fmt.Println("extractBuildOutputFromRESTResponse: A.5")  // debug
 	}
-	fmt.Println("extractBuildOutputFromRESTResponse: B")  // debug
 	
 	return output, nil
 }
+
+/*******************************************************************************
+ * Same as extractBuildOutputFromRESTResponse, but the JSON objects are decoded
+ * as they are read, and the build output stream that they encode is passed to
+ * the parser. An error object in the response is returned as a
+ * DockerEngineStreamError.
+ */
+func extractBuildOutputFromRESTStream(restResponse io.Reader, parser *buildOutputParser) error {
+	
+	return readEngineStream(restResponse, "build",
+		func(msg *engineStreamMessage) error {
+			
+			if msg.Stream != "" { parser.write(msg.Stream) }
+			if msg.Status != "" {
+				// Status messages (e.g., from pulling the base image) are not
+				// part of the build output, so they are not parsed.
+				var status = msg.Status
+				if msg.Id != "" { status = msg.Id + ": " + status }
+				parser.emit(&DockerBuildEvent{ Kind: BuildEventStream,
+					Step: parser.step, Text: status })
+			}
+			if (msg.Id == buildKitTraceId) && (len(msg.Aux) > 0) {
+				// BuildKit progress.
+				var status *buildKitStatus
+				var err error
+				status, err = parseBuildKitTrace(msg.Aux)
+				if err != nil { return utilities.ConstructServerError(
+					"While parsing BuildKit progress: " + err.Error()) }
+				parser.buildKitStatus(status)
+			} else if len(msg.Aux) > 0 {
+				// E.g., {"aux":{"ID":"sha256:76da55c8019d..."}}
+				var aux struct { ID string `json:"ID"` }
+				if json.Unmarshal(msg.Aux, &aux) == nil && aux.ID != "" {
+					parser.auxImageId(aux.ID)
+				}
+			}
+			return nil
+		})
+}
@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"sync"
+	"context"
+)
+
+/*******************************************************************************
+ * The layers of an image are pushed and pulled by DockerRegistryImpl (see
+ * PushImage and GetImage) with up to a configurable number of transfers at a
+ * time. The manifest of a push is sent only once every layer has been
+ * received, and lists the layers in their original order, as does the archive
+ * that a pull writes, whatever order the transfers complete in. If a transfer
+ * fails, those in progress are cancelled and no more are started.
+ */
+const defaultTransferParallelism = 4
+
+/*******************************************************************************
+ * Set the maximum number of layers that the connection transfers at a time. A
+ * value less than 1 is taken as 1, i.e., one layer after another. Copies made
+ * by WithContext after the call have the same setting. The setting is
+ * particular to DockerRegistryImpl (and InMemoryDockerRegistry), and is not
+ * part of the DockerRegistry interface.
+ */
+func (registry *DockerRegistryImpl) SetParallelism(parallelism int) {
+	if parallelism < 1 { parallelism = 1 }
+	registry.parallelism = parallelism
+}
+
+func (registry *DockerRegistryImpl) GetParallelism() int {
+	if registry.parallelism < 1 { return 1 }
+	return registry.parallelism
+}
+
+/*******************************************************************************
+ * Perform count transfers, numbered from 0, with up to parallelism of them at
+ * a time. Each transfer is passed a context that is cancelled if another
+ * transfer fails, or if ctx ends; once that happens, no more transfers are
+ * started. Return the first failure, or, if ctx ended, its error.
+ */
+func runTransfers(ctx context.Context, parallelism, count int,
+	transfer func(ctx context.Context, index int) error) error {
+	
+	if parallelism < 1 { parallelism = 1 }
+	if parallelism > count { parallelism = count }
+	var poolCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	
+	var indexes = make(chan int)
+	var firstErr error
+	var failOnce sync.Once
+	var workers sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for index := range indexes {
+				if poolCtx.Err() != nil { continue }
+				var err = transfer(poolCtx, index)
+				if err != nil { failOnce.Do(func() { firstErr = err; cancel() }) }
+			}
+		}()
+	}
+	
+	dispatch:
+	for index := 0; index < count; index++ {
+		select {
+			case indexes <- index:
+			case <-poolCtx.Done(): break dispatch
+		}
+	}
+	close(indexes)
+	workers.Wait()
+	
+	if firstErr != nil { return contextError(ctx, firstErr) }
+	return ctx.Err()
+}
@@ -0,0 +1,275 @@
+package docker
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"path"
+	"bufio"
+	"bytes"
+	"strings"
+	"io/ioutil"
+	"archive/tar"
+	"path/filepath"
+	"compress/gzip"
+	"compress/bzip2"
+	"encoding/json"
+	
+	"utilities"
+)
+
+/*******************************************************************************
+ * A source path of a COPY or ADD instruction in a dockerfile.
+ */
+type DockerfileCopySource struct {
+	LineNo int  // line of the dockerfile on which the instruction begins, from 1
+	Instruction string  // "COPY" or "ADD"
+	Source string
+}
+
+func (source *DockerfileCopySource) String() string {
+	return fmt.Sprintf("line %d: %s %s", source.LineNo, source.Instruction, source.Source)
+}
+
+/*******************************************************************************
+ * Return the sources of the COPY and ADD instructions of the specified
+ * dockerfile that must be present in the build context. Sources that cannot be
+ * checked before the build are not returned: those of COPY --from (which come
+ * from another stage or image), URLs and git repositories of ADD, here-documents,
+ * and sources that contain variable references.
+ */
+func ParseDockerfileCopySources(dockerfileContent string) ([]*DockerfileCopySource, error) {
+	
+	var sources = make([]*DockerfileCopySource, 0)
+	var escape = "\\"
+	var lines = strings.Split(dockerfileContent, "\n")
+	
+	// Parser directives, e.g., "# escape=`", may only appear at the top.
+	for _, line := range lines {
+		var trimmed = strings.TrimSpace(line)
+		if ! strings.HasPrefix(trimmed, "#") { break }
+		var directive = strings.ToLower(strings.Replace(strings.TrimSpace(trimmed[1:]), " ", "", -1))
+		if strings.HasPrefix(directive, "escape=") {
+			escape = strings.TrimPrefix(directive, "escape=")
+			if (escape != "\\") && (escape != "`") { return nil, utilities.ConstructUserError(
+				"Invalid escape directive in dockerfile: " + trimmed) }
+		}
+	}
+	
+	// Join continuation lines, skipping comment lines, and examine each instruction.
+	var instruction = ""
+	var startLineNo = 0
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		var trimmed = strings.TrimSpace(line)
+		if instruction == "" {
+			if (trimmed == "") || strings.HasPrefix(trimmed, "#") { continue }
+			startLineNo = i + 1
+		} else if strings.HasPrefix(trimmed, "#") {
+			continue  // comment within a continued instruction
+		}
+		if strings.HasSuffix(trimmed, escape) {
+			instruction = instruction + strings.TrimSuffix(trimmed, escape) + " "
+			continue
+		}
+		instruction = instruction + trimmed
+		
+		var instructionSources []*DockerfileCopySource
+		var err error
+		instructionSources, err = parseCopyInstruction(instruction, startLineNo)
+		if err != nil { return nil, err }
+		sources = append(sources, instructionSources...)
+		instruction = ""
+	}
+	if instruction != "" {
+		var instructionSources []*DockerfileCopySource
+		var err error
+		instructionSources, err = parseCopyInstruction(instruction, startLineNo)
+		if err != nil { return nil, err }
+		sources = append(sources, instructionSources...)
+	}
+	
+	return sources, nil
+}
+
+/*******************************************************************************
+ * If the instruction is a COPY or ADD, return its checkable sources; otherwise
+ * return none.
+ */
+func parseCopyInstruction(instruction string, lineNo int) ([]*DockerfileCopySource, error) {
+	
+	var fields = strings.Fields(instruction)
+	if len(fields) == 0 { return nil, nil }
+	var keyword = strings.ToUpper(fields[0])
+	if (keyword != "COPY") && (keyword != "ADD") { return nil, nil }
+	
+	// Flags, e.g., --chown=1000:1000 or --from=builder.
+	var args = fields[1:]
+	for (len(args) > 0) && strings.HasPrefix(args[0], "--") {
+		if strings.HasPrefix(args[0], "--from=") || (args[0] == "--from") { return nil, nil }
+		args = args[1:]
+	}
+	
+	// JSON form: COPY ["src1", "src2", "dest"]
+	var rest = strings.TrimSpace(strings.Join(args, " "))
+	if strings.HasPrefix(rest, "[") {
+		var jsonArgs []string
+		if json.Unmarshal([]byte(rest), &jsonArgs) == nil { args = jsonArgs }
+	}
+	if len(args) < 2 { return nil, utilities.ConstructUserError(fmt.Sprintf(
+		"line %d: %s requires at least a source and a destination", lineNo, keyword)) }
+	
+	var sources = make([]*DockerfileCopySource, 0)
+	for _, source := range args[:len(args)-1] {
+		if strings.HasPrefix(source, "<<") { return nil, nil }  // here-document
+		if strings.Contains(source, "$") { continue }
+		if (keyword == "ADD") && (IsHTTPURL(source) || IsGitURL(source)) { continue }
+		sources = append(sources, &DockerfileCopySource{
+			LineNo: lineNo,
+			Instruction: keyword,
+			Source: source,
+		})
+	}
+	return sources, nil
+}
+
+/*******************************************************************************
+ * Return the sources that match none of the specified build context entries.
+ * Entries are paths relative to the root of the context, using '/'. A source
+ * matches an entry if the source - which may contain wildcards - matches the
+ * entry or one of the entry's parent directories.
+ */
+func findMissingCopySources(sources []*DockerfileCopySource,
+	entries []string) []*DockerfileCopySource {
+	
+	var missing = make([]*DockerfileCopySource, 0)
+	for _, source := range sources {
+		var pattern = strings.TrimPrefix(path.Clean("/" + source.Source), "/")
+		if pattern == "" { continue }  // the root of the context
+		var found = false
+		for _, entry := range entries {
+			var parts = strings.Split(entry, "/")
+			for i := range parts {
+				var matched, _ = path.Match(pattern, strings.Join(parts[:i+1], "/"))
+				if matched { found = true; break }
+			}
+			if found { break }
+		}
+		if ! found { missing = append(missing, source) }
+	}
+	return missing
+}
+
+/*******************************************************************************
+ * Return a user error that lists the missing sources, or nil if there are none.
+ */
+func missingCopySourcesError(missing []*DockerfileCopySource) error {
+	
+	if len(missing) == 0 { return nil }
+	var descs = make([]string, 0)
+	for _, source := range missing {
+		descs = append(descs, source.String())
+	}
+	return utilities.ConstructUserError(
+		"Files referenced by the dockerfile are not in the build context: " +
+		strings.Join(descs, "; "))
+}
+
+/*******************************************************************************
+ * Check that every source of a COPY or ADD instruction of the dockerfile at the
+ * specified path within the build directory is in the build context (taking
+ * .dockerignore into account). The missing sources are reported as a user error.
+ */
+func CheckBuildContextDir(buildDirPath, dockerfilePath string) error {
+	
+	var content []byte
+	var err error
+	content, err = ioutil.ReadFile(filepath.Join(buildDirPath, filepath.FromSlash(dockerfilePath)))
+	if err != nil { return utilities.ConstructUserError(
+		"Cannot read dockerfile '" + dockerfilePath + "' in build context: " + err.Error()) }
+	var sources []*DockerfileCopySource
+	sources, err = ParseDockerfileCopySources(string(content))
+	if err != nil { return err }
+	
+	var entries []string
+	entries, _, _, err = listBuildContext(buildDirPath, dockerfilePath)
+	if err != nil { return err }
+	return missingCopySourcesError(findMissingCopySources(sources, entries))
+}
+
+/*******************************************************************************
+ * Same as CheckBuildContextDir, but for a build context that is a tar archive,
+ * optionally compressed with gzip or bzip2, in the specified file. (The engine
+ * also accepts xz; xz compressed archives are not checked.)
+ */
+func CheckBuildContextArchive(archivePath, dockerfilePath string) error {
+	
+	var file *os.File
+	var err error
+	file, err = os.Open(archivePath)
+	if err != nil { return err }
+	defer file.Close()
+	
+	// Detect compression by its magic number.
+	var bufReader = bufio.NewReader(file)
+	var magic []byte
+	magic, _ = bufReader.Peek(6)
+	var reader io.Reader = bufReader
+	if bytes.HasPrefix(magic, []byte{ 0x1f, 0x8b }) {
+		var gzipReader *gzip.Reader
+		gzipReader, err = gzip.NewReader(bufReader)
+		if err != nil { return utilities.ConstructUserError(
+			"Build context archive is not a valid gzip file: " + err.Error()) }
+		defer gzipReader.Close()
+		reader = gzipReader
+	} else if bytes.HasPrefix(magic, []byte("BZh")) {
+		reader = bzip2.NewReader(bufReader)
+	} else if bytes.HasPrefix(magic, []byte{ 0xfd, '7', 'z', 'X', 'Z', 0x00 }) {
+		return nil
+	}
+	
+	// Read the names of the entries, and the dockerfile and .dockerignore files.
+	var dockerfileName = strings.TrimPrefix(path.Clean("/" + dockerfilePath), "/")
+	var dockerfileContent []byte
+	var ignoreContents = make(map[string][]byte)
+	var names = make([]string, 0)
+	var tarReader = tar.NewReader(reader)
+	for {
+		var header *tar.Header
+		header, err = tarReader.Next()
+		if err == io.EOF { break }
+		if err != nil { return utilities.ConstructUserError(
+			"Build context is not a valid tar archive: " + err.Error()) }
+		var name = strings.TrimPrefix(path.Clean("/" + header.Name), "/")
+		if name == "" { continue }
+		names = append(names, name)
+		if (name == dockerfileName) || (name == ".dockerignore") ||
+			(name == dockerfileName + ".dockerignore") {
+			var content []byte
+			content, err = ioutil.ReadAll(tarReader)
+			if err != nil { return err }
+			if name == dockerfileName { dockerfileContent = content } else {
+				ignoreContents[name] = content }
+		}
+	}
+	if dockerfileContent == nil { return utilities.ConstructUserError(
+		"Dockerfile '" + dockerfilePath + "' is not in the build context archive") }
+	
+	// Apply .dockerignore, as the engine does.
+	var ignoreContent, found = ignoreContents[dockerfileName + ".dockerignore"]
+	if ! found { ignoreContent = ignoreContents[".dockerignore"] }
+	var dockerIgnore *DockerIgnore
+	dockerIgnore, err = ParseDockerIgnore(bytes.NewReader(ignoreContent))
+	if err != nil { return err }
+	var entries = make([]string, 0)
+	for _, name := range names {
+		if (name == dockerfileName) || (! dockerIgnore.Excludes(name)) {
+			entries = append(entries, name)
+		}
+	}
+	
+	var sources []*DockerfileCopySource
+	sources, err = ParseDockerfileCopySources(string(dockerfileContent))
+	if err != nil { return err }
+	return missingCopySourcesError(findMissingCopySources(sources, entries))
+}